@@ -0,0 +1,35 @@
+package impact
+
+import (
+	"net"
+	"time"
+)
+
+// Every new connection costs something before it has sent a single request: a TLS handshake, an authentication, a
+// session. A flood of them can swamp the server however few requests they go on to send, so -accept-rate limits how
+// many connections per second are let in, across every listener, in bursts of up to a second's worth. It is the front
+// door, in front of the rate limits on requests.
+//
+// -accept-overflow says what happens to a connection over the limit: block holds it until it is within the limit, and
+// those behind it wait in the listen backlog, and reject, the default, closes it at once, before its TLS handshake.
+
+// Decide whether a connection the network has just accepted is let in.
+func (s *server) admitConnection(remote net.Addr) bool {
+	for {
+		allowed, wait := s.acceptRateLimit.try()
+		if allowed {
+			s.acceptedConnections.Inc()
+			return true
+		}
+
+		if s.acceptOverflow == overflowReject {
+			s.rejectedConnections.Inc()
+			if s.debug.Load() {
+				s.logger.Printf("debug: connection from %s refused, over -accept-rate", remote)
+			}
+			return false
+		}
+
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// Under -accept-rate, with -accept-overflow reject, a connection over the rate is closed before its handshake, and
+// counted as rejected rather than accepted. Once there is room again, connections are let in.
+func TestAcceptRateRejects(t *testing.T) {
+	var config Config
+	// The one connection allowed is the one that found the listener up.
+	server, address := startServer(t, "echo", func(configured *Config) {
+		configured.AcceptRate = 0.01
+		config = *configured
+	})
+	eventually(t, "the first connection is let in", func() bool { return server.s.acceptedConnections.Value() == 1 })
+
+	for attempt := 0; attempt < 3; attempt++ {
+		client, answer := connect(t, address, message.NewHello(message.MinimumVersion, message.Version))
+		expectClosed(t, client, answer, message.ClosedRateLimited)
+	}
+	if rejected := server.s.rejectedConnections.Value(); rejected != 3 {
+		t.Fatalf("%d connections were counted as rejected, not 3", rejected)
+	}
+	if accepted := server.s.acceptedConnections.Value(); accepted != 1 {
+		t.Fatalf("%d connections were counted as accepted while over the rate", accepted-1)
+	}
+
+	config.AcceptRate = 1000
+	server.s.applySettings(config)
+	expectReply(t, dial(t, address).request(1, "let in"), "let in")
+	if accepted := server.s.acceptedConnections.Value(); accepted != 2 {
+		t.Fatalf("%d connections were counted as accepted once there was room, not 1", accepted-1)
+	}
+}
+
+// With -accept-overflow block, a connection over the rate waits its turn instead, and none is rejected.
+func TestAcceptRateBlocks(t *testing.T) {
+	const rate = 10
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.AcceptRate = rate
+		config.AcceptOverflow = overflowBlock
+	})
+
+	// Twice the burst can't all be let in at once.
+	start := time.Now()
+	for attempt := 0; attempt < 2*rate; attempt++ {
+		dial(t, address)
+	}
+	if waited := time.Since(start); waited < 500*time.Millisecond {
+		t.Fatalf("%d connections were let in within %s, faster than -accept-rate %d", 2*rate, waited, rate)
+	}
+	if rejected := server.s.rejectedConnections.Value(); rejected != 0 {
+		t.Fatalf("%d connections were rejected under -accept-overflow block", rejected)
+	}
+}
@@ -0,0 +1,64 @@
+package impact
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// How much each new latency sample moves the average. Higher reacts faster, lower smooths out noise.
+const latencyWeight = 0.2
+
+// The latency shedder turns away a share of new requests when the resource is slowing down, rather than letting the
+// queue grow until every request is slow. It keeps an exponentially weighted moving average of how long the resource
+// takes per request. Below the threshold, nothing is shed. Above it, the share shed grows with the average, reaching
+// the maximum at twice the threshold. The maximum is less than everything, so that some requests still get through
+// and the average can recover once the resource does.
+type latencyShedder struct {
+	threshold   time.Duration
+	maxFraction float64
+
+	lock    sync.Mutex
+	average float64
+	started bool
+}
+
+func newLatencyShedder(threshold time.Duration, maxFraction float64) *latencyShedder {
+	return &latencyShedder{threshold: threshold, maxFraction: maxFraction}
+}
+
+func (l *latencyShedder) observe(latency time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// The first sample is the best estimate we have, rather than dragging the average up from zero.
+	if !l.started {
+		l.average = float64(latency)
+		l.started = true
+		return
+	}
+
+	l.average = latencyWeight*float64(latency) + (1-latencyWeight)*l.average
+}
+
+func (l *latencyShedder) averageLatency() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return time.Duration(l.average)
+}
+
+// The share of new requests currently being turned away, from 0 to the configured maximum.
+func (l *latencyShedder) fraction() float64 {
+	if l.threshold <= 0 {
+		return 0
+	}
+
+	over := float64(l.averageLatency()-l.threshold) / float64(l.threshold)
+	return l.maxFraction * min(max(over, 0), 1)
+}
+
+func (l *latencyShedder) shed() bool {
+	fraction := l.fraction()
+	return fraction > 0 && rand.Float64() < fraction
+}
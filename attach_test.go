@@ -0,0 +1,105 @@
+package impact
+
+import (
+	"errors"
+	"github.com/blanu/impact/internal/message"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Run the test resource the way something other than impact would, on pipes whose other ends are held open and never
+// used, and return it along with a channel that is closed once it has exited.
+func runResourceElsewhere(t *testing.T) (*exec.Cmd, chan bool) {
+	t.Helper()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("-attach-pid reaches the process's descriptors through /proc")
+	}
+
+	inputReader, inputWriter, inputError := os.Pipe()
+	if inputError != nil {
+		t.Fatal(inputError)
+	}
+	outputReader, outputWriter, outputError := os.Pipe()
+	if outputError != nil {
+		t.Fatal(outputError)
+	}
+
+	command := exec.Command(os.Args[0])
+	command.Env = append(os.Environ(), testResourceMode+"=echo")
+	command.Stdin, command.Stdout = inputReader, outputWriter
+	if startError := command.Start(); startError != nil {
+		t.Fatal(startError)
+	}
+	_, _ = inputReader.Close(), outputWriter.Close()
+
+	exited := make(chan bool)
+	go func() {
+		_ = command.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		_ = command.Process.Kill()
+		<-exited
+		_, _ = inputWriter.Close(), outputReader.Close()
+	})
+
+	return command, exited
+}
+
+// A resource impact attached to is served like one it launched, and is left running when impact shuts down.
+func TestAttachPID(t *testing.T) {
+	command, exited := runResourceElsewhere(t)
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.Path = ""
+		config.AttachPID = command.Process.Pid
+	})
+	client := dial(t, address)
+
+	for _, payload := range []string{"first", "second"} {
+		expectReply(t, client.request(1, payload), payload)
+	}
+
+	go client.hangUpWhenClosed()
+	if closeError := server.Close(); closeError != nil {
+		t.Fatalf("Close gave %v, not a clean shutdown", closeError)
+	}
+	select {
+	case <-exited:
+		t.Fatal("the resource impact attached to exited when impact shut down")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if signalError := command.Process.Signal(syscall.Signal(0)); signalError != nil {
+		t.Fatalf("the resource impact attached to is gone: %v", signalError)
+	}
+}
+
+// When a resource impact attached to exits, impact isn't the one to relaunch it, and gives up on it with exit code 40,
+// even under -restart always.
+func TestAttachedResourceExits(t *testing.T) {
+	command, exited := runResourceElsewhere(t)
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.Path = ""
+		config.AttachPID = command.Process.Pid
+		config.Restart = restartAlways
+	})
+	client := dial(t, address)
+
+	client.send(1, "exit")
+	expectError(t, receiveAnswer(client), message.ResourceStopped)
+	<-exited
+	go client.hangUpWhenClosed()
+	select {
+	case <-server.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server is still serving without the resource it attached to")
+	}
+	var exitError *ExitError
+	if closeError := server.Close(); !errors.As(closeError, &exitError) || exitError.Code != 40 {
+		t.Fatalf("the server ended with %v, not exit code 40", closeError)
+	}
+}
@@ -0,0 +1,286 @@
+package impact
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/radiowave"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records every request a client sends, with the reply it got, when, and who sent it, in a form that
+// can't be changed without it showing. Each entry is one line: the SHA-256 of the entry, in hex, a space, and the entry
+// itself as JSON. Each entry names the hash of the one before, and is numbered one after it, so changing an entry
+// breaks its own hash, and taking one out or putting one in breaks the chain. The first entry's previous hash is all
+// zeroes. A restarted impact carries the chain on from the last entry in the file, and won't start on a log
+// whose chain is broken.
+//
+// Payloads are recorded by their SHA-256, not in full, so the log shows what a client sent and got without keeping a
+// copy of it. A request impact turned away has the error it was answered with, and no reply digest.
+//
+// The log is written like the journal, and synced to disk as -journal-sync says. Entries are chained in the order they
+// are written, one at a time, however many requests finish at once. -verify-audit checks a log, and exits 0 if it is
+// intact, or 1 at the first entry that isn't. Cutting entries off the end of the log leaves a shorter chain that is
+// still intact, so the last entry's number and hash are worth keeping somewhere else as well.
+
+// The previous hash of the first entry.
+var auditGenesis = strings.Repeat("0", 2*sha256.Size)
+
+type auditEntry struct {
+	Seq           uint64 `json:"seq"`
+	Prev          string `json:"prev"`
+	Time          string `json:"time"`
+	ConnectionID  string `json:"connection_id"`
+	Identity      string `json:"identity,omitempty"`
+	CorrelationID uint64 `json:"correlation_id"`
+	Resource      string `json:"resource,omitempty"`
+	RequestSHA256 string `json:"request_sha256"`
+	RequestBytes  int    `json:"request_bytes"`
+	// How the request ended: replied, failed, refused, cancelled or disconnected.
+	Outcome     string `json:"outcome"`
+	ErrorCode   int    `json:"error_code,omitempty"`
+	ReplySHA256 string `json:"reply_sha256,omitempty"`
+	ReplyBytes  int    `json:"reply_bytes,omitempty"`
+}
+
+// How an audited request ended.
+const (
+	auditReplied      = "replied"
+	auditFailed       = "failed"
+	auditRefused      = "refused"
+	auditCancelled    = "cancelled"
+	auditDisconnected = "disconnected"
+)
+
+func auditOutcome(failed bool, cancelled bool) string {
+	switch {
+	case cancelled:
+		return auditCancelled
+	case failed:
+		return auditFailed
+	default:
+		return auditReplied
+	}
+}
+
+type audit struct {
+	*journal
+
+	// The number and hash of the last entry, under the lock, so that entries are chained in the order they are written.
+	lock sync.Mutex
+	seq  uint64
+	prev string
+}
+
+func newAudit(path string, policy string, interval time.Duration, logger *log.Logger) (*audit, error) {
+	seq, prev, tailError := auditTail(path)
+	if tailError != nil {
+		return nil, tailError
+	}
+
+	j, journalError := newJournal(path, policy, interval, logger)
+	if journalError != nil {
+		return nil, journalError
+	}
+
+	return &audit{journal: j, seq: seq, prev: prev}, nil
+}
+
+// Whatever the sync policy, everything recorded is made durable when we exit cleanly.
+func (a *audit) close() {
+	if a == nil {
+		return
+	}
+
+	a.journal.close()
+}
+
+// The number and hash of the last entry of an existing log, or of none at all for a log that isn't there yet. A log
+// whose chain is broken isn't carried on from, so that a new entry never vouches for a tampered one.
+func auditTail(path string) (uint64, string, error) {
+	file, openError := os.Open(path)
+	if errors.Is(openError, os.ErrNotExist) {
+		return 0, auditGenesis, nil
+	}
+	if openError != nil {
+		return 0, "", openError
+	}
+	defer file.Close()
+
+	seq, prev, checkError := checkAuditLog(file)
+	var broken *auditBreak
+	if errors.As(checkError, &broken) {
+		return 0, "", fmt.Errorf("audit log %s is %w, so it can't be carried on from", path, checkError)
+	}
+	if checkError != nil {
+		return 0, "", fmt.Errorf("audit log %s can't be read: %w", path, checkError)
+	}
+
+	return seq, prev, nil
+}
+
+// Where an audit log's chain breaks.
+type auditBreak struct {
+	Line    int
+	Problem string
+}
+
+func (b *auditBreak) Error() string {
+	return fmt.Sprintf("not intact at line %d: %s", b.Line, b.Problem)
+}
+
+// Follow the chain of an audit log, and return the number and hash of its last entry, or an *auditBreak at the first
+// line that doesn't follow on from the one before.
+func checkAuditLog(reader io.Reader) (uint64, string, error) {
+	seq, prev := uint64(0), auditGenesis
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		entryHash, entry, parseError := parseAuditLine(scanner.Bytes())
+		switch {
+		case parseError != nil:
+			return 0, "", &auditBreak{Line: line, Problem: parseError.Error()}
+		case entry.Prev != prev:
+			return 0, "", &auditBreak{Line: line, Problem: "previous hash doesn't match the entry before"}
+		case entry.Seq != seq+1:
+			return 0, "", &auditBreak{Line: line, Problem: fmt.Sprintf("entry %d follows entry %d", entry.Seq, seq)}
+		}
+
+		seq, prev = entry.Seq, entryHash
+	}
+
+	return seq, prev, scanner.Err()
+}
+
+func parseAuditLine(line []byte) (string, auditEntry, error) {
+	var entry auditEntry
+
+	entryHash, body, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return "", entry, errors.New("no hash")
+	}
+	if unmarshalError := json.Unmarshal(body, &entry); unmarshalError != nil {
+		return "", entry, unmarshalError
+	}
+
+	// The hash is of the entry exactly as it was written.
+	if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != string(entryHash) {
+		return "", entry, errors.New("hash doesn't match the entry")
+	}
+
+	return string(entryHash), entry, nil
+}
+
+// What is known of a request's reply as it comes, for its audit entry.
+type auditTrail struct {
+	entry auditEntry
+	reply hash.Hash
+}
+
+// Start an audit entry for a request, or nil without an audit log.
+func (a *audit) begin(conn *connection.Conn, r request.Request) *auditTrail {
+	if a == nil {
+		return nil
+	}
+
+	var payload []byte
+	if typed, ok := r.Message.(message.ImpactMessage); ok {
+		payload = typed.Payload
+	}
+	digest := sha256.Sum256(payload)
+
+	return &auditTrail{
+		entry: auditEntry{
+			ConnectionID:  conn.ID,
+			Identity:      conn.Identity,
+			CorrelationID: r.CorrelationID,
+			Resource:      r.Resource,
+			RequestSHA256: hex.EncodeToString(digest[:]),
+			RequestBytes:  len(payload),
+		},
+		reply: sha256.New(),
+	}
+}
+
+// Add part of the reply, or the error that answered the request.
+func (t *auditTrail) add(wave radiowave.Message) {
+	if t == nil {
+		return
+	}
+
+	switch typed := wave.(type) {
+	case message.ImpactError:
+		t.entry.ErrorCode = int(typed.Code)
+	case message.ImpactMessage:
+		t.reply.Write(typed.Payload)
+		t.entry.ReplyBytes += len(typed.Payload)
+	}
+}
+
+// Chain the finished entry on to the log.
+func (a *audit) record(t *auditTrail, outcome string) {
+	if a == nil || t == nil {
+		return
+	}
+
+	entry := t.entry
+	entry.Outcome = outcome
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if entry.ReplyBytes > 0 {
+		entry.ReplySHA256 = hex.EncodeToString(t.reply.Sum(nil))
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entry.Seq, entry.Prev = a.seq+1, a.prev
+	// Nothing in an entry can fail to marshal.
+	body, _ := json.Marshal(entry)
+	sum := sha256.Sum256(body)
+	entryHash := hex.EncodeToString(sum[:])
+
+	line := make([]byte, 0, len(entryHash)+1+len(body)+1)
+	line = append(append(append(append(line, entryHash...), ' '), body...), '\n')
+	if writeError := a.write(line); writeError != nil {
+		a.logger.Println("audit log write failed:", writeError)
+		return
+	}
+	a.seq, a.prev = entry.Seq, entryHash
+}
+
+// Check an audit log, reporting the first thing wrong with it, and return the exit code.
+func runVerifyAudit(path string, logger *log.Logger) int {
+	file, openError := os.Open(path)
+	if openError != nil {
+		logger.Printf("audit log %s can't be read: %v", path, openError)
+		return 1
+	}
+	defer file.Close()
+
+	seq, prev, checkError := checkAuditLog(file)
+	var broken *auditBreak
+	if errors.As(checkError, &broken) {
+		logger.Printf("audit log %s is %v", path, broken)
+		return 1
+	}
+	if checkError != nil {
+		logger.Printf("audit log %s can't be read: %v", path, checkError)
+		return 1
+	}
+
+	logger.Printf("audit log %s is intact: %d entries, last hash %s", path, seq, prev)
+	return 0
+}
@@ -0,0 +1,129 @@
+package impact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Serve requests from several connections at once with an audit log, and return the log's lines once closed.
+func writeAuditLog(t *testing.T, path string, connections int) []string {
+	t.Helper()
+
+	server, address := startServer(t, "echo", func(config *Config) { config.Audit = path })
+
+	var clients sync.WaitGroup
+	for index := 0; index < connections; index++ {
+		client := dial(t, address)
+		clients.Add(1)
+		go func(index int) {
+			defer clients.Done()
+			for correlationID := uint64(1); correlationID <= 5; correlationID++ {
+				if _, requestError := client.tryRequest(correlationID, fmt.Sprintf("request %d", index)); requestError != nil {
+					t.Errorf("connection %d: %v", index, requestError)
+					return
+				}
+			}
+		}(index)
+	}
+	clients.Wait()
+	if closeError := server.Close(); closeError != nil {
+		t.Fatalf("Close: %v", closeError)
+	}
+
+	contents, readError := os.ReadFile(path)
+	if readError != nil {
+		t.Fatalf("reading the audit log: %v", readError)
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+func verifyAudit(t *testing.T, path string) (int, string) {
+	t.Helper()
+
+	var logs bytes.Buffer
+	code := runVerifyAudit(path, log.New(&logs, "", 0))
+	return code, logs.String()
+}
+
+// Entries written by requests finishing at once still make one chain, and a restart carries it on.
+func TestAuditChain(t *testing.T) {
+	path := t.TempDir() + "/audit"
+
+	lines := writeAuditLog(t, path, 4)
+	if len(lines) != 20 {
+		t.Fatalf("20 requests made %d entries", len(lines))
+	}
+	if code, logs := verifyAudit(t, path); code != 0 || !strings.Contains(logs, "20 entries") {
+		t.Fatalf("-verify-audit exited %d: %s", code, logs)
+	}
+
+	lines = writeAuditLog(t, path, 1)
+	if len(lines) != 25 {
+		t.Fatalf("after a restart the log has %d entries, not 25", len(lines))
+	}
+	if code, logs := verifyAudit(t, path); code != 0 || !strings.Contains(logs, "25 entries") {
+		t.Fatalf("-verify-audit exited %d after a restart: %s", code, logs)
+	}
+}
+
+// Editing, taking out or reordering entries is found at the line it happened, both by -verify-audit and by a server
+// that would carry the chain on.
+func TestAuditTampering(t *testing.T) {
+	lines := writeAuditLog(t, t.TempDir()+"/audit", 2)
+
+	tamperings := []struct {
+		name   string
+		tamper func(lines []string) []string
+		line   int
+	}{
+		{"edited", func(lines []string) []string {
+			lines[3] = strings.Replace(lines[3], `"request_bytes":9`, `"request_bytes":10`, 1)
+			return lines
+		}, 4},
+		{"rehashed", func(lines []string) []string {
+			lines[3] = strings.Repeat("f", 64) + lines[3][64:]
+			return lines
+		}, 4},
+		{"taken out", func(lines []string) []string {
+			return append(lines[:5], lines[6:]...)
+		}, 6},
+		{"reordered", func(lines []string) []string {
+			lines[2], lines[7] = lines[7], lines[2]
+			return lines
+		}, 3},
+		{"unreadable", func(lines []string) []string {
+			lines[8] = "not an entry"
+			return lines
+		}, 9},
+	}
+	for _, tampering := range tamperings {
+		t.Run(tampering.name, func(t *testing.T) {
+			tampered := tampering.tamper(append([]string(nil), lines...))
+			path := t.TempDir() + "/audit"
+			if writeError := os.WriteFile(path, []byte(strings.Join(tampered, "\n")+"\n"), 0o600); writeError != nil {
+				t.Fatal(writeError)
+			}
+
+			at := fmt.Sprintf("line %d:", tampering.line)
+			if code, logs := verifyAudit(t, path); code != 1 || !strings.Contains(logs, at) {
+				t.Fatalf("-verify-audit exited %d, not 1 at %s: %s", code, at, logs)
+			}
+
+			config := DefaultConfig()
+			config.Port = freePort(t)
+			config.Path = os.Args[0]
+			config.Audit = path
+			_, serverError := NewServer(WithConfig(config), WithLogger(log.New(&lockedBuffer{}, "", 0)))
+			var exitError *ExitError
+			if !errors.As(serverError, &exitError) || exitError.Code != 4 || !strings.Contains(serverError.Error(), at) {
+				t.Fatalf("NewServer on a tampered log gave %v, not exit code 4 at %s", serverError, at)
+			}
+		})
+	}
+}
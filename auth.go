@@ -0,0 +1,261 @@
+package impact
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"net"
+	"os"
+	"strings"
+)
+
+// An IdentityExtractor finds out who a client is, once its hello has arrived and before it is welcomed. The identity
+// it returns is the connection's from then on: it is who the connection's usage is counted against, what its logs and
+// audit entries say, and who may resume its session.
+//
+// The contract is:
+//
+//   - an identity and no error means the extractor knows who the client is, and the client is let in as that;
+//   - ErrNoIdentity means the client didn't offer anything this extractor goes by, such as a token or a certificate,
+//     and the next one in the chain gets to try;
+//   - any other error means the client offered something that doesn't hold up, such as a token we don't know. The
+//     next one still gets to try, but if none of them knows the client, it is turned away even under
+//     -auth-fallback anonymous, since a client that tried to prove who it is and failed isn't anonymous.
+//
+// Bringing a new way of telling who a client is only takes an extractor, added to the server's chain with
+// WithIdentityExtractor, after the built in ones that -auth names.
+type IdentityExtractor func(client Client) (string, error)
+
+// A Client is what an IdentityExtractor has to go on.
+type Client struct {
+	// Where the client connects from.
+	RemoteAddr net.Addr
+	// The client's certificate, if it sent one that was checked against the client CA. Nil otherwise.
+	Certificate *x509.Certificate
+	// The token in the client's hello. Empty if there is none.
+	Token string
+}
+
+// ErrNoIdentity is what an IdentityExtractor returns when the client offered nothing it goes by.
+var ErrNoIdentity = errors.New("client offered no identity")
+
+// WithIdentityExtractor adds an extractor to the end of the server's chain, under the name that its authentications
+// are counted by. A server with any extractor at all turns away clients that none of them knows, unless -auth-fallback
+// lets them in.
+func WithIdentityExtractor(name string, extract IdentityExtractor) Option {
+	return func(server *Server) {
+		server.extractors = append(server.extractors, identityMethod{name: name, extract: extract})
+	}
+}
+
+// An extractor in the chain, under the name that its authentications are counted by.
+type identityMethod struct {
+	name    string
+	extract IdentityExtractor
+}
+
+// What an extractor has to go on, for the client on the connection that sent the hello.
+func clientOf(conn *connection.Conn, hello message.ImpactMessage) Client {
+	certificate, _ := conn.VerifiedCertificate()
+	return Client{RemoteAddr: conn.RemoteAddr(), Certificate: certificate, Token: hello.Header.Token}
+}
+
+// What happens to a client that none of the chain knows.
+const (
+	authFallbackReject    = "reject"
+	authFallbackAnonymous = "anonymous"
+)
+
+// A client certificate, checked against the client CA when the TLS session was set up, proves who the client is.
+// The identity is the certificate's common name.
+func certificateIdentity(client Client) (string, error) {
+	if client.Certificate == nil {
+		return "", ErrNoIdentity
+	}
+
+	return client.Certificate.Subject.CommonName, nil
+}
+
+// The same, but the identity is the certificate's whole subject, for CAs whose common names aren't unique.
+func certificateSubjectIdentity(client Client) (string, error) {
+	if client.Certificate == nil {
+		return "", ErrNoIdentity
+	}
+
+	return client.Certificate.Subject.String(), nil
+}
+
+// The same, but the identity is the certificate's first URI name, such as a SPIFFE id.
+func certificateURIIdentity(client Client) (string, error) {
+	if client.Certificate == nil {
+		return "", ErrNoIdentity
+	}
+	if len(client.Certificate.URIs) == 0 {
+		return "", errors.New("client certificate has no URI name")
+	}
+
+	return client.Certificate.URIs[0].String(), nil
+}
+
+// A token sent in the client's hello proves who the client is, if it is one that we know.
+func tokenIdentity(identities map[string]string) IdentityExtractor {
+	return func(client Client) (string, error) {
+		if client.Token == "" {
+			return "", ErrNoIdentity
+		}
+
+		identity, found := identities[client.Token]
+		if !found {
+			return "", errors.New("unknown token")
+		}
+
+		return identity, nil
+	}
+}
+
+// The address the client connects from is its identity, for networks where that is proof enough. It proves nothing
+// on its own, so it only makes sense behind something that does, or combined with something that does.
+func addressIdentity(client Client) (string, error) {
+	if client.RemoteAddr == nil {
+		return "", ErrNoIdentity
+	}
+	host, _, splitError := net.SplitHostPort(client.RemoteAddr.String())
+	if splitError != nil || host == "" {
+		return "", ErrNoIdentity
+	}
+
+	return host, nil
+}
+
+// A combination of extractors knows the client only if every one of them does, and the identity is all of theirs,
+// joined with slashes, in order.
+func combinedIdentity(parts []IdentityExtractor) IdentityExtractor {
+	return func(client Client) (string, error) {
+		identities := make([]string, len(parts))
+		for index, part := range parts {
+			identity, extractError := part(client)
+			if extractError != nil {
+				return "", extractError
+			}
+			identities[index] = identity
+		}
+
+		return strings.Join(identities, "/"), nil
+	}
+}
+
+// The token file has one token per line, followed by the identity it proves, separated by whitespace.
+// Blank lines and lines starting with # are ignored.
+func loadTokens(path string) (map[string]string, error) {
+	file, openError := os.Open(path)
+	if openError != nil {
+		return nil, openError
+	}
+	defer file.Close()
+
+	identities := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("each line of the token file must be a token and an identity")
+		}
+		identities[fields[0]] = fields[1]
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	return identities, nil
+}
+
+// The built in extractor of the given name.
+func builtinIdentity(name string, tokenPath string) (IdentityExtractor, error) {
+	switch name {
+	case "cert":
+		return certificateIdentity, nil
+	case "cert-dn":
+		return certificateSubjectIdentity, nil
+	case "cert-uri":
+		return certificateURIIdentity, nil
+	case "address":
+		return addressIdentity, nil
+	case "token":
+		identities, tokenError := loadTokens(tokenPath)
+		if tokenError != nil {
+			return nil, tokenError
+		}
+		return tokenIdentity(identities), nil
+	default:
+		return nil, fmt.Errorf("unknown authentication method %q", name)
+	}
+}
+
+// Build the chain of extractors named in -auth, in the order they are to be tried. A name made of several joined by +
+// is their combination.
+func newAuthChain(methods string, tokenPath string) ([]identityMethod, error) {
+	if methods == "" {
+		return nil, nil
+	}
+
+	chain := make([]identityMethod, 0)
+	for _, method := range strings.Split(methods, ",") {
+		method = strings.TrimSpace(method)
+
+		var parts []IdentityExtractor
+		for _, name := range strings.Split(method, "+") {
+			part, partError := builtinIdentity(name, tokenPath)
+			if partError != nil {
+				return nil, partError
+			}
+			parts = append(parts, part)
+		}
+
+		extract := parts[0]
+		if len(parts) > 1 {
+			extract = combinedIdentity(parts)
+		}
+		chain = append(chain, identityMethod{name: method, extract: extract})
+	}
+
+	return chain, nil
+}
+
+// Try each extractor in turn until one of them knows who the client is. With none, every client is let in without an
+// identity. Otherwise, a client that none of them knows is turned away, unless -auth-fallback lets it in anonymously.
+func (s *server) authenticate(connection *connection.Conn, hello message.ImpactMessage) bool {
+	if len(s.authenticators) == 0 {
+		return true
+	}
+
+	client := clientOf(connection, hello)
+	offeredBadIdentity := false
+	for _, method := range s.authenticators {
+		identity, extractError := method.extract(client)
+		if extractError == nil {
+			connection.Identity = identity
+			connection.AuthMethod = method.name
+			s.authentications.Inc(method.name)
+			return true
+		}
+		if !errors.Is(extractError, ErrNoIdentity) {
+			offeredBadIdentity = true
+		}
+	}
+
+	if s.authFallback == authFallbackAnonymous && !offeredBadIdentity {
+		s.authentications.Inc(authFallbackAnonymous)
+		return true
+	}
+
+	s.authentications.Inc("failed")
+	return false
+}
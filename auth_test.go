@@ -0,0 +1,54 @@
+package impact
+
+import (
+	"errors"
+	"github.com/blanu/impact/internal/message"
+	"testing"
+)
+
+// An extractor added by whoever makes the server decides who clients are, after the methods -auth names.
+func TestWithIdentityExtractor(t *testing.T) {
+	friends := func(client Client) (string, error) {
+		switch client.Token {
+		case "":
+			return "", ErrNoIdentity
+		case "friend":
+			return "friendly client", nil
+		default:
+			return "", errors.New("not a friend")
+		}
+	}
+	server, address := startServer(t, "echo", nil, WithIdentityExtractor("friends", friends))
+
+	hello := message.NewHello(message.MinimumVersion, message.Version)
+	hello.Header.Token = "friend"
+	client, welcome := connect(t, address, hello)
+	if welcome.Header.Type != message.Welcome {
+		t.Fatalf("a friend got a message of type %d in answer to its hello", welcome.Header.Type)
+	}
+	expectReply(t, client.request(1, "hello"), "hello")
+
+	connections := server.s.currentConnections()
+	if len(connections) != 1 || connections[0].Identity != "friendly client" || connections[0].AuthMethod != "friends" {
+		t.Fatalf("the friend's connection is %+v", connections)
+	}
+
+	// A client the extractor doesn't know is turned away, whether it offered nothing or something that didn't hold up.
+	for _, token := range []string{"", "stranger"} {
+		hello.Header.Token = token
+		_, answer := connect(t, address, hello)
+		expectError(t, answer, message.Unauthenticated)
+	}
+}
+
+func TestIdentityExtractorNeedsAHandshake(t *testing.T) {
+	config := DefaultConfig()
+	config.Port = freePort(t)
+	config.Path = "/bin/true"
+	config.UDPPort = freePort(t)
+
+	never := func(Client) (string, error) { return "", ErrNoIdentity }
+	if _, serverError := NewServer(WithConfig(config), WithIdentityExtractor("never", never)); serverError == nil {
+		t.Fatal("NewServer let datagrams, which have no hello, past an identity extractor")
+	}
+}
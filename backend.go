@@ -0,0 +1,168 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/impact/internal/resource"
+	"github.com/blanu/impact/internal/scheduler"
+	"sync/atomic"
+	"time"
+)
+
+// A backend is one serialization domain: a pool of resource processes, the queue of requests waiting for them, and
+// the coroutines that feed them and keep an eye on them. Requests to one backend never wait behind requests to
+// another, and a backend restarting doesn't disturb the others. Everything else, such as connections, limits and
+// metrics, belongs to the server that the backend's requests came through.
+type backend struct {
+	*server
+
+	// The backend's name, for logs.
+	name string
+	// The resource executable, and how it is connected to us.
+	path    string
+	options resource.Options
+
+	// Client requests wait here until the scheduler lets them into the funnel.
+	scheduler scheduler.Scheduler
+	// All client requests go into the funnel. Every member of the pool takes its next request from it. It is
+	// unbuffered unless -funnel-buffer says otherwise.
+	funnel chan request.Request
+
+	// The resource processes serving this backend. There is usually just the one.
+	members []*member
+	// How many members' process handlers are still running.
+	running atomic.Int32
+
+	// How many requests the resource may work on at once. Above one, replies are matched to requests by correlation id.
+	concurrency int
+	// What to do when the resource closes its output but keeps running.
+	outputClosedPolicy string
+	// What to make of what the resource writes before it is sent anything, and what says it is ready.
+	bannerMode string
+	readyText  string
+
+	// Paces requests into the funnel while the resource warms up.
+	warmup *warmup
+
+	// Turns away requests when the resource is slow.
+	shedder *latencyShedder
+
+	// Whether the backend's resource failing is its own problem. A named resource is one of several, and the server
+	// carries on without it, where the primary and large backends failing takes the server down.
+	isolated bool
+	// What happens when the server's last resource exits, and how long a resource that keeps exiting waits to be
+	// relaunched.
+	restartPolicy     string
+	restartBackoff    time.Duration
+	restartBackoffMax time.Duration
+	// What is done to the resource when a request to it times out.
+	timeoutAction string
+
+	// The pid of a resource that someone else runs, which the backend attached to rather than launching its own.
+	// Zero means the backend launches its resource from path.
+	attachPID int
+}
+
+func (s *server) newBackend(name string, path string, queue scheduler.Scheduler) *backend {
+	return &backend{
+		server:    s,
+		name:      name,
+		path:      path,
+		scheduler: queue,
+		funnel:    make(chan request.Request, s.funnelBuffer),
+	}
+}
+
+// Start an instance of the backend's resource, or attach to the one that is already running.
+func (b *backend) launch() (*resource.Process, error) {
+	if b.attachPID != 0 {
+		return resource.Attach(b.factory, b.attachPID, b.options)
+	}
+
+	return resource.Launch(b.factory, b.path, b.options)
+}
+
+// Choose the backend for a request. Big requests go to the large backend, if there is one, so that small requests
+// aren't stuck behind them.
+func (s *server) route(r request.Request) *backend {
+	// A request that names its resource gets that one, or none at all if there is no such resource.
+	if r.Resource != "" {
+		return s.named[r.Resource]
+	}
+
+	if s.large != nil && payloadSize(r.Message) > s.largeRequestSize {
+		return s.large
+	}
+
+	return s.primary
+}
+
+// How many requests are waiting on this backend, including the ones it is working on.
+func (b *backend) waiting() int {
+	return b.scheduler.Len() + len(b.funnel) + b.busyMembers()
+}
+
+// How many members of the pool have a process running. The rest are being relaunched, or have stopped.
+func (b *backend) healthyMembers() int {
+	healthy := 0
+	for _, m := range b.members {
+		if m.healthy.Load() {
+			healthy += 1
+		}
+	}
+
+	return healthy
+}
+
+func (b *backend) busyMembers() int {
+	busy := 0
+	for _, m := range b.members {
+		if m.busy.Load() {
+			busy += 1
+		}
+	}
+
+	return busy
+}
+
+// Launch a backend's resource, or attach to it if it's already running, and start the coroutines that serve and watch
+// it. A large pool may be launched in batches, and only part of it before this returns. An isolated backend's resource failing leaves the rest of the server running.
+func (s *server) startBackend(config Config, name string, path string, attachPID int, isolated bool, probes probeCounters) *backend {
+	var queue scheduler.Scheduler
+	switch config.Scheduler {
+	case "fifo":
+		queue = scheduler.NewFIFO()
+	case "cost":
+		queue = scheduler.NewDeficitRoundRobin(config.CostQuantum)
+	case "edf":
+		queue = scheduler.NewEarliestDeadline()
+	case "priority":
+		queue = scheduler.NewPriority()
+	}
+
+	b := s.newBackend(name, path, queue)
+	b.isolated = isolated
+	b.attachPID = attachPID
+	b.warmup = newWarmup(config.WarmupPeriod, config.WarmupStartRate, config.WarmupFullRate)
+	b.warmup.begin()
+	b.shedder = newLatencyShedder(config.ShedLatency, config.ShedMaxFraction)
+	b.concurrency = config.ResourceConcurrency
+	b.outputClosedPolicy = config.OutputClosed
+	b.bannerMode = config.ResourceBanner
+	b.readyText = config.ResourceReady
+	b.restartPolicy = config.Restart
+	b.restartBackoff = config.RestartBackoff
+	b.restartBackoffMax = config.RestartBackoffMax
+	b.timeoutAction = config.TimeoutAction
+	b.options = resource.Options{
+		OutputFD:    config.ResourceOutputFD,
+		Diagnostics: func(line string) { s.logger.Printf("resource %s: %s", name, line) },
+		Text:        config.ResourceBanner != resourceBannerNone,
+	}
+
+	b.spawnPool(config, probes)
+
+	// The scheduler decides which queued request goes into the funnel next.
+	go b.handleScheduler()
+
+	return b
+}
@@ -0,0 +1,97 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/resource"
+	"github.com/blanu/radiowave"
+	"time"
+)
+
+// How a send to the resource ended.
+type sendOutcome int
+
+const (
+	// The resource has the message.
+	sendDelivered sendOutcome = iota
+	// Something asked for the resource to be restarted before it took the message.
+	sendRestart
+	// The resource exited before it took the message.
+	sendExited
+)
+
+// Send a message to the resource, keeping track of whether it is taking its input. If something asked for a restart
+// instead, the reason it gave goes with the outcome.
+//
+// A resource that has stopped reading its input fills the pipe to it, and then sending it the next request blocks.
+// That looks just like a resource that is slow to reply, except that nothing has even reached it. When a send blocks
+// for longer than -input-stall, the member is marked as blocked, which shows up in metrics and the pool listing. While
+// every member of a backend is blocked, new requests for it are turned away, since they could only join the queue
+// behind a resource that isn't taking anything.
+func (m *member) send(process *resource.Process, wave radiowave.Message) (sendOutcome, string) {
+	if outcome, reason, ready := m.awaitBanner(process); !ready {
+		return outcome, reason
+	}
+
+	var stalled <-chan time.Time
+	if m.inputStall > 0 {
+		timer := time.NewTimer(m.inputStall)
+		defer timer.Stop()
+		stalled = timer.C
+	}
+
+	for {
+		select {
+		case process.InputChannel <- wave:
+			m.setInputBlocked(false)
+			return sendDelivered, ""
+
+		case <-stalled:
+			m.setInputBlocked(true)
+			stalled = nil
+
+		// Whatever the old process wasn't taking, the next one starts afresh.
+		case reason := <-m.restarts:
+			m.inputBlocked.Store(false)
+			return sendRestart, reason
+
+		case <-process.ExitChannel:
+			m.inputBlocked.Store(false)
+			return sendExited, ""
+		}
+	}
+}
+
+func (m *member) setInputBlocked(blocked bool) {
+	if m.inputBlocked.Swap(blocked) == blocked {
+		return
+	}
+
+	if blocked {
+		m.inputStalls.Inc()
+		m.logger.Printf("resource %s has not taken its input for %s, turning new requests away until it does", m.name, m.inputStall)
+	} else {
+		m.logger.Printf("resource %s is taking its input again", m.name)
+	}
+}
+
+// Whether every member of the backend has stopped taking its input.
+func (b *backend) inputBlocked() bool {
+	for _, m := range b.members {
+		if !m.inputBlocked.Load() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// How many members of the backend have stopped taking their input.
+func (b *backend) blockedMembers() int {
+	blocked := 0
+	for _, m := range b.members {
+		if m.inputBlocked.Load() {
+			blocked += 1
+		}
+	}
+
+	return blocked
+}
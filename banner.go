@@ -0,0 +1,165 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"github.com/blanu/radiowave"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Some resources announce themselves when they start, with a banner or a prompt, before they have been sent anything.
+// Taken as it comes, that would be the reply to the first request, and every reply after it would be one behind.
+// -resource-banner says what to make of whatever the resource writes before it is sent its first message, one of:
+const (
+	// The resource writes nothing of its own accord, so whatever it writes is a reply. Text where a message should be
+	// ends its output, as any other corruption does.
+	resourceBannerNone = "none"
+	// Whatever the resource writes before it is sent anything is its banner, logged and thrown away, whether it is
+	// messages or plain text. Text it writes later is logged and thrown away too.
+	resourceBannerLog = "log"
+	// The same, but the resource isn't sent anything until its banner has said it is ready, in a line of text or a
+	// message containing -resource-ready.
+	resourceBannerReady = "ready"
+)
+
+// The most of each process's banner kept for the pool listing.
+const maxBannerKept = 1024
+
+// What is known of one process's banner.
+type bannerWatch struct {
+	// Closed once the resource has been sent something. Whatever it writes after is a reply.
+	sending     chan bool
+	sendingOnce sync.Once
+	// Closed once the resource is ready to be sent something.
+	ready     chan bool
+	readyOnce sync.Once
+
+	lock sync.Mutex
+	text string
+}
+
+func (w *bannerWatch) keep(line string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if room := maxBannerKept - len(w.text); room > 0 {
+		line += "\n"
+		w.text += line[:min(len(line), room)]
+	}
+}
+
+// Whatever of the banner has been kept, for the pool listing.
+func (w *bannerWatch) kept() string {
+	if w == nil {
+		return ""
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.text
+}
+
+// Take the banner out of a freshly launched process's output, before anything else sees it.
+func (m *member) watchBanner(process *resource.Process) {
+	if m.bannerMode == resourceBannerNone {
+		m.banner.Store(nil)
+		return
+	}
+
+	watch := &bannerWatch{sending: make(chan bool), ready: make(chan bool)}
+	if m.bannerMode == resourceBannerLog {
+		close(watch.ready)
+	}
+	m.banner.Store(watch)
+
+	output := process.OutputChannel
+	rest := make(chan radiowave.Message)
+	process.OutputChannel = rest
+
+	launched := time.Now()
+	go func() {
+		for {
+			select {
+			case wave, open := <-output:
+				if !open {
+					close(rest)
+					return
+				}
+
+				if m.bannered(watch, wave, launched) {
+					continue
+				}
+
+				select {
+				case rest <- wave:
+				case <-process.ExitChannel:
+					return
+				}
+
+			case <-process.ExitChannel:
+				return
+			}
+		}
+	}()
+}
+
+// Report whether something the resource wrote was its banner, or other text, rather than a reply.
+func (m *member) bannered(watch *bannerWatch, wave radiowave.Message, launched time.Time) bool {
+	line := ""
+	select {
+	case <-watch.sending:
+		// Once the resource has been sent something, only text isn't a reply.
+		text, isText := wave.(resource.Text)
+		if !isText {
+			return false
+		}
+		m.logger.Printf("resource %s wrote text between messages: %s", m.name, text.Line)
+		return true
+
+	default:
+		switch typed := wave.(type) {
+		case resource.Text:
+			line = typed.Line
+		case message.ImpactMessage:
+			line = string(typed.Payload)
+		default:
+			return false
+		}
+	}
+
+	m.logger.Printf("resource %s banner: %s", m.name, line)
+	watch.keep(line)
+
+	if m.bannerMode == resourceBannerReady && strings.Contains(line, m.readyText) {
+		watch.readyOnce.Do(func() {
+			m.logger.Printf("resource %s is ready after %s", m.name, time.Since(launched).Round(time.Millisecond))
+			close(watch.ready)
+		})
+	}
+
+	return true
+}
+
+// Before the resource is first sent anything, wait for it to be ready, unless something else happens first, in which
+// case the caller gives up sending and the outcome says why.
+func (m *member) awaitBanner(process *resource.Process) (sendOutcome, string, bool) {
+	watch := m.banner.Load()
+	if watch == nil {
+		return sendDelivered, "", true
+	}
+
+	select {
+	case <-watch.ready:
+	case reason := <-m.restarts:
+		return sendRestart, reason, false
+	case <-process.ExitChannel:
+		return sendExited, "", false
+	}
+
+	// From here on, whatever the resource writes is taken as a reply.
+	watch.sendingOnce.Do(func() { close(watch.sending) })
+	return sendDelivered, "", true
+}
@@ -0,0 +1,45 @@
+package impact
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+// A resource that announces itself before it is sent anything doesn't have its banner taken for the first reply.
+// Under -resource-banner ready, nothing is sent until the prompt has come, so all of the banner is skipped, the
+// message in the middle of it included, and every reply goes to its own request.
+func TestResourceBannerReady(t *testing.T) {
+	t.Setenv(testResourceBanner, "banner message")
+	logs := &lockedBuffer{}
+	_, address := startServer(t, "echo", func(config *Config) {
+		config.ResourceBanner = resourceBannerReady
+		config.ResourceReady = "ready>"
+	}, WithLogger(log.New(logs, "", 0)))
+	client := dial(t, address)
+
+	for correlationID := uint64(1); correlationID <= 3; correlationID++ {
+		payload := fmt.Sprintf("after the banner %d", correlationID)
+		expectReply(t, client.request(correlationID, payload), payload)
+	}
+	for _, logged := range []string{"banner: test resource starting", "banner: banner message", "banner: ready>", "is ready after"} {
+		if !strings.Contains(logs.String(), logged) {
+			t.Fatalf("%q wasn't logged:\n%s", logged, logs.String())
+		}
+	}
+}
+
+// Under -resource-banner log, a banner that has all come before the first request is logged and skipped.
+func TestResourceBannerLog(t *testing.T) {
+	t.Setenv(testResourceBanner, "banner message")
+	logs := &lockedBuffer{}
+	_, address := startServer(t, "echo", func(config *Config) { config.ResourceBanner = resourceBannerLog }, WithLogger(log.New(logs, "", 0)))
+	client := dial(t, address)
+
+	eventually(t, "the whole banner is logged", func() bool { return strings.Contains(logs.String(), "banner: ready>") })
+	expectReply(t, client.request(1, "after the banner"), "after the banner")
+	if !strings.Contains(logs.String(), "banner: test resource starting") {
+		t.Fatalf("the banner's first line wasn't logged:\n%s", logs.String())
+	}
+}
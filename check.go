@@ -0,0 +1,122 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"github.com/blanu/radiowave"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// With -check, impact checks everything it can without serving, and exits. It is meant for deploy pipelines, so that
+// a bad configuration or a broken resource fails the deploy rather than the service. The exit code says what failed,
+// using the same codes impact would exit with on starting up for real: 4 for the configuration, 5 for TLS, 9 for a
+// resource that can't be found, and 12 for one that can't be launched or doesn't answer. Zero means all is well.
+//
+// The configuration itself has been parsed and validated before we get here. What's left are the files it names, and,
+// with -check-launch, the resources themselves.
+func runCheck(config Config, factory radiowave.MessageFactory, logger *log.Logger) int {
+	// A resource impact attaches to is already running, and isn't impact's to launch. It only has to be there.
+	var paths []string
+	if config.AttachPID != 0 {
+		if _, attachError := os.Stat(fmt.Sprintf("/proc/%d/fd/0", config.AttachPID)); attachError != nil {
+			logger.Printf("check failed: can't attach to process %d: %v", config.AttachPID, attachError)
+			return 9
+		}
+	} else {
+		paths = append(paths, config.Path)
+	}
+	if config.LargeRequestSize > 0 && config.LargePath != "" {
+		paths = append(paths, config.LargePath)
+	}
+	// Validate has already checked the resources.
+	resources, _ := parseResources(config.Resources)
+	for _, named := range resources {
+		paths = append(paths, named.path)
+	}
+
+	for _, path := range paths {
+		if _, pathError := exec.LookPath(path); pathError != nil {
+			logger.Printf("check failed: resource %s: %v", path, pathError)
+			return 9
+		}
+	}
+
+	if _, authError := newAuthChain(config.Auth, config.AuthTokens); authError != nil {
+		logger.Printf("check failed: authentication: %v", authError)
+		return 4
+	}
+
+	if config.DebugTokenFile != "" {
+		if _, tokenError := loadDebugToken(config.DebugTokenFile); tokenError != nil {
+			logger.Printf("check failed: debug token: %v", tokenError)
+			return 4
+		}
+	}
+
+	if config.TLSCertificate != "" {
+		if _, tlsError := newTLSConfig(config.TLSCertificate, config.TLSKey, config.TLSTicketKeys, config.TLSClientCA, config.TLSRequireClientCert); tlsError != nil {
+			logger.Printf("check failed: TLS configuration: %v", tlsError)
+			return 5
+		}
+	}
+
+	if config.CheckLaunch {
+		options := resource.Options{
+			OutputFD:    config.ResourceOutputFD,
+			Diagnostics: func(line string) { logger.Printf("resource: %s", line) },
+		}
+		for _, path := range paths {
+			if launchError := checkLaunch(factory, path, options, config.ProbeMessage, config.ProbeTimeout); launchError != nil {
+				logger.Printf("check failed: resource %s: %v", path, launchError)
+				return 12
+			}
+			logger.Printf("resource %s launched and answered a probe", path)
+		}
+	}
+
+	logger.Printf("check passed")
+	return 0
+}
+
+// Launch the resource, send it the probe and wait for it to answer, then stop it again.
+func checkLaunch(factory radiowave.MessageFactory, path string, options resource.Options, payload string, timeout time.Duration) error {
+	process, launchError := resource.Launch(factory, path, options)
+	if launchError != nil {
+		return launchError
+	}
+	defer func() {
+		process.Kill()
+		<-process.ExitChannel
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	probe := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	select {
+	case process.InputChannel <- probe:
+	case <-process.ExitChannel:
+		return fmt.Errorf("exited before taking the probe")
+	case <-timer.C:
+		return fmt.Errorf("did not take the probe within %s", timeout)
+	}
+
+	select {
+	case reply, open := <-process.OutputChannel:
+		if !open {
+			return fmt.Errorf("closed its output without answering the probe")
+		}
+		if _, failed := reply.(message.ImpactError); failed {
+			return fmt.Errorf("answered the probe with an error")
+		}
+		return nil
+	case <-process.ExitChannel:
+		return fmt.Errorf("exited without answering the probe")
+	case <-timer.C:
+		return fmt.Errorf("did not answer the probe within %s", timeout)
+	}
+}
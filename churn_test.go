@@ -0,0 +1,26 @@
+package impact
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// What a short connection costs: connect, hello, one request, close, over and over. Allocations count the client's
+// as well as impact's, since they share the process. Run with go test -run '^$' -bench Churn.
+func BenchmarkConnectionChurn(b *testing.B) {
+	_, address := startServer(b, "echo", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for index := 0; index < b.N; index++ {
+		client := dial(b, address)
+		payload := fmt.Sprintf("churn %d", index)
+		if answer := client.request(1, payload); string(answer.Payload) != payload {
+			b.Fatalf("connection %d was answered with %q", index, answer.Payload)
+		}
+		_ = client.conn.Close()
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "conns/s")
+}
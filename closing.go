@@ -0,0 +1,45 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+)
+
+// Why the server ends a connection. Connection handlers call their connection "connection", so these stand in for the
+// package's names there.
+const (
+	closeFinished     = connection.CloseFinished
+	closeRefused      = connection.CloseRefused
+	closeProtocol     = connection.CloseProtocol
+	closeShutdown     = connection.CloseShutdown
+	closeRateLimited  = connection.CloseRateLimited
+	closeResourceGone = connection.CloseResourceGone
+)
+
+// The close code each reason for closing a connection is sent to the client with. A client that hung up has nobody
+// left to tell, and one that stopped reading can't be told, so neither has one.
+var closeCodes = map[connection.CloseReason]message.CloseCode{
+	closeRefused:      message.ClosedRefused,
+	closeProtocol:     message.ClosedProtocol,
+	closeShutdown:     message.ClosedShutdown,
+	closeRateLimited:  message.ClosedRateLimited,
+	closeResourceGone: message.ClosedResourceGone,
+}
+
+// A client whose connection is closed gracefully is told why, as the last message it gets, after whatever error
+// explained it, so that it can tell impact closing the connection on purpose from the connection failing.
+func farewell(conn *connection.Conn, reason connection.CloseReason) radiowave.Message {
+	code, known := closeCodes[reason]
+	if !known {
+		return nil
+	}
+
+	// A client refused in the handshake, or before it, may not have agreed a version, so it gets the oldest we speak.
+	version := conn.Version
+	if version == 0 {
+		version = message.MinimumVersion
+	}
+
+	return message.NewClosing(version, code, "closing connection: "+reason.String())
+}
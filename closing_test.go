@@ -0,0 +1,83 @@
+package impact
+
+import (
+	"errors"
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// Read until the server's farewell, which has to have the close code and be the last message on the connection.
+// Whatever comes before it, such as the error that explains it, is skipped.
+func expectClosed(t *testing.T, client *testClient, answer message.ImpactMessage, code message.CloseCode) {
+	t.Helper()
+
+	for answer.Header.Type != message.GoingAway || answer.Header.CloseCode == 0 {
+		var readError error
+		if answer, readError = client.tryReceive(5 * time.Second); readError != nil {
+			t.Fatalf("the connection ended without a close code: %v", readError)
+		}
+	}
+	if answer.Header.CloseCode != code {
+		t.Fatalf("the connection was closed with code %d, not %d", answer.Header.CloseCode, code)
+	}
+	if _, readError := client.tryReceive(5 * time.Second); readError == nil {
+		t.Fatal("the connection is still open after its farewell")
+	}
+}
+
+// Every connection the server closes on purpose ends with a close code saying why.
+func TestCloseCodes(t *testing.T) {
+	t.Run("refused", func(t *testing.T) {
+		tokens := func(client Client) (string, error) {
+			if client.Token == "" {
+				return "", ErrNoIdentity
+			}
+			return client.Token, nil
+		}
+		_, address := startServer(t, "echo", nil, WithIdentityExtractor("tokens", tokens))
+
+		client, answer := connect(t, address, message.NewHello(message.MinimumVersion, message.Version))
+		expectClosed(t, client, answer, message.ClosedRefused)
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		_, address := startServer(t, "echo", func(config *Config) { config.UnknownType = unknownTypeClose })
+		client := dial(t, address)
+
+		client.write(message.ImpactMessage{Header: message.NewHeader(message.Reply)})
+		expectClosed(t, client, client.receive(), message.ClosedProtocol)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		server, address := startServer(t, "echo", nil)
+		client := dial(t, address)
+
+		closed := make(chan error, 1)
+		go func() { closed <- server.Close() }()
+		expectClosed(t, client, client.receive(), message.ClosedShutdown)
+		if closeError := <-closed; closeError != nil {
+			t.Fatalf("Close gave %v, not a clean shutdown", closeError)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		// The one connection allowed is the one that found the listener up.
+		_, address := startServer(t, "echo", func(config *Config) { config.AcceptRate = 0.01 })
+
+		client, answer := connect(t, address, message.NewHello(message.MinimumVersion, message.Version))
+		expectClosed(t, client, answer, message.ClosedRateLimited)
+	})
+
+	t.Run("resource gone", func(t *testing.T) {
+		server, address := startServer(t, "echo", nil)
+		client := dial(t, address)
+
+		client.send(1, "exit")
+		expectClosed(t, client, client.receive(), message.ClosedResourceGone)
+		var exitError *ExitError
+		if closeError := server.Close(); !errors.As(closeError, &exitError) {
+			t.Fatalf("the server ended with %v, not for want of its resource", closeError)
+		}
+	})
+}
@@ -0,0 +1,9 @@
+// The impact program provides multi-user serialized access to a resource. It is all in package impact, so that it can
+// be embedded in other programs as well.
+package main
+
+import "github.com/blanu/impact"
+
+func main() {
+	impact.Main()
+}
@@ -0,0 +1,56 @@
+package impact
+
+import (
+	"errors"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+)
+
+// Compress a message for the client, if the client agreed to compression and the payload is big enough to be worth
+// it. A payload that doesn't get any smaller is sent as it is.
+func (s *server) compressFor(connection *connection.Conn, wave radiowave.Message) radiowave.Message {
+	typed, ok := wave.(message.ImpactMessage)
+	if !ok || connection.Compression == 0 || len(typed.Payload) < s.compressionMinSize || typed.Header.Flags&message.Compressed != 0 {
+		return wave
+	}
+
+	compressed, compressError := message.Compress(message.Compression(connection.Compression), typed.Payload)
+	if compressError != nil || len(compressed) >= len(typed.Payload) {
+		return wave
+	}
+
+	typed.Payload = compressed
+	typed.Header.Flags |= message.Compressed
+	return typed
+}
+
+// Undo the client's compression, so that the resource only ever sees plain payloads.
+func (s *server) decompressFrom(connection *connection.Conn, impactMessage message.ImpactMessage) (message.ImpactMessage, error) {
+	if impactMessage.Header.Flags&message.Compressed == 0 {
+		return impactMessage, nil
+	}
+
+	if connection.Compression == 0 {
+		return impactMessage, errors.New("compressed message, but no compression was agreed")
+	}
+
+	// The uncompressed message is held to the same size limit as the message on the wire.
+	limit := maximumDecompressedSize
+	if s.maxRequestSize > 0 {
+		limit = s.maxRequestSize
+	}
+
+	payload, decompressError := message.Decompress(message.Compression(connection.Compression), impactMessage.Payload, limit)
+	if decompressError != nil {
+		return impactMessage, decompressError
+	}
+
+	impactMessage.Payload = payload
+	impactMessage.Header.Flags &^= message.Compressed
+	return impactMessage, nil
+}
+
+// The most a compressed payload may expand to when there is no message size limit, matching the most the framing
+// lets anyone send uncompressed.
+const maximumDecompressedSize = 1 << 30
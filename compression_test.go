@@ -0,0 +1,150 @@
+package impact
+
+import (
+	"bytes"
+	"github.com/blanu/impact/internal/message"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A hello offering the algorithms, by their codes, so that ones impact doesn't speak can be offered too.
+func helloOffering(algorithms ...message.Compression) message.ImpactMessage {
+	hello := message.NewHello(message.MinimumVersion, message.Version)
+	hello.Header.Compression = algorithms
+	return hello
+}
+
+// What the welcome agreed to, or zero for no compression.
+func agreedCompression(t *testing.T, welcome message.ImpactMessage) message.Compression {
+	t.Helper()
+
+	if welcome.Header.Type != message.Welcome {
+		t.Fatalf("got a message of type %d in answer to the hello", welcome.Header.Type)
+	}
+	switch len(welcome.Header.Compression) {
+	case 0:
+		return 0
+	case 1:
+		return welcome.Header.Compression[0]
+	default:
+		t.Fatalf("the welcome named %d algorithms, not one", len(welcome.Header.Compression))
+		return 0
+	}
+}
+
+// Zstd isn't in the standard library, so impact doesn't speak it, but a client may still offer it.
+const zstd message.Compression = 3
+
+func TestCompressionNegotiation(t *testing.T) {
+	negotiations := []struct {
+		name    string
+		server  string
+		offered []message.Compression
+		agreed  message.Compression
+	}{
+		{"both speak the best", "deflate,gzip", []message.Compression{message.Gzip, message.Deflate}, message.Deflate},
+		{"the server's order wins", "gzip,deflate", []message.Compression{message.Deflate, message.Gzip}, message.Gzip},
+		{"zstd is passed over", "deflate,gzip", []message.Compression{zstd, message.Gzip}, message.Gzip},
+		{"only zstd", "deflate,gzip", []message.Compression{zstd}, 0},
+		{"mismatched", "gzip", []message.Compression{message.Deflate}, 0},
+		{"client declines", "deflate,gzip", nil, 0},
+		{"server declines", "", []message.Compression{message.Deflate, message.Gzip}, 0},
+	}
+	for _, negotiation := range negotiations {
+		t.Run(negotiation.name, func(t *testing.T) {
+			_, address := startServer(t, "upper", func(config *Config) { config.Compression = negotiation.server })
+			client, welcome := connect(t, address, helloOffering(negotiation.offered...))
+			agreed := agreedCompression(t, welcome)
+			if agreed != negotiation.agreed {
+				t.Fatalf("agreed on %s, not %s", agreed, negotiation.agreed)
+			}
+
+			// The resource upper-cases what it is sent, which would garble a payload it was sent compressed.
+			plain := strings.Repeat("compress me ", 100)
+			request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(plain)}
+			request.Header.CorrelationID = 1
+			if agreed != 0 {
+				compressed, compressError := message.Compress(agreed, request.Payload)
+				if compressError != nil {
+					t.Fatal(compressError)
+				}
+				request.Payload = compressed
+				request.Header.Flags |= message.Compressed
+			}
+			client.write(request)
+
+			reply := client.receive()
+			if agreed == 0 {
+				if reply.Header.Flags&message.Compressed != 0 {
+					t.Fatal("the reply was compressed, though no compression was agreed")
+				}
+				expectReply(t, reply, strings.ToUpper(plain))
+				return
+			}
+
+			if reply.Header.Flags&message.Compressed == 0 {
+				t.Fatal("a large reply wasn't compressed")
+			}
+			payload, decompressError := message.Decompress(agreed, reply.Payload, 1<<20)
+			if decompressError != nil {
+				t.Fatalf("the reply doesn't decompress with %s: %v", agreed, decompressError)
+			}
+			if !bytes.Equal(payload, []byte(strings.ToUpper(plain))) {
+				t.Fatalf("the reply decompressed to %q", payload)
+			}
+		})
+	}
+}
+
+// A payload that won't decompress is answered with CorruptPayload and the connection is closed, rather than the
+// resource being sent garbage: whatever comes back after the error, nothing is a reply.
+func TestCorruptCompressedPayload(t *testing.T) {
+	payloads := []struct {
+		name    string
+		offered []message.Compression
+		payload []byte
+	}{
+		{"garbage", []message.Compression{message.Gzip}, []byte("this was never gzip")},
+		{"truncated", []message.Compression{message.Gzip}, nil},
+		{"not agreed", nil, []byte("compressed with what?")},
+	}
+	for _, corrupt := range payloads {
+		t.Run(corrupt.name, func(t *testing.T) {
+			_, address := startServer(t, "echo", nil)
+			client, _ := connect(t, address, helloOffering(corrupt.offered...))
+
+			payload := corrupt.payload
+			if payload == nil {
+				whole, _ := message.Compress(message.Gzip, []byte(strings.Repeat("cut short ", 100)))
+				payload = whole[:len(whole)/2]
+			}
+			request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: payload}
+			request.Header.CorrelationID = 1
+			request.Header.Flags |= message.Compressed
+			client.write(request)
+
+			expectError(t, client.receive(), message.CorruptPayload)
+			for {
+				answer, readError := client.tryReceive(5 * time.Second)
+				if readError != nil {
+					break
+				}
+				if answer.Header.Type == message.Reply {
+					t.Fatalf("the resource was sent the corrupt payload, and answered %q", answer.Payload)
+				}
+			}
+		})
+	}
+}
+
+// Nor can impact be told to offer it.
+func TestZstdCantBeConfigured(t *testing.T) {
+	config := DefaultConfig()
+	config.Path = os.Args[0]
+	config.Compression = "zstd,deflate"
+	if validationError := config.Validate(); validationError == nil {
+		t.Fatal("-compression zstd,deflate was taken")
+	}
+}
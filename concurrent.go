@@ -0,0 +1,170 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"time"
+)
+
+// With -resource-concurrency above one, the resource is trusted to work on several requests at once. Requests are
+// sent on as soon as they come through the funnel, up to the limit, without waiting for earlier replies, and replies
+// are matched up with their requests by correlation id. This is for resources that are stateless, or do their own
+// locking. It is still one process per member; a pool of processes is -pool-size.
+//
+// The resource must copy each request's correlation id into every message of its reply, and must keep reading
+// requests while it is writing replies.
+func (m *member) handleConcurrentProcess(process *resource.Process) {
+	// Clients choose their own correlation ids, so two connections can use the same one. The resource sees ids of our
+	// own choosing instead, which are unique for as long as the backend runs.
+	inFlight := map[uint64]*exchange{}
+	var lastID uint64
+
+	// One timer serves every request in flight, set for whichever is due first.
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for process != nil {
+		// Once the resource has as much as it can take, new work waits in the funnel.
+		funnel := m.intake()
+		probes := m.probes
+		if len(inFlight) >= m.concurrency {
+			funnel = nil
+			probes = nil
+		}
+
+		m.busy.Store(len(inFlight) > 0)
+
+		var expired <-chan time.Time
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		wait, hasTimeout, timedOut := m.expireTimeouts(inFlight)
+		if timedOut && m.timeoutAction != timeoutActionNone {
+			process = m.afterTimeout(process, inFlight)
+			continue
+		}
+		if hasTimeout {
+			timer.Reset(wait)
+			expired = timer.C
+		}
+
+		select {
+		case request := <-funnel:
+			if m.stale(request) || !m.journaled(request) {
+				continue
+			}
+
+			lastID += 1
+			process = m.dispatch(process, inFlight, lastID, &exchange{request: request})
+
+		case probe := <-probes:
+			lastID += 1
+			process = m.dispatch(process, inFlight, lastID, &exchange{request: probe, probe: true})
+
+		case reply, open := <-process.OutputChannel:
+			if !open {
+				for id, x := range inFlight {
+					m.abandonOutputClosed(x, process)
+					delete(inFlight, id)
+					m.finish(x)
+				}
+				process = m.outputClosed(process)
+				continue
+			}
+
+			m.recordProgress()
+
+			id := correlationOf(reply)
+			x, found := inFlight[id]
+			if !found {
+				m.logger.Printf("resource %s replied to request %d, which it was not working on", m.name, id)
+				continue
+			}
+
+			if m.sentinel(x, reply) {
+				delete(inFlight, id)
+				m.finish(x)
+				m.abandonAll(inFlight, dropRestart, message.ResourceRestarted, "resource reported a bad state and was restarted")
+				process = m.restartProcess(process, restartSentinel)
+				continue
+			}
+
+			if m.relay(x, reply) {
+				delete(inFlight, id)
+				m.finish(x)
+			}
+
+		// Overdue requests are timed out next time round, as the timer is reset.
+		case <-expired:
+
+		// A restart takes every request in flight down with it.
+		case reason := <-m.restarts:
+			m.abandonAll(inFlight, dropRestart, message.ResourceRestarted, "resource restarted while handling the request")
+			process = m.restartProcess(process, reason)
+
+		// Only probes can still be in flight, since the drain is done.
+		case done := <-m.quits:
+			m.abandonAll(inFlight, dropShutdown, message.ResourceStopped, "resource stopped because the server is shutting down")
+			m.quit(process)
+			close(done)
+			process = nil
+
+		// Draining or undraining changes whether we take from the funnel, which is looked at again next time round.
+		case <-m.wake:
+
+		case <-process.ExitChannel:
+			m.abandonAll(inFlight, dropShutdown, message.ResourceStopped, "resource stopped while handling the request")
+			process = m.processExited(process)
+		}
+	}
+
+	m.busy.Store(false)
+
+	// We only get here if the resource stopped during shutdown. The drain is waiting for the funnel to empty.
+	m.stopped()
+}
+
+// Send a request to the resource under the given id, returning the process that should serve the next one.
+func (m *member) dispatch(process *resource.Process, inFlight map[uint64]*exchange, id uint64, x *exchange) *resource.Process {
+	wire := x.request.Message
+	if typed, ok := wire.(message.ImpactMessage); ok {
+		typed.Header.CorrelationID = id
+		wire = typed
+	}
+
+	x.dispatched = time.Now()
+	inFlight[id] = x
+
+	switch outcome, reason := m.send(process, wire); outcome {
+	case sendRestart:
+		m.abandonAll(inFlight, dropRestart, message.ResourceRestarted, "resource restarted while handling the request")
+		return m.restartProcess(process, reason)
+
+	case sendExited:
+		m.abandonAll(inFlight, dropShutdown, message.ResourceStopped, "resource stopped while handling the request")
+		return m.processExited(process)
+
+	default:
+		m.markExecuting(x.request)
+		m.recordProgress()
+		return process
+	}
+}
+
+func (b *backend) abandonAll(inFlight map[uint64]*exchange, reason string, code message.ErrorCode, description string) {
+	for id, x := range inFlight {
+		b.abandon(x, reason, code, description)
+		delete(inFlight, id)
+		b.finish(x)
+	}
+}
+
+// A client request stops being pending once it has its whole answer.
+func (b *backend) finish(x *exchange) {
+	if !x.probe {
+		b.pending.Add(-1)
+	}
+}
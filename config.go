@@ -0,0 +1,874 @@
+package impact
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// Where a setting can come from.
+const (
+	sourceFlag        = "flag"
+	sourceEnvironment = "environment"
+	sourceFile        = "file"
+)
+
+// Config is everything an operator can tell impact at startup.
+type Config struct {
+	Port                 int
+	Path                 string
+	ProbeMessage         string
+	ProbeInterval        time.Duration
+	ProbeTimeout         time.Duration
+	ProbeFailures        int
+	WatchdogInterval     time.Duration
+	WatchdogRestart      bool
+	Scheduler            string
+	CostQuantum          int64
+	ReplyRatioAlarm      float64
+	TLSCertificate       string
+	TLSKey               string
+	TLSTicketKeys        string
+	TLSClientCA          string
+	Auth                 string
+	AuthTokens           string
+	AuthFallback         string
+	MaxInFlight          int64
+	MaxInFlightIdentity  int64
+	MaxAnonymousPriority int
+	UnknownType          string
+	MaxMessageSize       int
+	MaxReplySize         int
+	Profiling            bool
+	ShedLatency          time.Duration
+	ShedMaxFraction      float64
+	WarmupPeriod         time.Duration
+	WarmupStartRate      float64
+	WarmupFullRate       float64
+	Debug                bool
+	MetricsAddress       string
+	DedupSize            int
+	DedupTTL             time.Duration
+	ConnectionIDs        string
+	SLOThresholds        string
+	Journal              string
+	JournalSync          string
+	JournalSyncInterval  time.Duration
+	Compression          string
+	CompressionMinSize   int
+	LargeRequestSize     int
+	LargePath            string
+	ResourceConcurrency  int
+	OutputClosed         string
+	RateLimit            float64
+	GlobalRateLimit      float64
+	ResourceOutputFD     int
+	QueuePosition        bool
+	UDPPort              int
+	RestartSentinel      string
+	RestartSentinelReply string
+	PoolSize             int
+	ErrorTemplate        string
+	MaxTLSHandshakes     int
+	TLSHandshakeTimeout  time.Duration
+	ResourceMaxMessage   int
+	RequestTimeout       time.Duration
+	MaxRequestTimeout    time.Duration
+	InputStall           time.Duration
+	Resources            string
+	DebugTokenFile       string
+	WriteTimeout         time.Duration
+	CloseReset           string
+	CloseLinger          time.Duration
+	Framing              string
+	UnixSocket           string
+	UnixFraming          string
+	Check                bool
+	CheckLaunch          bool
+	StatusErrors         string
+	FlowWindow           int
+	FlowReplenish        int
+	AttachPID            int
+	MaxLifetime          time.Duration
+	ShutdownCommand      string
+	ShutdownWait         time.Duration
+	MaxOutstandingBytes  int
+	InFlightOverflow     string
+	FlowOverflow         string
+	CorrelationTag       string
+	FunnelBuffer         int
+	ResumeTTL            time.Duration
+	ResumeReplies        string
+	ResumeBuffer         int
+	MessageReadTimeout   time.Duration
+	Audit                string
+	VerifyAudit          string
+	SpawnConcurrency     int
+	SpawnWait            string
+	SpawnReadyTimeout    time.Duration
+	ResourceBanner       string
+	ResourceReady        string
+	SpanSlow             time.Duration
+	SpanSample           float64
+	AcceptRate           float64
+	AcceptOverflow       string
+	TLSRequireClientCert bool
+	Restart              string
+	RestartBackoff       time.Duration
+	RestartBackoffMax    time.Duration
+	ShutdownSignal       string
+	DrainTimeout         time.Duration
+	TimeoutAction        string
+	LogFormat            string
+
+	// Where each setting given anywhere came from, by flag name: flag, environment or file.
+	Sources map[string]string
+}
+
+// DefaultConfig is the configuration impact has when nothing is set anywhere: every setting at its flag's default.
+func DefaultConfig() Config {
+	config := Config{Sources: map[string]string{}}
+	defineFlags(flag.NewFlagSet("impact", flag.ContinueOnError), &config)
+	return config
+}
+
+// Read the configuration from the command line, the environment and the config file, in that order of precedence.
+func parseConfig() (Config, error) {
+	return loadConfig(flag.CommandLine, os.Args[1:])
+}
+
+// Read the configuration into a fresh set of flags, so that it can be read again while running. The command line
+// hasn't changed since startup, but the environment may have been edited in a supervisor, and the config file on disk.
+func reloadConfig() (Config, *flag.FlagSet, error) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	config, loadError := loadConfig(flags, os.Args[1:])
+	return config, flags, loadError
+}
+
+func loadConfig(flags *flag.FlagSet, arguments []string) (Config, error) {
+	config := Config{}
+	configPath := defineFlags(flags, &config)
+	if parseError := flags.Parse(arguments); parseError != nil {
+		return config, parseError
+	}
+
+	// Anything given on the command line wins. Whatever is left comes from the environment, then the config file,
+	// and anything not set anywhere keeps its default.
+	config.Sources = map[string]string{}
+	flags.Visit(func(setting *flag.Flag) { config.Sources[settingName(setting.Name)] = sourceFlag })
+
+	settings := map[string]string{}
+	sources := map[string]string{}
+	if *configPath != "" {
+		fileSettings, fileError := readConfigFile(*configPath)
+		if fileError != nil {
+			return config, fileError
+		}
+		for name, value := range fileSettings {
+			if addError := addSetting(settings, sources, name, value, sourceFile); addError != nil {
+				return config, addError
+			}
+		}
+	}
+	for name, value := range environmentSettings(flags) {
+		if addError := addSetting(settings, sources, name, value, sourceEnvironment); addError != nil {
+			return config, addError
+		}
+	}
+
+	for name, value := range settings {
+		if config.Sources[name] == sourceFlag {
+			continue
+		}
+		if flags.Lookup(name) == nil || name == "config" {
+			return config, fmt.Errorf("unknown setting %q", name)
+		}
+		if setError := flags.Set(name, value); setError != nil {
+			return config, fmt.Errorf("bad value for %s: %w", name, setError)
+		}
+		config.Sources[name] = sources[name]
+	}
+
+	// A token file on its own means that clients authenticate with a token from it.
+	if config.Auth == "" && config.AuthTokens != "" {
+		config.Auth = "token"
+	}
+
+	return config, nil
+}
+
+// Add a setting from a source, under its own name if it was given by another. Given by both names in the same source, it
+// has to have the same value under each, since neither can be said to come after the other.
+func addSetting(settings map[string]string, sources map[string]string, name string, value string, source string) error {
+	name = settingName(name)
+	if previous, found := settings[name]; found && sources[name] == source && previous != value {
+		return fmt.Errorf("the %s gives %s two different values, under its own name and another", source, name)
+	}
+
+	settings[name] = value
+	sources[name] = source
+	return nil
+}
+
+// Some settings go by other names as well, which are what some people know them by: worker pools for pools, and a
+// bound on requests waiting for the resource, which -max-in-flight is, for a queue. Another name is the same setting
+// as the one it names, with one value, coming from one place, and is reported and reloaded by the setting's own name.
+var settingAliases = map[string]string{
+	"workers":         "pool-size",
+	"unix":            "unix-socket",
+	"max-queue":       "max-in-flight",
+	"auth-token-file": "auth-tokens",
+}
+
+// The setting's own name, for a flag that may be another name for it.
+func settingName(flagName string) string {
+	if name, found := settingAliases[flagName]; found {
+		return name
+	}
+
+	return flagName
+}
+
+// Give every setting its flag, each with its default, and the flag for the config file, whose path is returned.
+func defineFlags(flags *flag.FlagSet, config *Config) *string {
+	flags.IntVar(&config.Port, "port", 1111, "port on which to listen, or 0 to listen only on -unix-socket")
+	flags.StringVar(&config.Path, "path", "", "path for shared resource executable")
+	flags.StringVar(&config.ProbeMessage, "probe-message", "", "payload sent to the resource to check that it is still responding")
+	flags.DurationVar(&config.ProbeInterval, "probe-interval", 0, "how often to probe the resource, 0 disables probing")
+	flags.DurationVar(&config.ProbeTimeout, "probe-timeout", time.Second, "how long the resource has to reply to a probe")
+	flags.IntVar(&config.ProbeFailures, "probe-failures", 3, "consecutive failed probes before the resource is restarted")
+	flags.DurationVar(&config.WatchdogInterval, "watchdog-interval", 0, "warn if no request completes for this long while requests are pending, 0 disables the watchdog")
+	flags.BoolVar(&config.WatchdogRestart, "watchdog-restart", false, "restart the resource when the watchdog finds it stalled")
+	flags.StringVar(&config.Scheduler, "scheduler", "fifo", "order in which queued requests are served: fifo, cost to share the resource by client cost estimates, edf for the soonest deadline first, or priority for the most urgent first")
+	flags.Int64Var(&config.CostQuantum, "cost-quantum", 1000, "cost credited to each connection per turn by the cost scheduler")
+	flags.Float64Var(&config.ReplyRatioAlarm, "reply-ratio-alarm", 0, "warn when a reply is more than this many times the size of its request, 0 disables the warning")
+	flags.StringVar(&config.TLSCertificate, "tls-cert", "", "certificate file for serving clients over TLS, empty serves cleartext")
+	flags.StringVar(&config.TLSKey, "tls-key", "", "private key file for the TLS certificate")
+	flags.StringVar(&config.TLSTicketKeys, "tls-ticket-keys", "", "file of hex session ticket keys shared between instances, newest first, reloaded on SIGHUP")
+	flags.StringVar(&config.TLSClientCA, "tls-ca", "", "CA certificate file for checking client certificates, which clients may then present")
+	flags.StringVar(&config.Auth, "auth", "", "ways of telling who clients are, tried in order, from cert, cert-dn, cert-uri, token and address, or several joined with + that must all agree to; empty lets every client in")
+	flags.StringVar(&config.AuthFallback, "auth-fallback", authFallbackReject, "what becomes of a client that no -auth method knows: reject it, or let it in as anonymous, unless it offered an identity that didn't hold up")
+	flags.StringVar(&config.AuthTokens, "auth-tokens", "", "file of client tokens, one token and the identity it proves per line; on its own, it is -auth token")
+	flags.Int64Var(&config.MaxInFlight, "max-in-flight", 0, "most requests allowed to be queued or executing at once across all connections, 0 is unlimited")
+	flags.IntVar(&config.MaxAnonymousPriority, "max-anonymous-priority", 255, "highest priority a request from a client that didn't authenticate, or came over UDP, is given; higher asks are lowered to it")
+	flags.Int64Var(&config.MaxInFlightIdentity, "max-in-flight-per-identity", 0, "most requests each authenticated identity may have queued or executing at once across all its connections, anonymous clients counting as one, 0 is unlimited")
+	flags.StringVar(&config.UnknownType, "unknown-type", unknownTypeReject, "what to do with a client message that isn't a request: reject it with an error, send it to the default resource, or close the connection")
+	flags.IntVar(&config.MaxMessageSize, "max-message-size", 0, "largest message, or chunk of a reply, in bytes including its header, 0 is unlimited")
+	flags.IntVar(&config.MaxReplySize, "max-reply-size", 0, "largest reply in bytes including headers, counting every chunk, 0 is unlimited")
+	flags.BoolVar(&config.Profiling, "pprof", false, "serve pprof profiles and expvar variables on the metrics address, not for production")
+	flags.DurationVar(&config.ShedLatency, "shed-latency", 0, "start turning away new requests when the resource's average latency passes this, 0 disables shedding")
+	flags.Float64Var(&config.ShedMaxFraction, "shed-max-fraction", 0.9, "largest share of new requests turned away when the resource is slow")
+	flags.DurationVar(&config.WarmupPeriod, "warmup", 0, "after each start of the resource, ramp up the request rate over this long, 0 disables warmup")
+	flags.Float64Var(&config.WarmupStartRate, "warmup-start-rate", 1, "requests per second allowed at the start of the warmup")
+	flags.Float64Var(&config.WarmupFullRate, "warmup-full-rate", 100, "requests per second allowed by the end of the warmup, after which there is no limit")
+	flags.BoolVar(&config.Debug, "debug", false, "log debugging detail, such as every dropped request")
+	flags.StringVar(&config.MetricsAddress, "metrics-addr", "", "address on which to serve metrics, empty disables metrics")
+	flags.IntVar(&config.DedupSize, "dedup-size", 0, "most replies remembered for answering retries of requests with idempotency keys, 0 disables deduplication")
+	flags.DurationVar(&config.DedupTTL, "dedup-ttl", 5*time.Minute, "how long a reply is remembered for answering retries")
+	flags.StringVar(&config.ConnectionIDs, "connection-ids", "counter", "how connections are named in logs and to the resource: counter, uuid, or address")
+	flags.StringVar(&config.SLOThresholds, "slo", "", "comma separated latencies, from queueing to reply, counted against when a request takes longer")
+	flags.StringVar(&config.Journal, "journal", "", "file to which every client request is appended before the resource sees it, empty disables the journal")
+	flags.StringVar(&config.JournalSync, "journal-sync", journalSyncInterval, "when the journal is synced to disk: always, before each request is sent, interval, or never")
+	flags.DurationVar(&config.JournalSyncInterval, "journal-sync-interval", time.Second, "how often a buffered journal is written out")
+	flags.StringVar(&config.Compression, "compression", "deflate,gzip", "compression algorithms offered to clients, best first, empty disables compression")
+	flags.IntVar(&config.CompressionMinSize, "compression-min-size", 512, "smallest payload, in bytes, compressed on its way to a client")
+	flags.IntVar(&config.LargeRequestSize, "large-request-size", 0, "requests with payloads bigger than this many bytes go to a separate instance of the resource, 0 sends every request to the same one")
+	flags.StringVar(&config.LargePath, "large-path", "", "executable for the instance of the resource that serves large requests, by default the same as -path")
+	flags.IntVar(&config.ResourceConcurrency, "resource-concurrency", 1, "requests sent to the resource at once without waiting for replies; above 1, the resource must copy correlation ids into its replies and handle requests concurrently")
+	flags.StringVar(&config.OutputClosed, "output-closed", outputClosedExit, "what to do when the resource closes its output but keeps running: exit, as if the resource had stopped, restart it, or drain its input and then restart it")
+	flags.Float64Var(&config.RateLimit, "rate-limit", 0, "requests per second allowed on each connection, in bursts of up to a second's worth, 0 is unlimited")
+	flags.Float64Var(&config.GlobalRateLimit, "global-rate-limit", 0, "requests per second allowed across all connections, in bursts of up to a second's worth, 0 is unlimited")
+	flags.IntVar(&config.ResourceOutputFD, "resource-output-fd", 1, "file descriptor on which the resource writes replies; 1 is stdout, and 3 or more gives the resource an extra pipe so that its stdout can be logged as diagnostics")
+	flags.BoolVar(&config.QueuePosition, "queue-position", false, "acknowledge each queued request with a Queued message giving how many requests are ahead of it")
+	flags.IntVar(&config.UDPPort, "udp-port", 0, "port on which to also take requests over UDP, one per datagram, with no ordering or delivery guarantees; 0 disables UDP")
+	flags.StringVar(&config.RestartSentinel, "restart-sentinel", "", "reply payload with which the resource says it needs restarting, as text or hex: followed by hex digits; empty disables it")
+	flags.StringVar(&config.RestartSentinelReply, "restart-sentinel-reply", sentinelSuppress, "what the client gets when the resource sends the sentinel: suppress, for a restarted error, or deliver, for the sentinel itself")
+	flags.IntVar(&config.PoolSize, "pool-size", 1, "copies of the resource to run for each backend, each taking the next queued request when it is free")
+	flags.StringVar(&config.ErrorTemplate, "error-template", "", "Go template for the payload of a reply sent instead of each error impact synthesizes, given .CorrelationID, .Code, .Description and .RetryAfter; empty sends impact errors")
+	flags.IntVar(&config.MaxTLSHandshakes, "max-tls-handshakes", 0, "most TLS handshakes in progress at once, with more connections waiting their turn, 0 is unlimited")
+	flags.DurationVar(&config.TLSHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "how long a connection may wait for its turn to handshake, and then how long its TLS handshake may take, 0 is forever")
+	flags.IntVar(&config.ResourceMaxMessage, "resource-max-message-size", 0, "largest request the resource accepts, in bytes including its header; clients are told the smaller of this and -max-message-size, 0 is unlimited")
+	flags.DurationVar(&config.RequestTimeout, "request-timeout", 0, "how long the resource has to reply to a request that doesn't give a timeout of its own, 0 is forever")
+	flags.DurationVar(&config.MaxRequestTimeout, "max-request-timeout", 0, "longest timeout a request may give in its header, 0 is no cap")
+	flags.DurationVar(&config.InputStall, "input-stall", time.Second, "how long sending to the resource may block before it counts as not taking its input, turning new requests away until it does; 0 never does")
+	flags.StringVar(&config.Resources, "resources", "", "more resources, served by name, as a comma-separated list of name=path; clients choose one in the request header, and requests that don't go to -path")
+	flags.StringVar(&config.DebugTokenFile, "debug-token-file", "", "file holding a token which, given as a bearer token, lets GET /debug on the metrics address dump every connection, queue and pool member; empty disables the dump")
+	flags.DurationVar(&config.WriteTimeout, "write-timeout", 30*time.Second, "how long a write to a client may block before the connection is closed, so that a client that stops reading can't hold up the resource; 0 is forever")
+	flags.StringVar(&config.CloseReset, "close-reset", "", "reasons for closing a connection for which it is reset rather than closed gracefully, from refused, protocol, timeout, shutdown, rate-limited, resource-gone and finished")
+	flags.DurationVar(&config.CloseLinger, "close-linger", time.Second, "how long a graceful close waits for the client to end its side of the connection")
+	flags.StringVar(&config.Framing, "framing", framingRadiowave, "how messages are framed on -port: radiowave, or length32 for a plain four byte big-endian length")
+	flags.StringVar(&config.UnixSocket, "unix-socket", "", "path of a Unix domain socket on which to also take connections, serving the same resources; empty disables it")
+	flags.StringVar(&config.UnixFraming, "unix-framing", framingRadiowave, "how messages are framed on -unix-socket: radiowave or length32")
+	flags.BoolVar(&config.Check, "check", false, "check the configuration and the files it names, then exit without serving, 0 if all is well")
+	flags.BoolVar(&config.CheckLaunch, "check-launch", false, "with -check, also launch each resource and send it -probe-message, failing if it doesn't answer within -probe-timeout")
+	flags.StringVar(&config.StatusErrors, "status-errors", "", "comma-separated reply statuses from the resource to pass on to the client as ResourceFailed errors rather than as replies")
+	flags.IntVar(&config.FlowWindow, "flow-window", 0, "requests each client may have unanswered at once, granted as credits in its welcome and granted back as requests are answered; 0 disables flow control")
+	flags.IntVar(&config.FlowReplenish, "flow-replenish", 1, "with -flow-window, how many answered requests' credits are granted back to the client at a time")
+	flags.IntVar(&config.AttachPID, "attach-pid", 0, "pid of an already running resource to attach to through its stdin and stdout, instead of launching -path; Linux only, and impact never restarts it")
+	flags.DurationVar(&config.MaxLifetime, "max-lifetime", 0, "longest a request may be in impact, from being read to being answered, queueing, running and replying all told, before it is given up on; 0 is forever")
+	flags.StringVar(&config.ShutdownCommand, "shutdown-command", "", "payload of a final request sent to each resource once the drain is done, telling it to exit; off if empty, and the resource is left to exit when its input closes")
+	flags.DurationVar(&config.ShutdownWait, "shutdown-command-timeout", 5*time.Second, "how long a resource is given to exit after its -shutdown-command or -shutdown-signal before it is killed")
+	flags.IntVar(&config.MaxOutstandingBytes, "max-outstanding-bytes", 0, "most bytes of request payloads each connection may have read but unanswered; once it has, it isn't read from until some are answered; 0 is unlimited")
+	flags.StringVar(&config.InFlightOverflow, "in-flight-overflow", overflowReject, "what gives once -max-in-flight is reached: reject the new request, block until there is room, drop-newest to drop it without an answer, or drop-oldest to turn away the request queued longest instead")
+	flags.StringVar(&config.FlowOverflow, "flow-overflow", overflowReject, "what happens to a request sent without -flow-window credit: reject it with an error, block reading from the client until it has credit, or drop-newest to drop it without an answer")
+	flags.StringVar(&config.CorrelationTag, "correlation-tag", "", "tag each request for matching impact's logs with the resource's, and pass the tag on in the request's header, or in front of its payload; empty is off")
+	flags.IntVar(&config.FunnelBuffer, "funnel-buffer", 0, "requests that may wait between each backend's scheduler and its resources, already taken out of the scheduler's order; 0 hands each one over directly")
+	flags.DurationVar(&config.ResumeTTL, "resume-ttl", 0, "how long a client that went away has to reconnect with the token from its welcome and resume its session, getting back its connection id and the reply to what it had in flight; 0 is off")
+	flags.StringVar(&config.ResumeReplies, "resume-replies", resumeRepliesKeep, "with -resume-ttl, what becomes of the reply to a request in flight when its client went: keep it for the client, or throw it away and tell the client with an error, or drop it without a word")
+	flags.IntVar(&config.ResumeBuffer, "resume-buffer", 1<<20, "with -resume-replies keep, most bytes of reply payload kept for a client that went; a bigger reply is thrown away and the client told with an error; 0 is unlimited")
+	flags.DurationVar(&config.MessageReadTimeout, "message-read-timeout", 0, "how long a client has to send the rest of a message once its first byte has arrived, before the connection is closed as a protocol error; 0 is forever")
+	flags.StringVar(&config.Audit, "audit", "", "file to which a hash-chained entry is appended for every client request once it is answered, saying who sent what and what they got back, synced like the journal; empty is off")
+	flags.StringVar(&config.VerifyAudit, "verify-audit", "", "check the hash chain of this -audit file, then exit without serving, 0 if it is intact and 1 if it isn't")
+	flags.IntVar(&config.SpawnConcurrency, "spawn-concurrency", 0, "members of each backend's pool launched at a time, each batch ready, by answering -probe-message if there is one, before the next is launched; 0 launches them all at once")
+	flags.StringVar(&config.SpawnWait, "spawn-wait", spawnWaitAll, "with -spawn-concurrency, whether startup waits for all of each pool to launch, or only the first batch, launching the rest while serving")
+	flags.DurationVar(&config.SpawnReadyTimeout, "spawn-ready-timeout", time.Minute, "with -spawn-concurrency, how long each member has to answer -probe-message before the next batch is launched without it")
+	flags.StringVar(&config.ResourceBanner, "resource-banner", resourceBannerNone, "what to make of whatever the resource writes before it is sent anything: none takes it as a reply, log logs and skips it as a banner, text included, and ready also waits for -resource-ready in it before sending anything")
+	flags.StringVar(&config.ResourceReady, "resource-ready", "", "with -resource-banner ready, text in the resource's banner that says it is ready")
+	flags.DurationVar(&config.SpanSlow, "span-slow", 0, "log where the time went for every request that takes at least this long, from being read to the last of its reply being sent; 0 is off")
+	flags.Float64Var(&config.SpanSample, "span-sample", 0, "fraction of other requests, from 0 to 1, for which to log where the time went")
+	flags.Float64Var(&config.AcceptRate, "accept-rate", 0, "new connections per second let in across all listeners, in bursts of up to a second's worth, 0 is unlimited")
+	flags.StringVar(&config.AcceptOverflow, "accept-overflow", overflowReject, "what happens to a connection over -accept-rate: reject closes it at once, before any TLS handshake, or block holds it, and those behind it, until it is within the rate")
+	flags.BoolVar(&config.TLSRequireClientCert, "tls-require-client-cert", false, "with -tls-ca, turn away clients that don't present a certificate signed by it, rather than letting them prove who they are some other way")
+	flags.StringVar(&config.Restart, "restart", restartNever, "what happens when the server's last resource exits without being asked to: always relaunches it, on-failure relaunches it unless it exited with status 0, and never exits with it")
+	flags.DurationVar(&config.RestartBackoff, "restart-backoff", time.Second, "how long a resource that exited soon after being launched waits to be relaunched, doubling each time it does so again")
+	flags.DurationVar(&config.RestartBackoffMax, "restart-backoff-max", 30*time.Second, "the longest a resource waits to be relaunched, and how long it has to run for the wait to start again from -restart-backoff")
+	flags.StringVar(&config.ShutdownSignal, "shutdown-signal", "", "signal sent to each resource once the drain is done, telling it to exit, such as TERM; off if empty")
+	flags.DurationVar(&config.DrainTimeout, "drain-timeout", 0, "how long shutdown waits for pending requests before turning away those still queued and closing connections anyway, 0 is as long as it takes")
+	flags.StringVar(&config.TimeoutAction, "timeout-action", timeoutActionNone, "what is done to a resource when a request to it times out: none leaves it to finish, restart restarts it, and kill kills it as if it had crashed, for -restart to deal with")
+	// Other names for settings, each in settingAliases.
+	flags.IntVar(&config.PoolSize, "workers", 1, "another name for -pool-size")
+	flags.StringVar(&config.UnixSocket, "unix", "", "another name for -unix-socket")
+	flags.Int64Var(&config.MaxInFlight, "max-queue", 0, "another name for -max-in-flight")
+	flags.StringVar(&config.AuthTokens, "auth-token-file", "", "another name for -auth-tokens")
+	flags.StringVar(&config.LogFormat, "log-format", logFormatText, "how log lines are written: text, json for one JSON object per line, or logfmt")
+	return flags.String("config", "", "file of settings, one name = value per line, using the flag names")
+}
+
+// Every setting can also come from an environment variable, named after its flag: IMPACT_ followed by the flag name
+// in upper case with dashes as underscores, so -max-in-flight is IMPACT_MAX_IN_FLIGHT. Platforms that assign the port
+// usually pass it in PORT, so that is used too when IMPACT_PORT isn't set.
+func environmentSettings(flags *flag.FlagSet) map[string]string {
+	settings := map[string]string{}
+
+	if port, found := os.LookupEnv("PORT"); found {
+		settings["port"] = port
+	}
+
+	flags.VisitAll(func(setting *flag.Flag) {
+		if setting.Name == "config" {
+			return
+		}
+		if value, found := os.LookupEnv(environmentName(setting.Name)); found {
+			settings[setting.Name] = value
+		}
+	})
+
+	return settings
+}
+
+func environmentName(flagName string) string {
+	return "IMPACT_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// The config file has one setting per line, as name = value, where the name is a flag name without its dash.
+// Blank lines and lines starting with # are ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	file, openError := os.Open(path)
+	if openError != nil {
+		return nil, openError
+	}
+	defer file.Close()
+
+	settings := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, lineNumber)
+		}
+		settings[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return settings, scanner.Err()
+}
+
+// The largest message a client may send, given impact's own limit and the resource's. Zero means neither has one.
+func (config Config) maxRequestSize() int {
+	if config.MaxMessageSize == 0 || config.ResourceMaxMessage == 0 {
+		return max(config.MaxMessageSize, config.ResourceMaxMessage)
+	}
+
+	return min(config.MaxMessageSize, config.ResourceMaxMessage)
+}
+
+// Validate checks for settings that make no sense, alone or together.
+// Options that quietly do nothing, or that fight each other, would otherwise only show up as odd behavior in
+// production. Every problem found is reported at once, so that fixing a configuration doesn't take several tries.
+func (config Config) Validate() error {
+	var problems []error
+	problem := func(format string, arguments ...any) {
+		problems = append(problems, fmt.Errorf(format, arguments...))
+	}
+
+	if config.Scheduler != "fifo" && config.Scheduler != "cost" && config.Scheduler != "edf" && config.Scheduler != "priority" {
+		problem("unknown -scheduler %q", config.Scheduler)
+	}
+	if config.Scheduler == "cost" && config.CostQuantum <= 0 {
+		problem("-cost-quantum must be positive, or the cost scheduler never serves anyone")
+	}
+
+	if connectionIDScheme(config.ConnectionIDs) == nil {
+		problem("unknown -connection-ids %q", config.ConnectionIDs)
+	}
+	// Unix sockets' clients have no addresses, so they would all have the same id.
+	if config.UnixSocket != "" && config.ConnectionIDs == "address" {
+		problem("-connection-ids address can't tell -unix-socket connections apart")
+	}
+	if !knownFraming(config.Framing) {
+		problem("unknown -framing %q", config.Framing)
+	}
+	if !knownFraming(config.UnixFraming) {
+		problem("unknown -unix-framing %q", config.UnixFraming)
+	}
+
+	if config.UnknownType != unknownTypeReject && config.UnknownType != unknownTypeDefault && config.UnknownType != unknownTypeClose {
+		problem("unknown -unknown-type %q", config.UnknownType)
+	}
+
+	// Half a TLS configuration would otherwise mean serving cleartext to clients that expected TLS.
+	if config.TLSCertificate != "" && config.TLSKey == "" {
+		problem("-tls-cert needs -tls-key")
+	}
+	if config.TLSKey != "" && config.TLSCertificate == "" {
+		problem("-tls-key needs -tls-cert")
+	}
+	if config.TLSTicketKeys != "" && config.TLSCertificate == "" {
+		problem("-tls-ticket-keys needs -tls-cert, session tickets only exist for TLS")
+	}
+
+	if config.MaxTLSHandshakes < 0 {
+		problem("-max-tls-handshakes can't be negative")
+	}
+	if config.MaxTLSHandshakes > 0 && config.TLSCertificate == "" {
+		problem("-max-tls-handshakes needs -tls-cert, handshakes only exist for TLS")
+	}
+	if config.TLSHandshakeTimeout < 0 {
+		problem("-tls-handshake-timeout can't be negative")
+	}
+
+	if config.TLSClientCA != "" && config.TLSCertificate == "" {
+		problem("-tls-ca needs -tls-cert, client certificates only exist for TLS")
+	}
+	if config.TLSRequireClientCert && config.TLSClientCA == "" {
+		problem("-tls-require-client-cert needs -tls-ca, or no client certificate can be checked")
+	}
+
+	if !knownLogFormat(config.LogFormat) {
+		problem("unknown -log-format %q", config.LogFormat)
+	}
+
+	// The Unix socket is cleartext, so TLS is only for the port.
+	if config.Port == 0 && config.TLSCertificate != "" {
+		problem("-tls-cert needs -port, the Unix socket doesn't serve TLS")
+	}
+
+	// Datagrams have no handshake, so they would be a way around whatever the stream listener insists on.
+	if config.UDPPort < 0 || config.UDPPort > 65535 {
+		problem("-udp-port must be between 0 and 65535")
+	}
+	if config.UDPPort != 0 && config.TLSCertificate != "" {
+		problem("-udp-port would serve cleartext alongside TLS")
+	}
+	if config.UDPPort != 0 && config.Auth != "" {
+		problem("-udp-port can't be used with -auth, there is no handshake to authenticate in")
+	}
+
+	for _, method := range strings.Split(config.Auth, ",") {
+		for _, name := range strings.Split(strings.TrimSpace(method), "+") {
+			switch name {
+			case "":
+				if config.Auth != "" {
+					problem("-auth has an empty method")
+				}
+			case "cert", "cert-dn", "cert-uri":
+				if config.TLSClientCA == "" {
+					problem("-auth %s needs -tls-ca, or no client certificate can be checked", name)
+				}
+			case "token":
+				if config.AuthTokens == "" {
+					problem("-auth token needs -auth-tokens")
+				}
+			case "address":
+			default:
+				problem("unknown -auth method %q", name)
+			}
+		}
+	}
+	if config.AuthFallback != authFallbackReject && config.AuthFallback != authFallbackAnonymous {
+		problem("-auth-fallback must be reject or anonymous")
+	}
+	if config.AuthTokens != "" && !strings.Contains(config.Auth, "token") {
+		problem("-auth-tokens has no effect unless -auth includes token")
+	}
+
+	if config.Profiling && config.MetricsAddress == "" {
+		problem("-pprof needs -metrics-addr, profiles are served on the metrics address")
+	}
+
+	if config.DebugTokenFile != "" && config.MetricsAddress == "" {
+		problem("-debug-token-file needs -metrics-addr, the debug dump is served on the metrics address")
+	}
+
+	if config.WatchdogRestart && config.WatchdogInterval <= 0 {
+		problem("-watchdog-restart needs -watchdog-interval, the watchdog is disabled")
+	}
+	// The watchdog looks a few times per interval, and has to have some time between looks.
+	if config.WatchdogInterval != 0 && config.WatchdogInterval < minimumWatchdogInterval {
+		problem("-watchdog-interval must be 0 or at least %s", minimumWatchdogInterval)
+	}
+
+	if config.ProbeInterval > 0 && config.ProbeFailures < 1 {
+		problem("-probe-failures must be at least 1")
+	}
+	if _, statusError := parseStatusErrors(config.StatusErrors); statusError != nil {
+		problem("%v", statusError)
+	}
+	if config.MaxInFlightIdentity < 0 {
+		problem("-max-in-flight-per-identity must not be negative")
+	}
+	if config.MaxAnonymousPriority < 0 || config.MaxAnonymousPriority > math.MaxUint8 {
+		problem("-max-anonymous-priority must be from 0 to 255")
+	}
+	if config.FlowWindow < 0 {
+		problem("-flow-window must not be negative")
+	}
+	if config.FlowWindow > 0 && (config.FlowReplenish < 1 || config.FlowReplenish > config.FlowWindow) {
+		problem("-flow-replenish must be from 1 to -flow-window, or a client can run out of credit for good")
+	}
+	if policyError := checkOverflowPolicy("-in-flight-overflow", config.InFlightOverflow, overflowReject, overflowBlock, overflowDropNewest, overflowDropOldest); policyError != nil {
+		problem("%v", policyError)
+	}
+	if policyError := checkOverflowPolicy("-flow-overflow", config.FlowOverflow, overflowReject, overflowBlock, overflowDropNewest); policyError != nil {
+		problem("%v", policyError)
+	}
+	if config.CorrelationTag != "" && config.CorrelationTag != correlationTagHeader && config.CorrelationTag != correlationTagPayload {
+		problem("-correlation-tag must be header, payload, or empty")
+	}
+	if config.ResumeTTL < 0 {
+		problem("-resume-ttl must not be negative")
+	}
+	if config.ResumeReplies != resumeRepliesKeep && config.ResumeReplies != resumeRepliesError && config.ResumeReplies != resumeRepliesDrop {
+		problem("-resume-replies must be keep, error or drop")
+	}
+	if config.ResumeBuffer < 0 {
+		problem("-resume-buffer must not be negative")
+	}
+	if config.FunnelBuffer < 0 {
+		problem("-funnel-buffer must not be negative")
+	}
+	if config.MaxOutstandingBytes < 0 {
+		problem("-max-outstanding-bytes must not be negative")
+	}
+	if config.MaxLifetime < 0 {
+		problem("-max-lifetime must not be negative")
+	}
+	if _, signalError := parseShutdownSignal(config.ShutdownSignal); signalError != nil {
+		problem("-shutdown-signal: %v", signalError)
+	}
+	if config.ShutdownSignal != "" && config.ShutdownCommand != "" {
+		problem("-shutdown-signal and -shutdown-command are two ways of telling the resource to exit, pick one")
+	}
+	if config.ShutdownSignal != "" && config.ShutdownWait <= 0 {
+		problem("-shutdown-command-timeout must be positive, or no resource is given time to act on -shutdown-signal")
+	}
+	if config.TimeoutAction != timeoutActionNone && config.TimeoutAction != timeoutActionRestart && config.TimeoutAction != timeoutActionKill {
+		problem("-timeout-action must be %s, %s or %s", timeoutActionNone, timeoutActionRestart, timeoutActionKill)
+	}
+	if config.DrainTimeout < 0 {
+		problem("-drain-timeout must not be negative")
+	}
+	if config.ShutdownCommand != "" && config.ShutdownWait <= 0 {
+		problem("-shutdown-command-timeout must be positive, or no resource is given time to act on -shutdown-command")
+	}
+	if config.AttachPID < 0 {
+		problem("-attach-pid must be a pid")
+	}
+	if config.AttachPID > 0 {
+		if config.Path != "" {
+			problem("-attach-pid and -path both name the primary resource, give one or the other")
+		}
+		if config.PoolSize > 1 {
+			problem("-attach-pid attaches to one process, so -pool-size can't be more than 1")
+		}
+		if config.LargeRequestSize > 0 && config.LargePath == "" {
+			problem("-large-request-size needs -large-path with -attach-pid, since there is no -path to launch copies of")
+		}
+	}
+	if config.CheckLaunch && !config.Check {
+		problem("-check-launch only makes sense with -check")
+	}
+	if config.CheckLaunch && config.ProbeTimeout <= 0 {
+		problem("-check-launch needs a positive -probe-timeout, or a resource that never answers is never found out")
+	}
+	if config.ProbeInterval > 0 && config.ProbeTimeout <= 0 {
+		problem("-probe-timeout must be positive, or every probe fails")
+	}
+
+	// Every client starts with a hello, so a limit smaller than that turns away every client.
+	hello := len(message.NewHello(message.MinimumVersion, message.Version).ToBytes())
+	if config.MaxMessageSize < 0 || config.MaxMessageSize > 0 && config.MaxMessageSize < hello {
+		problem("-max-message-size must be 0 or at least %d bytes, the size of a hello", hello)
+	}
+	if config.ResourceMaxMessage < 0 || config.ResourceMaxMessage > 0 && config.ResourceMaxMessage < hello {
+		problem("-resource-max-message-size must be 0 or at least %d bytes, the size of a hello", hello)
+	}
+	if config.MaxReplySize < 0 {
+		problem("-max-reply-size must not be negative")
+	}
+
+	if config.ShedMaxFraction < 0 || config.ShedMaxFraction > 1 {
+		problem("-shed-max-fraction must be between 0 and 1")
+	}
+
+	// A warmup rate of zero would hold every request back until the warmup ends, which is an outage, not a warmup.
+	if config.WarmupPeriod > 0 && (config.WarmupStartRate <= 0 || config.WarmupFullRate <= 0) {
+		problem("-warmup-start-rate and -warmup-full-rate must be positive")
+	}
+
+	if config.DedupSize < 0 {
+		problem("-dedup-size must not be negative")
+	}
+	if config.DedupSize > 0 && config.DedupTTL <= 0 {
+		problem("-dedup-ttl must be positive, or no reply is remembered long enough to answer a retry")
+	}
+
+	if config.JournalSync != journalSyncAlways && config.JournalSync != journalSyncInterval && config.JournalSync != journalSyncNever {
+		problem("unknown -journal-sync %q", config.JournalSync)
+	}
+	if (config.Journal != "" || config.Audit != "") && config.JournalSync != journalSyncAlways && config.JournalSyncInterval <= 0 {
+		problem("-journal-sync-interval must be positive")
+	}
+
+	if _, compressionError := parseCompression(config.Compression); compressionError != nil {
+		problem("-compression: %v", compressionError)
+	}
+
+	if config.LargeRequestSize < 0 {
+		problem("-large-request-size must not be negative")
+	}
+	if config.LargePath != "" && config.LargeRequestSize == 0 {
+		problem("-large-path has no effect without -large-request-size")
+	}
+
+	if _, resourcesError := parseResources(config.Resources); resourcesError != nil {
+		problem("-resources: %v", resourcesError)
+	}
+
+	if config.ResourceConcurrency < 1 {
+		problem("-resource-concurrency must be at least 1")
+	}
+
+	if _, templateError := parseErrorTemplate(config.ErrorTemplate); templateError != nil {
+		problem("-error-template: %v", templateError)
+	}
+
+	if config.RequestTimeout < 0 || config.MaxRequestTimeout < 0 {
+		problem("-request-timeout and -max-request-timeout can't be negative")
+	}
+	if config.MaxRequestTimeout > 0 && (config.RequestTimeout == 0 || config.RequestTimeout > config.MaxRequestTimeout) {
+		problem("-request-timeout must be set, and no longer than -max-request-timeout")
+	}
+
+	if config.WriteTimeout < 0 {
+		problem("-write-timeout must not be negative")
+	}
+	if config.MessageReadTimeout < 0 {
+		problem("-message-read-timeout must not be negative")
+	}
+	if _, closerError := connection.NewCloser(config.CloseReset, config.CloseLinger); closerError != nil {
+		problem("-close-reset: %v", closerError)
+	}
+	if config.CloseLinger < 0 {
+		problem("-close-linger must not be negative")
+	}
+	if config.InputStall < 0 {
+		problem("-input-stall can't be negative")
+	}
+
+	if config.PoolSize < 1 {
+		problem("-pool-size must be at least 1")
+	}
+	if config.ResourceBanner != resourceBannerNone && config.ResourceBanner != resourceBannerLog && config.ResourceBanner != resourceBannerReady {
+		problem("-resource-banner must be %s, %s or %s", resourceBannerNone, resourceBannerLog, resourceBannerReady)
+	}
+	if config.ResourceBanner == resourceBannerReady && config.ResourceReady == "" {
+		problem("-resource-banner ready needs -resource-ready")
+	}
+	if config.ResourceReady != "" && config.ResourceBanner != resourceBannerReady {
+		problem("-resource-ready only applies under -resource-banner ready")
+	}
+	if config.SpanSlow < 0 {
+		problem("-span-slow must not be negative")
+	}
+	if config.SpanSample < 0 || config.SpanSample > 1 {
+		problem("-span-sample must be from 0 to 1")
+	}
+	if config.Restart != restartAlways && config.Restart != restartOnFailure && config.Restart != restartNever {
+		problem("-restart must be %s, %s or %s", restartAlways, restartOnFailure, restartNever)
+	}
+	if config.RestartBackoff < 0 {
+		problem("-restart-backoff must not be negative")
+	}
+	if config.RestartBackoffMax < config.RestartBackoff {
+		problem("-restart-backoff-max must be at least -restart-backoff")
+	}
+	if config.SpawnConcurrency < 0 {
+		problem("-spawn-concurrency must not be negative")
+	}
+	if config.SpawnWait != spawnWaitAll && config.SpawnWait != spawnWaitFirst {
+		problem("-spawn-wait must be %s or %s", spawnWaitAll, spawnWaitFirst)
+	}
+	if config.SpawnConcurrency > 0 && config.ProbeMessage != "" && config.SpawnReadyTimeout <= 0 {
+		problem("-spawn-ready-timeout must be positive")
+	}
+
+	if config.OutputClosed != outputClosedExit && config.OutputClosed != outputClosedRestart && config.OutputClosed != outputClosedDrain {
+		problem("unknown -output-closed %q", config.OutputClosed)
+	}
+
+	if config.RateLimit < 0 {
+		problem("-rate-limit must not be negative")
+	}
+	if config.GlobalRateLimit < 0 {
+		problem("-global-rate-limit must not be negative")
+	}
+	if config.AcceptRate < 0 {
+		problem("-accept-rate must not be negative")
+	}
+	if policyError := checkOverflowPolicy("-accept-overflow", config.AcceptOverflow, overflowReject, overflowBlock); policyError != nil {
+		problem("%v", policyError)
+	}
+
+	if config.ResourceOutputFD != 1 && config.ResourceOutputFD < 3 {
+		problem("-resource-output-fd must be 1, for stdout, or 3 or more")
+	}
+
+	if _, sentinelError := parseSentinel(config.RestartSentinel); sentinelError != nil {
+		problem("-restart-sentinel: %v", sentinelError)
+	}
+	if config.RestartSentinelReply != sentinelSuppress && config.RestartSentinelReply != sentinelDeliver {
+		problem("unknown -restart-sentinel-reply %q", config.RestartSentinelReply)
+	}
+
+	if _, sloError := parseSLOThresholds(config.SLOThresholds); sloError != nil {
+		problem("-slo: %v", sloError)
+	}
+
+	return errors.Join(problems...)
+}
+
+func connectionIDScheme(name string) connection.IDScheme {
+	switch name {
+	case "counter":
+		return connection.CounterIDs()
+	case "uuid":
+		return connection.RandomIDs()
+	case "address":
+		return connection.AddressIDs()
+	default:
+		return nil
+	}
+}
+
+func parseSLOThresholds(list string) ([]time.Duration, error) {
+	thresholds := make([]time.Duration, 0)
+	if list == "" {
+		return thresholds, nil
+	}
+
+	for _, field := range strings.Split(list, ",") {
+		threshold, parseError := time.ParseDuration(strings.TrimSpace(field))
+		if parseError != nil {
+			return nil, parseError
+		}
+		if threshold <= 0 {
+			return nil, errors.New("thresholds must be positive")
+		}
+		thresholds = append(thresholds, threshold)
+	}
+
+	return thresholds, nil
+}
+
+// A resource served by name.
+type namedResource struct {
+	name string
+	path string
+}
+
+// Parse -resources, keeping the order it was given in.
+func parseResources(list string) ([]namedResource, error) {
+	resources := make([]namedResource, 0)
+	if list == "" {
+		return resources, nil
+	}
+
+	seen := map[string]bool{}
+	for _, field := range strings.Split(list, ",") {
+		name, path, hasPath := strings.Cut(strings.TrimSpace(field), "=")
+		name = strings.TrimSpace(name)
+		path = strings.TrimSpace(path)
+		switch {
+		case !hasPath || path == "":
+			return nil, fmt.Errorf("resource %q has no path", name)
+		case name == "":
+			return nil, fmt.Errorf("resource for %q has no name", path)
+		case len(name) > 255:
+			return nil, fmt.Errorf("resource name %q is longer than 255 bytes", name)
+		// These are the names of the backends impact makes by itself.
+		case name == "primary" || name == "large":
+			return nil, fmt.Errorf("resource name %q is reserved", name)
+		case seen[name]:
+			return nil, fmt.Errorf("resource %q is given more than once", name)
+		}
+
+		seen[name] = true
+		resources = append(resources, namedResource{name: name, path: path})
+	}
+
+	return resources, nil
+}
+
+func parseCompression(list string) ([]message.Compression, error) {
+	algorithms := make([]message.Compression, 0)
+	if list == "" {
+		return algorithms, nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		algorithm, known := message.ParseCompression(strings.TrimSpace(name))
+		if !known {
+			return nil, fmt.Errorf("unknown compression algorithm %q", name)
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+
+	return algorithms, nil
+}
@@ -0,0 +1,110 @@
+package impact
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Load a configuration from the arguments, the environment as the test has set it, and a config file of the lines, if
+// there are any.
+func loadTestConfig(t *testing.T, arguments []string, fileLines ...string) (Config, error) {
+	t.Helper()
+
+	if len(fileLines) > 0 {
+		path := t.TempDir() + "/impact.conf"
+		if writeError := os.WriteFile(path, []byte(strings.Join(fileLines, "\n")+"\n"), 0o600); writeError != nil {
+			t.Fatal(writeError)
+		}
+		arguments = append([]string{"-config", path}, arguments...)
+	}
+
+	flags := flag.NewFlagSet("impact", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return loadConfig(flags, arguments)
+}
+
+// Another name for a setting is the same setting: it takes its place in the order of precedence, and is reported by
+// the setting's own name.
+func TestAliasIsTheSameSetting(t *testing.T) {
+	t.Run("flag over environment", func(t *testing.T) {
+		t.Setenv(environmentName("pool-size"), "2")
+		config, loadError := loadTestConfig(t, []string{"-workers", "4"})
+		if loadError != nil {
+			t.Fatal(loadError)
+		}
+		if config.PoolSize != 4 || config.Sources["pool-size"] != sourceFlag {
+			t.Fatalf("-workers 4 with IMPACT_POOL_SIZE=2 gave a pool of %d from the %s", config.PoolSize, config.Sources["pool-size"])
+		}
+		if _, found := config.Sources["workers"]; found {
+			t.Fatal("the setting was reported under its other name")
+		}
+	})
+
+	t.Run("environment over file", func(t *testing.T) {
+		t.Setenv(environmentName("workers"), "3")
+		config, loadError := loadTestConfig(t, nil, "pool-size = 5")
+		if loadError != nil {
+			t.Fatal(loadError)
+		}
+		if config.PoolSize != 3 || config.Sources["pool-size"] != sourceEnvironment {
+			t.Fatalf("IMPACT_WORKERS=3 with pool-size = 5 in the file gave a pool of %d from the %s", config.PoolSize, config.Sources["pool-size"])
+		}
+	})
+}
+
+// Both names in the same place have to agree, since neither comes after the other.
+func TestAliasesInOnePlace(t *testing.T) {
+	if _, loadError := loadTestConfig(t, nil, "workers = 3", "pool-size = 5"); loadError == nil {
+		t.Fatal("different values under both names in the config file were taken")
+	}
+
+	config, loadError := loadTestConfig(t, nil, "workers = 3", "pool-size = 3")
+	if loadError != nil || config.PoolSize != 3 {
+		t.Fatalf("the same value under both names gave a pool of %d: %v", config.PoolSize, loadError)
+	}
+}
+
+// -unix given on the command line is the socket served, whatever the environment says under -unix-socket.
+func TestUnixAlias(t *testing.T) {
+	t.Setenv(environmentName("unix-socket"), "/run/impact/environment.sock")
+	config, loadError := loadTestConfig(t, []string{"-unix", "/run/impact/flag.sock"})
+	if loadError != nil {
+		t.Fatal(loadError)
+	}
+	if config.UnixSocket != "/run/impact/flag.sock" || config.Sources["unix-socket"] != sourceFlag {
+		t.Fatalf("-unix gave the socket %s from the %s", config.UnixSocket, config.Sources["unix-socket"])
+	}
+}
+
+// -auth-token-file is -auth-tokens, and on its own it turns on token auth, whatever the config file says under the
+// setting's own name.
+func TestAuthTokenFileAlias(t *testing.T) {
+	config, loadError := loadTestConfig(t, []string{"-auth-token-file", "/etc/impact/flag.tokens"}, "auth-tokens = /etc/impact/file.tokens")
+	if loadError != nil {
+		t.Fatal(loadError)
+	}
+	if config.AuthTokens != "/etc/impact/flag.tokens" || config.Sources["auth-tokens"] != sourceFlag {
+		t.Fatalf("-auth-token-file gave the token file %s from the %s", config.AuthTokens, config.Sources["auth-tokens"])
+	}
+	if config.Auth != "token" {
+		t.Fatalf("a token file on its own gave -auth %q, not token", config.Auth)
+	}
+}
+
+// A watchdog interval too short to look at a few times over is refused, rather than panicking at startup, and so is a
+// negative one.
+func TestWatchdogIntervalMinimum(t *testing.T) {
+	for _, interval := range []time.Duration{-time.Second, 3, minimumWatchdogInterval - 1, 0, minimumWatchdogInterval, time.Second} {
+		config := DefaultConfig()
+		config.Path = "/bin/true"
+		config.WatchdogInterval = interval
+		validateError := config.Validate()
+		if refused := interval != 0 && interval < minimumWatchdogInterval; refused != (validateError != nil) {
+			t.Errorf("-watchdog-interval %s gave %v", interval, validateError)
+		}
+	}
+}
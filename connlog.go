@@ -0,0 +1,36 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/connection"
+	"log"
+	"log/slog"
+)
+
+// Log lines about a connection start with who it is: its ID, where it came from, and, if it authenticated, its
+// identity. Everything that happened on one connection can then be found by grepping for its ID, without each line
+// having to say so. A connection is told how to make its logger once its handshake is done, since that is when its
+// identity is known, and makes it the first time it logs. Anything that only has a connection's ID, such as a backend
+// answering one of its requests, looks it up.
+
+func (s *server) startLogger(conn *connection.Conn) {
+	conn.LogWith(func(conn *connection.Conn) *log.Logger {
+		context := []slog.Attr{slog.String("connection", conn.ID), slog.String("remote", conn.RemoteAddr().String())}
+		if conn.Identity != "" {
+			context = append(context, slog.String("identity", conn.Identity))
+		}
+
+		return withAttrs(s.logger, context...)
+	})
+}
+
+// The logger for a connection, by its ID. A connection that has gone, or a UDP peer, which has no connection, still
+// gets its lines named.
+func (s *server) loggerFor(connectionID string) *log.Logger {
+	if conn, found := s.findConnection(connectionID); found {
+		if logger := conn.Logger(); logger != nil {
+			return logger
+		}
+	}
+
+	return withAttrs(s.logger, slog.String("connection", connectionID))
+}
@@ -0,0 +1,50 @@
+package impact
+
+import (
+	"expvar"
+	"github.com/blanu/impact/internal/metrics"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Everything served on the metrics address. Metrics, and the list of pool members, are always there. The profiling
+// endpoints are only there if asked for, since they cost CPU while in use and say a lot about the server to anyone who
+// can reach them. Whatever says who the clients are and what they are doing, or changes what the server does, is only
+// served with a debug token, and only to requests that give it, since anyone who can scrape metrics can reach the rest.
+func (s *server) newMetricsHandler(registry *metrics.Registry, profiling bool, debugToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", registry)
+	mux.HandleFunc("/pool", s.servePool)
+
+	mux.HandleFunc("/debug", requireDebugToken(debugToken, s.serveDebugDump))
+	mux.HandleFunc("/requests", requireDebugToken(debugToken, s.serveRequests))
+	mux.HandleFunc("/usage", requireDebugToken(debugToken, s.serveUsage))
+	mux.HandleFunc("/pool/drain", requireDebugToken(debugToken, s.serveDrain(true)))
+	mux.HandleFunc("/pool/undrain", requireDebugToken(debugToken, s.serveDrain(false)))
+
+	if profiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		mux.Handle("/debug/vars", s.newVarsHandler())
+	}
+
+	return mux
+}
+
+// Our expvar variables are kept in a map of our own rather than published globally, so that they belong to this
+// server alone. The standard memstats and cmdline variables are included alongside them, as expvar would.
+func (s *server) newVarsHandler() http.Handler {
+	vars := new(expvar.Map).Init()
+	vars.Set("cmdline", expvar.Get("cmdline"))
+	vars.Set("memstats", expvar.Get("memstats"))
+	vars.Set("funnel_length", expvar.Func(func() any { return s.primary.scheduler.Len() + len(s.primary.funnel) }))
+	vars.Set("resource_busy", expvar.Func(func() any { return s.primary.busyMembers() > 0 }))
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, _ *http.Request) {
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = writer.Write([]byte(vars.String()))
+	})
+}
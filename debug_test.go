@@ -0,0 +1,133 @@
+package impact
+
+import (
+	"encoding/json"
+	"github.com/blanu/impact/internal/message"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Anything that says who the clients are, or changes what the server does, needs the debug token.
+func TestMetricsEndpointsNeedTheDebugToken(t *testing.T) {
+	tokenFile := t.TempDir() + "/debug-token"
+	if writeError := os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); writeError != nil {
+		t.Fatal(writeError)
+	}
+	metrics := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	server, _ := startServer(t, "echo", func(config *Config) {
+		config.MetricsAddress = metrics
+		config.DebugTokenFile = tokenFile
+	})
+
+	for _, endpoint := range []struct{ method, path string }{
+		{http.MethodGet, "/debug"},
+		{http.MethodGet, "/requests"},
+		{http.MethodGet, "/usage"},
+		{http.MethodPost, "/pool/drain?member=0"},
+		{http.MethodPost, "/pool/undrain?member=0"},
+	} {
+		for _, token := range []string{"", "wrong", "s3cret"} {
+			status := metricsStatus(t, metrics, endpoint.method, endpoint.path, token)
+			if token == "s3cret" && status != http.StatusOK || token != "s3cret" && status != http.StatusUnauthorized {
+				t.Errorf("%s %s with token %q gave status %d", endpoint.method, endpoint.path, token, status)
+			}
+			if endpoint.path == "/pool/drain?member=0" && server.s.primary.members[0].drained.Load() != (token == "s3cret") {
+				t.Errorf("POST %s with token %q left the member drained %v", endpoint.path, token, server.s.primary.members[0].drained.Load())
+			}
+		}
+	}
+
+	if status := metricsStatus(t, metrics, http.MethodGet, "/pool", ""); status != http.StatusOK {
+		t.Errorf("GET /pool gave status %d", status)
+	}
+}
+
+// Without a token, they aren't served at all.
+func TestMetricsEndpointsWithoutADebugToken(t *testing.T) {
+	metrics := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	server, _ := startServer(t, "echo", func(config *Config) { config.MetricsAddress = metrics })
+
+	for _, path := range []string{"/debug", "/requests", "/usage", "/pool/drain?member=0", "/pool/undrain?member=0"} {
+		if status := metricsStatus(t, metrics, http.MethodPost, path, ""); status != http.StatusNotFound {
+			t.Errorf("POST %s gave status %d", path, status)
+		}
+	}
+	if server.s.primary.members[0].drained.Load() {
+		t.Error("the member was drained")
+	}
+}
+
+func metricsStatus(t *testing.T, address string, method string, path string, token string) int {
+	t.Helper()
+
+	request, requestError := http.NewRequest(method, "http://"+address+path, strings.NewReader(""))
+	if requestError != nil {
+		t.Fatal(requestError)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	var response *http.Response
+	eventually(t, "the metrics listener", func() bool {
+		var responseError error
+		response, responseError = http.DefaultClient.Do(request)
+		return responseError == nil
+	})
+	_ = response.Body.Close()
+
+	return response.StatusCode
+}
+
+// GET the path from the metrics listener, which must be up, with the token, and decode the JSON it answers with.
+func metricsJSON(t *testing.T, address string, path string, token string, into any) {
+	t.Helper()
+
+	request, _ := http.NewRequest(http.MethodGet, "http://"+address+path, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	response, responseError := http.DefaultClient.Do(request)
+	if responseError != nil {
+		t.Fatalf("GET %s: %v", path, responseError)
+	}
+	defer response.Body.Close()
+
+	if decodeError := json.NewDecoder(response.Body).Decode(into); decodeError != nil {
+		t.Fatalf("GET %s: %v", path, decodeError)
+	}
+}
+
+// /requests lists a request in flight as executing, and a request answered with an error ends up failed, not replied.
+func TestRequestStates(t *testing.T) {
+	tokenFile := t.TempDir() + "/debug-token"
+	if writeError := os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); writeError != nil {
+		t.Fatal(writeError)
+	}
+	metrics := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.MetricsAddress = metrics
+		config.DebugTokenFile = tokenFile
+		config.RequestTimeout = 150 * time.Millisecond
+	})
+	client := dial(t, address)
+	metricsStatus(t, metrics, http.MethodGet, "/requests", "s3cret")
+
+	client.send(1, "sleep")
+	eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+	var reports []requestReport
+	metricsJSON(t, metrics, "/requests", "s3cret", &reports)
+	if len(reports) != 1 || reports[0].CorrelationID != 1 || reports[0].State != "executing" {
+		t.Fatalf("/requests listed %+v", reports)
+	}
+	slow := server.s.trackedRequests()[0]
+
+	expectError(t, client.receive(), message.TimedOut)
+	eventually(t, "the request is done with", func() bool { return len(server.s.trackedRequests()) == 0 })
+	if state := newRequestReport(slow, time.Now()).State; state != "failed" {
+		t.Fatalf("a request answered with an error ended up %s", state)
+	}
+}
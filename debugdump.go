@@ -0,0 +1,153 @@
+package impact
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/blanu/impact/internal/request"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The debug dump is everything /requests and /pool say, and more, put together in one consistent place: each
+// connection with the requests it has in flight, each backend's queue, and what each member of each pool is working
+// on. It is for working out where a rare hang is stuck, while it is stuck.
+//
+// It says a lot about who is connected and what they are doing, so it is only served if -debug-token-file is given,
+// and only to someone who presents that token.
+
+type debugDump struct {
+	Time        time.Time        `json:"time"`
+	Connections []connectionDump `json:"connections"`
+	Backends    []backendDump    `json:"backends"`
+	// Requests whose connection isn't open any more, or never was, such as those that came over UDP.
+	Unattached []requestReport `json:"unattached"`
+}
+
+type connectionDump struct {
+	ID         string          `json:"id"`
+	Remote     string          `json:"remote"`
+	Identity   string          `json:"identity,omitempty"`
+	AuthMethod string          `json:"auth_method,omitempty"`
+	Version    uint8           `json:"version"`
+	Flow       *windowReport   `json:"flow,omitempty"`
+	Requests   []requestReport `json:"requests"`
+}
+
+type backendDump struct {
+	Name string `json:"name"`
+	// Requests the backend has taken but not yet sent to a member, whether in its queue or on their way through the
+	// funnel.
+	QueueLength int             `json:"queue_length"`
+	Queued      []requestReport `json:"queued"`
+	Members     []memberDump    `json:"members"`
+}
+
+type memberDump struct {
+	memberReport
+	SinceProgressSeconds float64         `json:"since_progress_seconds"`
+	Requests             []requestReport `json:"requests"`
+}
+
+// Read the token for the debug dump. The file holds the token alone, and surrounding whitespace doesn't count.
+func loadDebugToken(path string) (string, error) {
+	contents, readError := os.ReadFile(path)
+	if readError != nil {
+		return "", readError
+	}
+
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", errors.New("debug token file is empty")
+	}
+
+	return token, nil
+}
+
+// Serve only to those with the token, as a bearer token. Without a token, there is nobody to serve.
+func requireDebugToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(writer, "not served without -debug-token-file", http.StatusNotFound)
+			return
+		}
+
+		presented, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hasToken || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "debug token required", http.StatusUnauthorized)
+			return
+		}
+
+		handler(writer, r)
+	}
+}
+
+func (s *server) serveDebugDump(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(s.debugDump())
+}
+
+// Put the dump together. Each part is read separately, without stopping the server, so a request that moves on while
+// the dump is being made can show up in one place or in two. Everything it shows was true a moment ago.
+func (s *server) debugDump() debugDump {
+	now := time.Now()
+	dump := debugDump{Time: now, Connections: []connectionDump{}, Backends: []backendDump{}, Unattached: []requestReport{}}
+
+	// Each request is listed under its connection.
+	tracked := s.trackedRequests()
+	byConnection := map[string][]requestReport{}
+	for _, r := range tracked {
+		byConnection[r.ConnectionID] = append(byConnection[r.ConnectionID], newRequestReport(r, now))
+	}
+
+	for _, connection := range s.currentConnections() {
+		requests := byConnection[connection.ID]
+		if requests == nil {
+			requests = []requestReport{}
+		}
+		delete(byConnection, connection.ID)
+
+		dump.Connections = append(dump.Connections, connectionDump{
+			ID:         connection.ID,
+			Remote:     connection.RemoteAddr().String(),
+			Identity:   connection.Identity,
+			AuthMethod: connection.AuthMethod,
+			Version:    connection.Version,
+			Flow:       s.windowOf(connection).report(),
+			Requests:   requests,
+		})
+	}
+	for _, requests := range byConnection {
+		dump.Unattached = append(dump.Unattached, requests...)
+	}
+
+	// And again under the backend that has it, and the member serving it, once there is one.
+	for _, b := range s.backends() {
+		backend := backendDump{Name: b.name, QueueLength: b.scheduler.Len(), Queued: []requestReport{}, Members: []memberDump{}}
+		for _, r := range tracked {
+			state := r.Status.State()
+			if (state == request.Queued || state == request.Dispatched) && s.route(r) == b {
+				backend.Queued = append(backend.Queued, newRequestReport(r, now))
+			}
+		}
+
+		for _, m := range b.members {
+			member := memberDump{memberReport: m.report(), SinceProgressSeconds: m.sinceProgress().Seconds(), Requests: []requestReport{}}
+			for _, r := range tracked {
+				if r.Status.State() == request.Executing && r.Status.Holder() == m.name {
+					member.Requests = append(member.Requests, newRequestReport(r, now))
+				}
+			}
+			backend.Members = append(backend.Members, member)
+		}
+
+		dump.Backends = append(dump.Backends, backend)
+	}
+
+	return dump
+}
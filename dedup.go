@@ -0,0 +1,114 @@
+package impact
+
+import (
+	"container/list"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+	"sync"
+	"time"
+)
+
+// A client that retries after a network blip can't tell whether its first attempt ran. If it gives every attempt the
+// same idempotency key, we remember the reply to the first attempt that got one, and answer retries with it instead of
+// running the request again. A key is only the client's own: the same key from another identity, or for another
+// resource, is another request. Replies are remembered for a while after they're sent, up to a fixed number of them,
+// dropping the least recently used first.
+//
+// Only replies from the resource are remembered. An error from impact, such as the resource restarting, means the
+// request may not have run, so a retry should run it.
+type replyCache struct {
+	size int
+	ttl  time.Duration
+
+	lock    sync.Mutex
+	entries map[dedupKey]*list.Element
+	// Most recently used at the front.
+	order *list.List
+}
+
+// Which attempts are retries of one another: those with the same idempotency key, from the same identity, for the
+// same resource.
+type dedupKey struct {
+	identity string
+	resource string
+	key      string
+}
+
+type cachedReply struct {
+	key     dedupKey
+	replies []radiowave.Message
+	stored  time.Time
+}
+
+// A size of zero disables the cache.
+func newReplyCache(size int, ttl time.Duration) *replyCache {
+	return &replyCache{size: size, ttl: ttl, entries: map[dedupKey]*list.Element{}, order: list.New()}
+}
+
+// Find the reply, every chunk of it, to an earlier attempt with this key.
+func (c *replyCache) lookup(key dedupKey) ([]radiowave.Message, bool) {
+	if c.size == 0 || key.key == "" {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	entry := element.Value.(*cachedReply)
+	if time.Since(entry.stored) > c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.replies, true
+}
+
+func (c *replyCache) store(key dedupKey, replies []radiowave.Message) {
+	if c.size == 0 || key.key == "" {
+		return
+	}
+
+	for _, reply := range replies {
+		if _, failed := reply.(message.ImpactError); failed {
+			return
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&cachedReply{key: key, replies: replies, stored: time.Now()})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedReply).key)
+	}
+}
+
+func (c *replyCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
+
+// Answer a retry with an earlier attempt's reply, addressed to the retry.
+func readdress(reply radiowave.Message, correlationID uint64) radiowave.Message {
+	if typed, ok := reply.(message.ImpactMessage); ok {
+		typed.Header.CorrelationID = correlationID
+		return typed
+	}
+
+	return reply
+}
@@ -0,0 +1,53 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"testing"
+)
+
+// Send a request with an idempotency key and wait for its answer.
+func (c *testClient) requestOnce(correlationID uint64, key string, payload string) message.ImpactMessage {
+	c.t.Helper()
+
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	request.Header.IdempotencyKey = key
+	c.write(request)
+
+	return receiveAnswer(c)
+}
+
+// Two clients who happen to choose the same idempotency key are making different requests. Each is answered with its
+// own reply, and a retry from either gets that one back, not the other's.
+func TestDedupKeyedByIdentity(t *testing.T) {
+	tokens := func(client Client) (string, error) {
+		if client.Token == "" {
+			return "", ErrNoIdentity
+		}
+		return client.Token, nil
+	}
+	server, address := startServer(t, "echo", func(config *Config) { config.DedupSize = 16 }, WithIdentityExtractor("tokens", tokens))
+
+	clients := map[string]*testClient{}
+	for _, identity := range []string{"alice", "bob"} {
+		hello := message.NewHello(message.MinimumVersion, message.Version)
+		hello.Header.Token = identity
+		client, welcome := connect(t, address, hello)
+		if welcome.Header.Type != message.Welcome {
+			t.Fatalf("%s got a message of type %d in answer to the hello", identity, welcome.Header.Type)
+		}
+		clients[identity] = client
+	}
+
+	expectReply(t, clients["alice"].requestOnce(1, "shared", "from alice"), "from alice")
+	expectReply(t, clients["bob"].requestOnce(1, "shared", "from bob"), "from bob")
+	if entries := server.s.replies.len(); entries != 2 {
+		t.Fatalf("%d replies are remembered, not one for each identity", entries)
+	}
+
+	expectReply(t, clients["alice"].requestOnce(2, "shared", "alice again"), "from alice")
+	expectReply(t, clients["bob"].requestOnce(2, "shared", "bob again"), "from bob")
+	if hits := server.s.dedupHits.Value(); hits != 2 {
+		t.Fatalf("%d retries were answered from the cache, not 2", hits)
+	}
+}
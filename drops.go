@@ -0,0 +1,46 @@
+package impact
+
+// Why a request failed to complete normally. Each of these is a label value on the dropped requests counter, so that
+// a slow resource, disconnecting clients, and load shedding can be told apart.
+const (
+	// The server already had as many requests in flight as it is allowed.
+	dropCapacity = "capacity"
+	// The client's identity already had as many requests in flight as each identity is allowed.
+	dropIdentityCapacity = "identity-capacity"
+	// The client sent something other than a request, or used the wrong protocol version.
+	dropProtocol = "protocol"
+	// The client sent a message type that has nowhere to go.
+	dropUnroutable = "unroutable"
+	// The resource was slow, so the request was turned away to keep latency down.
+	dropShed = "shed"
+	// The request, or its reply, was larger than the server allows.
+	dropOversized = "oversized"
+	// The resource was restarted while the request was waiting for it.
+	dropRestart = "restart"
+	// The resource stopped during shutdown and there was nothing left to serve the request.
+	dropShutdown = "shutdown"
+	// The client was gone by the time the reply was ready.
+	dropDisconnect = "disconnect"
+	// The request couldn't be written to the journal, so it wasn't run.
+	dropJournal = "journal"
+	// The client, or all clients together, sent requests faster than the rate limit.
+	dropRateLimited = "ratelimit"
+	// The request's deadline passed before the resource got to it.
+	dropExpired = "expired"
+	// The resource took longer than the request's timeout to reply.
+	dropTimedOut = "timeout"
+	// The resource had stopped taking its input, so the request was turned away rather than queued behind it.
+	dropBackpressure = "backpressure"
+	// The client was under flow control, and sent the request without credit.
+	dropNoCredit = "nocredit"
+	// The request was in impact for longer than its lifetime.
+	dropLifetime = "lifetime"
+)
+
+func (s *server) drop(connectionID string, correlationID uint64, reason string, detail string) {
+	s.droppedRequests.Inc(reason)
+
+	if s.debug.Load() {
+		s.loggerFor(connectionID).Printf("debug: dropped request %d (%s): %s", correlationID, reason, detail)
+	}
+}
@@ -0,0 +1,78 @@
+package impact
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+	"io"
+	"text/template"
+)
+
+// An errorEncoder turns an error that impact synthesized for a client into the message the client actually gets.
+// Clients written for impact get the ImpactError as it is. Clients written for the resource alone may expect its
+// failures in some format of their own, such as JSON or a status byte, and can be given that instead.
+type errorEncoder func(message.ImpactError) radiowave.Message
+
+// The ImpactError, with its code and description, as the protocol defines it.
+func impactErrors(impactError message.ImpactError) radiowave.Message {
+	return impactError
+}
+
+// What an error template can use.
+type errorTemplateData struct {
+	CorrelationID uint64
+	Code          uint8
+	Description   string
+	// Whole milliseconds, rounded up, as on the wire. Zero if impact doesn't know.
+	RetryAfter uint32
+}
+
+// Parse -error-template into an encoder. The template's output becomes the payload of an ordinary reply, so that
+// the client can't tell it from a reply the resource made, except by what it says.
+func parseErrorTemplate(text string) (errorEncoder, error) {
+	if text == "" {
+		return impactErrors, nil
+	}
+
+	parsed, parseError := template.New("error").Option("missingkey=error").Parse(text)
+	if parseError != nil {
+		return nil, fmt.Errorf("bad template: %w", parseError)
+	}
+
+	// A template can parse and still not work, by naming a field that doesn't exist, say. Better to find out now.
+	if executeError := parsed.Execute(io.Discard, errorTemplateData{}); executeError != nil {
+		return nil, fmt.Errorf("bad template: %w", executeError)
+	}
+
+	return func(impactError message.ImpactError) radiowave.Message {
+		// The reply keeps the error's header fields, such as how long to wait before retrying.
+		header := impactError.Header()
+		header.Type = message.Reply
+
+		data := errorTemplateData{
+			CorrelationID: impactError.CorrelationID,
+			Code:          uint8(impactError.Code),
+			Description:   impactError.Description,
+			RetryAfter:    header.RetryAfter,
+		}
+
+		// The template has already been tried out, so it only fails here on something like a write error, which a
+		// buffer doesn't have. Should it fail anyway, the client is better off with the error it would have got.
+		var payload bytes.Buffer
+		if executeError := parsed.Execute(&payload, data); executeError != nil {
+			return impactError
+		}
+
+		return message.ImpactMessage{Header: header, Payload: payload.Bytes()}
+	}, nil
+}
+
+// Errors on their way to a client are encoded however the operator asked. Everything else goes as it is.
+func (s *server) encodeErrors(wave radiowave.Message) radiowave.Message {
+	if impactError, isError := wave.(message.ImpactError); isError {
+		return s.encodeError(impactError)
+	}
+
+	return wave
+}
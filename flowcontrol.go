@@ -0,0 +1,272 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// Under flow control, a client may only have so many requests unanswered at once. Its welcome grants it that many
+// credits, each request it sends uses one up, and impact grants them back once the requests are answered, in a Credit
+// message. A client that pipelines its requests as fast as it can then waits for credit instead of piling requests up
+// in impact's buffers, which is a better way to pace a fast producer than timing it out.
+//
+// Credits are granted back in batches of -flow-replenish, to save sending a credit message after every reply. A
+// request that arrives without credit is answered with a NoCredit error in its turn, and not run. Requests that arrive over UDP aren't
+// under flow control, since datagrams can be lost, and credits with them.
+//
+// A count of requests doesn't bound the memory a few enormous ones can pin, so a connection can also be held to
+// -max-outstanding-bytes of request payloads that have been read but not yet answered. Once it has that many
+// outstanding, it isn't read from again until some of them are answered, and its client waits on its socket instead.
+// A request's size isn't known until it has been read, so the last one read can take a connection over its cap, and a
+// single request bigger than the cap is still read once nothing else is outstanding, or it could never be.
+
+type flowWindow struct {
+	// How many credits a batch grants back. Zero means the client isn't under credit, only under the cap on bytes.
+	replenish int64
+
+	// Credits are used up as requests are read, and given back as they are answered, on different coroutines. The
+	// debug dump reads both.
+	// The credits the client has left.
+	credits atomic.Int64
+	// Requests answered whose credits haven't been granted back yet.
+	owed atomic.Int64
+
+	// The most request payload bytes that may be outstanding at once. Zero means there is no cap.
+	maxBytes int64
+	// The payload bytes of requests read but not answered yet.
+	outstanding atomic.Int64
+	// The size of each of those requests, oldest first. Requests are answered in the order they are read, so the
+	// oldest is always the next to be answered.
+	sizesLock sync.Mutex
+	sizes     []int64
+	// Wakes the reader once bytes have been answered, or credits granted back.
+	room chan bool
+}
+
+// The flow control window for a new connection, nil if flow control is off and there is no cap on bytes.
+func (s *server) startWindow(conn *connection.Conn) *flowWindow {
+	if s.windowSize <= 0 && s.maxOutstandingBytes <= 0 {
+		return nil
+	}
+
+	window := &flowWindow{maxBytes: int64(s.maxOutstandingBytes), room: make(chan bool, 1)}
+	if s.windowSize > 0 {
+		window.replenish = int64(s.windowReplenish)
+		window.credits.Store(int64(s.windowSize))
+	}
+
+	s.windowsLock.Lock()
+	defer s.windowsLock.Unlock()
+	s.windows[conn.ID] = window
+
+	return window
+}
+
+func (s *server) endWindow(conn *connection.Conn) {
+	s.windowsLock.Lock()
+	defer s.windowsLock.Unlock()
+
+	delete(s.windows, conn.ID)
+}
+
+func (s *server) windowOf(conn *connection.Conn) *flowWindow {
+	s.windowsLock.Lock()
+	defer s.windowsLock.Unlock()
+
+	return s.windows[conn.ID]
+}
+
+// The payload bytes a connection has outstanding, by its ID.
+func (s *server) outstandingBytes(id string) int64 {
+	s.windowsLock.Lock()
+	defer s.windowsLock.Unlock()
+
+	if window, found := s.windows[id]; found {
+		return window.outstanding.Load()
+	}
+
+	return 0
+}
+
+// A request that arrived without credit. It is answered in its turn, with an error.
+type uncredited struct {
+	message.ImpactMessage
+}
+
+// Whether a message from a client needs a credit.
+func needsCredit(wave radiowave.Message) bool {
+	typed, ok := wave.(message.ImpactMessage)
+	return ok && typed.Header.Type == message.Request
+}
+
+// Messages from the client, as the connection handler is to take them. Without flow control, that's straight from the
+// connection. With it, they are read ahead into a buffer the size of the window, and each request uses up a credit as
+// it arrives, or is marked as uncredited if there is none left. A client that keeps to its credit never has to wait
+// to be read, and one that doesn't is told so, in order, without its requests piling up. With a cap on bytes, nothing
+// more is read while the connection has as much outstanding as it may.
+func (s *server) readAhead(conn *connection.Conn, w *flowWindow, gone chan bool) <-chan radiowave.Message {
+	if w == nil {
+		return conn.OutputChannel
+	}
+
+	incoming := make(chan radiowave.Message, s.windowSize)
+	go func() {
+		defer close(incoming)
+
+		for {
+			if !w.waitForRoom(gone) {
+				return
+			}
+
+			wave, open := <-conn.OutputChannel
+			if !open {
+				return
+			}
+
+			// What happens to a request without credit is up to -flow-overflow.
+			if needsCredit(wave) {
+				credited := w.take()
+				if !credited && s.flowOverflow == overflowBlock {
+					credited = w.waitForCredit(gone)
+				}
+
+				switch {
+				case credited:
+					w.charge(wave)
+				case s.flowOverflow == overflowDropNewest:
+					s.drop(conn.ID, correlationOf(wave), dropNoCredit, "request sent without credit, dropped without an answer")
+					continue
+				default:
+					wave = uncredited{wave.(message.ImpactMessage)}
+				}
+			}
+
+			select {
+			case incoming <- wave:
+			case <-gone:
+				return
+			}
+		}
+	}()
+
+	return incoming
+}
+
+// Use up a credit, and report whether there was one to use. A client that isn't under credit always has one.
+func (w *flowWindow) take() bool {
+	if w.replenish == 0 {
+		return true
+	}
+
+	for {
+		credits := w.credits.Load()
+		if credits <= 0 {
+			return false
+		}
+		if w.credits.CompareAndSwap(credits, credits-1) {
+			return true
+		}
+	}
+}
+
+// Wait for a credit, and use it up. Report false if the client went away first.
+func (w *flowWindow) waitForCredit(gone chan bool) bool {
+	for !w.take() {
+		select {
+		case <-w.room:
+		case <-gone:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Count a request's payload as outstanding.
+func (w *flowWindow) charge(wave radiowave.Message) {
+	if w.maxBytes == 0 {
+		return
+	}
+
+	size := int64(payloadSize(wave))
+	w.sizesLock.Lock()
+	w.sizes = append(w.sizes, size)
+	w.sizesLock.Unlock()
+	w.outstanding.Add(size)
+}
+
+// Wait until the connection may have another request read. Report false if the client went away first.
+func (w *flowWindow) waitForRoom(gone chan bool) bool {
+	for w.maxBytes > 0 && w.outstanding.Load() >= w.maxBytes {
+		select {
+		case <-w.room:
+		case <-gone:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The oldest outstanding request has been answered, so its bytes no longer count.
+func (w *flowWindow) release() {
+	if w.maxBytes == 0 {
+		return
+	}
+
+	w.sizesLock.Lock()
+	size := w.sizes[0]
+	w.sizes = w.sizes[1:]
+	w.sizesLock.Unlock()
+	w.outstanding.Add(-size)
+	w.wake()
+}
+
+func (w *flowWindow) wake() {
+	select {
+	case w.room <- true:
+	default:
+	}
+}
+
+// A message has been answered. If it was a request, its bytes are no longer outstanding. It also had a credit, and once
+// a batch of them has been answered, the client is granted their credits back.
+func (s *server) replenish(conn *connection.Conn, w *flowWindow, wave radiowave.Message) {
+	if w == nil || !needsCredit(wave) {
+		return
+	}
+
+	w.release()
+	if w.replenish == 0 {
+		return
+	}
+
+	owed := w.owed.Add(1)
+	if owed < w.replenish {
+		return
+	}
+
+	w.owed.Store(0)
+	w.credits.Add(owed)
+	w.wake()
+	_ = conn.WriteMessage(message.NewCredit(conn.Version, uint32(min(owed, math.MaxUint32))))
+}
+
+// How a connection's window stands, for the debug dump.
+type windowReport struct {
+	Credits          int64 `json:"credits"`
+	Owed             int64 `json:"owed"`
+	OutstandingBytes int64 `json:"outstanding_bytes"`
+}
+
+func (w *flowWindow) report() *windowReport {
+	if w == nil {
+		return nil
+	}
+
+	return &windowReport{Credits: w.credits.Load(), Owed: w.owed.Load(), OutstandingBytes: w.outstanding.Load()}
+}
@@ -0,0 +1,43 @@
+package impact
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Under -max-outstanding-bytes, a connection that has read as many request bytes as it may isn't read from again until
+// some are answered, however much credit it has left. The request that takes it over the cap is still read, as is one
+// bigger than the cap on its own.
+func TestMaxOutstandingBytes(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.FlowWindow = 10
+		config.MaxOutstandingBytes = 8
+	})
+	client := dial(t, address)
+	eventually(t, "the connection is open", func() bool { return len(server.s.currentConnections()) == 1 })
+	id := server.s.currentConnections()[0].ID
+
+	// Five bytes leave room for more, and the next six take the connection over its cap, so the last isn't read.
+	client.send(1, "sleep")
+	client.send(2, "second")
+	client.send(3, "third")
+	eventually(t, "the requests under the cap are read", func() bool { return server.s.outstandingBytes(id) == 11 })
+	time.Sleep(100 * time.Millisecond)
+	if outstanding := server.s.outstandingBytes(id); outstanding != 11 {
+		t.Fatalf("%d bytes are outstanding while the connection is over its cap, not 11", outstanding)
+	}
+
+	for correlationID, payload := range []string{"sleep", "second", "third"} {
+		answer := receiveAnswer(client)
+		if answer.Header.CorrelationID != uint64(correlationID+1) {
+			t.Fatalf("got the answer to request %d, not %d", answer.Header.CorrelationID, correlationID+1)
+		}
+		expectReply(t, answer, payload)
+	}
+	eventually(t, "nothing is outstanding", func() bool { return server.s.outstandingBytes(id) == 0 })
+
+	big := strings.Repeat("x", 20)
+	client.send(4, big)
+	expectReply(t, receiveAnswer(client), big)
+}
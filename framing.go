@@ -0,0 +1,41 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+)
+
+// The ways a listener can frame messages. Either way, the messages themselves are the same.
+const (
+	// Radiowave's own framing: a one byte count, then that many bytes of length.
+	framingRadiowave = "radiowave"
+	// A plain four byte big-endian length, for clients without a radiowave library.
+	framingLength32 = "length32"
+)
+
+func knownFraming(name string) bool {
+	return name == framingRadiowave || name == framingLength32
+}
+
+func (s *server) codec(framing string) connection.Codec {
+	if framing == framingLength32 {
+		return connection.LengthPrefixCodec(func(data []byte) (radiowave.Message, error) { return message.Decode(data) })
+	}
+
+	return connection.RadiowaveCodec(s.factory)
+}
+
+// Every listener's connections are treated alike, whatever their framing, once their messages are read.
+func (s *server) configureListener(listener *connection.Listener, config Config, framing string, ids connection.IDScheme) {
+	listener.Codec = s.codec(framing)
+	listener.MaxMessageSize = s.maxRequestSize
+	listener.WriteTimeout = config.WriteTimeout
+	listener.MessageReadTimeout = config.MessageReadTimeout
+	listener.IDs = ids
+	listener.Admit = s.admitConnection
+
+	// Validate has already checked the reasons.
+	listener.Closer, _ = connection.NewCloser(config.CloseReset, config.CloseLinger)
+	listener.Closer.Farewell = farewell
+}
@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// How a client speaks the framing, which is how the server speaks it too.
+func codecFor(framing string) connection.Codec {
+	if framing == framingLength32 {
+		return connection.LengthPrefixCodec(func(data []byte) (radiowave.Message, error) { return message.Decode(data) })
+	}
+
+	return connection.RadiowaveCodec(message.NewImpactMessageFactory())
+}
+
+// A TCP listener and a Unix socket listener with different framings serve the same resource side by side, and a
+// client of either gets its replies in the framing it spoke.
+func TestTwoListenersTwoFramings(t *testing.T) {
+	for _, framings := range [][2]string{{framingRadiowave, framingLength32}, {framingLength32, framingRadiowave}} {
+		tcpFraming, unixFraming := framings[0], framings[1]
+		t.Run(fmt.Sprintf("tcp %s, unix %s", tcpFraming, unixFraming), func(t *testing.T) {
+			// Unix socket paths are short, shorter than the test's own temporary directory might be.
+			directory, directoryError := os.MkdirTemp("", "impact")
+			if directoryError != nil {
+				t.Fatal(directoryError)
+			}
+			t.Cleanup(func() { _ = os.RemoveAll(directory) })
+			socket := filepath.Join(directory, "impact.sock")
+
+			_, address := startServer(t, "upper", func(config *Config) {
+				config.Framing = tcpFraming
+				config.UnixSocket = socket
+				config.UnixFraming = unixFraming
+			})
+
+			hello := message.NewHello(message.MinimumVersion, message.Version)
+			tcpClient, tcpWelcome := connectWith(t, "tcp", address, codecFor(tcpFraming), hello)
+			unixClient, unixWelcome := connectWith(t, "unix", socket, codecFor(unixFraming), hello)
+			if tcpWelcome.Header.Type != message.Welcome || unixWelcome.Header.Type != message.Welcome {
+				t.Fatalf("got messages of types %d and %d in answer to the hellos", tcpWelcome.Header.Type, unixWelcome.Header.Type)
+			}
+
+			for correlationID := uint64(1); correlationID <= 3; correlationID++ {
+				tcpPayload := fmt.Sprintf("over tcp %d", correlationID)
+				unixPayload := fmt.Sprintf("over unix %d", correlationID)
+				expectReply(t, tcpClient.request(correlationID, tcpPayload), strings.ToUpper(tcpPayload))
+				expectReply(t, unixClient.request(correlationID, unixPayload), strings.ToUpper(unixPayload))
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package impact
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Throughput and latency with and without a funnel buffer, from 64 connections each making one request after another
+// as fast as they are answered, to one resource and to a pool of four. Run with go test -run '^$' -bench Funnel.
+func BenchmarkFunnel(b *testing.B) {
+	const connections = 64
+
+	for _, poolSize := range []int{1, 4} {
+		for _, funnelBuffer := range []int{0, 64} {
+			b.Run(fmt.Sprintf("pool=%d/buffer=%d", poolSize, funnelBuffer), func(b *testing.B) {
+				_, address := startServer(b, "echo", func(config *Config) {
+					config.PoolSize = poolSize
+					config.FunnelBuffer = funnelBuffer
+				})
+				clients := make([]*testClient, connections)
+				for index := range clients {
+					clients[index] = dial(b, address)
+				}
+
+				var sent, waited atomic.Int64
+				failures := make(chan error, connections)
+				var running sync.WaitGroup
+				b.ResetTimer()
+				start := time.Now()
+				for _, client := range clients {
+					running.Add(1)
+					go func(client *testClient) {
+						defer running.Done()
+						for correlationID := uint64(1); sent.Add(1) <= int64(b.N); correlationID++ {
+							sentAt := time.Now()
+							if _, requestError := client.tryRequest(correlationID, "funnel"); requestError != nil {
+								failures <- fmt.Errorf("request %d: %w", correlationID, requestError)
+								return
+							}
+							waited.Add(int64(time.Since(sentAt)))
+						}
+					}(client)
+				}
+				running.Wait()
+				elapsed := time.Since(start)
+				b.StopTimer()
+
+				close(failures)
+				for failure := range failures {
+					b.Fatal(failure)
+				}
+				b.ReportMetric(float64(b.N)/elapsed.Seconds(), "req/s")
+				b.ReportMetric(float64(waited.Load())/float64(b.N)/float64(time.Millisecond), "ms/req")
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"math"
+)
+
+// The handshake is the first exchange on every connection. The client says which protocol versions it speaks, and we
+// choose the newest one that we both speak. If there isn't one, we say so and the connection ends. When sessions can be
+// resumed, the connection joins one, which may be one it is resuming.
+func (s *server) handshake(connection *connection.Conn) (*session, bool) {
+	wave, open := <-connection.OutputChannel
+	if !open {
+		return nil, false
+	}
+
+	hello, isMessage := wave.(message.ImpactMessage)
+	if !isMessage || hello.Header.Type != message.Hello {
+		_ = connection.WriteMessage(message.ImpactError{CorrelationID: correlationOf(wave), Code: message.UnexpectedMessage, Description: "expected a hello"})
+		return nil, false
+	}
+
+	minimum, maximum, helloError := message.DecodeHello(hello)
+	if helloError != nil {
+		_ = connection.WriteMessage(message.ImpactError{CorrelationID: hello.Header.CorrelationID, Code: message.UnexpectedMessage, Description: helloError.Error()})
+		return nil, false
+	}
+
+	version, agreed := message.NegotiateVersion(minimum, maximum)
+	if !agreed {
+		description := fmt.Sprintf("client speaks versions %d to %d, but impact speaks versions %d to %d", minimum, maximum, message.MinimumVersion, message.Version)
+		_ = connection.WriteMessage(message.ImpactError{CorrelationID: hello.Header.CorrelationID, Code: message.UnsupportedVersion, Description: description})
+		return nil, false
+	}
+
+	connection.Version = version
+
+	if !s.authenticate(connection, hello) {
+		_ = connection.WriteMessage(message.ImpactError{CorrelationID: hello.Header.CorrelationID, Code: message.Unauthenticated, Description: "client did not prove who it is"})
+		return nil, false
+	}
+
+	welcome := message.NewWelcome(version)
+	welcome.Header.CorrelationID = hello.Header.CorrelationID
+	// Clients that know the limit can turn down oversized requests themselves, instead of sending them to be refused.
+	welcome.Header.MaxMessageSize = uint32(min(s.maxRequestSize, math.MaxUint32))
+	// Under flow control, the client starts with a full window.
+	welcome.Header.Credits = uint32(min(s.windowSize, math.MaxUint32))
+
+	// Compression is optional. A client that offers nothing we speak simply doesn't get any.
+	if algorithm, agreed := message.NegotiateCompression(s.compression, hello.Header.Compression); agreed {
+		connection.Compression = uint8(algorithm)
+		welcome.Header.Compression = []message.Compression{algorithm}
+	}
+
+	session := s.joinSession(connection, hello, &welcome)
+
+	return session, connection.WriteMessage(welcome) == nil
+}
@@ -0,0 +1,598 @@
+// Package impact provides multi-user serialized access to a resource. It launches the resource, accepts connections
+// from any number of clients, and funnels their requests to it, so that the resource sees one request at a time.
+//
+// The impact program, in cmd/impact, is Main. A Go service can embed the same server instead of running the program
+// beside it: NewServer makes a Server from a Config, Serve runs it, and Close shuts it down.
+package impact
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/metrics"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// ErrServerClosed is what Serve returns once the server has shut down after Close, or after its context was done,
+// and what it returns at once if the server has already been served.
+var ErrServerClosed = errors.New("impact: server closed")
+
+// An ExitError is how a Server says that it gave up, with the status the impact program exits with when it does the
+// same. Anything else worth knowing has been logged.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (exitError *ExitError) Error() string {
+	if exitError.Err == nil {
+		return fmt.Sprintf("impact: gave up, exit status %d", exitError.Code)
+	}
+
+	return exitError.Err.Error()
+}
+
+func (exitError *ExitError) Unwrap() error {
+	return exitError.Err
+}
+
+// An Option changes how NewServer makes a Server.
+type Option func(*Server)
+
+// WithConfig serves with the given configuration, rather than DefaultConfig. It is checked just as the impact
+// program's is.
+func WithConfig(config Config) Option {
+	return func(server *Server) { server.config = config }
+}
+
+// WithLogger logs to the given logger, rather than the standard one, or one writing where it does in -log-format.
+func WithLogger(logger *log.Logger) Option {
+	return func(server *Server) { server.logger = logger }
+}
+
+// A Server is impact, embedded in another program. It serves from the time Serve is called until Close is, or until
+// it gives up, and can't be served again after that.
+//
+// Embedded, impact installs no signal handlers, so it neither shuts down on SIGTERM nor reloads or rotates its TLS
+// session ticket keys on SIGHUP, and it never exits the process. Where the impact program would exit, Serve returns, and anything still running is stopped: the
+// listeners are closed, and so are the connections, and every resource is killed, after -shutdown-command or
+// -shutdown-signal has had its chance to stop it more gently.
+type Server struct {
+	config   Config
+	logger   *log.Logger
+	factory  message.ImpactMessageFactory
+	registry *metrics.Registry
+	s        *server
+
+	// The debug dump's token, read ahead of serving.
+	debugToken string
+	// Extractors added by whoever made the server, to go after those that -auth names.
+	extractors []identityMethod
+
+	// Set by Main. The server is the whole program, so it handles signals, and exits the process when it is done.
+	program bool
+
+	lock    sync.Mutex
+	serving bool
+	closed  bool
+	halted  bool
+	// Closed by Close, to start the shutdown.
+	closing chan bool
+
+	// What the server listens on, for stopping it.
+	listeners []*connection.Listener
+	datagrams *net.UDPConn
+	metrics   *http.Server
+
+	// Closed once the server has finished, when result says how.
+	done       chan bool
+	finishOnce sync.Once
+	result     error
+}
+
+// NewServer makes a server from the options, ready to Serve. The configuration is checked, and the journal, the audit
+// log and anything else named by it is opened, but nothing is launched or listened on until Serve.
+func NewServer(options ...Option) (*Server, error) {
+	server := &Server{config: DefaultConfig(), closing: make(chan bool), done: make(chan bool)}
+	for _, option := range options {
+		option(server)
+	}
+	config := server.config
+
+	if problem := startupProblem(config); problem != nil {
+		return nil, problem
+	}
+	if len(server.extractors) > 0 && config.UDPPort != 0 {
+		return nil, &ExitError{Code: 4, Err: errors.New("-udp-port can't be used with an identity extractor, there is no handshake to authenticate in")}
+	}
+	if server.logger == nil {
+		server.logger = log.Default()
+		if config.LogFormat != logFormatText {
+			server.logger = newLogger(config.LogFormat, log.Writer())
+		}
+	}
+
+	server.factory = message.NewImpactMessageFactory()
+	server.registry = metrics.NewRegistry()
+	registry := server.registry
+
+	s := newServer(server.factory, registry, server.logger)
+	s.exit = server.exited
+	server.s = s
+	logAttrs(s.logger, "starting", config.summary()...)
+
+	authenticators, authError := newAuthChain(config.Auth, config.AuthTokens)
+	if authError != nil {
+		return nil, &ExitError{Code: 4, Err: authError}
+	}
+	s.authenticators = append(authenticators, server.extractors...)
+	s.authFallback = config.AuthFallback
+	s.replyRatioAlarm = config.ReplyRatioAlarm
+	s.globalRateLimit = newRateLimit(0)
+	s.acceptRateLimit = newRateLimit(0)
+	s.acceptOverflow = config.AcceptOverflow
+	s.acceptedConnections = registry.NewCounter("impact_connections_accepted_total", "Connections let in, within -accept-rate.")
+	s.rejectedConnections = registry.NewCounter("impact_connections_rejected_total", "Connections closed as soon as they were accepted, for being over -accept-rate.")
+	s.applySettings(config)
+	s.maxMessageSize = config.MaxMessageSize
+	s.maxRequestSize = config.maxRequestSize()
+	s.inputStall = config.InputStall
+	s.maxReplySize = config.MaxReplySize
+	s.unknownType = config.UnknownType
+	// Validate has already checked the template.
+	s.encodeError, _ = parseErrorTemplate(config.ErrorTemplate)
+	s.queuePosition = config.QueuePosition
+	// Validate has already checked the sentinel.
+	s.restartSentinel, _ = parseSentinel(config.RestartSentinel)
+	s.sentinelReply = config.RestartSentinelReply
+	s.replies = newReplyCache(config.DedupSize, config.DedupTTL)
+	// Validate has already checked the algorithm names.
+	s.compression, _ = parseCompression(config.Compression)
+	s.compressionMinSize = config.CompressionMinSize
+	s.maxLifetime = config.MaxLifetime
+	s.funnelBuffer = config.FunnelBuffer
+	s.spanSlow = config.SpanSlow
+	s.spanSample = config.SpanSample
+	s.resumeTTL = config.ResumeTTL
+	s.resumeReplies = config.ResumeReplies
+	s.resumeBuffer = config.ResumeBuffer
+	s.shutdownCommand = config.ShutdownCommand
+	s.correlationTag = config.CorrelationTag
+	// Tags count up from somewhere random, so that one run's tags are unlikely to be taken for another's.
+	s.tags.Store(rand.Uint32())
+	s.shutdownWait = config.ShutdownWait
+	// Validate has already checked the signal.
+	s.shutdownSignal, _ = parseShutdownSignal(config.ShutdownSignal)
+	s.drainTimeout = config.DrainTimeout
+	s.windowSize = config.FlowWindow
+	s.windowReplenish = config.FlowReplenish
+	s.maxOutstandingBytes = config.MaxOutstandingBytes
+	s.inFlightOverflow = config.InFlightOverflow
+	s.maxAnonymousPriority = uint8(config.MaxAnonymousPriority)
+	s.flowOverflow = config.FlowOverflow
+	// Validate has already checked the statuses.
+	s.statusErrors, _ = parseStatusErrors(config.StatusErrors)
+	if config.Journal != "" {
+		journal, journalError := newJournal(config.Journal, config.JournalSync, config.JournalSyncInterval, s.logger)
+		if journalError != nil {
+			return nil, &ExitError{Code: 9, Err: journalError}
+		}
+		s.journal = journal
+	}
+	if config.Audit != "" {
+		audit, auditError := newAudit(config.Audit, config.JournalSync, config.JournalSyncInterval, s.logger)
+		if auditError != nil {
+			s.journal.close()
+			return nil, &ExitError{Code: 4, Err: auditError}
+		}
+		s.audit = audit
+	}
+	// Validate has already checked the thresholds.
+	sloThresholds, _ := parseSLOThresholds(config.SLOThresholds)
+	s.slo = newSLOCounter(registry, sloThresholds)
+
+	// The debug dump's token is read at startup, so that a bad file is found now rather than in the middle of an incident.
+	if config.MetricsAddress != "" && config.DebugTokenFile != "" {
+		debugToken, tokenError := loadDebugToken(config.DebugTokenFile)
+		if tokenError != nil {
+			s.journal.close()
+			s.audit.close()
+			return nil, &ExitError{Code: 4, Err: tokenError}
+		}
+		server.debugToken = debugToken
+	}
+
+	return server, nil
+}
+
+// Settings without which there is nothing to serve, or that can't work together, are caught before anything starts,
+// rather than misbehaving once we're serving.
+func startupProblem(config Config) *ExitError {
+	// A Unix socket can be listened on instead of a port.
+	if config.Port < 0 || config.Port > 65535 || config.Port == 0 && config.UnixSocket == "" {
+		return &ExitError{Code: 3, Err: errors.New("port required")}
+	}
+
+	if config.Path == "" && config.AttachPID == 0 {
+		return &ExitError{Code: 9, Err: errors.New("No path to resource")}
+	}
+
+	if configError := config.Validate(); configError != nil {
+		return &ExitError{Code: 4, Err: configError}
+	}
+
+	return nil
+}
+
+// Serve launches the resource, listens, and serves clients until ctx is done or Close is called, and then shuts down
+// as the impact program does on SIGTERM, returning ErrServerClosed once it has drained. If the server gives up
+// instead, Serve returns an ExitError.
+func (server *Server) Serve(ctx context.Context) error {
+	server.lock.Lock()
+	if server.serving || server.closed {
+		server.lock.Unlock()
+		return ErrServerClosed
+	}
+	server.serving = true
+	server.lock.Unlock()
+
+	// Whatever gives up on the server does so from wherever it is running, so the server runs on goroutines of its
+	// own, and Serve waits for it to finish.
+	go server.run(ctx)
+	<-server.done
+
+	return server.result
+}
+
+// Close shuts the server down, draining the requests already submitted, and waits until it has. It returns nil once
+// the server has shut down, or the ExitError it gave up with if it had already given up.
+func (server *Server) Close() error {
+	server.lock.Lock()
+	serving := server.serving
+	if !server.closed {
+		server.closed = true
+		close(server.closing)
+	}
+	server.lock.Unlock()
+
+	// A server that was never served has launched and listened on nothing, but still has the files NewServer opened.
+	if !serving {
+		server.s.journal.close()
+		server.s.audit.close()
+		return nil
+	}
+
+	<-server.done
+	if errors.Is(server.result, ErrServerClosed) {
+		return nil
+	}
+	return server.result
+}
+
+func (server *Server) run(ctx context.Context) {
+	s, config, registry, factory := server.s, server.config, server.registry, server.factory
+
+	// If we can't launch the resource, we must give up.
+	probes := newProbeCounters(registry)
+	s.primary = s.startBackend(config, "primary", config.Path, config.AttachPID, false, probes)
+	if config.LargeRequestSize > 0 {
+		largePath := config.LargePath
+		if largePath == "" {
+			largePath = config.Path
+		}
+		s.large = s.startBackend(config, "large", largePath, 0, false, probes)
+		s.largeRequestSize = config.LargeRequestSize
+	}
+	// Validate has already checked the resources.
+	resources, _ := parseResources(config.Resources)
+	s.named = make(map[string]*backend, len(resources))
+	for _, named := range resources {
+		b := s.startBackend(config, named.name, named.path, 0, true, probes)
+		s.named[named.name] = b
+		s.namedOrder = append(s.namedOrder, b)
+	}
+
+	registry.NewGaugeFunc("impact_warmup_rate", "Requests per second allowed while the resource warms up, 0 when not warming up.", func() float64 {
+		rate, _ := s.primary.warmup.rate()
+		return rate
+	})
+	registry.NewGaugeFunc("impact_resource_latency_ewma_seconds", "Moving average of the time the resource takes per request.", func() float64 { return s.primary.shedder.averageLatency().Seconds() })
+	registry.NewGaugeFunc("impact_shed_fraction", "Share of new requests being turned away because the resource is slow.", s.primary.shedder.fraction)
+	registry.NewGaugeFunc("impact_resource_input_blocked", "Resources in the primary pool that have stopped taking their input.", func() float64 { return float64(s.primary.blockedMembers()) })
+	// The same for every backend, so that backends can be told apart when there are several.
+	registry.NewGaugeFuncVec("impact_backend_queue_length", "Requests waiting on each backend, including the ones it is working on.", "backend", func() map[string]float64 {
+		return s.perBackend(func(b *backend) float64 { return float64(b.waiting()) })
+	})
+	registry.NewGaugeFuncVec("impact_backend_busy_members", "Members of each backend's pool working on a request.", "backend", func() map[string]float64 {
+		return s.perBackend(func(b *backend) float64 { return float64(b.busyMembers()) })
+	})
+	registry.NewGaugeFuncVec("impact_backend_missing_members", "Members of each backend's pool without a running resource, being relaunched or stopped, so serving at reduced capacity.", "backend", func() map[string]float64 {
+		return s.perBackend(func(b *backend) float64 { return float64(len(b.members) - b.healthyMembers()) })
+	})
+	registry.NewGaugeFuncVec("impact_backend_input_blocked", "Members of each backend's pool that have stopped taking their input.", "backend", func() map[string]float64 {
+		return s.perBackend(func(b *backend) float64 { return float64(b.blockedMembers()) })
+	})
+	registry.NewGaugeFunc("impact_dedup_entries", "Replies remembered for answering retries.", func() float64 { return float64(s.replies.len()) })
+	registry.NewGaugeFunc("impact_connections_open", "Client connections open, on every listener, once they have finished their handshake.", func() float64 { return float64(s.openConnections()) })
+	registry.NewGaugeFunc("impact_requests_in_flight", "Requests queued or executing.", func() float64 { return float64(s.pending.Load()) })
+	registry.NewGaugeFuncVec("impact_tenant_requests_in_flight", "Requests queued or executing, by authenticated identity.", "tenant", func() map[string]float64 {
+		values := map[string]float64{}
+		for tenant, count := range s.identitiesPending() {
+			values[tenant] = float64(count)
+		}
+		return values
+	})
+	registry.NewGaugeFunc("impact_requests_in_flight_max", "Most requests allowed to be queued or executing, 0 if unlimited.", func() float64 { return float64(s.maxInFlight.Load()) })
+
+	// If we can't listen, we must give up. Every listener shares one connection id scheme, so that ids are unique
+	// across all of them.
+	ids := connectionIDScheme(config.ConnectionIDs)
+	var listeners []*connection.Listener
+	// Without a port, there is only the Unix socket.
+	if config.Port != 0 {
+		listener, listenError := server.listenPort(config, ids)
+		if listenError != nil {
+			server.fail(listenError)
+			return
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if config.UnixSocket != "" {
+		unixListener, unixError := connection.ListenUnix(factory, config.UnixSocket)
+		if unixError != nil {
+			server.fail(&ExitError{Code: 10, Err: fmt.Errorf("Unix socket listen failed: %w", unixError)})
+			return
+		}
+		server.listening(unixListener)
+		s.configureListener(unixListener, config, config.UnixFraming, ids)
+		listeners = append(listeners, unixListener)
+	}
+
+	if config.UDPPort != 0 {
+		datagrams, udpError := net.ListenUDP("udp", &net.UDPAddr{Port: config.UDPPort})
+		if udpError != nil {
+			server.fail(&ExitError{Code: 10, Err: fmt.Errorf("UDP listen failed: %w", udpError)})
+			return
+		}
+		server.lock.Lock()
+		server.datagrams = datagrams
+		server.lock.Unlock()
+		go s.serveDatagrams(datagrams)
+	}
+
+	if config.MetricsAddress != "" {
+		metricsServer := &http.Server{Addr: config.MetricsAddress, Handler: s.newMetricsHandler(registry, config.Profiling, server.debugToken)}
+		server.lock.Lock()
+		server.metrics = metricsServer
+		server.lock.Unlock()
+		go func() {
+			// Metrics are optional, but if they were asked for and we can't serve them, something is badly misconfigured.
+			metricsError := metricsServer.ListenAndServe()
+			if errors.Is(metricsError, http.ErrServerClosed) {
+				return
+			}
+			s.logger.Println("error: metrics listener failed:", metricsError)
+			s.exit(13)
+		}()
+	}
+
+	if server.program {
+		// On SIGTERM or SIGINT, the shutdown coroutine closes the listeners and lets the funnel drain.
+		go s.handleShutdown(listeners)
+
+		// On SIGHUP, the settings that can be changed while running are read again.
+		go s.handleReloads()
+	} else {
+		go server.awaitClose(ctx, listeners)
+	}
+
+	for _, listener := range listeners[1:] {
+		go server.accept(listener)
+	}
+	server.accept(listeners[0])
+}
+
+// Listen on the port, over TLS if it was asked for.
+func (server *Server) listenPort(config Config, ids connection.IDScheme) (*connection.Listener, error) {
+	s, registry, factory := server.s, server.registry, server.factory
+
+	address := "0.0.0.0:" + strconv.Itoa(config.Port)
+	var listener *connection.Listener
+	var listenError error
+	if config.TLSCertificate != "" {
+		// If TLS was asked for, serving cleartext instead would be worse than not serving at all.
+		tlsConfig, tlsError := newTLSConfig(config.TLSCertificate, config.TLSKey, config.TLSTicketKeys, config.TLSClientCA, config.TLSRequireClientCert)
+		if tlsError != nil {
+			return nil, &ExitError{Code: 5, Err: fmt.Errorf("TLS configuration failed: %w", tlsError)}
+		}
+
+		// Keys are rotated on SIGHUP, which is the impact program's to handle. Embedded, they are read once.
+		if config.TLSTicketKeys != "" && server.program {
+			go handleTicketKeyRotation(tlsConfig, config.TLSTicketKeys, s.logger)
+		}
+
+		listener, listenError = connection.ListenTLS(factory, address, tlsConfig)
+	} else {
+		listener, listenError = connection.Listen(factory, address)
+	}
+	if listenError != nil {
+		return nil, &ExitError{Code: 10, Err: fmt.Errorf("listen failed: %w", listenError)}
+	}
+	server.listening(listener)
+	if config.TLSCertificate != "" {
+		handshakes := connection.NewHandshakeLimit(config.MaxTLSHandshakes, config.TLSHandshakeTimeout)
+		listener.Handshakes = handshakes
+		registry.NewGaugeFunc("impact_tls_handshakes_in_progress", "TLS handshakes under way.", func() float64 { return float64(handshakes.InProgress()) })
+		registry.NewGaugeFunc("impact_tls_handshakes_waiting", "New connections waiting for their turn to handshake.", func() float64 { return float64(handshakes.Waiting()) })
+	}
+	s.configureListener(listener, config, config.Framing, ids)
+
+	return listener, nil
+}
+
+// Accept connections from one listener until it is closed, and give up if it breaks.
+func (server *Server) accept(listener *connection.Listener) {
+	if acceptError := server.s.acceptConnections(listener); acceptError != nil {
+		server.fail(&ExitError{Code: 11, Err: acceptError})
+	}
+}
+
+func (server *Server) listening(listener *connection.Listener) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.listeners = append(server.listeners, listener)
+}
+
+// Embedded, the server shuts down when it is closed, or its context is done, rather than on a signal.
+func (server *Server) awaitClose(ctx context.Context, listeners []*connection.Listener) {
+	select {
+	case <-ctx.Done():
+	case <-server.closing:
+	case <-server.done:
+		return
+	}
+
+	server.s.shutdown(listeners)
+}
+
+// Embedded, the server can't exit the process, so it stops everything instead, and Serve returns. Whatever gave up
+// carries on no further, as if the process had exited under it.
+func (server *Server) exited(code int) {
+	result := error(ErrServerClosed)
+	if code != 0 {
+		result = &ExitError{Code: code}
+	}
+
+	// What gave up may be holding the lifecycle lock, which it lets go of on its way out.
+	go server.fail(result)
+	runtime.Goexit()
+}
+
+// Finish serving with the given result. The impact program is about to exit, which stops everything for it. Embedded,
+// everything has to be stopped here.
+func (server *Server) fail(result error) {
+	if !server.program {
+		server.halt()
+
+		// A clean shutdown has closed them already.
+		if !errors.Is(result, ErrServerClosed) {
+			server.s.journal.close()
+			server.s.audit.close()
+		}
+	}
+
+	server.finishOnce.Do(func() {
+		server.result = result
+		close(server.done)
+	})
+}
+
+// Stop everything the server started: its listeners, its connections and its resources.
+func (server *Server) halt() {
+	s := server.s
+	s.lifecycleLock.Lock()
+	s.shuttingDown.Store(true)
+	s.lifecycleLock.Unlock()
+
+	server.lock.Lock()
+	listeners, datagrams, metricsServer := server.listeners, server.datagrams, server.metrics
+	server.lock.Unlock()
+
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	if datagrams != nil {
+		_ = datagrams.Close()
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+
+	s.closeConnections(closeShutdown)
+
+	for _, b := range s.backends() {
+		// A server that gave up while launching its resources may not have all of its backends.
+		if b == nil {
+			continue
+		}
+		for _, m := range b.members {
+			if process := m.process.Load(); process != nil {
+				process.Kill()
+			}
+		}
+		b.scheduler.Close()
+	}
+
+	// Everything that runs for as long as the server does stops now. Whatever gave up may get here more than once.
+	server.lock.Lock()
+	if !server.halted {
+		server.halted = true
+		close(s.halted)
+	}
+	server.lock.Unlock()
+}
+
+// Main runs the impact program. It reads the configuration from the command line, the environment and the config file,
+// serves until it is told to stop by a signal, and exits.
+func Main() {
+	config, configError := parseConfig()
+	if configError != nil {
+		log.Println("error:", configError)
+		os.Exit(4)
+	}
+	// An unknown format is reported by the configuration's check, in plain lines.
+	if knownLogFormat(config.LogFormat) {
+		setLogFormat(config.LogFormat)
+	}
+
+	// Checking an audit log has nothing to do with serving, so it needs nothing else.
+	if config.VerifyAudit != "" {
+		os.Exit(runVerifyAudit(config.VerifyAudit, log.Default()))
+	}
+
+	if problem := startupProblem(config); problem != nil {
+		log.Println("error:", problem)
+		os.Exit(problem.Code)
+	}
+
+	// A check goes no further than finding out whether impact could start, and never listens.
+	if config.Check {
+		os.Exit(runCheck(config, message.NewImpactMessageFactory(), log.Default()))
+	}
+
+	server, serverError := NewServer(WithConfig(config), WithLogger(log.Default()))
+	if serverError != nil {
+		log.Println("error:", serverError)
+		os.Exit(exitCode(serverError))
+	}
+	server.program = true
+	server.s.exit = os.Exit
+	server.s.settings = flagValues(flag.CommandLine)
+
+	// Serving only ends here if the server gave up. Otherwise, the process exits once it has shut down.
+	serveError := server.Serve(context.Background())
+	log.Println("error:", serveError)
+	os.Exit(exitCode(serveError))
+}
+
+// The status to exit with for an error from NewServer or Serve.
+func exitCode(serveError error) int {
+	var exitError *ExitError
+	if errors.As(serveError, &exitError) {
+		return exitError.Code
+	}
+
+	return 1
+}
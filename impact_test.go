@@ -0,0 +1,494 @@
+package impact
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The resource the tests serve is the test binary itself, launched with testResourceMode saying how it behaves.
+const testResourceMode = "IMPACT_TEST_RESOURCE"
+
+// If set, the test resource announces itself before reading anything: with a line of text, then a message with this
+// as its payload, then a prompt that doesn't end its line, 50ms apart.
+const testResourceBanner = "IMPACT_TEST_BANNER"
+
+// If set, the test resource catches SIGUSR1, and notes each one it gets in the file this names, rather than exiting.
+const testResourceSignals = "IMPACT_TEST_SIGNALS"
+
+func TestMain(m *testing.M) {
+	if mode, isResource := os.LookupEnv(testResourceMode); isResource {
+		runTestResource(mode)
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// The test resource replies to each request with its payload, unless the payload asks for something else:
+//
+//	hang       never reply
+//	exit       exit with status 1, without replying
+//	crash      exit with status 1 after 100ms, without replying
+//	sleep      reply after 200ms
+//	chunks     reply in three chunks
+//	double     reply with the payload twice over
+//	headers    reply with the request's trace id and tag
+//	trickle    reply in two chunks, 200ms apart
+//	fragments  write the reply a few bytes at a time
+//	garbled    write a frame that isn't a message before the reply
+//	eof        close its output without replying, and read its input until that closes too
+//	deaf       close its input, reply, and carry on running
+//
+// The mode can change what the resource does:
+//
+//	upper  reply with the payload in upper case
+func runTestResource(mode string) {
+	// A resource outliving the test that launched it would hold on to the test's output.
+	go func() {
+		for os.Getppid() != 1 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		os.Exit(0)
+	}()
+
+	if signals := os.Getenv(testResourceSignals); signals != "" {
+		caught := make(chan os.Signal, 1)
+		signal.Notify(caught, syscall.SIGUSR1)
+		go func() {
+			for received := range caught {
+				noted, _ := os.OpenFile(signals, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+				_, _ = fmt.Fprintln(noted, received)
+				_ = noted.Close()
+			}
+		}()
+	}
+
+	if banner := os.Getenv(testResourceBanner); banner != "" {
+		_, _ = os.Stdout.WriteString("test resource starting\n")
+		time.Sleep(50 * time.Millisecond)
+		writeTestReply(message.ImpactMessage{Header: message.NewHeader(message.Reply), Payload: []byte(banner)}.ToBytes())
+		time.Sleep(50 * time.Millisecond)
+		_, _ = os.Stdout.WriteString("ready> ")
+	}
+
+	factory := message.NewImpactMessageFactory()
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		frame, readError := connection.ReadFrame(reader, 0)
+		if readError != nil {
+			os.Exit(0)
+		}
+		wave, parseError := factory.FromBytes(frame)
+		if parseError != nil {
+			continue
+		}
+		request := wave.(message.ImpactMessage)
+		payload := string(request.Payload)
+
+		reply := message.ImpactMessage{Header: message.NewHeader(message.Reply), Payload: request.Payload}
+		reply.Header.CorrelationID = request.Header.CorrelationID
+
+		switch {
+		case strings.HasPrefix(payload, "hang"):
+			select {}
+
+		case strings.HasPrefix(payload, "exit"):
+			os.Exit(1)
+
+		case strings.HasPrefix(payload, "crash"):
+			time.Sleep(100 * time.Millisecond)
+			os.Exit(1)
+
+		case strings.HasPrefix(payload, "sleep"):
+			time.Sleep(200 * time.Millisecond)
+
+		case strings.HasPrefix(payload, "chunks"):
+			for chunk := 0; chunk < 2; chunk++ {
+				more := reply
+				more.Header.Flags = message.More
+				writeTestReply(more.ToBytes())
+			}
+
+		case strings.HasPrefix(payload, "headers"):
+			reply.Payload = []byte(fmt.Sprintf("trace=%s tag=%s", request.Header.Trace, request.Header.Tag))
+
+		case strings.HasPrefix(payload, "double"):
+			reply.Payload = bytes.Repeat(request.Payload, 2)
+
+		case strings.HasPrefix(payload, "trickle"):
+			more := reply
+			more.Header.Flags = message.More
+			writeTestReply(more.ToBytes())
+			time.Sleep(200 * time.Millisecond)
+
+		case strings.HasPrefix(payload, "fragments"):
+			var framed bytes.Buffer
+			_ = connection.WriteFrame(&framed, reply.ToBytes())
+			for fragment := framed.Bytes(); len(fragment) > 0; fragment = fragment[min(3, len(fragment)):] {
+				_, _ = os.Stdout.Write(fragment[:min(3, len(fragment))])
+				time.Sleep(5 * time.Millisecond)
+			}
+			continue
+
+		case strings.HasPrefix(payload, "eof"):
+			_ = os.Stdout.Close()
+			for {
+				if _, readError := connection.ReadFrame(reader, 0); readError != nil {
+					os.Exit(0)
+				}
+			}
+
+		case strings.HasPrefix(payload, "deaf"):
+			_ = os.Stdin.Close()
+			writeTestReply(reply.ToBytes())
+			select {}
+
+		case strings.HasPrefix(payload, "garbled"):
+			writeTestReply([]byte("not a message"))
+		}
+
+		if mode == "upper" {
+			reply.Payload = bytes.ToUpper(reply.Payload)
+		}
+		writeTestReply(reply.ToBytes())
+	}
+}
+
+func writeTestReply(reply []byte) {
+	if writeError := connection.WriteFrame(os.Stdout, reply); writeError != nil {
+		os.Exit(0)
+	}
+}
+
+// Serve with the test resource in the given mode, on a free port, with the configuration changed by configure, and any
+// other options. The server is closed when the test finishes, if the test hasn't closed it already, and its log is
+// included in the test's output if the test fails.
+func startServer(t testing.TB, mode string, configure func(config *Config), options ...Option) (*Server, string) {
+	t.Helper()
+
+	t.Setenv(testResourceMode, mode)
+
+	config := DefaultConfig()
+	config.Port = freePort(t)
+	config.Path = os.Args[0]
+	if configure != nil {
+		configure(&config)
+	}
+
+	logs := &lockedBuffer{}
+	options = append([]Option{WithConfig(config), WithLogger(log.New(logs, "", log.Lmicroseconds))}, options...)
+	server, serverError := NewServer(options...)
+	if serverError != nil {
+		t.Fatalf("NewServer: %v", serverError)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(context.Background()) }()
+	t.Cleanup(func() {
+		_ = server.Close()
+		<-served
+		if t.Failed() {
+			t.Logf("impact logged:\n%s", logs.String())
+		}
+	})
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(config.Port))
+	waitForListener(t, address, served)
+
+	return server, address
+}
+
+func freePort(t testing.TB) int {
+	t.Helper()
+
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		t.Fatalf("no free port: %v", listenError)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func waitForListener(t testing.TB, address string, served chan error) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		select {
+		case serveError := <-served:
+			served <- serveError
+			t.Fatalf("server stopped before it listened: %v", serveError)
+		default:
+		}
+
+		conn, dialError := net.DialTimeout("tcp", address, 100*time.Millisecond)
+		if dialError == nil {
+			_ = conn.Close()
+			return
+		}
+	}
+
+	t.Fatalf("server didn't listen on %s", address)
+}
+
+// A client of the server under test, which has finished its handshake.
+type testClient struct {
+	t      testing.TB
+	conn   net.Conn
+	reader *bufio.Reader
+	codec  connection.Codec
+}
+
+func dial(t testing.TB, address string) *testClient {
+	t.Helper()
+
+	client, welcome := connect(t, address, message.NewHello(message.MinimumVersion, message.Version))
+	if welcome.Header.Type != message.Welcome {
+		t.Fatalf("got a message of type %d in answer to the hello", welcome.Header.Type)
+	}
+
+	return client
+}
+
+// Connect and send the hello, returning whatever the server answered it with.
+func connect(t testing.TB, address string, hello message.ImpactMessage) (*testClient, message.ImpactMessage) {
+	t.Helper()
+
+	return connectWith(t, "tcp", address, connection.RadiowaveCodec(message.NewImpactMessageFactory()), hello)
+}
+
+// The same, over any network and speaking any framing.
+func connectWith(t testing.TB, network string, address string, codec connection.Codec, hello message.ImpactMessage) (*testClient, message.ImpactMessage) {
+	t.Helper()
+
+	conn, dialError := net.DialTimeout(network, address, time.Second)
+	if dialError != nil {
+		t.Fatalf("dial %s: %v", address, dialError)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), codec: codec}
+	client.write(hello)
+
+	return client, client.receive()
+}
+
+func (c *testClient) write(wave message.ImpactMessage) {
+	c.t.Helper()
+
+	if writeError := c.codec.WriteFrame(c.conn, wave); writeError != nil {
+		c.t.Fatalf("write: %v", writeError)
+	}
+}
+
+func (c *testClient) send(correlationID uint64, payload string) {
+	c.t.Helper()
+
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	c.write(request)
+}
+
+// The next message from the server, which has to come within a few seconds.
+func (c *testClient) receive() message.ImpactMessage {
+	c.t.Helper()
+
+	wave, readError := c.tryReceive(5 * time.Second)
+	if readError != nil {
+		c.t.Fatalf("read: %v", readError)
+	}
+
+	return wave
+}
+
+func (c *testClient) tryReceive(timeout time.Duration) (message.ImpactMessage, error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	frame, readError := c.codec.ReadFrame(c.reader, 0)
+	if readError != nil {
+		return message.ImpactMessage{}, readError
+	}
+
+	wave, parseError := c.codec.Decode(frame)
+	if parseError != nil {
+		return message.ImpactMessage{}, parseError
+	}
+
+	return wave.(message.ImpactMessage), nil
+}
+
+// Send a request and wait for its answer, skipping any queued acknowledgements.
+func (c *testClient) request(correlationID uint64, payload string) message.ImpactMessage {
+	c.t.Helper()
+
+	answer, requestError := c.tryRequest(correlationID, payload)
+	if requestError != nil {
+		c.t.Fatalf("request %d: %v", correlationID, requestError)
+	}
+
+	return answer
+}
+
+// The same, from a goroutine other than the test's, which mustn't fail the test itself.
+func (c *testClient) tryRequest(correlationID uint64, payload string) (message.ImpactMessage, error) {
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	if writeError := c.codec.WriteFrame(c.conn, request); writeError != nil {
+		return message.ImpactMessage{}, writeError
+	}
+
+	for {
+		answer, readError := c.tryReceive(5 * time.Second)
+		if readError != nil || answer.Header.Type != message.Queued {
+			return answer, readError
+		}
+	}
+}
+
+// Fail unless the answer is a reply with the payload.
+func expectReply(t testing.TB, answer message.ImpactMessage, payload string) {
+	t.Helper()
+
+	if answer.Header.Type == message.Error {
+		impactError, _ := message.DecodeError(answer)
+		t.Fatalf("got error %d, %q, rather than a reply %q", impactError.Code, impactError.Description, payload)
+	}
+	if answer.Header.Type != message.Reply || string(answer.Payload) != payload {
+		t.Fatalf("got a message of type %d with %q, rather than a reply %q", answer.Header.Type, answer.Payload, payload)
+	}
+}
+
+// Fail unless the answer is an error with the code.
+func expectError(t testing.TB, answer message.ImpactMessage, code message.ErrorCode) message.ImpactError {
+	t.Helper()
+
+	impactError, decodeError := message.DecodeError(answer)
+	if decodeError != nil {
+		t.Fatalf("got a message of type %d with %q, rather than error %d", answer.Header.Type, answer.Payload, code)
+	}
+	if impactError.Code != code {
+		t.Fatalf("got error %d, %q, rather than error %d", impactError.Code, impactError.Description, code)
+	}
+
+	return impactError
+}
+
+// Wait for the condition to hold, failing the test if it doesn't within a few seconds.
+func eventually(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// What a server logs, written from its goroutines and read by the test.
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buffer.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buffer.String()
+}
+
+func TestServeAndClose(t *testing.T) {
+	server, address := startServer(t, "echo", nil)
+
+	client := dial(t, address)
+	expectReply(t, client.request(1, "hello"), "hello")
+
+	if closeError := server.Close(); closeError != nil {
+		t.Fatalf("Close: %v", closeError)
+	}
+	if serveError := server.Serve(context.Background()); !errors.Is(serveError, ErrServerClosed) {
+		t.Fatalf("serving a closed server gave %v, not ErrServerClosed", serveError)
+	}
+}
+
+// Everything a server starts is stopped by Close, down to the coroutines that watch and probe its resources.
+func TestCloseStopsEverything(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for round := 0; round < 3; round++ {
+		t.Run(strconv.Itoa(round), func(t *testing.T) {
+			server, address := startServer(t, "echo", func(config *Config) {
+				config.ProbeInterval = 20 * time.Millisecond
+				config.WatchdogInterval = 100 * time.Millisecond
+				config.Journal = t.TempDir() + "/journal"
+				config.JournalSync = journalSyncInterval
+			})
+
+			client := dial(t, address)
+			expectReply(t, client.request(1, "hello"), "hello")
+
+			if closeError := server.Close(); closeError != nil {
+				t.Fatalf("Close: %v", closeError)
+			}
+		})
+	}
+
+	// Connections and pipes take a moment to notice that they are closed.
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			var stacks bytes.Buffer
+			_ = pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+			t.Fatalf("%d goroutines before serving, %d after closing:\n%s", before, runtime.NumGoroutine(), stacks.String())
+		}
+	}
+}
+
+// A server that is closed without ever being served still lets go of what NewServer opened.
+func TestCloseWithoutServe(t *testing.T) {
+	directory := t.TempDir()
+	config := DefaultConfig()
+	config.Port = freePort(t)
+	config.Path = os.Args[0]
+	config.Journal = directory + "/journal"
+	config.Audit = directory + "/audit"
+
+	server, serverError := NewServer(WithConfig(config), WithLogger(log.New(&lockedBuffer{}, "", 0)))
+	if serverError != nil {
+		t.Fatalf("NewServer: %v", serverError)
+	}
+	if closeError := server.Close(); closeError != nil {
+		t.Fatalf("Close: %v", closeError)
+	}
+
+	if !server.s.journal.isClosed() || !server.s.audit.journal.isClosed() {
+		t.Fatal("the journal and audit log were left open")
+	}
+	if serveError := server.Serve(context.Background()); !errors.Is(serveError, ErrServerClosed) {
+		t.Fatalf("serving a closed server gave %v, not ErrServerClosed", serveError)
+	}
+}
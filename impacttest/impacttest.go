@@ -0,0 +1,130 @@
+// Package impacttest serves impact for integration tests, so that each test doesn't need its own copy of the code that
+// finds a free port, starts the server, waits for it to listen and stops it again afterwards.
+//
+// The server is an impact.Server, in the test's own process, so it is the code being tested, rather than whatever impact
+// program happens to be installed, and it needs nothing built beforehand.
+package impacttest
+
+import (
+	"bytes"
+	"context"
+	"github.com/blanu/impact"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// How long the server gets to start listening, and to drain when it is stopped.
+const (
+	startTimeout = 10 * time.Second
+	stopTimeout  = 10 * time.Second
+)
+
+// Start serves the configuration on a free port, unless it names one, and returns the loopback address to dial and a
+// function that stops the server. The server is also stopped when the test finishes, so calling stop is only needed to
+// stop it sooner. Whatever the server logged is included in the test's output if the test fails.
+func Start(t testing.TB, config impact.Config) (address string, stop func()) {
+	t.Helper()
+
+	if config.Port == 0 {
+		config.Port = freePort(t)
+	}
+
+	output := &lockedBuffer{}
+	server, serverError := impact.NewServer(impact.WithConfig(config), impact.WithLogger(log.New(output, "", log.LstdFlags)))
+	if serverError != nil {
+		t.Fatalf("impact could not be started: %v", serverError)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(context.Background()) }()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			// Close drains what the server has in flight. A server that won't drain is left behind, so that a hung
+			// resource can't hang the test run as well.
+			closed := make(chan error, 1)
+			go func() { closed <- server.Close() }()
+			select {
+			case closeError := <-closed:
+				if closeError != nil {
+					t.Errorf("impact gave up: %v", closeError)
+				}
+			case <-time.After(stopTimeout):
+				t.Errorf("impact did not drain within %v", stopTimeout)
+			}
+
+			if t.Failed() {
+				t.Logf("impact output:\n%s", output.String())
+			}
+		})
+	}
+	t.Cleanup(stop)
+
+	address = net.JoinHostPort("127.0.0.1", strconv.Itoa(config.Port))
+	waitForListener(t, address, served, output)
+
+	return address, stop
+}
+
+// Ask the operating system for a port nobody is using. Another process could take it before impact does, but on a
+// test machine that is rare enough not to be worth a more complicated handoff.
+func freePort(t testing.TB) int {
+	t.Helper()
+
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		t.Fatalf("no free port for impact: %v", listenError)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// The server is ready once it accepts connections. If Serve returns first, it isn't going to.
+func waitForListener(t testing.TB, address string, served chan error, output *lockedBuffer) {
+	t.Helper()
+
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case serveError := <-served:
+			t.Fatalf("impact stopped before it started listening: %v\n%s", serveError, output.String())
+		default:
+		}
+
+		conn, dialError := net.DialTimeout("tcp", address, 100*time.Millisecond)
+		if dialError == nil {
+			_ = conn.Close()
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("impact did not start listening on %s within %v:\n%s", address, startTimeout, output.String())
+}
+
+// The server's output is written by its goroutines and read by the test.
+type lockedBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buffer.Write(data)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.buffer.String()
+}
@@ -0,0 +1,93 @@
+package impacttest_test
+
+import (
+	"bufio"
+	"github.com/blanu/impact"
+	"github.com/blanu/impact/impacttest"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// The resource is the test binary itself, launched with this set in its environment.
+const echoResource = "IMPACTTEST_ECHO"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(echoResource) != "" {
+		echo()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// Reply to every request with its payload.
+func echo() {
+	factory := message.NewImpactMessageFactory()
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		frame, readError := connection.ReadFrame(reader, 0)
+		if readError != nil {
+			return
+		}
+		wave, parseError := factory.FromBytes(frame)
+		if parseError != nil {
+			continue
+		}
+
+		request := wave.(message.ImpactMessage)
+		reply := message.ImpactMessage{Header: message.NewHeader(message.Reply), Payload: request.Payload}
+		if connection.WriteFrame(os.Stdout, reply.ToBytes()) != nil {
+			return
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	t.Setenv(echoResource, "1")
+
+	config := impact.DefaultConfig()
+	config.Path = os.Args[0]
+	address, stop := impacttest.Start(t, config)
+
+	conn, dialError := net.DialTimeout("tcp", address, time.Second)
+	if dialError != nil {
+		t.Fatalf("dial %s: %v", address, dialError)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	exchange := func(sent message.ImpactMessage) message.ImpactMessage {
+		if writeError := connection.WriteFrame(conn, sent.ToBytes()); writeError != nil {
+			t.Fatalf("write: %v", writeError)
+		}
+		frame, readError := connection.ReadFrame(reader, 0)
+		if readError != nil {
+			t.Fatalf("read: %v", readError)
+		}
+		wave, parseError := message.NewImpactMessageFactory().FromBytes(frame)
+		if parseError != nil {
+			t.Fatalf("parse: %v", parseError)
+		}
+		return wave.(message.ImpactMessage)
+	}
+
+	if welcome := exchange(message.NewHello(message.MinimumVersion, message.Version)); welcome.Header.Type != message.Welcome {
+		t.Fatalf("got a message of type %d in answer to the hello", welcome.Header.Type)
+	}
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte("hello")}
+	if reply := exchange(request); reply.Header.Type != message.Reply || string(reply.Payload) != "hello" {
+		t.Fatalf("got a message of type %d with %q, rather than the echo", reply.Header.Type, reply.Payload)
+	}
+
+	// Once stopped, the server listens no more.
+	stop()
+	if after, dialError := net.DialTimeout("tcp", address, time.Second); dialError == nil {
+		_ = after.Close()
+		t.Fatal("the server was still listening after stop")
+	}
+}
@@ -0,0 +1,174 @@
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/blanu/radiowave"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// CloseReason is why a connection is being closed.
+type CloseReason uint8
+
+const (
+	// CloseFinished means the connection has simply come to an end, usually because the client hung up.
+	CloseFinished CloseReason = iota
+	// CloseRefused means the client didn't get through the handshake, or through the TLS handshake before it.
+	CloseRefused
+	// CloseProtocol means the client sent something impact couldn't make sense of, or wouldn't accept.
+	CloseProtocol
+	// CloseTimeout means the client took too long to read what it was sent.
+	CloseTimeout
+	// CloseShutdown means impact is shutting down.
+	CloseShutdown
+	// CloseRateLimited means the connection was over the rate at which new connections are let in.
+	CloseRateLimited
+	// CloseResourceGone means impact has lost its resource for good, and is exiting.
+	CloseResourceGone
+)
+
+var closeReasonNames = []string{
+	CloseFinished:     "finished",
+	CloseRefused:      "refused",
+	CloseProtocol:     "protocol",
+	CloseTimeout:      "timeout",
+	CloseShutdown:     "shutdown",
+	CloseRateLimited:  "rate-limited",
+	CloseResourceGone: "resource-gone",
+}
+
+func (reason CloseReason) String() string {
+	if int(reason) < len(closeReasonNames) {
+		return closeReasonNames[reason]
+	}
+
+	return fmt.Sprintf("reason %d", reason)
+}
+
+// A Closer decides how connections end. A graceful close sends the client a farewell, if there is one for the reason,
+// after anything already being written, and then ends our side of the connection and gives the client a moment to end
+// its own, so that it sees a clean end of stream. A reset drops the connection at once, and the client sees the
+// connection reset. Clients can tell the two apart, and so tell a deliberate close from something going wrong.
+type Closer struct {
+	// Farewell makes the last message sent on a connection closed gracefully. Nil, or a nil message, means none.
+	Farewell func(conn *Conn, reason CloseReason) radiowave.Message
+
+	// Linger is how long a graceful close waits for the client to end its side of the connection.
+	Linger time.Duration
+
+	// The reasons for which connections are reset rather than closed gracefully.
+	resets map[CloseReason]bool
+}
+
+// NewCloser resets connections closed for any of the reasons in the comma-separated list, and closes the rest
+// gracefully.
+func NewCloser(resets string, linger time.Duration) (*Closer, error) {
+	closer := &Closer{Linger: linger, resets: map[CloseReason]bool{}}
+	if resets == "" {
+		return closer, nil
+	}
+
+	for _, name := range strings.Split(resets, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for reason, reasonName := range closeReasonNames {
+			if name == reasonName {
+				closer.resets[CloseReason(reason)] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown close reason %q", name)
+		}
+	}
+
+	return closer, nil
+}
+
+// CloseFor ends the connection for the given reason, gracefully or not as the listener's Closer says. It is safe to
+// call more than once, and from any coroutine, and only the first call has any effect.
+func (c *Conn) CloseFor(reason CloseReason) error {
+	// A connection the client has already ended has nothing left to close gracefully.
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+
+	// A graceful close writes, and a write that fails closes the connection again. Only the first close gets a say.
+	if !c.closing.CompareAndSwap(false, true) {
+		return c.Close()
+	}
+
+	if c.closer == nil || !c.closer.resets[reason] {
+		c.closeGracefully(reason)
+	} else {
+		c.reset()
+	}
+
+	return c.Close()
+}
+
+func (c *Conn) closeGracefully(reason CloseReason) {
+	// Until a TLS handshake is done, there's no way to send anything, and trying would only start the handshake again.
+	if tlsConn, isTLS := c.network.(*tls.Conn); isTLS && !tlsConn.ConnectionState().HandshakeComplete {
+		return
+	}
+
+	// A client that timed out reading isn't going to read a farewell either.
+	if c.closer != nil && c.closer.Farewell != nil && reason != CloseTimeout {
+		if farewell := c.closer.Farewell(c, reason); farewell != nil {
+			// A client that can't be told has gone already, and the connection is closed all the same.
+			if writeError := c.WriteMessage(farewell); writeError != nil {
+				if logger := c.Logger(); logger != nil {
+					logger.Printf("could not send farewell before closing for %s: %v", reason, writeError)
+				}
+				return
+			}
+		}
+	}
+
+	// Taking the write lock means anything already being written goes first.
+	c.writeLock.Lock()
+	if halfCloser, canHalfClose := c.network.(interface{ CloseWrite() error }); canHalfClose {
+		_ = halfCloser.CloseWrite()
+	}
+	c.writeLock.Unlock()
+
+	// The client sees the end of our side, and ends its own, which our reader notices and closes the connection for.
+	if c.closer == nil || c.closer.Linger <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(c.closer.Linger)
+	defer timer.Stop()
+	select {
+	case <-c.closed:
+	case <-timer.C:
+	}
+}
+
+// Throw away anything not yet sent and reset the connection, rather than ending it cleanly.
+func (c *Conn) reset() {
+	network := c.network
+	if netConner, isWrapped := network.(interface{ NetConn() net.Conn }); isWrapped {
+		network = netConner.NetConn()
+	}
+
+	if tcp, isTCP := network.(*net.TCPConn); isTCP {
+		_ = tcp.SetLinger(0)
+	}
+}
+
+// Why a failed write failed, as a reason to close the connection.
+func writeCloseReason(writeError error) CloseReason {
+	if errors.Is(writeError, os.ErrDeadlineExceeded) {
+		return CloseTimeout
+	}
+
+	return CloseFinished
+}
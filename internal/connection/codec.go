@@ -0,0 +1,103 @@
+package connection
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/blanu/radiowave"
+	"io"
+)
+
+// A Codec is how one listener's clients put messages on the wire: how each message is framed on the stream, and how
+// a frame becomes the message it carries and back again. Whatever a codec reads, it decodes to the same messages, so
+// everything past the connection is the same whichever listener a client came in on.
+type Codec interface {
+	// ReadFrame reads the next frame. A frame with a payload longer than limit bytes, if limit isn't zero, is skipped
+	// rather than read, and reported as an oversizedError.
+	ReadFrame(reader io.Reader, limit int) ([]byte, error)
+
+	// Decode turns a frame that ReadFrame read into a message.
+	Decode(frame []byte) (radiowave.Message, error)
+
+	// WriteFrame frames and writes a message.
+	WriteFrame(writer io.Writer, message radiowave.Message) error
+}
+
+// RadiowaveCodec frames messages the way radiowave does, and hands complete frames to the factory. This is how impact
+// has always spoken.
+func RadiowaveCodec(factory radiowave.MessageFactory) Codec {
+	return radiowaveCodec{factory: factory}
+}
+
+type radiowaveCodec struct {
+	factory radiowave.MessageFactory
+}
+
+func (c radiowaveCodec) ReadFrame(reader io.Reader, limit int) ([]byte, error) {
+	return ReadFrame(reader, limit)
+}
+
+func (c radiowaveCodec) Decode(frame []byte) (radiowave.Message, error) {
+	return c.factory.FromBytes(frame)
+}
+
+func (c radiowaveCodec) WriteFrame(writer io.Writer, message radiowave.Message) error {
+	return WriteFrame(writer, message.ToBytes())
+}
+
+// LengthPrefixCodec frames each message with a plain four byte big-endian length, which is easy to speak from any
+// language without a radiowave library. Frames are just the message, so decode is given them without any framing.
+func LengthPrefixCodec(decode func(data []byte) (radiowave.Message, error)) Codec {
+	return lengthPrefixCodec{decode: decode}
+}
+
+type lengthPrefixCodec struct {
+	decode func(data []byte) (radiowave.Message, error)
+}
+
+func (c lengthPrefixCodec) ReadFrame(reader io.Reader, limit int) ([]byte, error) {
+	prefix := make([]byte, 4)
+	_, prefixError := io.ReadFull(reader, prefix)
+	if prefixError != nil {
+		return nil, prefixError
+	}
+
+	length := binary.BigEndian.Uint32(prefix)
+	if length > maximumFrameLength {
+		return nil, errors.New("frame is too long")
+	}
+
+	if limit > 0 && uint64(length) > uint64(limit) {
+		_, discardError := io.CopyN(io.Discard, reader, int64(length))
+		if discardError != nil {
+			return nil, discardError
+		}
+
+		return nil, oversizedError{uint64(length)}
+	}
+
+	frame, frameError := readPayload(reader, uint64(length))
+	if frameError != nil {
+		return nil, frameError
+	}
+
+	return frame, nil
+}
+
+func (c lengthPrefixCodec) Decode(frame []byte) (radiowave.Message, error) {
+	return c.decode(frame)
+}
+
+func (c lengthPrefixCodec) WriteFrame(writer io.Writer, message radiowave.Message) error {
+	body := message.ToBytes()
+	if len(body) > maximumFrameLength {
+		return errors.New("message is too long to frame")
+	}
+
+	frame := make([]byte, 0, 4+len(body))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	frame = append(frame, body...)
+
+	// As with WriteFrame, there are no short writes.
+	_, writeError := writer.Write(frame)
+	return writeError
+}
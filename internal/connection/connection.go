@@ -0,0 +1,252 @@
+package connection
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/blanu/radiowave"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Oversized stands in for a message from the client that was larger than the connection's limit.
+// Its contents were discarded without being read.
+type Oversized struct {
+	Size uint64
+}
+
+func (o Oversized) ToBytes() []byte {
+	return nil
+}
+
+// Conn is a client connection carrying impact messages.
+// It speaks the same framing as radiowave.Conn, but it can be closed from our side without racing its own pumps,
+// and it keeps track of what was negotiated with the client when the connection started.
+type Conn struct {
+	// OutputChannel delivers each message read from the client. It is closed when the connection ends.
+	OutputChannel chan radiowave.Message
+
+	// Version is the protocol version agreed with the client in the handshake.
+	Version uint8
+
+	// Compression is the message.Compression agreed with the client in the handshake. Zero means none.
+	Compression uint8
+
+	// ID names the connection in logs, to the resource, and to anything else that needs to tell connections apart.
+	// It is set when the connection is accepted, and is never empty.
+	ID string
+
+	// Identity is who the client proved itself to be when the connection started, and AuthMethod is how it proved
+	// it. Both are empty if the client didn't have to.
+	Identity   string
+	AuthMethod string
+
+	// The logger for lines about this connection, and how to make it. Most connections never log anything, so it is
+	// only made the first time it is wanted.
+	logger     *log.Logger
+	newLogger  func(*Conn) *log.Logger
+	loggerOnce sync.Once
+
+	// Draining is set once the client has been told that impact is going away. Anything it sends from then on is
+	// turned away, while what it sent before is still answered.
+	Draining atomic.Bool
+
+	codec   Codec
+	network net.Conn
+
+	// The largest message payload accepted from the client, in bytes. Zero means there is no limit.
+	maxMessageSize int
+	// Paces TLS handshakes. Nil means the handshake happens by itself, on the first read.
+	handshakes *HandshakeLimit
+	// How long a write may block. Zero means forever.
+	writeTimeout time.Duration
+	// How long the rest of a message may take once it has started. Zero means forever.
+	messageReadTimeout time.Duration
+	// How the connection ends. Nil means gracefully, with no farewell.
+	closer *Closer
+
+	writeLock sync.Mutex
+	closing   atomic.Bool
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+func newConn(codec Codec, network net.Conn, maxMessageSize int, handshakes *HandshakeLimit, writeTimeout time.Duration, messageReadTimeout time.Duration, closer *Closer) *Conn {
+	conn := &Conn{
+		OutputChannel:  make(chan radiowave.Message),
+		codec:          codec,
+		network:        network,
+		maxMessageSize: maxMessageSize,
+		handshakes:     handshakes,
+		writeTimeout:   writeTimeout,
+		closer:         closer,
+		closed:         make(chan bool),
+
+		messageReadTimeout: messageReadTimeout,
+	}
+
+	go conn.pumpNetwork()
+
+	return conn
+}
+
+// WriteMessage sends a message to the client. It is safe to call from more than one coroutine.
+//
+// A client that stops reading but keeps the connection open would otherwise block the write forever, and with it
+// whoever is waiting to hand us the next message, all the way back to the resource. A write that takes longer than
+// the write timeout fails instead, and ends the connection, since part of a frame may already have gone out and the
+// client could never find the start of the next one.
+func (c *Conn) WriteMessage(message radiowave.Message) error {
+	c.writeLock.Lock()
+	if c.writeTimeout > 0 {
+		_ = c.network.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	writeError := c.codec.WriteFrame(c.network, message)
+	c.writeLock.Unlock()
+
+	if writeError != nil {
+		_ = c.CloseFor(writeCloseReason(writeError))
+	}
+
+	return writeError
+}
+
+// Close ends the connection there and then, however its Closer would have ended it. It is for connections that have
+// already ended at the client's end. It is safe to call more than once, and from any coroutine.
+func (c *Conn) Close() error {
+	closeError := error(nil)
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		closeError = c.network.Close()
+	})
+
+	return closeError
+}
+
+// Done is closed once the connection has ended, whether the client closed it or we did.
+func (c *Conn) Done() <-chan bool {
+	return c.closed
+}
+
+// LogWith says how to make the connection's logger. It has to be called before Logger is, and only once.
+func (c *Conn) LogWith(newLogger func(*Conn) *log.Logger) {
+	c.newLogger = newLogger
+}
+
+// Logger is for lines about this connection, and says which connection they are about. It is nil until LogWith has
+// been called.
+func (c *Conn) Logger() *log.Logger {
+	if c.newLogger == nil {
+		return nil
+	}
+
+	c.loggerOnce.Do(func() { c.logger = c.newLogger(c) })
+	return c.logger
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.network.RemoteAddr()
+}
+
+// VerifiedCertificate is the client's certificate, if it presented one over TLS and the certificate checked out.
+func (c *Conn) VerifiedCertificate() (*x509.Certificate, bool) {
+	tlsConn, isTLS := c.network.(*tls.Conn)
+	if !isTLS {
+		return nil, false
+	}
+
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil, false
+	}
+
+	return chains[0][0], true
+}
+
+// MaxMessageSize is the largest message payload accepted from the client, in bytes. Zero means there is no limit.
+func (c *Conn) MaxMessageSize() int {
+	return c.maxMessageSize
+}
+
+// WriteTimeout is how long a write to the client may block. Zero means forever.
+func (c *Conn) WriteTimeout() time.Duration {
+	return c.writeTimeout
+}
+
+// MessageReadTimeout is how long the client has to send the rest of a message once it has started. Zero means forever.
+func (c *Conn) MessageReadTimeout() time.Duration {
+	return c.messageReadTimeout
+}
+
+func (c *Conn) pumpNetwork() {
+	// We are the only sender on OutputChannel, so we are the one to close it.
+	defer close(c.OutputChannel)
+
+	// A client that can't finish its TLS handshake in time never gets to send anything.
+	if tlsConn, isTLS := c.network.(*tls.Conn); isTLS && c.handshakes != nil {
+		if !c.handshakes.handshake(tlsConn, c.closed) {
+			_ = c.CloseFor(CloseRefused)
+			return
+		}
+	}
+
+	// A frame is read a few bytes at a time, its length and then its payload. Buffering the reads means a small
+	// frame, which usually arrives in one piece, takes one read from the network rather than one for each part.
+	reader := bufio.NewReader(c.network)
+	for {
+		var wave radiowave.Message
+
+		frame, readError := c.readFrame(reader)
+		if oversized, isOversized := readError.(oversizedError); isOversized {
+			wave = Oversized{oversized.size}
+		} else if stalled(readError) {
+			// A client that starts a message and doesn't finish it is stalling, and the connection goes with it.
+			_ = c.CloseFor(CloseProtocol)
+			return
+		} else if readError != nil {
+			_ = c.Close()
+			return
+		} else {
+			// A client that sends something we can't parse has lost track of the protocol, and can't be trusted to
+			// find its way back to a message boundary.
+			var parseError error
+			wave, parseError = c.codec.Decode(frame)
+			if parseError != nil {
+				_ = c.CloseFor(CloseProtocol)
+				return
+			}
+		}
+
+		select {
+		case c.OutputChannel <- wave:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Read the next frame. A client may take as long as it likes to start a message, but under a message read timeout,
+// once the first byte has come, the rest has to follow within the timeout. Otherwise a client could hold a read open
+// for ever, a byte at a time.
+func (c *Conn) readFrame(reader *bufio.Reader) ([]byte, error) {
+	if c.messageReadTimeout > 0 {
+		if _, peekError := reader.Peek(1); peekError != nil {
+			return nil, peekError
+		}
+
+		_ = c.network.SetReadDeadline(time.Now().Add(c.messageReadTimeout))
+		defer func() { _ = c.network.SetReadDeadline(time.Time{}) }()
+	}
+
+	return c.codec.ReadFrame(reader, c.maxMessageSize)
+}
+
+// Whether a read failed because the message read timeout ran out.
+func stalled(readError error) bool {
+	var netError net.Error
+	return errors.As(readError, &netError) && netError.Timeout()
+}
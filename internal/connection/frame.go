@@ -0,0 +1,121 @@
+package connection
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Messages are framed the same way radiowave frames them: a one byte count, then that many bytes of big-endian
+// payload length, then the payload. As with radiowave, the complete frame is what gets handed to the message factory.
+// Resources speak the same framing over their pipes, so this is also how the resource package reads and writes them.
+// No sensible message comes anywhere near this. It keeps a corrupt length from asking the allocator for exabytes.
+const maximumFrameLength = 1 << 30
+
+// A payload up to this long is read straight into a buffer of its size, which is one allocation. Only longer ones, which
+// a corrupt or hostile length could claim, grow their buffer as the payload arrives.
+const eagerPayloadLength = 64 << 10
+
+// A frame whose payload is longer than the limit is skipped over, rather than read, and reported as oversized.
+// The connection stays in step with the client, which can be told its message was too big.
+type oversizedError struct {
+	size uint64
+}
+
+func (e oversizedError) Error() string {
+	return "frame is larger than the limit"
+}
+
+// ReadFrame reads the next complete frame, however many reads it takes to arrive. A frame with a payload longer than
+// limit bytes, if limit isn't zero, is skipped rather than read, and reported as an oversized error.
+func ReadFrame(reader io.Reader, limit int) ([]byte, error) {
+	prefix := make([]byte, 1)
+	_, prefixError := io.ReadFull(reader, prefix)
+	if prefixError != nil {
+		return nil, prefixError
+	}
+
+	varintCount := int(prefix[0])
+	if varintCount > 8 {
+		return nil, errors.New("frame length prefix is longer than 8 bytes")
+	}
+
+	compressedBuffer := make([]byte, varintCount)
+	_, compressedError := io.ReadFull(reader, compressedBuffer)
+	if compressedError != nil {
+		return nil, compressedError
+	}
+
+	uncompressedBuffer := make([]byte, 8)
+	copy(uncompressedBuffer[8-varintCount:], compressedBuffer)
+	payloadCount := binary.BigEndian.Uint64(uncompressedBuffer)
+	if payloadCount > maximumFrameLength {
+		return nil, errors.New("frame is too long")
+	}
+
+	if limit > 0 && payloadCount > uint64(limit) {
+		_, discardError := io.CopyN(io.Discard, reader, int64(payloadCount))
+		if discardError != nil {
+			return nil, discardError
+		}
+
+		return nil, oversizedError{payloadCount}
+	}
+
+	payload, payloadError := readPayload(reader, payloadCount)
+	if payloadError != nil {
+		return nil, payloadError
+	}
+
+	completeMessage := make([]byte, 0, 1+varintCount+len(payload))
+	completeMessage = append(completeMessage, prefix...)
+	completeMessage = append(completeMessage, compressedBuffer...)
+	completeMessage = append(completeMessage, payload...)
+
+	return completeMessage, nil
+}
+
+// Read a payload of the given length. Past eagerPayloadLength, the buffer grows as the payload arrives, rather than
+// being allocated up front, so that a frame claiming to be huge costs only as much memory as the bytes that actually
+// follow it.
+func readPayload(reader io.Reader, length uint64) ([]byte, error) {
+	if length <= eagerPayloadLength {
+		payload := make([]byte, length)
+		_, readError := io.ReadFull(reader, payload)
+		if readError != nil {
+			return nil, readError
+		}
+
+		return payload, nil
+	}
+
+	var payload bytes.Buffer
+	read, readError := io.CopyN(&payload, reader, int64(length))
+	if uint64(read) < length {
+		if readError == io.EOF {
+			readError = io.ErrUnexpectedEOF
+		}
+		return nil, readError
+	}
+
+	return payload.Bytes(), nil
+}
+
+// WriteFrame frames the payload and writes it in one call.
+func WriteFrame(writer io.Writer, payload []byte) error {
+	compressedBuffer := binary.BigEndian.AppendUint64(nil, uint64(len(payload)))
+	for len(compressedBuffer) > 0 && compressedBuffer[0] == 0 {
+		compressedBuffer = compressedBuffer[1:]
+	}
+
+	completeMessage := make([]byte, 0, 1+len(compressedBuffer)+len(payload))
+	completeMessage = append(completeMessage, byte(len(compressedBuffer)))
+	completeMessage = append(completeMessage, compressedBuffer...)
+	completeMessage = append(completeMessage, payload...)
+
+	// Neither net.Conn's nor a pipe's Write returns until everything is written, or there is an error, so there are no
+	// short writes.
+	_, writeError := writer.Write(completeMessage)
+	return writeError
+}
@@ -0,0 +1,88 @@
+package connection
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+)
+
+func FuzzReadFrame(f *testing.F) {
+	for _, payload := range [][]byte{nil, []byte("hello"), bytes.Repeat([]byte("a"), 300)} {
+		var frame bytes.Buffer
+		if writeError := WriteFrame(&frame, payload); writeError != nil {
+			f.Fatal(writeError)
+		}
+		f.Add(frame.Bytes(), 0)
+		f.Add(frame.Bytes(), 16)
+	}
+	f.Add([]byte{9}, 0)
+	f.Add([]byte{8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 0)
+	f.Add([]byte{4, 0x3f, 0xff, 0xff, 0xff, 'x'}, 0)
+
+	f.Fuzz(func(t *testing.T, data []byte, limit int) {
+		reader := bytes.NewReader(data)
+		frame, readError := ReadFrame(reader, limit)
+		if readError != nil {
+			return
+		}
+
+		consumed := len(data) - reader.Len()
+		if !bytes.Equal(frame, data[:consumed]) {
+			t.Fatalf("frame %x isn't the %d bytes it was read from", frame, consumed)
+		}
+
+		payload := frame[1+int(frame[0]):]
+		if limit > 0 && len(payload) > limit {
+			t.Fatalf("read a %d byte payload under a limit of %d", len(payload), limit)
+		}
+
+		var written bytes.Buffer
+		if writeError := WriteFrame(&written, payload); writeError != nil {
+			t.Fatal(writeError)
+		}
+		again, againError := ReadFrame(&written, 0)
+		if againError != nil || !bytes.Equal(again[1+int(again[0]):], payload) {
+			t.Fatalf("payload didn't survive being framed again: %v", againError)
+		}
+	})
+}
+
+// A frame can claim any length up to maximumFrameLength before a byte of it arrives. Reading it must only cost as much
+// memory as the bytes that actually follow.
+func TestReadFrameDoesNotTrustTheLength(t *testing.T) {
+	claimed := []byte{4, 0x3f, 0xff, 0xff, 0xff, 'x', 'y', 'z'}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, readError := ReadFrame(bytes.NewReader(claimed), 0)
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(readError, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v reading a truncated frame, not %v", readError, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("reading a 3 byte payload that claimed to be 1 GiB allocated %d bytes", allocated)
+	}
+}
+
+// An oversized frame is skipped whole, so that the next frame is read from where it starts.
+func TestReadFrameSkipsOversized(t *testing.T) {
+	var stream bytes.Buffer
+	for _, payload := range []string{"far too long", "ok"} {
+		if writeError := WriteFrame(&stream, []byte(payload)); writeError != nil {
+			t.Fatal(writeError)
+		}
+	}
+
+	_, readError := ReadFrame(&stream, 4)
+	if oversized, isOversized := readError.(oversizedError); !isOversized || oversized.size != 12 {
+		t.Fatalf("got %v reading a 12 byte payload under a limit of 4", readError)
+	}
+
+	frame, readError := ReadFrame(&stream, 4)
+	if readError != nil || string(frame[2:]) != "ok" {
+		t.Fatalf("got %q, %v after the oversized frame", frame, readError)
+	}
+}
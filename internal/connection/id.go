@@ -0,0 +1,43 @@
+package connection
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// An IDScheme names each connection as it is accepted. Whatever the scheme, no two open connections share an id.
+type IDScheme func(remote net.Addr) string
+
+// CounterIDs numbers connections in the order they are accepted, starting from 1. The ids are short and easy to
+// follow through the logs, but they start again from 1 every time the server starts.
+func CounterIDs() IDScheme {
+	var count atomic.Uint64
+	return func(_ net.Addr) string {
+		return strconv.FormatUint(count.Add(1), 10)
+	}
+}
+
+// RandomIDs gives every connection a random UUID, so that ids are unique across restarts and across servers.
+func RandomIDs() IDScheme {
+	return func(_ net.Addr) string {
+		var uuid [16]byte
+		_, _ = rand.Read(uuid[:])
+
+		// Version 4, variant 1.
+		uuid[6] = uuid[6]&0x0f | 0x40
+		uuid[8] = uuid[8]&0x3f | 0x80
+
+		return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+	}
+}
+
+// AddressIDs names each connection by the client's address and port. An open connection is the only one with its
+// address, and the id says where the client is, but a later connection can reuse the same address.
+func AddressIDs() IDScheme {
+	return func(remote net.Addr) string {
+		return remote.String()
+	}
+}
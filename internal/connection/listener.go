@@ -0,0 +1,117 @@
+package connection
+
+import (
+	"crypto/tls"
+	"github.com/blanu/radiowave"
+	"net"
+	"time"
+)
+
+type Listener struct {
+	// MaxMessageSize is the largest message payload accepted on new connections, in bytes. Zero means no limit.
+	MaxMessageSize int
+
+	// IDs names new connections. By default, they are numbered in the order they are accepted.
+	IDs IDScheme
+
+	// Handshakes paces the TLS handshakes of new connections. By default, there is no limit.
+	Handshakes *HandshakeLimit
+
+	// WriteTimeout is how long a write to a client may block before the connection is given up on. Zero means forever.
+	WriteTimeout time.Duration
+
+	// MessageReadTimeout is how long a client has to send the rest of a message once its first byte has arrived.
+	// Zero means forever.
+	MessageReadTimeout time.Duration
+
+	// Closer decides how new connections end. By default, they are closed gracefully with no farewell.
+	Closer *Closer
+
+	// Codec is how new connections' messages are framed and decoded. By default, it is radiowave's framing, with the
+	// factory the listener was made with.
+	Codec Codec
+
+	// Admit decides whether each connection the network accepts is within the rate at which connections are let in.
+	// One that isn't is closed there and then for CloseRateLimited, before its TLS handshake or anything else that costs
+	// us, and Accept goes on to the next. By default, every connection is let in.
+	Admit func(remote net.Addr) bool
+
+	network net.Listener
+}
+
+func Listen(factory radiowave.MessageFactory, address string) (*Listener, error) {
+	network, listenError := net.Listen("tcp", address)
+	if listenError != nil {
+		return nil, listenError
+	}
+
+	return &Listener{IDs: CounterIDs(), Codec: RadiowaveCodec(factory), network: network}, nil
+}
+
+// ListenUnix is like Listen, but on a Unix domain socket at the given path.
+func ListenUnix(factory radiowave.MessageFactory, path string) (*Listener, error) {
+	network, listenError := net.Listen("unix", path)
+	if listenError != nil {
+		return nil, listenError
+	}
+
+	return &Listener{IDs: CounterIDs(), Codec: RadiowaveCodec(factory), network: network}, nil
+}
+
+func (l *Listener) Accept() (*Conn, error) {
+	network, acceptError := l.network.Accept()
+	for acceptError == nil && l.Admit != nil && !l.Admit(network.RemoteAddr()) {
+		l.refuse(network)
+		network, acceptError = l.network.Accept()
+	}
+	if acceptError != nil {
+		return nil, acceptError
+	}
+
+	conn := newConn(l.Codec, network, l.MaxMessageSize, l.Handshakes, l.WriteTimeout, l.MessageReadTimeout, l.Closer)
+	conn.ID = l.IDs(network.RemoteAddr())
+
+	return conn, nil
+}
+
+// A refused connection's farewell fits in its empty send buffer, so it should never block. If it somehow does, the
+// connections behind it aren't held up for long.
+const refusalWriteTimeout = 100 * time.Millisecond
+
+// Close a connection that wasn't let in, as the Closer says. Gracefully, it is sent its farewell, unless it would first
+// need a TLS handshake, which is what refusing it was meant to save. Nothing else has been written to it, and it has no
+// reader to wait for, so there is no lingering either way.
+func (l *Listener) refuse(network net.Conn) {
+	defer network.Close()
+
+	conn := &Conn{codec: l.Codec, network: network, closer: l.Closer, closed: make(chan bool)}
+	if l.Closer == nil {
+		return
+	}
+	if l.Closer.resets[CloseRateLimited] {
+		conn.reset()
+		return
+	}
+	if _, isTLS := network.(*tls.Conn); isTLS || l.Closer.Farewell == nil {
+		return
+	}
+
+	if farewell := l.Closer.Farewell(conn, CloseRateLimited); farewell != nil {
+		_ = network.SetWriteDeadline(time.Now().Add(refusalWriteTimeout))
+		_ = l.Codec.WriteFrame(network, farewell)
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.network.Close()
+}
+
+// ListenTLS is like Listen, but every connection must speak TLS using the given configuration.
+func ListenTLS(factory radiowave.MessageFactory, address string, config *tls.Config) (*Listener, error) {
+	network, listenError := tls.Listen("tcp", address, config)
+	if listenError != nil {
+		return nil, listenError
+	}
+
+	return &Listener{IDs: CounterIDs(), Codec: RadiowaveCodec(factory), network: network}, nil
+}
@@ -0,0 +1,80 @@
+package connection
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+)
+
+// HandshakeLimit caps how many TLS handshakes are in progress at once. Handshakes cost far more CPU than anything a
+// client can do before it has one, so a burst of new connections could otherwise use up the CPU before any of them
+// has got as far as authenticating. Connections beyond the limit wait their turn, for as long as a handshake is allowed
+// to take, and are closed if their turn doesn't come.
+type HandshakeLimit struct {
+	// One token per handshake allowed at once. Nil means there is no limit.
+	slots chan struct{}
+	// How long a connection may wait for its turn, and then how long its handshake may take.
+	timeout time.Duration
+
+	inProgress atomic.Int64
+	waiting    atomic.Int64
+}
+
+// NewHandshakeLimit allows limit handshakes at once, or any number if limit is zero. Each connection has timeout to
+// start its handshake and timeout again to finish it. A zero timeout means connections may take as long as they like.
+func NewHandshakeLimit(limit int, timeout time.Duration) *HandshakeLimit {
+	handshakes := &HandshakeLimit{timeout: timeout}
+	if limit > 0 {
+		handshakes.slots = make(chan struct{}, limit)
+	}
+
+	return handshakes
+}
+
+// InProgress is how many handshakes are under way right now.
+func (h *HandshakeLimit) InProgress() int64 {
+	return h.inProgress.Load()
+}
+
+// Waiting is how many connections are waiting for their turn to handshake.
+func (h *HandshakeLimit) Waiting() int64 {
+	return h.waiting.Load()
+}
+
+// Handshake with the client, once there is room. Report whether the handshake succeeded.
+func (h *HandshakeLimit) handshake(tlsConn *tls.Conn, closed chan bool) bool {
+	ctx := context.Background()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	if h.slots != nil {
+		h.waiting.Add(1)
+		select {
+		case h.slots <- struct{}{}:
+			h.waiting.Add(-1)
+			defer func() { <-h.slots }()
+		case <-ctx.Done():
+			h.waiting.Add(-1)
+			return false
+		case <-closed:
+			h.waiting.Add(-1)
+			return false
+		}
+
+		// The wait used up some of the timeout, but the handshake gets the whole of it.
+		if h.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.Background(), h.timeout)
+			defer cancel()
+		}
+	}
+
+	h.inProgress.Add(1)
+	defer h.inProgress.Add(-1)
+
+	return tlsConn.HandshakeContext(ctx) == nil
+}
@@ -0,0 +1,111 @@
+package message
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// Compression is an algorithm for compressing payloads. A client offers the ones it can use in its hello, and the
+// welcome says which one was chosen, if any. After that, either side may compress the payload of any message, and
+// marks the ones it does with the Compressed flag.
+type Compression uint8
+
+const (
+	Deflate Compression = 1
+	Gzip    Compression = 2
+)
+
+// The algorithms we speak, best first.
+var supportedCompression = []Compression{Deflate, Gzip}
+
+func (c Compression) String() string {
+	switch c {
+	case Deflate:
+		return "deflate"
+	case Gzip:
+		return "gzip"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseCompression(name string) (Compression, bool) {
+	for _, algorithm := range supportedCompression {
+		if algorithm.String() == name {
+			return algorithm, true
+		}
+	}
+
+	return 0, false
+}
+
+// NegotiateCompression picks the first of our preferred algorithms that the client also offered, if there is one.
+func NegotiateCompression(preferred []Compression, offered []Compression) (Compression, bool) {
+	for _, algorithm := range preferred {
+		for _, offer := range offered {
+			if offer == algorithm {
+				return algorithm, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func Compress(algorithm Compression, payload []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	var writer io.WriteCloser
+	switch algorithm {
+	case Deflate:
+		deflater, deflateError := flate.NewWriter(&buffer, flate.DefaultCompression)
+		if deflateError != nil {
+			return nil, deflateError
+		}
+		writer = deflater
+	case Gzip:
+		writer = gzip.NewWriter(&buffer)
+	default:
+		return nil, errors.New("unknown compression algorithm")
+	}
+
+	if _, writeError := writer.Write(payload); writeError != nil {
+		return nil, writeError
+	}
+	if closeError := writer.Close(); closeError != nil {
+		return nil, closeError
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Decompress a payload, refusing to produce more than limit bytes, so that a small message can't expand to fill memory.
+func Decompress(algorithm Compression, payload []byte, limit int) ([]byte, error) {
+	var reader io.ReadCloser
+	switch algorithm {
+	case Deflate:
+		reader = flate.NewReader(bytes.NewReader(payload))
+	case Gzip:
+		gunzipper, gzipError := gzip.NewReader(bytes.NewReader(payload))
+		if gzipError != nil {
+			return nil, gzipError
+		}
+		reader = gunzipper
+	default:
+		return nil, errors.New("unknown compression algorithm")
+	}
+	defer reader.Close()
+
+	decompressed, readError := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if readError != nil {
+		return nil, readError
+	}
+	if len(decompressed) > limit {
+		return nil, errors.New("decompressed payload is larger than allowed")
+	}
+
+	return decompressed, nil
+}
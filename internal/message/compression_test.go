@@ -0,0 +1,41 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The limit the fuzzer decompresses under. Small enough that a payload which expands past it is easy to find.
+const fuzzDecompressLimit = 4096
+
+func FuzzDecompress(f *testing.F) {
+	for _, algorithm := range supportedCompression {
+		for _, payload := range [][]byte{nil, []byte("hello"), bytes.Repeat([]byte("a"), 2*fuzzDecompressLimit)} {
+			compressed, compressError := Compress(algorithm, payload)
+			if compressError != nil {
+				f.Fatal(compressError)
+			}
+			f.Add(uint8(algorithm), compressed)
+		}
+	}
+	f.Add(uint8(0), []byte("hello"))
+
+	f.Fuzz(func(t *testing.T, algorithm uint8, payload []byte) {
+		decompressed, decompressError := Decompress(Compression(algorithm), payload, fuzzDecompressLimit)
+		if decompressError != nil {
+			return
+		}
+		if len(decompressed) > fuzzDecompressLimit {
+			t.Fatalf("decompressed %d bytes, past the limit of %d", len(decompressed), fuzzDecompressLimit)
+		}
+
+		compressed, compressError := Compress(Compression(algorithm), decompressed)
+		if compressError != nil {
+			t.Fatalf("decompressed payload doesn't compress again: %v", compressError)
+		}
+		again, againError := Decompress(Compression(algorithm), compressed, fuzzDecompressLimit)
+		if againError != nil || !bytes.Equal(again, decompressed) {
+			t.Fatalf("payload didn't survive compressing again: %v", againError)
+		}
+	})
+}
@@ -1,3 +0,0 @@
-module message
-
-go 1.21
@@ -0,0 +1,39 @@
+package message
+
+import "errors"
+
+// A hello's payload is the oldest and newest protocol versions the client speaks, one byte each.
+func NewHello(minimum uint8, maximum uint8) ImpactMessage {
+	return ImpactMessage{Header: NewHeader(Hello), Payload: []byte{minimum, maximum}}
+}
+
+func DecodeHello(hello ImpactMessage) (uint8, uint8, error) {
+	if len(hello.Payload) != 2 {
+		return 0, 0, errors.New("hello must have exactly 2 bytes of payload")
+	}
+
+	minimum, maximum := hello.Payload[0], hello.Payload[1]
+	if minimum > maximum {
+		return 0, 0, errors.New("hello has a minimum version newer than its maximum")
+	}
+
+	return minimum, maximum, nil
+}
+
+// A welcome's payload is the protocol version chosen for the connection, in one byte.
+func NewWelcome(version uint8) ImpactMessage {
+	header := NewHeader(Welcome)
+	header.Version = version
+
+	return ImpactMessage{Header: header, Payload: []byte{version}}
+}
+
+// NegotiateVersion picks the newest protocol version spoken by both the client and us, if there is one.
+func NegotiateVersion(minimum uint8, maximum uint8) (uint8, bool) {
+	newest := min(maximum, Version)
+	if newest < max(minimum, MinimumVersion) {
+		return 0, false
+	}
+
+	return newest, true
+}
@@ -0,0 +1,28 @@
+package message
+
+import "testing"
+
+func FuzzDecodeHello(f *testing.F) {
+	f.Add(NewHello(MinimumVersion, Version).ToBytes())
+	f.Add(NewHello(Version, MinimumVersion).ToBytes())
+	f.Add(ImpactMessage{Header: NewHeader(Hello)}.ToBytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hello, decodeError := Decode(data)
+		if decodeError != nil {
+			return
+		}
+
+		minimum, maximum, helloError := DecodeHello(hello)
+		if helloError != nil {
+			return
+		}
+		if minimum > maximum {
+			t.Fatalf("hello decoded with minimum %d above maximum %d", minimum, maximum)
+		}
+
+		if version, ok := NegotiateVersion(minimum, maximum); ok && (version < minimum || version > maximum) {
+			t.Fatalf("negotiated version %d outside the hello's %d to %d", version, minimum, maximum)
+		}
+	})
+}
@@ -0,0 +1,402 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Every impact message starts with a fixed header, followed by optional extension fields, followed by the payload.
+//
+//	offset  size  field
+//	0       2     magic, "IM"
+//	2       1     protocol version
+//	3       1     message type
+//	4       2     flags
+//	6       2     length of the extension fields
+//	8       4     length of the payload
+//	12      8     correlation id
+//
+// Extension fields carry per-message settings that most messages don't need. Each one is a one byte tag, a one byte
+// length, and that many bytes of value. Unknown tags are skipped, so new extensions don't break older peers.
+const (
+	Magic        uint16 = 0x494D
+	HeaderLength        = 20
+
+	// Version is the newest protocol version we speak, and MinimumVersion the oldest.
+	Version        uint8 = 1
+	MinimumVersion uint8 = 1
+)
+
+type MessageType uint8
+
+const (
+	// Request is sent by a client for the resource to handle.
+	Request MessageType = 1
+	// Reply is the resource's answer to a request.
+	Reply MessageType = 2
+	// Error is sent by impact instead of a reply when a request could not be served.
+	Error MessageType = 3
+	// Hello is the first message from a client, announcing the range of protocol versions it speaks.
+	Hello MessageType = 4
+	// Welcome is impact's answer to a hello, giving the protocol version chosen for the connection.
+	Welcome MessageType = 5
+	// GoingAway tells a client that impact is shutting down, so it should finish up and reconnect elsewhere. With a
+	// CloseCode, it is instead the last message on a connection that impact is closing, and says why.
+	GoingAway MessageType = 6
+	// Push is sent by the resource whenever it likes, not in answer to a request. Impact passes it on to the connection
+	// named by its ConnectionID, or to every connection if it doesn't name one. Clients get pushes mixed in with
+	// their replies, and tell them apart by type.
+	Push MessageType = 7
+	// Queued acknowledges that a request has been queued for the resource, when impact is asked to say so, and gives
+	// the request's QueuePosition. The reply follows later as usual.
+	Queued MessageType = 8
+	// Credit grants a client more requests under flow control. Its Credits says how many more it may send.
+	Credit MessageType = 9
+	// Limits asks impact what limits apply to the connection it is sent on. Impact answers with a Limits message with
+	// the same CorrelationID, whose payload is the limits as a JSON object.
+	Limits MessageType = 10
+)
+
+// Flags are bits that modify how a message is handled.
+type Flags uint16
+
+const (
+	// More marks a reply that is one chunk of a larger reply, with more chunks to follow. The last chunk doesn't
+	// have this flag, so a reply that fits in one message is simply a reply without it.
+	More Flags = 1 << 0
+	// Compressed marks a message whose payload is compressed with the algorithm agreed in the handshake.
+	Compressed Flags = 1 << 1
+	// Resumed marks a welcome to a client that resumed its earlier session, rather than starting a new one.
+	Resumed Flags = 1 << 2
+)
+
+// Extension tags.
+const (
+	costTag           uint8 = 1
+	priorityTag       uint8 = 2
+	idempotencyKeyTag uint8 = 3
+	connectionIDTag   uint8 = 4
+	tokenTag          uint8 = 5
+	compressionTag    uint8 = 6
+	retryAfterTag     uint8 = 7
+	queuePositionTag  uint8 = 8
+	deadlineTag       uint8 = 9
+	maxMessageSizeTag uint8 = 10
+	timeoutTag        uint8 = 11
+	resourceTag       uint8 = 12
+	statusTag         uint8 = 13
+	creditsTag        uint8 = 14
+	traceTag          uint8 = 15
+	resumeTag         uint8 = 16
+	closeCodeTag      uint8 = 17
+	tagTag            uint8 = 18
+)
+
+type Header struct {
+	Version uint8
+	Type    MessageType
+	Flags   Flags
+
+	// CorrelationID is chosen by the client and copied onto whatever is sent back in answer, so that the client
+	// can tell which request a reply belongs to.
+	CorrelationID uint64
+
+	// Cost is the client's estimate of how expensive a request is for the resource, used by the cost scheduler.
+	// Zero means no estimate, and is not sent.
+	Cost uint32
+
+	// Priority says how urgent a request is, higher being more urgent. Zero is the default, and is not sent.
+	Priority uint8
+
+	// IdempotencyKey is chosen by the client, and is the same on every retry of one request, so that a retry can be
+	// answered with the reply to an earlier attempt instead of being run again. Empty means every attempt is run.
+	// Like every extension, it can be at most 255 bytes long.
+	IdempotencyKey string
+
+	// ConnectionID is only used between impact and the resource. Impact sets it on every request it passes on, to say
+	// which client connection the request came from, and the resource sets it on a push to say where it should go.
+	// Empty means no connection in particular. It can be at most 255 bytes long.
+	ConnectionID string
+
+	// Token is sent by a client in its hello, to prove who it is when impact asks for tokens. Empty means no token.
+	Token string
+
+	// Compression is sent in a hello as the compression algorithms the client can use, and in a welcome as the one
+	// chosen, if any. Empty means no compression.
+	Compression []Compression
+
+	// RetryAfter is sent on an error, in milliseconds, when impact knows how long the client should wait before trying
+	// again. Zero means no hint, and is not sent.
+	RetryAfter uint32
+
+	// QueuePosition is sent on a queued acknowledgement, as the number of requests that will be served before this
+	// one, as far as impact can tell when it is queued. Zero means it is next, and is not sent.
+	QueuePosition uint32
+
+	// Deadline is sent on a request as how long, in milliseconds from when impact receives it, the client is willing
+	// to wait for its reply. A request still queued at its deadline is answered with an error instead of being run.
+	// Zero means no deadline, and is not sent.
+	Deadline uint32
+
+	// MaxMessageSize is sent on a welcome as the largest message, in bytes including its header, that impact will
+	// accept from the client on the connection. Zero means there is no limit, and is not sent.
+	MaxMessageSize uint32
+
+	// Timeout is sent on a request as how long, in milliseconds from when the resource is sent it, the resource has
+	// to reply. Impact holds it to the server's maximum. Zero means the server's default, and is not sent.
+	Timeout uint32
+
+	// Resource is sent on a request to name the resource it is for, out of those impact serves by name. Empty means
+	// whichever resource impact would choose by itself. It can be at most 255 bytes long.
+	Resource string
+
+	// Status is set by the resource on a reply, to say how the request went as far as the resource is concerned. What
+	// the numbers mean is up to the resource. Impact counts them, and passes them on to the client. Zero means no
+	// status, and is not sent.
+	Status uint16
+
+	// Credits is sent under flow control, on a welcome as how many requests the client may have unanswered at once,
+	// and on a credit message as how many more it may send. Zero means no flow control on a welcome, and is not sent.
+	Credits uint32
+
+	// Trace is sent on a request by a client that traces its requests, as the trace id of the one it is part of, which
+	// impact passes on to the resource and links the request's latency to. Empty means no trace id.
+	Trace string
+
+	// Resume is sent when sessions can be resumed, on a welcome as the token with which the client can resume its
+	// session on a later connection, and on a hello as the token from the welcome of an earlier one. Empty means a new
+	// session.
+	Resume string
+
+	// CloseCode is sent on a going away message that is the last message on its connection, to say why impact is
+	// closing the connection. Zero means the connection isn't being closed yet, as when impact warns that it is
+	// starting to shut down, and is not sent.
+	CloseCode CloseCode
+
+	// Tag is set by impact on a request it passes on, if asked to, to the tag it logs the request under, so that the
+	// resource can log it too and the two logs can be matched up. Empty means no tag.
+	Tag string
+}
+
+func NewHeader(messageType MessageType) Header {
+	return Header{Version: Version, Type: messageType}
+}
+
+func (h Header) encode(payloadLength int) []byte {
+	extensions := make([]byte, 0)
+	if h.Cost != 0 {
+		extensions = appendExtension(extensions, costTag, binary.BigEndian.AppendUint32(nil, h.Cost))
+	}
+	if h.Priority != 0 {
+		extensions = appendExtension(extensions, priorityTag, []byte{h.Priority})
+	}
+	if h.IdempotencyKey != "" {
+		extensions = appendExtension(extensions, idempotencyKeyTag, []byte(h.IdempotencyKey))
+	}
+	if h.ConnectionID != "" {
+		extensions = appendExtension(extensions, connectionIDTag, []byte(h.ConnectionID))
+	}
+	if h.Token != "" {
+		extensions = appendExtension(extensions, tokenTag, []byte(h.Token))
+	}
+	if len(h.Compression) != 0 {
+		algorithms := make([]byte, len(h.Compression))
+		for index, algorithm := range h.Compression {
+			algorithms[index] = byte(algorithm)
+		}
+		extensions = appendExtension(extensions, compressionTag, algorithms)
+	}
+	if h.RetryAfter != 0 {
+		extensions = appendExtension(extensions, retryAfterTag, binary.BigEndian.AppendUint32(nil, h.RetryAfter))
+	}
+	if h.QueuePosition != 0 {
+		extensions = appendExtension(extensions, queuePositionTag, binary.BigEndian.AppendUint32(nil, h.QueuePosition))
+	}
+	if h.Deadline != 0 {
+		extensions = appendExtension(extensions, deadlineTag, binary.BigEndian.AppendUint32(nil, h.Deadline))
+	}
+	if h.MaxMessageSize != 0 {
+		extensions = appendExtension(extensions, maxMessageSizeTag, binary.BigEndian.AppendUint32(nil, h.MaxMessageSize))
+	}
+	if h.Timeout != 0 {
+		extensions = appendExtension(extensions, timeoutTag, binary.BigEndian.AppendUint32(nil, h.Timeout))
+	}
+	if h.Resource != "" {
+		extensions = appendExtension(extensions, resourceTag, []byte(h.Resource))
+	}
+	if h.Status != 0 {
+		extensions = appendExtension(extensions, statusTag, binary.BigEndian.AppendUint16(nil, h.Status))
+	}
+	if h.Credits != 0 {
+		extensions = appendExtension(extensions, creditsTag, binary.BigEndian.AppendUint32(nil, h.Credits))
+	}
+	if h.Trace != "" {
+		extensions = appendExtension(extensions, traceTag, []byte(h.Trace))
+	}
+	if h.Resume != "" {
+		extensions = appendExtension(extensions, resumeTag, []byte(h.Resume))
+	}
+	if h.CloseCode != 0 {
+		extensions = appendExtension(extensions, closeCodeTag, []byte{byte(h.CloseCode)})
+	}
+	if h.Tag != "" {
+		extensions = appendExtension(extensions, tagTag, []byte(h.Tag))
+	}
+
+	header := make([]byte, HeaderLength, HeaderLength+len(extensions)+payloadLength)
+	binary.BigEndian.PutUint16(header[0:2], Magic)
+	header[2] = h.Version
+	header[3] = byte(h.Type)
+	binary.BigEndian.PutUint16(header[4:6], uint16(h.Flags))
+	binary.BigEndian.PutUint16(header[6:8], uint16(len(extensions)))
+	binary.BigEndian.PutUint32(header[8:12], uint32(payloadLength))
+	binary.BigEndian.PutUint64(header[12:20], h.CorrelationID)
+
+	return append(header, extensions...)
+}
+
+// Parse the header from the front of a message, returning it along with the payload that follows it.
+func decodeHeader(data []byte) (Header, []byte, error) {
+	if len(data) < HeaderLength {
+		return Header{}, nil, errors.New("message is shorter than the impact header")
+	}
+
+	if binary.BigEndian.Uint16(data[0:2]) != Magic {
+		return Header{}, nil, errors.New("message does not start with the impact magic number")
+	}
+
+	header := Header{
+		Version:       data[2],
+		Type:          MessageType(data[3]),
+		Flags:         Flags(binary.BigEndian.Uint16(data[4:6])),
+		CorrelationID: binary.BigEndian.Uint64(data[12:20]),
+	}
+	if header.Version == 0 {
+		return Header{}, nil, errors.New("message has no protocol version")
+	}
+
+	extensionsLength := int(binary.BigEndian.Uint16(data[6:8]))
+	payloadLength := int(binary.BigEndian.Uint32(data[8:12]))
+	if len(data) != HeaderLength+extensionsLength+payloadLength {
+		return Header{}, nil, errors.New("message length does not match its header")
+	}
+
+	extensionsError := header.decodeExtensions(data[HeaderLength : HeaderLength+extensionsLength])
+	if extensionsError != nil {
+		return Header{}, nil, extensionsError
+	}
+
+	return header, data[HeaderLength+extensionsLength:], nil
+}
+
+func (h *Header) decodeExtensions(extensions []byte) error {
+	for len(extensions) > 0 {
+		if len(extensions) < 2 {
+			return errors.New("extension field is truncated")
+		}
+
+		tag := extensions[0]
+		length := int(extensions[1])
+		if len(extensions) < 2+length {
+			return errors.New("extension field is longer than the extensions")
+		}
+		value := extensions[2 : 2+length]
+		extensions = extensions[2+length:]
+
+		switch tag {
+		case costTag:
+			if length != 4 {
+				return errors.New("cost extension must be 4 bytes")
+			}
+			h.Cost = binary.BigEndian.Uint32(value)
+
+		case priorityTag:
+			if length != 1 {
+				return errors.New("priority extension must be 1 byte")
+			}
+			h.Priority = value[0]
+
+		case idempotencyKeyTag:
+			h.IdempotencyKey = string(value)
+
+		case connectionIDTag:
+			h.ConnectionID = string(value)
+
+		case tokenTag:
+			h.Token = string(value)
+
+		case compressionTag:
+			h.Compression = make([]Compression, len(value))
+			for index, algorithm := range value {
+				h.Compression[index] = Compression(algorithm)
+			}
+
+		case retryAfterTag:
+			if length != 4 {
+				return errors.New("retry after extension must be 4 bytes")
+			}
+			h.RetryAfter = binary.BigEndian.Uint32(value)
+
+		case queuePositionTag:
+			if length != 4 {
+				return errors.New("queue position extension must be 4 bytes")
+			}
+			h.QueuePosition = binary.BigEndian.Uint32(value)
+
+		case deadlineTag:
+			if length != 4 {
+				return errors.New("deadline extension must be 4 bytes")
+			}
+			h.Deadline = binary.BigEndian.Uint32(value)
+
+		case maxMessageSizeTag:
+			if length != 4 {
+				return errors.New("max message size extension must be 4 bytes")
+			}
+			h.MaxMessageSize = binary.BigEndian.Uint32(value)
+
+		case timeoutTag:
+			if length != 4 {
+				return errors.New("timeout extension must be 4 bytes")
+			}
+			h.Timeout = binary.BigEndian.Uint32(value)
+
+		case resourceTag:
+			h.Resource = string(value)
+
+		case statusTag:
+			if length != 2 {
+				return errors.New("status extension must be 2 bytes")
+			}
+			h.Status = binary.BigEndian.Uint16(value)
+
+		case creditsTag:
+			if length != 4 {
+				return errors.New("credits extension must be 4 bytes")
+			}
+			h.Credits = binary.BigEndian.Uint32(value)
+
+		case traceTag:
+			h.Trace = string(value)
+
+		case resumeTag:
+			h.Resume = string(value)
+
+		case closeCodeTag:
+			if length != 1 {
+				return errors.New("close code extension must be 1 byte")
+			}
+			h.CloseCode = CloseCode(value[0])
+
+		case tagTag:
+			h.Tag = string(value)
+		}
+	}
+
+	return nil
+}
+
+func appendExtension(extensions []byte, tag uint8, value []byte) []byte {
+	extensions = append(extensions, tag, byte(len(value)))
+	return append(extensions, value...)
+}
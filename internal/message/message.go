@@ -1,13 +1,26 @@
 package message
 
-import "github.com/blanu/radiowave"
+import (
+	"errors"
+	"github.com/blanu/radiowave"
+	"math"
+	"time"
+)
 
+// ImpactMessage is a request or reply: an impact header followed by an opaque payload for the resource.
 type ImpactMessage struct {
+	Header  Header
 	Payload []byte
 }
 
 func (m ImpactMessage) ToBytes() []byte {
-	return m.Payload
+	return append(m.Header.encode(len(m.Payload)), m.Payload...)
+}
+
+// HasMore says whether a message is a reply chunk with more chunks of the same reply to follow.
+func HasMore(wave radiowave.Message) bool {
+	impactMessage, ok := wave.(ImpactMessage)
+	return ok && impactMessage.Header.Flags&More != 0
 }
 
 type ImpactMessageFactory struct {
@@ -18,5 +31,207 @@ func NewImpactMessageFactory() ImpactMessageFactory {
 }
 
 func (f ImpactMessageFactory) FromBytes(data []byte) (radiowave.Message, error) {
-	return ImpactMessage{data}, nil
+	body, unframeError := unframe(data)
+	if unframeError != nil {
+		return nil, unframeError
+	}
+
+	return Decode(body)
+}
+
+// Decode parses a message that isn't framed, such as one that arrived in a datagram, whose length is already known.
+func Decode(data []byte) (ImpactMessage, error) {
+	header, payload, headerError := decodeHeader(data)
+	if headerError != nil {
+		return ImpactMessage{}, headerError
+	}
+
+	return ImpactMessage{Header: header, Payload: payload}, nil
+}
+
+// A going away message's payload is a human-readable reason.
+func NewGoingAway(version uint8, reason string) ImpactMessage {
+	header := NewHeader(GoingAway)
+	header.Version = version
+
+	return ImpactMessage{Header: header, Payload: []byte(reason)}
+}
+
+// NewClosing is the last message on a connection impact is closing, saying why, in the code and in a human-readable
+// reason.
+func NewClosing(version uint8, code CloseCode, reason string) ImpactMessage {
+	message := NewGoingAway(version, reason)
+	message.Header.CloseCode = code
+
+	return message
+}
+
+// NewQueued acknowledges a queued request, with how many requests are ahead of it.
+func NewQueued(version uint8, correlationID uint64, position int) ImpactMessage {
+	header := NewHeader(Queued)
+	header.Version = version
+	header.CorrelationID = correlationID
+	header.QueuePosition = uint32(min(uint64(max(position, 0)), math.MaxUint32))
+
+	return ImpactMessage{Header: header}
+}
+
+// NewCredit grants a client under flow control that many more requests.
+func NewCredit(version uint8, credits uint32) ImpactMessage {
+	header := NewHeader(Credit)
+	header.Version = version
+	header.Credits = credits
+
+	return ImpactMessage{Header: header}
+}
+
+// NewLimits answers a client's question about the limits on its connection, with the limits as JSON.
+func NewLimits(version uint8, correlationID uint64, limits []byte) ImpactMessage {
+	header := NewHeader(Limits)
+	header.Version = version
+	header.CorrelationID = correlationID
+
+	return ImpactMessage{Header: header, Payload: limits}
+}
+
+// radiowave gives us the complete frame, including its varint length prefix. The prefix has to come off here,
+// or it is framed a second time when the message is written on to the resource or back to the client.
+func unframe(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errors.New("frame is missing its length prefix")
+	}
+
+	prefixLength := 1 + int(data[0])
+	if len(data) < prefixLength {
+		return nil, errors.New("frame is shorter than its length prefix")
+	}
+
+	return data[prefixLength:], nil
+}
+
+// ErrorCode says why impact could not get a reply from the resource.
+type ErrorCode byte
+
+const (
+	// ResourceRestarted means the resource was restarted while it was handling the request.
+	ResourceRestarted ErrorCode = 1
+	// UnexpectedMessage means impact was sent a message type that it does not accept from clients.
+	UnexpectedMessage ErrorCode = 2
+	// UnsupportedVersion means the client and impact have no protocol version in common.
+	UnsupportedVersion ErrorCode = 3
+	// AtCapacity means impact already has as many requests in flight as it is allowed, so this one was not queued.
+	AtCapacity ErrorCode = 4
+	// UnknownMessageType means impact has nowhere to send a message of this type.
+	UnknownMessageType ErrorCode = 5
+	// MessageTooLarge means the client sent a message bigger than impact allows. It was discarded unread.
+	MessageTooLarge ErrorCode = 6
+	// ReplyTooLarge means the resource's reply was bigger than impact allows. Whatever was already sent of a chunked
+	// reply should be thrown away.
+	ReplyTooLarge ErrorCode = 7
+	// Overloaded means the resource is responding slowly, so impact turned the request away. Try again later.
+	Overloaded ErrorCode = 8
+	// ResourceStopped means the resource has stopped for good, because the server is shutting down.
+	ResourceStopped ErrorCode = 9
+	// Unauthenticated means the client couldn't prove who it is in any of the ways impact accepts.
+	Unauthenticated ErrorCode = 10
+	// NotJournaled means impact couldn't record the request in its journal, so it didn't send it to the resource.
+	NotJournaled ErrorCode = 11
+	// CorruptPayload means a compressed payload from the client couldn't be decompressed. Impact closes the connection,
+	// since it can no longer trust anything the client sends.
+	CorruptPayload ErrorCode = 12
+	// RateLimited means the client, or all clients together, sent requests faster than impact allows. The error says
+	// how long to wait before the next request will be accepted.
+	RateLimited ErrorCode = 13
+	// DeadlineExceeded means the request's deadline passed while it was still queued, so it was never run.
+	DeadlineExceeded ErrorCode = 14
+	// TimedOut means the resource didn't reply within the request's timeout. The resource may still finish the
+	// request, but its reply is thrown away.
+	TimedOut ErrorCode = 15
+	// UnknownResource means the request named a resource that impact doesn't serve.
+	UnknownResource ErrorCode = 16
+	// ResourceFailed means the resource answered with a status that impact was told to pass on as an error. The
+	// description gives the status, and the resource's reply is thrown away.
+	ResourceFailed ErrorCode = 17
+	// NoCredit means a client under flow control sent a request when it had no credit left. The request wasn't run.
+	NoCredit ErrorCode = 18
+	// LifetimeExceeded means the request was in impact for longer than the server allows, all told, so impact gave up
+	// on it, wherever it had got to. Whatever was already sent of a chunked reply should be thrown away.
+	LifetimeExceeded ErrorCode = 19
+	// ShuttingDown means impact is draining before it shuts down, and didn't take the request. The request was never
+	// run, so it is safe to send elsewhere.
+	ShuttingDown ErrorCode = 20
+	// ReplyLost means the client's connection went while the request was in flight, and its reply wasn't kept for
+	// the client to resume its session with. The request may well have run.
+	ReplyLost ErrorCode = 21
+)
+
+// CloseCode says why impact closed a connection, so that the client can tell a deliberate close from its connection
+// failing, and what to do about it. A connection the client ended, or that impact gave up on because the client stopped
+// reading, has no close code, since there is nobody to read it.
+type CloseCode byte
+
+const (
+	// ClosedRefused means the client didn't get through the handshake, for instance because it couldn't be
+	// authenticated.
+	ClosedRefused CloseCode = 1
+	// ClosedProtocol means the client sent something impact couldn't make sense of, or wouldn't accept, or stalled part
+	// way through a message.
+	ClosedProtocol CloseCode = 2
+	// ClosedShutdown means impact has drained and is shutting down. Whatever the client sent before it was told impact
+	// was going away has been answered.
+	ClosedShutdown CloseCode = 3
+	// ClosedRateLimited means the connection was over the rate at which impact lets in new connections. It is safe to
+	// connect again after a pause.
+	ClosedRateLimited CloseCode = 4
+	// ClosedResourceGone means impact has lost its resource for good and is exiting without it. Requests in flight
+	// were not answered.
+	ClosedResourceGone CloseCode = 5
+)
+
+// ImpactError is a reply synthesized by impact itself, rather than by the resource, when a request could not be served.
+// On the wire it is an Error message whose payload is the code followed by the description.
+type ImpactError struct {
+	CorrelationID uint64
+	Code          ErrorCode
+	Description   string
+
+	// RetryAfter is how long the client should wait before trying again, if impact knows. It goes on the wire in
+	// whole milliseconds, rounded up so that a client waiting that long is never early.
+	RetryAfter time.Duration
+}
+
+// Header is the header the error goes on the wire with.
+func (e ImpactError) Header() Header {
+	header := NewHeader(Error)
+	header.CorrelationID = e.CorrelationID
+	header.RetryAfter = retryAfterMilliseconds(e.RetryAfter)
+
+	return header
+}
+
+func (e ImpactError) ToBytes() []byte {
+	payload := append([]byte{byte(e.Code)}, []byte(e.Description)...)
+	return ImpactMessage{Header: e.Header(), Payload: payload}.ToBytes()
+}
+
+// Every message read off the wire is an ImpactMessage, including errors. DecodeError gets at an error's contents.
+func DecodeError(m ImpactMessage) (ImpactError, error) {
+	if m.Header.Type != Error {
+		return ImpactError{}, errors.New("message is not an error")
+	}
+
+	if len(m.Payload) < 1 {
+		return ImpactError{}, errors.New("error message is missing its code")
+	}
+
+	return ImpactError{CorrelationID: m.Header.CorrelationID, Code: ErrorCode(m.Payload[0]), Description: string(m.Payload[1:]), RetryAfter: time.Duration(m.Header.RetryAfter) * time.Millisecond}, nil
+}
+
+func retryAfterMilliseconds(wait time.Duration) uint32 {
+	if wait <= 0 {
+		return 0
+	}
+
+	milliseconds := (wait + time.Millisecond - 1) / time.Millisecond
+	return uint32(min(milliseconds, math.MaxUint32))
 }
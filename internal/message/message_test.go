@@ -0,0 +1,120 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Messages of every kind the decoder has to deal with, as seeds for the fuzzer.
+func seedMessages() []ImpactMessage {
+	request := NewHeader(Request)
+	request.CorrelationID = 7
+	request.Cost = 3
+	request.Priority = 2
+	request.IdempotencyKey = "retry-1"
+	request.Deadline = 500
+	request.Timeout = 1000
+	request.Resource = "echo"
+	request.Trace = "4bf92f3577b34da6"
+	request.Tag = "0000002a"
+
+	hello := NewHello(MinimumVersion, Version)
+	hello.Header.Token = "secret"
+	hello.Header.Compression = []Compression{Deflate, Gzip}
+	hello.Header.Resume = "session"
+
+	reply := NewHeader(Reply)
+	reply.Flags = More
+	reply.Status = 404
+	reply.ConnectionID = "connection-1"
+
+	return []ImpactMessage{
+		{Header: request, Payload: []byte("hello")},
+		hello,
+		{Header: reply, Payload: []byte("chunk")},
+		NewWelcome(Version),
+		NewClosing(Version, 1, "shutting down"),
+		NewQueued(Version, 7, 3),
+		NewCredit(Version, 10),
+		NewLimits(Version, 7, []byte(`{"max-message-size":1024}`)),
+	}
+}
+
+// Whatever the bytes, Decode either refuses them or gives a message that encodes to something it decodes the same way.
+func FuzzDecode(f *testing.F) {
+	for _, seed := range seedMessages() {
+		f.Add(seed.ToBytes())
+	}
+	f.Add([]byte{})
+	f.Add(make([]byte, HeaderLength))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, decodeError := Decode(data)
+		if decodeError != nil {
+			return
+		}
+
+		encoded := decoded.ToBytes()
+		again, againError := Decode(encoded)
+		if againError != nil {
+			t.Fatalf("re-encoded message doesn't decode: %v", againError)
+		}
+		if !bytes.Equal(again.ToBytes(), encoded) {
+			t.Fatalf("message changed when re-encoded: %x became %x", encoded, again.ToBytes())
+		}
+		if !bytes.Equal(again.Payload, decoded.Payload) {
+			t.Fatalf("payload changed when re-encoded: %q became %q", decoded.Payload, again.Payload)
+		}
+	})
+}
+
+// FromBytes is given whole frames, including the length prefix, and has to cope with any prefix at all.
+func FuzzFromBytes(f *testing.F) {
+	factory := NewImpactMessageFactory()
+	for _, seed := range seedMessages() {
+		body := seed.ToBytes()
+		f.Add(append([]byte{2, byte(len(body) >> 8), byte(len(body))}, body...))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{8})
+	f.Add([]byte{255, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		wave, parseError := factory.FromBytes(data)
+		if parseError != nil {
+			return
+		}
+
+		if _, ok := wave.(ImpactMessage); !ok {
+			t.Fatalf("FromBytes gave a %T", wave)
+		}
+	})
+}
+
+func FuzzDecodeError(f *testing.F) {
+	for _, seed := range []ImpactError{
+		{CorrelationID: 7, Code: ResourceRestarted, Description: "the resource restarted"},
+		{CorrelationID: 8, Code: UnexpectedMessage, RetryAfter: 1500 * time.Millisecond},
+	} {
+		f.Add(seed.ToBytes())
+	}
+	f.Add(NewHeader(Error).encode(0))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, decodeError := Decode(data)
+		if decodeError != nil {
+			return
+		}
+
+		impactError, errorError := DecodeError(decoded)
+		if errorError != nil {
+			return
+		}
+
+		again, _ := Decode(impactError.ToBytes())
+		if roundTrip, _ := DecodeError(again); roundTrip != impactError {
+			t.Fatalf("error changed when re-encoded: %+v became %+v", impactError, roundTrip)
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Registry holds all of the metrics for one server and serves them in the Prometheus text format, or in the
+// OpenMetrics text format to a scraper that asks for it. Only OpenMetrics has exemplars, so that is the only format
+// they are served in.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(writer io.Writer, openMetrics bool)
+}
+
+// The longest an exemplar's labels may be, in characters, in OpenMetrics.
+const maxExemplarLabels = 128
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	openMetrics := strings.Contains(request.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		writer.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range r.metrics {
+		m.write(writer, openMetrics)
+	}
+	if openMetrics {
+		_, _ = fmt.Fprint(writer, "# EOF\n")
+	}
+}
+
+// In OpenMetrics, a counter's family is named without the _total that its samples have.
+func writeHeader(writer io.Writer, name string, help string, kind string, openMetrics bool) {
+	if openMetrics && kind == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+
+	_, _ = fmt.Fprintf(writer, "# HELP %s %s\n", name, help)
+	_, _ = fmt.Fprintf(writer, "# TYPE %s %s\n", name, kind)
+}
+
+// Counter is a value that only ever goes up, such as the number of requests served.
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	counter := &Counter{name: name, help: help}
+	r.register(counter)
+
+	return counter
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(delta int64) {
+	c.value.Add(delta)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+func (c *Counter) write(writer io.Writer, openMetrics bool) {
+	writeHeader(writer, c.name, c.help, "counter", openMetrics)
+	_, _ = fmt.Fprintf(writer, "%s %d\n", c.name, c.Value())
+}
+
+// Histogram counts observations, such as sizes or durations, into buckets by value.
+type Histogram struct {
+	name string
+	help string
+
+	// The upper bound of each bucket, in increasing order. There is always an implicit last bucket for everything else.
+	bounds []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+
+	// The last observation in each bucket that came with a trace id, the implicit last bucket included. Nil for a
+	// bucket that hasn't had one.
+	exemplars []*exemplar
+}
+
+// An exemplar links a bucket to one trace that landed in it, so that a slow bucket leads to a slow trace.
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+func (r *Registry) NewHistogram(name string, help string, bounds []float64) *Histogram {
+	histogram := &Histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds)), exemplars: make([]*exemplar, len(bounds)+1)}
+	r.register(histogram)
+
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.ObserveWithTrace(value, "")
+}
+
+// ObserveWithTrace observes a value, and keeps it as its bucket's exemplar if it came with a trace id. A trace id too
+// long for an exemplar, or that isn't UTF-8, is left out.
+func (h *Histogram) ObserveWithTrace(value float64, traceID string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	bucket := len(h.bounds)
+	for index, bound := range h.bounds {
+		if value <= bound {
+			h.counts[index] += 1
+			bucket = index
+			break
+		}
+	}
+
+	h.sum += value
+	h.count += 1
+
+	if traceID != "" && utf8.ValidString(traceID) && utf8.RuneCountInString("trace_id"+traceID) <= maxExemplarLabels {
+		h.exemplars[bucket] = &exemplar{traceID: traceID, value: value, time: time.Now()}
+	}
+}
+
+func (h *Histogram) write(writer io.Writer, openMetrics bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writeHeader(writer, h.name, h.help, "histogram", openMetrics)
+
+	// Prometheus buckets are cumulative: each one counts everything at or below its bound.
+	cumulative := uint64(0)
+	for index, bound := range h.bounds {
+		cumulative += h.counts[index]
+		_, _ = fmt.Fprintf(writer, "%s_bucket{le=\"%g\"} %d%s\n", h.name, bound, cumulative, h.exemplarFor(index, openMetrics))
+	}
+	_, _ = fmt.Fprintf(writer, "%s_bucket{le=\"+Inf\"} %d%s\n", h.name, h.count, h.exemplarFor(len(h.bounds), openMetrics))
+	_, _ = fmt.Fprintf(writer, "%s_sum %g\n", h.name, h.sum)
+	_, _ = fmt.Fprintf(writer, "%s_count %d\n", h.name, h.count)
+}
+
+// The bucket's exemplar, as it goes on the end of the bucket's line, or nothing.
+func (h *Histogram) exemplarFor(bucket int, openMetrics bool) string {
+	e := h.exemplars[bucket]
+	if !openMetrics || e == nil {
+		return ""
+	}
+
+	return fmt.Sprintf(" # {trace_id=%s} %g %.3f", quoteLabel(e.traceID), e.value, float64(e.time.UnixMilli())/1000)
+}
+
+// Label values are quoted with only backslash, double quote and newline escaped, as both formats have it.
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// GaugeFunc is a value that can go up and down, read from the function it was given whenever metrics are collected.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{name: name, help: help, value: value}
+	r.register(gauge)
+
+	return gauge
+}
+
+func (g *GaugeFunc) write(writer io.Writer, openMetrics bool) {
+	writeHeader(writer, g.name, g.help, "gauge", openMetrics)
+	_, _ = fmt.Fprintf(writer, "%s %g\n", g.name, g.value())
+}
+
+// GaugeFuncVec is a family of gauges told apart by the value of one label, all read from the function it was given
+// whenever metrics are collected.
+type GaugeFuncVec struct {
+	name   string
+	help   string
+	label  string
+	values func() map[string]float64
+}
+
+func (r *Registry) NewGaugeFuncVec(name string, help string, label string, values func() map[string]float64) *GaugeFuncVec {
+	vec := &GaugeFuncVec{name: name, help: help, label: label, values: values}
+	r.register(vec)
+
+	return vec
+}
+
+func (v *GaugeFuncVec) write(writer io.Writer, openMetrics bool) {
+	values := v.values()
+
+	writeHeader(writer, v.name, v.help, "gauge", openMetrics)
+
+	// Sorted, so that scrapes are stable and easy to compare by eye.
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		_, _ = fmt.Fprintf(writer, "%s{%s=%q} %g\n", v.name, v.label, labelValue, values[labelValue])
+	}
+}
+
+// CounterVec is a family of counters told apart by the value of one label, such as a count of errors by reason.
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	lock   sync.Mutex
+	values map[string]int64
+}
+
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	vec := &CounterVec{name: name, help: help, label: label, values: make(map[string]int64)}
+	r.register(vec)
+
+	return vec
+}
+
+func (v *CounterVec) Inc(labelValue string) {
+	v.Add(labelValue, 1)
+}
+
+func (v *CounterVec) Add(labelValue string, delta int64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.values[labelValue] += delta
+}
+
+func (v *CounterVec) Value(labelValue string) int64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return v.values[labelValue]
+}
+
+// Values is a copy of every counter in the family, by label value.
+func (v *CounterVec) Values() map[string]int64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	values := make(map[string]int64, len(v.values))
+	for labelValue, value := range v.values {
+		values[labelValue] = value
+	}
+
+	return values
+}
+
+func (v *CounterVec) write(writer io.Writer, openMetrics bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	writeHeader(writer, v.name, v.help, "counter", openMetrics)
+
+	// Sorted, so that scrapes are stable and easy to compare by eye.
+	labelValues := make([]string, 0, len(v.values))
+	for labelValue := range v.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		_, _ = fmt.Fprintf(writer, "%s{%s=%q} %d\n", v.name, v.label, labelValue, v.values[labelValue])
+	}
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Scrape the registry, asking for the format the Accept header names, and return the content type and the body.
+func scrape(t *testing.T, registry *Registry, accept string) (string, string) {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, request)
+
+	return recorder.Header().Get("Content-Type"), recorder.Body.String()
+}
+
+// Fail unless every line is in the body.
+func expectLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("no line %q in:\n%s", line, body)
+		}
+	}
+}
+
+// Buckets are cumulative, and everything over the last bound is only in +Inf.
+func TestHistogramBuckets(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogram("latency_seconds", "How long.", []float64{0.1, 1})
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		histogram.Observe(value)
+	}
+
+	_, body := scrape(t, registry, "")
+	expectLines(t, body,
+		"# TYPE latency_seconds histogram",
+		`latency_seconds_bucket{le="0.1"} 2`,
+		`latency_seconds_bucket{le="1"} 3`,
+		`latency_seconds_bucket{le="+Inf"} 4`,
+		"latency_seconds_sum 2.65",
+		"latency_seconds_count 4",
+	)
+}
+
+// A scraper that asks for OpenMetrics gets it, with counter families named without _total and an EOF at the end.
+// Anyone else gets the Prometheus text format.
+func TestOpenMetricsByAccept(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("requests_total", "Requests.").Add(3)
+
+	for _, accept := range []string{"", "text/plain", "application/openmetrics-text; version=1.0.0,text/plain;q=0.5"} {
+		contentType, body := scrape(t, registry, accept)
+		openMetrics := strings.HasPrefix(accept, "application/openmetrics-text")
+
+		switch {
+		case openMetrics && !strings.HasPrefix(contentType, "application/openmetrics-text"):
+			t.Errorf("Accept %q got content type %q, not OpenMetrics", accept, contentType)
+		case !openMetrics && !strings.HasPrefix(contentType, "text/plain"):
+			t.Errorf("Accept %q got content type %q, not the Prometheus text format", accept, contentType)
+		}
+
+		family := "requests_total"
+		if openMetrics {
+			family = "requests"
+		}
+		expectLines(t, body, "# TYPE "+family+" counter", "requests_total 3")
+		if strings.HasSuffix(body, "# EOF\n") != openMetrics {
+			t.Errorf("Accept %q got a body that ends %q", accept, body[max(0, len(body)-20):])
+		}
+	}
+}
+
+// An observation with a trace id becomes its bucket's exemplar, in OpenMetrics only. One with a trace id too long
+// for an exemplar, or that isn't UTF-8, is counted but kept out.
+func TestHistogramExemplars(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogram("latency_seconds", "How long.", []float64{0.1, 1})
+	histogram.ObserveWithTrace(0.05, "4bf92f3577b34da6")
+	histogram.ObserveWithTrace(0.5, `say "hi"`)
+	histogram.ObserveWithTrace(2, strings.Repeat("x", maxExemplarLabels))
+	histogram.ObserveWithTrace(3, "\xff")
+
+	_, body := scrape(t, registry, "application/openmetrics-text")
+	for _, line := range strings.Split(body, "\n") {
+		switch {
+		case strings.HasPrefix(line, `latency_seconds_bucket{le="0.1"} 1 # {trace_id="4bf92f3577b34da6"} 0.05 `):
+		case strings.HasPrefix(line, `latency_seconds_bucket{le="1"} 2 # {trace_id="say \"hi\""} 0.5 `):
+		case line == `latency_seconds_bucket{le="+Inf"} 4`:
+		case strings.HasPrefix(line, "latency_seconds_bucket"):
+			t.Errorf("bucket line %q", line)
+		}
+	}
+
+	_, body = scrape(t, registry, "")
+	if strings.Contains(body, "trace_id") {
+		t.Errorf("the Prometheus text format has exemplars:\n%s", body)
+	}
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket allows events at a steady rate, with bursts of up to a fixed size.
+// Tokens are added continuously at the rate, up to the burst size, and each event spends one.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket allows rate events per second, in bursts of up to burst events. It starts full.
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// SetRate changes the rate from now on. Tokens already in the bucket are kept.
+func (b *TokenBucket) SetRate(rate float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	b.rate = rate
+}
+
+// Allow spends a token if there is one, and reports whether there was.
+func (b *TokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens -= 1
+	return true
+}
+
+// Try spends a token if there is one. If there isn't, it reports how long until there will be.
+func (b *TokenBucket) Try() (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false, b.delay()
+	}
+
+	b.tokens -= 1
+	return true, 0
+}
+
+// Delay is how long until a token will be available, zero if there is one now.
+func (b *TokenBucket) Delay() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(time.Now())
+	return b.delay()
+}
+
+// Wait blocks until a token is available, then spends it.
+func (b *TokenBucket) Wait() {
+	for {
+		b.lock.Lock()
+		b.refill(time.Now())
+		if b.tokens >= 1 {
+			b.tokens -= 1
+			b.lock.Unlock()
+			return
+		}
+		delay := b.delay()
+		b.lock.Unlock()
+
+		time.Sleep(delay)
+	}
+}
+
+func (b *TokenBucket) delay() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	b.tokens = min(b.tokens+elapsed*b.rate, b.burst)
+}
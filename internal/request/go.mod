@@ -1,3 +0,0 @@
-module request
-
-go 1.21
@@ -1,10 +1,99 @@
 package request
 
 import (
+	"context"
 	"github.com/blanu/radiowave"
+	"time"
 )
 
 type Request struct {
 	Message      radiowave.Message
 	ReplyChannel chan radiowave.Message
+
+	// Gone is closed once nobody is waiting on ReplyChannel any more, because the client went away. Nil means somebody
+	// always is, as impact is for the probes it makes itself.
+	Gone <-chan bool
+
+	// CorrelationID is copied from the request's header onto whatever is sent back in answer to it.
+	CorrelationID uint64
+
+	// ConnectionID names the client connection the request came from. Empty for requests impact makes itself.
+	ConnectionID string
+
+	// Identity is who the client that sent the request authenticated as. Empty for clients that didn't, and for
+	// requests impact makes itself.
+	Identity string
+
+	// Resource is the name of the resource the client asked for. Empty means impact chooses.
+	Resource string
+
+	// Cost is the client's estimate of how expensive this request is for the resource. Zero means no estimate.
+	Cost uint32
+
+	// Priority is how urgent the client says this request is, higher being more urgent.
+	Priority uint8
+
+	// Deadline is when the client stops caring about the reply. A request still queued then is not run. Zero means
+	// the client will wait as long as it takes.
+	Deadline time.Time
+
+	// Timeout is how long the resource has to reply once it has been sent the request. Zero means it has as long as
+	// it takes.
+	Timeout time.Duration
+
+	// TraceID is the trace the client says the request is part of, from the trace extension it sent the request with.
+	// Empty if it didn't send one.
+	TraceID string
+
+	// Tag names the request in impact's logs, and in the resource's if the resource is sent it. Empty means the
+	// request isn't tagged.
+	Tag string
+
+	// Status shows where the request has got to, for finding stuck requests. Nil for requests that aren't tracked.
+	Status *Status
+
+	// Context is done once the request has been in impact for as long as it may be, from when it was received, at
+	// whatever stage it has got to. Nil means it may take as long as it takes.
+	Context context.Context
+	cancel  context.CancelFunc
+}
+
+// LimitLifetime gives the request until the deadline to be answered, counting from when it was received.
+func (r *Request) LimitLifetime(deadline time.Time) {
+	r.Context, r.cancel = context.WithDeadline(context.Background(), deadline)
+}
+
+// Lifetime is closed once the request has lived as long as it may. It is nil, and never closed, if there's no limit.
+func (r Request) Lifetime() <-chan struct{} {
+	if r.Context == nil {
+		return nil
+	}
+
+	return r.Context.Done()
+}
+
+// Expired says whether the request has lived as long as it may.
+func (r Request) Expired() bool {
+	return r.Context != nil && r.Context.Err() != nil
+}
+
+// End lets go of the request's lifetime, once it is over one way or another.
+func (r Request) End() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Reply sends an answer, or part of one, to whoever is waiting for it. If the client has gone, there is nobody to
+// take it, and the answer is dropped rather than left blocking the sender. The same goes once the request has outlived
+// its lifetime, since its client has already been told. Report whether it was taken.
+func (r Request) Reply(wave radiowave.Message) bool {
+	select {
+	case r.ReplyChannel <- wave:
+		return true
+	case <-r.Gone:
+		return false
+	case <-r.Lifetime():
+		return false
+	}
 }
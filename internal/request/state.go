@@ -0,0 +1,152 @@
+package request
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State is where a request has got to on its way through impact.
+//
+//	Received → Queued → Dispatched → Executing → Replied
+//
+// A request can end up Failed, if it was answered with an error instead of a reply, or Cancelled, if the client went
+// away before it could be answered, from any state before that.
+type State int32
+
+const (
+	// Received requests have been read from the client but not yet queued.
+	Received State = iota
+	// Queued requests are waiting for the scheduler to choose them.
+	Queued
+	// Dispatched requests have been chosen, and are waiting for the process handler to take them from the funnel.
+	Dispatched
+	// Executing requests have been sent to the resource, which hasn't finished replying.
+	Executing
+	// Replied requests have been answered by the resource.
+	Replied
+	// Failed requests were answered with an error.
+	Failed
+	// Cancelled requests lost their client before they could be answered.
+	Cancelled
+)
+
+func (state State) String() string {
+	switch state {
+	case Received:
+		return "received"
+	case Queued:
+		return "queued"
+	case Dispatched:
+		return "dispatched"
+	case Executing:
+		return "executing"
+	case Replied:
+		return "replied"
+	case Failed:
+		return "failed"
+	case Cancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// Status tracks a request's state. Requests are passed around by value, so every copy of one shares a Status.
+// Updating it is just a couple of atomic stores, so that it can always be on.
+type Status struct {
+	received time.Time
+	state    atomic.Int32
+	// When the state last changed, in Unix nanoseconds.
+	changed atomic.Int64
+	// Whatever the request was sent to, once it has been sent. Nil until then.
+	holder atomic.Pointer[string]
+
+	// When the request entered each state, in Unix nanoseconds, zero for states it never entered, and when the
+	// resource finished with it, zero if it hasn't. These are for saying where a slow request's time went.
+	entered  [Cancelled + 1]atomic.Int64
+	finished atomic.Int64
+}
+
+func NewStatus() *Status {
+	status := &Status{received: time.Now()}
+	status.changed.Store(status.received.UnixNano())
+	status.entered[Received].Store(status.received.UnixNano())
+	return status
+}
+
+func (status *Status) Set(state State) {
+	now := time.Now().UnixNano()
+	status.state.Store(int32(state))
+	status.changed.Store(now)
+	status.entered[state].Store(now)
+}
+
+// Entered is when the request entered the state, or the zero time if it never has.
+func (status *Status) Entered(state State) time.Time {
+	return unixTime(status.entered[state].Load())
+}
+
+// SetFinished records that the resource has finished with the request, having sent the last of its reply.
+func (status *Status) SetFinished() {
+	status.finished.Store(time.Now().UnixNano())
+}
+
+// Finished is when the resource finished with the request, or the zero time if it hasn't.
+func (status *Status) Finished() time.Time {
+	return unixTime(status.finished.Load())
+}
+
+func unixTime(nanoseconds int64) time.Time {
+	if nanoseconds == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanoseconds)
+}
+
+func (status *Status) State() State {
+	return State(status.state.Load())
+}
+
+func (status *Status) Received() time.Time {
+	return status.received
+}
+
+func (status *Status) Changed() time.Time {
+	return time.Unix(0, status.changed.Load())
+}
+
+func (status *Status) SetHolder(holder string) {
+	status.holder.Store(&holder)
+}
+
+// Holder names whatever the request was sent to, or is empty if it hasn't been sent anywhere yet.
+func (status *Status) Holder() string {
+	holder := status.holder.Load()
+	if holder == nil {
+		return ""
+	}
+
+	return *holder
+}
+
+// Move a request to a new state. Requests that impact makes for itself, such as probes, have no status to update.
+func (r Request) SetState(state State) {
+	if r.Status != nil {
+		r.Status.Set(state)
+	}
+}
+
+// Record that the resource has finished with a request. Requests that impact makes for itself have no status to update.
+func (r Request) SetFinished() {
+	if r.Status != nil {
+		r.Status.SetFinished()
+	}
+}
+
+// Record what is serving a request. Requests that impact makes for itself have no status to update.
+func (r Request) SetHolder(holder string) {
+	if r.Status != nil {
+		r.Status.SetHolder(holder)
+	}
+}
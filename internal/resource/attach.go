@@ -0,0 +1,92 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blanu/radiowave"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often an attached process is checked for whether it is still running. We aren't its parent, so we can't wait
+// for it.
+const attachedPollInterval = 250 * time.Millisecond
+
+// A process we attached to rather than launched. It belongs to someone else, so we never signal it. Stopping it only
+// lets go of its pipes.
+type attachment struct {
+	pid      int
+	detached chan bool
+	once     sync.Once
+}
+
+func (a *attachment) detach() {
+	a.once.Do(func() { close(a.detached) })
+}
+
+// Attach connects to a resource that is already running, by its pid, through its stdin, and stdout or the file
+// descriptor named in the options. The process's descriptors are reached through /proc, so this only works where there
+// is one, and only where they are pipes or FIFOs that nothing else is reading from or writing to. Diagnostics are left
+// to whoever runs the process.
+func Attach(factory radiowave.MessageFactory, pid int, options Options) (*Process, error) {
+	descriptors := "/proc/" + strconv.Itoa(pid) + "/fd/"
+	if _, statError := os.Stat(descriptors); statError != nil {
+		return nil, fmt.Errorf("can't reach the descriptors of process %d: %w", pid, statError)
+	}
+
+	outputFD := 1
+	if options.OutputFD > 2 {
+		outputFD = options.OutputFD
+	}
+
+	resourceInput, inputError := os.OpenFile(descriptors+"0", os.O_WRONLY, 0)
+	if inputError != nil {
+		return nil, inputError
+	}
+	resourceOutput, outputError := os.Open(descriptors + strconv.Itoa(outputFD))
+	if outputError != nil {
+		_ = resourceInput.Close()
+		return nil, outputError
+	}
+
+	process := &Process{
+		InputChannel:  make(chan radiowave.Message),
+		OutputChannel: make(chan radiowave.Message),
+		ExitChannel:   make(chan bool),
+		attached:      &attachment{pid: pid, detached: make(chan bool)},
+	}
+	go process.pumpInput(resourceInput)
+	go process.pumpOutput(process.OutputChannel, factory, resourceOutput, options.Text)
+	go process.watch(resourceOutput)
+
+	return process, nil
+}
+
+// Wait until the attached process is gone, or we let go of it.
+func (p *Process) watch(resourceOutput io.Closer) {
+	ticker := time.NewTicker(attachedPollInterval)
+	defer ticker.Stop()
+
+	running := true
+	for running {
+		select {
+		case <-ticker.C:
+			_, statError := os.Stat("/proc/" + strconv.Itoa(p.attached.pid))
+			running = !errors.Is(statError, os.ErrNotExist)
+		case <-p.attached.detached:
+			running = false
+		}
+	}
+
+	// Even once it's gone, something else may still hold its pipes open, so our reads wouldn't end by themselves.
+	_ = resourceOutput.Close()
+	close(p.ExitChannel)
+}
+
+// Attached says whether we attached to the process rather than launching it.
+func (p *Process) Attached() bool {
+	return p.attached != nil
+}
@@ -0,0 +1,280 @@
+package resource
+
+import (
+	"bufio"
+	"errors"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/radiowave"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+)
+
+// Process is one running instance of the shared resource, connected to us through its stdin/stdout.
+// Unlike radiowave.Process, we keep hold of the underlying command so that the resource can be killed and relaunched.
+type Process struct {
+	InputChannel chan radiowave.Message
+	// OutputChannel is closed once the resource's output ends. That happens when the process exits, but a resource
+	// can also close its output and keep running.
+	OutputChannel chan radiowave.Message
+
+	// ExitChannel is closed once the process has exited, whatever the reason.
+	ExitChannel chan bool
+
+	// Exactly one of these is set: the command if we launched the process, or the attachment if we attached to it.
+	command  *exec.Cmd
+	attached *attachment
+
+	// Why writing to the resource failed, if it did. Nil while its input is fine.
+	inputError atomic.Pointer[error]
+}
+
+// Options say how the resource is connected to us.
+type Options struct {
+	// OutputFD is the file descriptor on which the resource writes its replies. Zero or 1 means stdout. Above 2, the
+	// resource is given an extra pipe as that descriptor, and whatever it writes to stdout is diagnostics instead.
+	OutputFD int
+
+	// Diagnostics is given each line the resource writes to stdout, when its replies go elsewhere. Nil discards them.
+	Diagnostics func(line string)
+
+	// Text says to pass on text the resource writes where a message should be, such as a startup banner or a prompt, as
+	// Text. Otherwise the output ends at the first thing that isn't a frame, since nothing after it can be trusted.
+	Text bool
+}
+
+// Text stands in for a line of text the resource wrote where a message should have been, without its line ending. A
+// prompt that doesn't end its line is passed on as soon as nothing more of it has arrived.
+type Text struct {
+	Line string
+}
+
+func (t Text) ToBytes() []byte {
+	return []byte(t.Line)
+}
+
+// The longest line of text passed on in one piece. A longer one is passed on in several.
+const maximumTextLength = 4096
+
+// Launch attempts to start the resource as a separate process connected to us through stdin, and stdout or the file
+// descriptor named in the options.
+func Launch(factory radiowave.MessageFactory, path string, options Options) (*Process, error) {
+	command := exec.Command(path)
+	resourceInput, inputError := command.StdinPipe()
+	if inputError != nil {
+		return nil, inputError
+	}
+	resourceStdout, outputError := command.StdoutPipe()
+	if outputError != nil {
+		return nil, outputError
+	}
+
+	// Replies come over stdout unless the resource keeps its protocol apart from its logging.
+	var resourceOutput io.ReadCloser = resourceStdout
+	var replyWriter *os.File
+	if options.OutputFD > 2 {
+		reader, writer, pipeError := os.Pipe()
+		if pipeError != nil {
+			return nil, pipeError
+		}
+
+		// Entry i of ExtraFiles becomes descriptor 3+i in the resource. Any before ours are left closed.
+		command.ExtraFiles = make([]*os.File, options.OutputFD-2)
+		command.ExtraFiles[options.OutputFD-3] = writer
+		resourceOutput = reader
+		replyWriter = writer
+	}
+
+	startError := command.Start()
+	if replyWriter != nil {
+		// The resource has its own copy. Ours has to be closed for the reply pipe to end when the resource exits.
+		_ = replyWriter.Close()
+	}
+	if startError != nil {
+		if replyWriter != nil {
+			_ = resourceOutput.Close()
+		}
+		return nil, startError
+	}
+
+	// We pump the pipes ourselves rather than through radiowave.File. Its reader assumes each read returns a whole
+	// frame, so a reply that arrived in fragments was handed over cut short, and the rest was taken for the next reply.
+	process := &Process{
+		InputChannel:  make(chan radiowave.Message),
+		OutputChannel: make(chan radiowave.Message),
+		ExitChannel:   make(chan bool),
+		command:       command,
+	}
+	go process.pumpInput(resourceInput)
+	go process.pumpOutput(process.OutputChannel, factory, resourceOutput, options.Text)
+	if replyWriter != nil {
+		go pumpDiagnostics(resourceStdout, options.Diagnostics)
+	}
+	go process.wait(resourceOutput)
+
+	return process, nil
+}
+
+// Pid is the operating system's process id for the resource.
+func (p *Process) Pid() int {
+	if p.attached != nil {
+		return p.attached.pid
+	}
+
+	return p.command.Process.Pid
+}
+
+// ExitedCleanly reports whether the process exited by itself with status 0, once ExitChannel has been closed. A process
+// that was killed, or that we attached to and so can't know the status of, didn't.
+func (p *Process) ExitedCleanly() bool {
+	if p.command == nil || p.command.ProcessState == nil {
+		return false
+	}
+
+	return p.command.ProcessState.Success()
+}
+
+// Signal sends the process a signal, such as a request to terminate. A process we attached to isn't ours to signal.
+func (p *Process) Signal(signal os.Signal) error {
+	if p.attached != nil {
+		return errors.New("the resource was attached to, not launched")
+	}
+
+	return p.command.Process.Signal(signal)
+}
+
+// Kill stops the process immediately. ExitChannel is closed once it is actually gone. A process we attached to isn't
+// ours to stop, so we only let go of it, and ExitChannel is closed once we have.
+func (p *Process) Kill() {
+	if p.attached != nil {
+		p.attached.detach()
+		return
+	}
+
+	_ = p.command.Process.Kill()
+}
+
+// Release winds down the message pump feeding a process that has exited.
+// Only the process handler sends on InputChannel, so only the process handler may call this, and only once.
+func (p *Process) Release() {
+	close(p.InputChannel)
+}
+
+// Every message on InputChannel is written to the resource, until Release closes it.
+//
+// A write fails when the resource has closed its input, with a broken pipe, or has exited. Either way, nothing we send
+// it can reach it any more, and whatever it was sent is lost. A resource that closed its input but is still running
+// would otherwise be waited on forever for replies to requests it never got, so the process is killed, and the process
+// handler treats it like any other resource that exited. Everything after is dropped until Release.
+func (p *Process) pumpInput(resourceInput io.WriteCloser) {
+	for wave := range p.InputChannel {
+		if p.inputError.Load() != nil {
+			continue
+		}
+
+		if writeError := connection.WriteFrame(resourceInput, wave.ToBytes()); writeError != nil {
+			p.inputError.Store(&writeError)
+			p.Kill()
+		}
+	}
+
+	_ = resourceInput.Close()
+}
+
+// InputError is why writing to the resource failed, or nil if it never has.
+func (p *Process) InputError() error {
+	inputError := p.inputError.Load()
+	if inputError == nil {
+		return nil
+	}
+
+	return *inputError
+}
+
+// A message is only passed on once its whole frame has arrived, however many reads that took. The pump keeps the
+// channel it started with, since whoever takes the output can put another in its place, to sort it before passing it on.
+func (p *Process) pumpOutput(output chan radiowave.Message, factory radiowave.MessageFactory, resourceOutput io.Reader, text bool) {
+	defer close(output)
+
+	reader := bufio.NewReader(resourceOutput)
+	for {
+		// A frame starts with the length of its length, which is never more than 8. Anything else is text.
+		if text {
+			next, peekError := reader.Peek(1)
+			if peekError != nil {
+				return
+			}
+			if next[0] > 8 {
+				line, readError := readText(reader)
+				output <- Text{Line: line}
+				if readError != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		// A pipe hands back whatever happens to be in it, so a reply the resource wrote in one go can still arrive over
+		// several reads. The frame is read until it is complete, so a reply is never cut short at a read boundary.
+		frame, readError := connection.ReadFrame(reader, 0)
+		if readError != nil {
+			return
+		}
+
+		// The frame boundary is known even when its contents make no sense, so skipping it keeps us in step
+		// with the resource. The request it belonged to is left to the watchdog, as for a reply that never came.
+		wave, parseError := factory.FromBytes(frame)
+		if parseError != nil {
+			continue
+		}
+
+		output <- wave
+	}
+}
+
+// Read text up to the end of the line, or for as long as more of it has already arrived.
+func readText(reader *bufio.Reader) (string, error) {
+	line := make([]byte, 0, 80)
+	for len(line) < maximumTextLength {
+		next, readError := reader.ReadByte()
+		if readError != nil {
+			return string(line), readError
+		}
+		if next == '\n' {
+			break
+		}
+		line = append(line, next)
+		if reader.Buffered() == 0 {
+			break
+		}
+	}
+
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// Diagnostics are read a line at a time, and always read, so that a chatty resource never blocks on a full pipe.
+func pumpDiagnostics(resourceStdout io.Reader, diagnostics func(line string)) {
+	if diagnostics == nil {
+		_, _ = io.Copy(io.Discard, resourceStdout)
+		return
+	}
+
+	scanner := bufio.NewScanner(resourceStdout)
+	for scanner.Scan() {
+		diagnostics(scanner.Text())
+	}
+
+	// A line too long for the scanner still has to be drained.
+	_, _ = io.Copy(io.Discard, resourceStdout)
+}
+
+func (p *Process) wait(resourceOutput io.Closer) {
+	// Wait also closes our ends of the pipes it made, which stops the pumps reading the resource's output. A reply
+	// pipe of our own has to be closed here, in case the resource left a child holding the other end.
+	_ = p.command.Wait()
+	_ = resourceOutput.Close()
+
+	close(p.ExitChannel)
+}
@@ -0,0 +1,223 @@
+package scheduler
+
+import (
+	"github.com/blanu/impact/internal/request"
+	"sync"
+)
+
+// DeficitRoundRobin shares the resource between connections by the cost of their requests rather than their number.
+// Each connection with queued requests takes a turn in rotation. On each turn it is credited with a quantum of cost,
+// and its next request is served only once it has saved up enough credit to pay for it. A connection sending a few
+// huge requests therefore gets no more of the resource than one sending many tiny ones.
+//
+// Priority only orders requests within a connection's share, never across connections. When a connection's turn
+// comes, its most urgent queued request is the one it spends its credit on, but being urgent doesn't earn it any more
+// turns or credit. A connection that marks everything urgent gains nothing over its neighbours, and a connection that
+// sends one rare urgent request among its bulk traffic gets that request served first without being penalized for it.
+type DeficitRoundRobin struct {
+	lock    sync.Mutex
+	ready   *sync.Cond
+	quantum int64
+
+	// Connections are told apart by their id.
+	flows  map[string]*flow
+	active []*flow
+	length int
+	closed bool
+}
+
+// A flow is the queue of requests from one connection.
+type flow struct {
+	connectionID string
+	requests     []request.Request
+	deficit      int64
+}
+
+func NewDeficitRoundRobin(quantum int64) *DeficitRoundRobin {
+	drr := &DeficitRoundRobin{
+		quantum: quantum,
+		flows:   make(map[string]*flow),
+	}
+	drr.ready = sync.NewCond(&drr.lock)
+
+	return drr
+}
+
+func (d *DeficitRoundRobin) Push(request request.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	current, found := d.flows[request.ConnectionID]
+	if !found {
+		// A connection joining the rotation starts with one quantum of credit, ready for its first turn.
+		current = &flow{connectionID: request.ConnectionID, deficit: d.quantum}
+		d.flows[request.ConnectionID] = current
+		d.active = append(d.active, current)
+	}
+
+	current.requests = insertByPriority(current.requests, request)
+	d.length += 1
+	d.ready.Signal()
+}
+
+func (d *DeficitRoundRobin) Pop() (request.Request, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for d.length == 0 && !d.closed {
+		d.ready.Wait()
+	}
+	if d.closed {
+		return request.Request{}, false
+	}
+
+	for {
+		current := d.active[0]
+		next := current.requests[0]
+		cost := costOf(next)
+
+		if cost > current.deficit {
+			// This connection can't afford its next request yet. It gets more credit and goes to the back of the line.
+			current.deficit += d.quantum
+			d.active = append(d.active[1:], current)
+			continue
+		}
+
+		current.deficit -= cost
+		current.requests = current.requests[1:]
+		d.length -= 1
+
+		// A connection that has nothing queued leaves the rotation and does not keep its unspent credit.
+		if len(current.requests) == 0 {
+			d.active = d.active[1:]
+			delete(d.flows, current.connectionID)
+		}
+
+		return next, true
+	}
+}
+
+func (d *DeficitRoundRobin) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+	d.ready.Broadcast()
+}
+
+func (d *DeficitRoundRobin) Len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.length
+}
+
+// The position of a request depends on everyone's credit as well as on the queues, so it is found by playing Pop
+// forward on a copy of the rotation, counting the requests served before it.
+func (d *DeficitRoundRobin) Position(target request.Request) (int, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if target.Status == nil {
+		return 0, false
+	}
+
+	type turn struct {
+		flow    *flow
+		next    int
+		deficit int64
+	}
+
+	rotation := make([]*turn, len(d.active))
+	for index, active := range d.active {
+		rotation[index] = &turn{flow: active, deficit: active.deficit}
+	}
+
+	served := 0
+	for len(rotation) > 0 {
+		current := rotation[0]
+		next := current.flow.requests[current.next]
+		cost := costOf(next)
+
+		if cost > current.deficit {
+			current.deficit += d.quantum
+			rotation = append(rotation[1:], current)
+			continue
+		}
+
+		if next.Status == target.Status {
+			return served, true
+		}
+
+		current.deficit -= cost
+		current.next += 1
+		served += 1
+
+		if current.next == len(current.flow.requests) {
+			rotation = rotation[1:]
+		}
+	}
+
+	return 0, false
+}
+
+func (d *DeficitRoundRobin) Remove(target request.Request) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if target.Status == nil {
+		return false
+	}
+
+	current, found := d.flows[target.ConnectionID]
+	if !found {
+		return false
+	}
+
+	for index, queued := range current.requests {
+		if queued.Status == target.Status {
+			current.requests = append(current.requests[:index:index], current.requests[index+1:]...)
+			d.length -= 1
+			if len(current.requests) == 0 {
+				d.leave(current)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// A connection with nothing left queued leaves the rotation.
+func (d *DeficitRoundRobin) leave(current *flow) {
+	for index, active := range d.active {
+		if active == current {
+			d.active = append(d.active[:index:index], d.active[index+1:]...)
+			break
+		}
+	}
+	delete(d.flows, current.connectionID)
+}
+
+// Requests without a cost estimate are treated as the cheapest possible request.
+func costOf(request request.Request) int64 {
+	if request.Cost == 0 {
+		return 1
+	}
+
+	return int64(request.Cost)
+}
+
+// Queue a request behind every request that is at least as urgent, so requests of equal priority stay in order.
+func insertByPriority(requests []request.Request, next request.Request) []request.Request {
+	index := len(requests)
+	for index > 0 && requests[index-1].Priority < next.Priority {
+		index -= 1
+	}
+
+	requests = append(requests, request.Request{})
+	copy(requests[index+1:], requests[index:])
+	requests[index] = next
+
+	return requests
+}
@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/request"
+	"strings"
+	"testing"
+)
+
+// A request from the connection, named by its correlation id, for telling the order it was served in.
+func queued(connectionID string, correlationID uint64, cost uint32, priority uint8) request.Request {
+	return request.Request{ConnectionID: connectionID, CorrelationID: correlationID, Cost: cost, Priority: priority}
+}
+
+// Pop everything queued, and name each request served in order as connection/correlation id.
+func drain(t *testing.T, scheduler Scheduler) string {
+	t.Helper()
+
+	var served []string
+	for scheduler.Len() > 0 {
+		next, ok := scheduler.Pop()
+		if !ok {
+			t.Fatal("Pop reported the scheduler closed")
+		}
+		served = append(served, fmt.Sprintf("%s/%d", next.ConnectionID, next.CorrelationID))
+	}
+
+	return strings.Join(served, " ")
+}
+
+// An urgent request is served first of its connection's, on that connection's turn, and earns it no extra turns.
+func TestPriorityWithinAConnectionsShare(t *testing.T) {
+	drr := NewDeficitRoundRobin(10)
+	for correlationID := uint64(1); correlationID <= 3; correlationID++ {
+		drr.Push(queued("a", correlationID, 10, 0))
+		drr.Push(queued("b", correlationID, 10, 0))
+	}
+	drr.Push(queued("a", 4, 10, 9))
+
+	if served, want := drain(t, drr), "a/4 b/1 a/1 b/2 a/2 b/3 a/3"; served != want {
+		t.Fatalf("served %s, not %s", served, want)
+	}
+}
+
+// A connection that marks everything urgent still only gets its share.
+func TestPriorityBuysNoTurns(t *testing.T) {
+	drr := NewDeficitRoundRobin(10)
+	for correlationID := uint64(1); correlationID <= 3; correlationID++ {
+		drr.Push(queued("a", correlationID, 10, 0))
+		drr.Push(queued("b", correlationID, 10, 255))
+	}
+
+	if served, want := drain(t, drr), "a/1 b/1 a/2 b/2 a/3 b/3"; served != want {
+		t.Fatalf("served %s, not %s", served, want)
+	}
+}
+
+// Costs still decide the shares when priorities are given: an urgent request that costs twice as much takes two
+// turns' credit, and the cheaper connection is served twice in the meantime. Equal priorities keep arrival order.
+func TestPriorityPaysItsCost(t *testing.T) {
+	drr := NewDeficitRoundRobin(10)
+	drr.Push(queued("a", 1, 20, 0))
+	drr.Push(queued("a", 2, 20, 5))
+	drr.Push(queued("a", 3, 20, 5))
+	for correlationID := uint64(1); correlationID <= 4; correlationID++ {
+		drr.Push(queued("b", correlationID, 10, 0))
+	}
+
+	if served, want := drain(t, drr), "b/1 a/2 b/2 b/3 a/3 b/4 a/1"; served != want {
+		t.Fatalf("served %s, not %s", served, want)
+	}
+}
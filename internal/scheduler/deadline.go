@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"container/heap"
+	"github.com/blanu/impact/internal/request"
+	"sync"
+)
+
+// EarliestDeadline serves the queued request whose deadline is soonest. When requests carry deadlines, serving them in
+// arrival order can leave a request with a tight deadline stuck behind ones that could have waited, and it misses
+// its deadline for nothing. Requests without a deadline are served after every request with one, in arrival order,
+// as are requests whose deadlines are the same.
+//
+// Under sustained overload this still misses deadlines, but it misses the ones that were hardest to meet.
+type EarliestDeadline struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	requests deadlineHeap
+	arrivals uint64
+	closed   bool
+}
+
+func NewEarliestDeadline() *EarliestDeadline {
+	edf := &EarliestDeadline{}
+	edf.ready = sync.NewCond(&edf.lock)
+
+	return edf
+}
+
+func (e *EarliestDeadline) Push(request request.Request) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.arrivals += 1
+	heap.Push(&e.requests, queuedRequest{request: request, arrival: e.arrivals})
+	e.ready.Signal()
+}
+
+func (e *EarliestDeadline) Pop() (request.Request, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for len(e.requests) == 0 && !e.closed {
+		e.ready.Wait()
+	}
+	if e.closed {
+		return request.Request{}, false
+	}
+
+	return heap.Pop(&e.requests).(queuedRequest).request, true
+}
+
+func (e *EarliestDeadline) Close() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.closed = true
+	e.ready.Broadcast()
+}
+
+func (e *EarliestDeadline) Len() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return len(e.requests)
+}
+
+// Everything that sorts before the request is served before it.
+func (e *EarliestDeadline) Position(target request.Request) (int, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if target.Status == nil {
+		return 0, false
+	}
+
+	var found *queuedRequest
+	for index := range e.requests {
+		if e.requests[index].request.Status == target.Status {
+			found = &e.requests[index]
+			break
+		}
+	}
+	if found == nil {
+		return 0, false
+	}
+
+	ahead := 0
+	for _, queued := range e.requests {
+		if queued.before(*found) {
+			ahead += 1
+		}
+	}
+
+	return ahead, true
+}
+
+func (e *EarliestDeadline) Remove(target request.Request) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if target.Status == nil {
+		return false
+	}
+
+	for index := range e.requests {
+		if e.requests[index].request.Status == target.Status {
+			heap.Remove(&e.requests, index)
+			return true
+		}
+	}
+
+	return false
+}
+
+type queuedRequest struct {
+	request request.Request
+	arrival uint64
+}
+
+func (q queuedRequest) before(other queuedRequest) bool {
+	mine, theirs := q.request.Deadline, other.request.Deadline
+	switch {
+	case mine.IsZero() != theirs.IsZero():
+		return theirs.IsZero()
+	case !mine.Equal(theirs):
+		return mine.Before(theirs)
+	default:
+		return q.arrival < other.arrival
+	}
+}
+
+// deadlineHeap implements heap.Interface, soonest deadline first.
+type deadlineHeap []queuedRequest
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *deadlineHeap) Push(x any) {
+	*h = append(*h, x.(queuedRequest))
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return last
+}
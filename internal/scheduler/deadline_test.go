@@ -0,0 +1,77 @@
+package scheduler
+
+import (
+	"github.com/blanu/impact/internal/request"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// How many requests miss their deadlines when the scheduler orders them for a resource that takes a millisecond over
+// each. Requests come in bursts of ten, a little more slowly than they are served on average, each willing to wait
+// somewhere between two and forty milliseconds. Time is simulated, so the outcome doesn't depend on how busy the
+// machine running the test is.
+func missedDeadlines(scheduler Scheduler) int {
+	const service = time.Millisecond
+	start := time.Unix(0, 0)
+	random := rand.New(rand.NewSource(1))
+
+	type arrival struct {
+		at      time.Time
+		request request.Request
+	}
+	var arrivals []arrival
+	for burst := 0; burst < 20; burst++ {
+		at := start.Add(time.Duration(burst) * 10500 * time.Microsecond)
+		for index := 0; index < 10; index++ {
+			wait := time.Duration(2+random.Intn(39)) * time.Millisecond
+			arrivals = append(arrivals, arrival{at: at, request: request.Request{CorrelationID: uint64(len(arrivals)), Deadline: at.Add(wait)}})
+		}
+	}
+
+	missed, clock := 0, start
+	for len(arrivals) > 0 || scheduler.Len() > 0 {
+		for len(arrivals) > 0 && !arrivals[0].at.After(clock) {
+			scheduler.Push(arrivals[0].request)
+			arrivals = arrivals[1:]
+		}
+		if scheduler.Len() == 0 {
+			clock = arrivals[0].at
+			continue
+		}
+
+		next, _ := scheduler.Pop()
+		clock = clock.Add(service)
+		if clock.After(next.Deadline) {
+			missed += 1
+		}
+	}
+
+	return missed
+}
+
+// Under the same load, serving the soonest deadline first misses fewer deadlines than serving in arrival order.
+func TestEarliestDeadlineMissesFewer(t *testing.T) {
+	fifo, edf := missedDeadlines(NewFIFO()), missedDeadlines(NewEarliestDeadline())
+	t.Logf("of 200 requests, fifo missed %d deadlines and edf %d", fifo, edf)
+	if edf >= fifo {
+		t.Fatalf("edf missed %d deadlines, no fewer than fifo's %d", edf, fifo)
+	}
+}
+
+// Requests without a deadline go after those with one, and requests with the same deadline keep their arrival order.
+func TestEarliestDeadlineOrder(t *testing.T) {
+	edf := NewEarliestDeadline()
+	soon, later := time.Unix(10, 0), time.Unix(20, 0)
+	edf.Push(request.Request{CorrelationID: 1})
+	edf.Push(request.Request{CorrelationID: 2, Deadline: later})
+	edf.Push(request.Request{CorrelationID: 3, Deadline: soon})
+	edf.Push(request.Request{CorrelationID: 4})
+	edf.Push(request.Request{CorrelationID: 5, Deadline: soon})
+
+	for _, want := range []uint64{3, 5, 2, 1, 4} {
+		if next, _ := edf.Pop(); next.CorrelationID != want {
+			t.Fatalf("popped request %d, not %d", next.CorrelationID, want)
+		}
+	}
+}
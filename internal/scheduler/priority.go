@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"container/heap"
+	"github.com/blanu/impact/internal/request"
+	"sync"
+)
+
+// Priority serves the most urgent queued request first, whichever connection it came from, so that interactive requests
+// can go ahead of bulk ones. Requests of the same priority, including all those without one, are served in arrival
+// order.
+//
+// Priority is strict: as long as urgent requests keep arriving, less urgent ones wait.
+type Priority struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	requests priorityHeap
+	arrivals uint64
+	closed   bool
+}
+
+func NewPriority() *Priority {
+	p := &Priority{}
+	p.ready = sync.NewCond(&p.lock)
+
+	return p
+}
+
+func (p *Priority) Push(request request.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.arrivals += 1
+	heap.Push(&p.requests, prioritizedRequest{request: request, arrival: p.arrivals})
+	p.ready.Signal()
+}
+
+func (p *Priority) Pop() (request.Request, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for len(p.requests) == 0 && !p.closed {
+		p.ready.Wait()
+	}
+	if p.closed {
+		return request.Request{}, false
+	}
+
+	return heap.Pop(&p.requests).(prioritizedRequest).request, true
+}
+
+func (p *Priority) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	p.ready.Broadcast()
+}
+
+func (p *Priority) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return len(p.requests)
+}
+
+// Everything that sorts before the request is served before it.
+func (p *Priority) Position(target request.Request) (int, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if target.Status == nil {
+		return 0, false
+	}
+
+	var found *prioritizedRequest
+	for index := range p.requests {
+		if p.requests[index].request.Status == target.Status {
+			found = &p.requests[index]
+			break
+		}
+	}
+	if found == nil {
+		return 0, false
+	}
+
+	ahead := 0
+	for _, queued := range p.requests {
+		if queued.before(*found) {
+			ahead += 1
+		}
+	}
+
+	return ahead, true
+}
+
+func (p *Priority) Remove(target request.Request) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if target.Status == nil {
+		return false
+	}
+
+	for index := range p.requests {
+		if p.requests[index].request.Status == target.Status {
+			heap.Remove(&p.requests, index)
+			return true
+		}
+	}
+
+	return false
+}
+
+type prioritizedRequest struct {
+	request request.Request
+	arrival uint64
+}
+
+func (q prioritizedRequest) before(other prioritizedRequest) bool {
+	if q.request.Priority != other.request.Priority {
+		return q.request.Priority > other.request.Priority
+	}
+
+	return q.arrival < other.arrival
+}
+
+// priorityHeap implements heap.Interface, most urgent first.
+type priorityHeap []prioritizedRequest
+
+func (h priorityHeap) Len() int           { return len(h) }
+func (h priorityHeap) Less(i, j int) bool { return h[i].before(h[j]) }
+func (h priorityHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *priorityHeap) Push(x any) {
+	*h = append(*h, x.(prioritizedRequest))
+}
+
+func (h *priorityHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return last
+}
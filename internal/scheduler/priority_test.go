@@ -0,0 +1,107 @@
+package scheduler
+
+import (
+	"github.com/blanu/impact/internal/request"
+	"testing"
+	"time"
+)
+
+// A request with the priority, which Position and Remove can find.
+func prioritized(correlationID uint64, priority uint8) request.Request {
+	return request.Request{CorrelationID: correlationID, Priority: priority, Status: request.NewStatus()}
+}
+
+// The most urgent request goes first, and requests of the same priority, those without one included, keep their
+// arrival order.
+func TestPriorityOrder(t *testing.T) {
+	priority := NewPriority()
+	for _, r := range []request.Request{prioritized(1, 0), prioritized(2, 5), prioritized(3, 0), prioritized(4, 9), prioritized(5, 5)} {
+		priority.Push(r)
+	}
+
+	for _, want := range []uint64{4, 2, 5, 1, 3} {
+		if next, _ := priority.Pop(); next.CorrelationID != want {
+			t.Fatalf("popped request %d, not %d", next.CorrelationID, want)
+		}
+	}
+	if length := priority.Len(); length != 0 {
+		t.Fatalf("%d requests are left", length)
+	}
+}
+
+// A request's position is how many will be served before it, and a request that has left the queue has none.
+func TestPriorityPosition(t *testing.T) {
+	priority := NewPriority()
+	bulk, urgent, later := prioritized(1, 0), prioritized(2, 9), prioritized(3, 0)
+	priority.Push(bulk)
+	priority.Push(urgent)
+	priority.Push(later)
+
+	for _, want := range []struct {
+		request  request.Request
+		position int
+	}{{urgent, 0}, {bulk, 1}, {later, 2}} {
+		if position, queued := priority.Position(want.request); !queued || position != want.position {
+			t.Fatalf("request %d is at %d, queued %v, not at %d", want.request.CorrelationID, position, queued, want.position)
+		}
+	}
+
+	_, _ = priority.Pop()
+	if _, queued := priority.Position(urgent); queued {
+		t.Fatal("a request that was popped still has a position")
+	}
+	if position, _ := priority.Position(later); position != 1 {
+		t.Fatalf("the last request is at %d once the first has gone, not 1", position)
+	}
+	if _, queued := priority.Position(request.Request{CorrelationID: 3}); queued {
+		t.Fatal("a request without a status was found")
+	}
+}
+
+// A removed request is never served, and the rest keep their order.
+func TestPriorityRemove(t *testing.T) {
+	priority := NewPriority()
+	first, second, third := prioritized(1, 1), prioritized(2, 2), prioritized(3, 3)
+	priority.Push(first)
+	priority.Push(second)
+	priority.Push(third)
+
+	if !priority.Remove(second) {
+		t.Fatal("a queued request couldn't be removed")
+	}
+	if priority.Remove(second) {
+		t.Fatal("a request was removed twice")
+	}
+
+	for _, want := range []uint64{3, 1} {
+		if next, _ := priority.Pop(); next.CorrelationID != want {
+			t.Fatalf("popped request %d, not %d", next.CorrelationID, want)
+		}
+	}
+}
+
+// Close wakes a Pop waiting on an empty queue, which reports that the scheduler is closed.
+func TestPriorityCloseWakesPop(t *testing.T) {
+	priority := NewPriority()
+	popped := make(chan bool)
+	go func() {
+		_, open := priority.Pop()
+		popped <- open
+	}()
+
+	select {
+	case <-popped:
+		t.Fatal("Pop returned from an empty queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	priority.Close()
+	select {
+	case open := <-popped:
+		if open {
+			t.Fatal("Pop said the scheduler was open after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't wake Pop")
+	}
+}
@@ -0,0 +1,123 @@
+package scheduler
+
+import (
+	"github.com/blanu/impact/internal/request"
+	"sync"
+)
+
+// A Scheduler decides the order in which queued requests are given to the process handler.
+// Requests are pushed by the connection handlers and popped by the coroutine feeding the funnel.
+type Scheduler interface {
+	// Push queues a request. It never blocks.
+	Push(request request.Request)
+
+	// Pop removes the next request to serve, blocking until there is one. Once the scheduler is closed, it returns at
+	// once, and reports that there is nothing more to serve.
+	Pop() (request.Request, bool)
+
+	// Len is the number of requests currently queued.
+	Len() int
+
+	// Position is how many queued requests will be served before the given one, as things stand, and whether it is
+	// still queued at all. Requests are told apart by their Status. It can take time proportional to
+	// the length of the queue.
+	Position(request request.Request) (int, bool)
+
+	// Remove takes a request out of the queue without serving it, and reports whether it was still queued. Requests
+	// are told apart by their Status.
+	Remove(request request.Request) bool
+
+	// Close wakes anything waiting in Pop, so that whoever feeds the funnel can stop. Requests still queued stay where
+	// they are.
+	Close()
+}
+
+// FIFO serves requests in the order they arrived, which is how impact has always behaved.
+type FIFO struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	requests []request.Request
+	closed   bool
+}
+
+func NewFIFO() *FIFO {
+	fifo := &FIFO{}
+	fifo.ready = sync.NewCond(&fifo.lock)
+
+	return fifo
+}
+
+func (f *FIFO) Push(request request.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.requests = append(f.requests, request)
+	f.ready.Signal()
+}
+
+func (f *FIFO) Pop() (request.Request, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for len(f.requests) == 0 && !f.closed {
+		f.ready.Wait()
+	}
+	if f.closed {
+		return request.Request{}, false
+	}
+
+	next := f.requests[0]
+	f.requests = f.requests[1:]
+
+	return next, true
+}
+
+func (f *FIFO) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.requests)
+}
+
+func (f *FIFO) Position(target request.Request) (int, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if target.Status == nil {
+		return 0, false
+	}
+
+	for index, queued := range f.requests {
+		if queued.Status == target.Status {
+			return index, true
+		}
+	}
+
+	return 0, false
+}
+
+func (f *FIFO) Remove(target request.Request) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if target.Status == nil {
+		return false
+	}
+
+	for index, queued := range f.requests {
+		if queued.Status == target.Status {
+			f.requests = append(f.requests[:index:index], f.requests[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *FIFO) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.closed = true
+	f.ready.Broadcast()
+}
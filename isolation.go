@@ -0,0 +1,29 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/resource"
+	"time"
+)
+
+// A named resource exited without being asked to. It is one of several, so rather than take the whole server down
+// with it, we relaunch it, and only its own requests notice. Its queue waits, and everything else carries on as usual:
+// each backend has its own funnel, scheduler, and process handlers, so nothing another backend does can block them.
+//
+// A member of a pool is relaunched the same way while any other member of the pool is still running, and the pool
+// serves at reduced capacity in the meantime. Only once none is left does the whole server go down, as it would with a
+// pool of one.
+//
+// If it can't be relaunched, the member stops, and once the whole pool has stopped the backend's requests are refused.
+func (m *member) relaunchExited(process *resource.Process) *resource.Process {
+	process.Release()
+
+	if !m.shuttingDown.Load() {
+		lifetime := time.Since(m.launched)
+		m.relaunchDelay = m.nextRelaunchDelay(lifetime)
+		m.logger.Printf("resource %s exited after %s, relaunching it in %s", m.name, lifetime.Round(time.Millisecond), m.relaunchDelay)
+		time.Sleep(m.relaunchDelay)
+	}
+
+	// This checks again for shutdown, which may have started while we waited.
+	return m.relaunch(restartExited)
+}
@@ -0,0 +1,143 @@
+package impact
+
+import (
+	"bufio"
+	"github.com/blanu/radiowave"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How hard the journal tries to make sure a request is on disk before the resource sees it.
+const (
+	// Every request is written and synced to disk before it is sent to the resource. Nothing the resource has seen can
+	// be lost in a crash, but every request waits for the disk.
+	journalSyncAlways = "always"
+	// Requests are buffered, and written and synced to disk every interval. A crash can lose up to an interval of
+	// requests, but requests don't wait for the disk.
+	journalSyncInterval = "interval"
+	// Requests are buffered and written to the operating system as the buffer fills, and every interval, but never
+	// synced. The operating system decides when they reach the disk, so even a clean exit of impact loses nothing,
+	// but a machine crash can lose a lot.
+	journalSyncNever = "never"
+)
+
+// The journal records every client request, in the order they are sent to the resource, exactly as they are sent.
+// Each record is a framed impact message, so the journal can be read back with the message factory, or fed straight
+// to a resource to replay it.
+type journal struct {
+	policy string
+	logger *log.Logger
+
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	// Closed when the journal is, which stops the flushes.
+	closed chan bool
+}
+
+func newJournal(path string, policy string, interval time.Duration, logger *log.Logger) (*journal, error) {
+	file, openError := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if openError != nil {
+		return nil, openError
+	}
+
+	j := &journal{policy: policy, logger: logger, file: file, writer: bufio.NewWriter(file), closed: make(chan bool)}
+	if policy != journalSyncAlways {
+		go j.handleFlushes(interval)
+	}
+
+	return j, nil
+}
+
+// Record a request. With the always policy, this returns once the request is on disk. Without a journal, there is
+// nothing to do.
+func (j *journal) record(wave radiowave.Message) error {
+	if j == nil {
+		return nil
+	}
+
+	return j.write(wave.ToBytes())
+}
+
+// Append a record, as the policy says.
+func (j *journal) write(record []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	_, writeError := j.writer.Write(record)
+	if writeError != nil {
+		return writeError
+	}
+
+	if j.policy == journalSyncAlways {
+		return j.flush(true)
+	}
+
+	return nil
+}
+
+func (j *journal) handleFlushes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-j.closed:
+			return
+		}
+
+		j.lock.Lock()
+		// The journal may have been closed while the flush waited for it.
+		if j.isClosed() {
+			j.lock.Unlock()
+			return
+		}
+		flushError := j.flush(j.policy == journalSyncInterval)
+		j.lock.Unlock()
+
+		if flushError != nil {
+			j.logger.Println("journal flush failed:", flushError)
+		}
+	}
+}
+
+// Whatever the policy, everything recorded is made durable when we exit cleanly. Closing it again does nothing.
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.isClosed() {
+		return
+	}
+	close(j.closed)
+
+	if flushError := j.flush(true); flushError != nil {
+		j.logger.Println("journal flush failed:", flushError)
+	}
+	_ = j.file.Close()
+}
+
+func (j *journal) isClosed() bool {
+	select {
+	case <-j.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *journal) flush(sync bool) error {
+	flushError := j.writer.Flush()
+	if flushError != nil || !sync {
+		return flushError
+	}
+
+	return j.file.Sync()
+}
@@ -0,0 +1,35 @@
+package impact
+
+import (
+	"bytes"
+	"github.com/blanu/impact/internal/message"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// What each -journal-sync policy costs a request, on whatever disk holds the test's temporary directory. Run with
+// go test -run '^$' -bench Journal, on the disk the journal will really be on, as it matters far more than anything
+// here.
+func BenchmarkJournal(b *testing.B) {
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: bytes.Repeat([]byte("j"), 256)}
+
+	for _, policy := range []string{journalSyncAlways, journalSyncInterval, journalSyncNever} {
+		b.Run(policy, func(b *testing.B) {
+			j, journalError := newJournal(b.TempDir()+"/journal", policy, 10*time.Millisecond, log.New(io.Discard, "", 0))
+			if journalError != nil {
+				b.Fatal(journalError)
+			}
+			defer j.close()
+
+			b.SetBytes(int64(len(request.ToBytes())))
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				if recordError := j.record(request); recordError != nil {
+					b.Fatal(recordError)
+				}
+			}
+		})
+	}
+}
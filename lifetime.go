@@ -0,0 +1,35 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+)
+
+// A request's lifetime is how long it may be in impact, from being read to being answered, whatever it spends that
+// time on. Timeouts and deadlines each cover one stage, and a request could still be held on to for ever by some
+// stage that has none, such as waiting for a slow client to take its reply. The lifetime bounds how long anything can
+// be kept for a request under any conditions, and so how much memory and how many coroutines can pile up.
+//
+// The lifetime is a context on the request. Whoever is waiting for the answer gives up when it ends and tells the
+// client, and from then on anything still coming for the request is dropped. A request still queued is taken out of
+// the queue. One that the resource is working on is left to finish, as for a timeout, and its reply is thrown away.
+
+// Give a request its lifetime, counted from when it was read.
+func (s *server) limitLifetime(r *request.Request) {
+	if s.maxLifetime > 0 {
+		r.LimitLifetime(r.Status.Received().Add(s.maxLifetime))
+	}
+}
+
+// The request has outlived its lifetime. Return the error to answer it with.
+func (b *backend) outlived(r request.Request) message.ImpactError {
+	if b.scheduler.Remove(r) {
+		b.pending.Add(-1)
+	}
+
+	description := fmt.Sprintf("request was not answered within %s", b.maxLifetime)
+	b.drop(r.ConnectionID, r.CorrelationID, dropLifetime, description)
+
+	return message.ImpactError{CorrelationID: r.CorrelationID, Code: message.LifetimeExceeded, Description: description}
+}
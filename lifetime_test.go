@@ -0,0 +1,48 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"testing"
+	"time"
+)
+
+// Under -max-lifetime, a request still queued when its lifetime ends is answered without ever reaching the resource,
+// and one the resource is working on is answered then too, rather than when the resource is done with it. The one
+// that finishes in time is served as usual.
+func TestLifetimeExceeded(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) { config.MaxLifetime = 300 * time.Millisecond })
+
+	// The first finishes well within its lifetime. The second goes next, and is still running when its lifetime
+	// ends. The third waits behind both, and its lifetime ends before the resource gets to it.
+	clients := make([]*testClient, 3)
+	for index, payload := range []string{"sleep", "sleep", "queued"} {
+		clients[index] = dial(t, address)
+		clients[index].send(1, payload)
+		eventually(t, "the request is in impact", func() bool { return server.s.pending.Load() == int64(index+1) })
+	}
+	tracked := server.s.trackedRequests()
+	if len(tracked) != 3 {
+		t.Fatalf("%d requests are tracked, not 3", len(tracked))
+	}
+	running, queued := tracked[1].Status, tracked[2].Status
+
+	expectReply(t, clients[0].receive(), "sleep")
+	// Cut off, rather than answered with the resource's reply.
+	expectError(t, receiveAnswer(clients[1]), message.LifetimeExceeded)
+	expectError(t, receiveAnswer(clients[2]), message.LifetimeExceeded)
+	if running.Entered(request.Executing).IsZero() {
+		t.Fatal("the second request never reached the resource")
+	}
+	if !queued.Entered(request.Executing).IsZero() {
+		t.Fatal("a request whose lifetime ended while it was queued was run")
+	}
+	if dropped := server.s.droppedRequests.Value(dropLifetime); dropped != 2 {
+		t.Fatalf("%d requests were dropped for their lifetime, not 2", dropped)
+	}
+
+	// What the resource makes of the request that was cut off is thrown away, and the client's next request gets its
+	// own reply.
+	expectReply(t, clients[1].request(2, "after"), "after")
+	eventually(t, "nothing is left pending", func() bool { return server.s.pending.Load() == 0 })
+}
@@ -0,0 +1,85 @@
+package impact
+
+import (
+	"encoding/json"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"time"
+)
+
+// A client that knows the limits on its connection can keep within them, rather than finding them out by being turned
+// away. It can ask for them at any time with a Limits message, and gets them back as JSON, as they are for its
+// connection once the handshake is done and any reload is in effect. A limit of zero means there is none. Durations
+// are in milliseconds, as the protocol's deadlines and timeouts are.
+type connectionLimits struct {
+	// What was agreed in the handshake. Compression is empty if there is none.
+	Version     uint8  `json:"version"`
+	Compression string `json:"compression,omitempty"`
+	// Who the client authenticated as, which the per-identity limits are counted against. Empty if it didn't.
+	Identity string `json:"identity,omitempty"`
+
+	// The largest request payload the client may send, and reply it may be sent, in bytes.
+	MaxMessageSize int `json:"max_message_size"`
+	MaxReplySize   int `json:"max_reply_size"`
+
+	// Requests per second allowed on this connection, and across every connection.
+	RateLimit       float64 `json:"rate_limit"`
+	GlobalRateLimit float64 `json:"global_rate_limit"`
+
+	// The timeout a request gets when it doesn't ask for one, and the most it can ask for.
+	DefaultRequestTimeoutMs int64 `json:"default_request_timeout_ms"`
+	MaxRequestTimeoutMs     int64 `json:"max_request_timeout_ms"`
+
+	// Requests that may be in flight at once, across the whole server, and for the client's identity across all of its
+	// connections.
+	MaxInFlight            int64 `json:"max_in_flight"`
+	MaxInFlightPerIdentity int64 `json:"max_in_flight_per_identity"`
+
+	// Under flow control, how many requests the client may have unanswered, how many credits it has left now, and the
+	// most request payload bytes it may have unanswered.
+	FlowWindow          int   `json:"flow_window"`
+	Credits             int64 `json:"credits"`
+	MaxOutstandingBytes int   `json:"max_outstanding_bytes"`
+
+	// How long a write to the client may block, and how long it has to finish sending a message once it has started.
+	WriteTimeoutMs       int64 `json:"write_timeout_ms"`
+	MessageReadTimeoutMs int64 `json:"message_read_timeout_ms"`
+
+	// How long the client has to come back and resume its session if its connection drops.
+	ResumeTTLMs int64 `json:"resume_ttl_ms"`
+}
+
+func (s *server) limitsOf(conn *connection.Conn) connectionLimits {
+	limits := connectionLimits{
+		Version:                 conn.Version,
+		Identity:                conn.Identity,
+		MaxMessageSize:          conn.MaxMessageSize(),
+		MaxReplySize:            s.maxReplySize,
+		RateLimit:               s.connectionRateLimit(),
+		GlobalRateLimit:         s.globalRateLimit.currentRate(),
+		DefaultRequestTimeoutMs: time.Duration(s.defaultRequestTimeout.Load()).Milliseconds(),
+		MaxRequestTimeoutMs:     time.Duration(s.maxRequestTimeout.Load()).Milliseconds(),
+		MaxInFlight:             s.maxInFlight.Load(),
+		MaxInFlightPerIdentity:  s.maxInFlightIdentity.Load(),
+		MaxOutstandingBytes:     s.maxOutstandingBytes,
+		WriteTimeoutMs:          conn.WriteTimeout().Milliseconds(),
+		MessageReadTimeoutMs:    conn.MessageReadTimeout().Milliseconds(),
+		ResumeTTLMs:             s.resumeTTL.Milliseconds(),
+	}
+	if conn.Compression != 0 {
+		limits.Compression = message.Compression(conn.Compression).String()
+	}
+	if window := s.windowOf(conn); window != nil && window.replenish > 0 {
+		limits.FlowWindow = s.windowSize
+		limits.Credits = window.credits.Load()
+	}
+
+	return limits
+}
+
+// Answer a client's Limits message.
+func (s *server) answerLimits(conn *connection.Conn, correlationID uint64) {
+	// Nothing in the limits can fail to marshal.
+	limits, _ := json.Marshal(s.limitsOf(conn))
+	_ = conn.WriteMessage(s.compressFor(conn, message.NewLimits(conn.Version, correlationID, limits)))
+}
@@ -0,0 +1,96 @@
+package impact
+
+import (
+	"encoding/json"
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// Ask for the limits on the client's connection.
+func (c *testClient) limits(correlationID uint64) connectionLimits {
+	c.t.Helper()
+
+	question := message.ImpactMessage{Header: message.NewHeader(message.Limits)}
+	question.Header.CorrelationID = correlationID
+	c.write(question)
+
+	answer := receiveAnswer(c)
+	if answer.Header.Type != message.Limits || answer.Header.CorrelationID != correlationID {
+		c.t.Fatalf("got a message of type %d for request %d in answer to a Limits message", answer.Header.Type, answer.Header.CorrelationID)
+	}
+	var limits connectionLimits
+	if decodeError := json.Unmarshal(answer.Payload, &limits); decodeError != nil {
+		c.t.Fatalf("the limits aren't JSON: %v", decodeError)
+	}
+	return limits
+}
+
+// A client that asks is told the limits as they apply to its connection, including what it agreed in its handshake and
+// the credits it has left, and as they are after a reload.
+func TestAnswerLimits(t *testing.T) {
+	tokens := func(client Client) (string, error) {
+		if client.Token == "" {
+			return "", ErrNoIdentity
+		}
+		return client.Token, nil
+	}
+	var config Config
+	server, address := startServer(t, "echo", func(configured *Config) {
+		configured.MaxMessageSize = 4096
+		configured.MaxReplySize = 65536
+		configured.RateLimit = 5
+		configured.GlobalRateLimit = 50
+		configured.RequestTimeout = 2 * time.Second
+		configured.MaxRequestTimeout = 10 * time.Second
+		configured.MaxInFlight = 100
+		configured.MaxInFlightIdentity = 10
+		configured.FlowWindow = 4
+		configured.FlowReplenish = 2
+		configured.MaxOutstandingBytes = 1024
+		configured.WriteTimeout = 3 * time.Second
+		configured.MessageReadTimeout = 4 * time.Second
+		configured.ResumeTTL = time.Minute
+		config = *configured
+	}, WithIdentityExtractor("tokens", tokens))
+
+	hello := message.NewHello(message.MinimumVersion, message.Version)
+	hello.Header.Token = "alice"
+	client, welcome := connect(t, address, hello)
+	if welcome.Header.Type != message.Welcome {
+		t.Fatalf("got a message of type %d in answer to the hello", welcome.Header.Type)
+	}
+
+	want := connectionLimits{
+		Version:                 welcome.Header.Version,
+		Identity:                "alice",
+		MaxMessageSize:          4096,
+		MaxReplySize:            65536,
+		RateLimit:               5,
+		GlobalRateLimit:         50,
+		DefaultRequestTimeoutMs: 2000,
+		MaxRequestTimeoutMs:     10000,
+		MaxInFlight:             100,
+		MaxInFlightPerIdentity:  10,
+		FlowWindow:              4,
+		Credits:                 3,
+		MaxOutstandingBytes:     1024,
+		WriteTimeoutMs:          3000,
+		MessageReadTimeoutMs:    4000,
+		ResumeTTLMs:             60000,
+	}
+	// Its credit is only granted back with the next one's.
+	client.send(1, "uses a credit")
+	expectReply(t, receiveAnswer(client), "uses a credit")
+	if limits := client.limits(2); limits != want {
+		t.Fatalf("the limits are\n%+v\nnot\n%+v", limits, want)
+	}
+
+	config.RateLimit = 7
+	config.MaxInFlight = 200
+	server.s.applySettings(config)
+	want.RateLimit, want.MaxInFlight = 7, 200
+	if limits := client.limits(3); limits != want {
+		t.Fatalf("after a reload, the limits are\n%+v\nnot\n%+v", limits, want)
+	}
+}
@@ -0,0 +1,143 @@
+package impact
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Plain log lines suit a person reading a terminal, but not a log pipeline, which would rather not parse them. Under a
+// structured -log-format, each line is a record with a time, a level, a message and attributes, written as one line of
+// JSON or logfmt. Lines about a connection, and lines such as spans that are all details, are logged with their
+// details as attributes in the first place, and only written out as key=value pairs in plain lines. Any other line is
+// its message, with a level other than info taken from a prefix such as "warning: ".
+//
+// -log-format says how log lines are written, one of:
+const (
+	// Plain lines, after a timestamp, as the standard library writes them.
+	logFormatText = "text"
+	// One JSON object per line.
+	logFormatJSON = "json"
+	// One line of key=value pairs.
+	logFormatLogfmt = "logfmt"
+)
+
+// The prefixes that give a line a level other than info.
+var logLevels = []struct {
+	prefix string
+	level  slog.Level
+}{
+	{"debug: ", slog.LevelDebug},
+	{"warning: ", slog.LevelWarn},
+	{"error: ", slog.LevelError},
+}
+
+func knownLogFormat(format string) bool {
+	return format == logFormatText || format == logFormatJSON || format == logFormatLogfmt
+}
+
+// A logger writing to the output in the format. Validate has already checked the format.
+func newLogger(format string, output io.Writer) *log.Logger {
+	if format == logFormatText || format == "" {
+		return log.New(output, "", log.LstdFlags)
+	}
+
+	// The record has its own time, so the line doesn't start with one.
+	return log.New(newStructuredLog(format, output), "", 0)
+}
+
+// Write the standard logger's lines in the format, so that anything logged without a server's logger is too.
+func setLogFormat(format string) {
+	if format == logFormatText || format == "" {
+		return
+	}
+
+	log.SetFlags(0)
+	log.SetOutput(newStructuredLog(format, log.Writer()))
+}
+
+// Takes each line a logger writes apart into a record for its handler.
+type structuredLog struct {
+	handler slog.Handler
+}
+
+func newStructuredLog(format string, output io.Writer) *structuredLog {
+	// Whether to log debugging detail is decided before it is logged, by -debug, so every level is written.
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == logFormatJSON {
+		return &structuredLog{handler: slog.NewJSONHandler(output, options)}
+	}
+	return &structuredLog{handler: slog.NewTextHandler(output, options)}
+}
+
+// A logger writes each line with one call, so each call is one record.
+func (l *structuredLog) Write(line []byte) (int, error) {
+	text := strings.TrimSuffix(string(line), "\n")
+
+	level := slog.LevelInfo
+	for _, prefixed := range logLevels {
+		if strings.HasPrefix(text, prefixed.prefix) {
+			level = prefixed.level
+			text = text[len(prefixed.prefix):]
+			break
+		}
+	}
+
+	record := slog.NewRecord(time.Now(), level, text, 0)
+	if handleError := l.handler.Handle(context.Background(), record); handleError != nil {
+		return 0, handleError
+	}
+
+	return len(line), nil
+}
+
+// The handler a logger's records go to, if it writes in a structured format.
+func handlerOf(logger *log.Logger) (slog.Handler, bool) {
+	structured, isStructured := logger.Writer().(*structuredLog)
+	if !isStructured {
+		return nil, false
+	}
+
+	return structured.handler, true
+}
+
+// A logger whose lines all carry the attributes: as the records' own under a structured format, and in plain lines as
+// key=value pairs after the timestamp.
+func withAttrs(logger *log.Logger, attributes ...slog.Attr) *log.Logger {
+	if handler, structured := handlerOf(logger); structured {
+		return log.New(&structuredLog{handler: handler.WithAttrs(attributes)}, "", 0)
+	}
+
+	return log.New(logger.Writer(), formatAttrs(attributes)+" ", logger.Flags()|log.Lmsgprefix)
+}
+
+// Log a line that is a name and its details, at info. In plain lines, the details follow the name as key=value pairs.
+func logAttrs(logger *log.Logger, message string, attributes ...slog.Attr) {
+	handler, structured := handlerOf(logger)
+	if !structured {
+		logger.Print(message + ": " + formatAttrs(attributes))
+		return
+	}
+
+	record := slog.NewRecord(time.Now(), slog.LevelInfo, message, 0)
+	record.AddAttrs(attributes...)
+	_ = handler.Handle(context.Background(), record)
+}
+
+// Attributes as key=value pairs, with any value that would be ambiguous, or is empty, quoted.
+func formatAttrs(attributes []slog.Attr) string {
+	pairs := make([]string, 0, len(attributes))
+	for _, attribute := range attributes {
+		value := attribute.Value.Resolve().String()
+		if value == "" || strings.ContainsAny(value, " =\"") || strconv.Quote(value) != `"`+value+`"` {
+			value = strconv.Quote(value)
+		}
+		pairs = append(pairs, attribute.Key+"="+value)
+	}
+
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// The JSON records logged, one for each line.
+func jsonRecords(t *testing.T, logs *lockedBuffer) []map[string]any {
+	t.Helper()
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		record := map[string]any{}
+		if decodeError := json.Unmarshal([]byte(line), &record); decodeError != nil {
+			t.Fatalf("a line isn't JSON: %v\n%s", decodeError, line)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Under -log-format json, a connection's lines carry who it is as attributes, and a span has its details as attributes
+// of their own types, with the level taken from the line's prefix.
+func TestJSONLogs(t *testing.T) {
+	logs := &lockedBuffer{}
+	_, address := startServer(t, "echo", func(config *Config) {
+		config.Debug = true
+		config.SpanSample = 1
+	}, WithLogger(newLogger(logFormatJSON, logs)))
+
+	client := dial(t, address)
+	expectReply(t, client.request(7, "logged"), "logged")
+	eventually(t, "the span is logged", func() bool { return strings.Contains(logs.String(), `"msg":"span"`) })
+
+	var opened, span map[string]any
+	for _, record := range jsonRecords(t, logs) {
+		switch record["msg"] {
+		case "connection opened":
+			opened = record
+		case "span":
+			span = record
+		}
+	}
+	if opened == nil || opened["level"] != "DEBUG" || opened["connection"] == nil || opened["remote"] == nil {
+		t.Fatalf("the connection opening was logged as %v", opened)
+	}
+	if span == nil || span["connection"] != opened["connection"] {
+		t.Fatalf("the span was logged as %v, not for connection %v", span, opened["connection"])
+	}
+	if span["correlation"] != float64(7) || span["outcome"] != "replied" || span["why"] != "sampled" {
+		t.Fatalf("the span was logged as %v", span)
+	}
+	if total, isNumber := span["total"].(float64); !isNumber || total <= 0 {
+		t.Fatalf("the span's total is %v, not a duration", span["total"])
+	}
+}
@@ -1,103 +1,784 @@
-package main
+package impact
 
 import (
-	"flag"
+	"errors"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/impact/internal/resource"
 	"github.com/blanu/radiowave"
-	"internal/message"
-	"internal/request"
-	"os"
-	"strconv"
+	"net"
+	"syscall"
+	"time"
 )
 
-// The purpose of impact is to provided multi-user serialized access to a resource.
-func main() {
-	port := flag.Int("port", 1111, "port on which to listen")
-	if port == nil {
-		print("port required")
-		os.Exit(3)
-	}
-
-	path := flag.String("path", "", "path for shared resource executable")
-	if path == nil || *path == "" {
-		print("No path to resource")
-		os.Exit(9)
-	}
-
-	factory := message.NewImpactMessageFactory()
-
-	// If we can't launch the resource, we must give up.
-	process, resourceError := radiowave.Exec(factory, *path)
-	if resourceError != nil {
-		print(resourceError)
-		os.Exit(12)
-	}
-
-	// If we can't listen, we must give up.
-	listener, listenError := radiowave.Listen(factory, "0.0.0.0:"+strconv.Itoa(*port))
-	if listenError != nil {
-		os.Exit(10)
-	}
-
-	// There is only one process handler coroutine
-	funnel := make(chan request.Request)
-	go handleProcess(*process, funnel)
+// Accept connections from one listener until it is closed. Report why, if it wasn't closed by shutting down.
+func (s *server) acceptConnections(listener *connection.Listener) error {
+	// How long to wait before accepting again after a temporary failure.
+	acceptBackoff := time.Duration(0)
 
 	for {
 		// The purpose of this program is to give shared access for a resource to multiple connections.
 		connection, acceptError := listener.Accept()
 
-		// If we failed to accept then the listen is broken. We could continue to serve existing connections, but since
-		// this should never happen, let's give up instead.
 		if acceptError != nil {
-			os.Exit(11)
+			// If we closed the listener ourselves, we are shutting down and the drain decides when to exit.
+			if s.shuttingDown.Load() {
+				return nil
+			}
+
+			// Running out of file descriptors, or a client giving up mid-accept, doesn't mean the listener is broken.
+			// Existing connections will finish and free up what we need, so wait a little and try again.
+			if isTemporaryAcceptError(acceptError) {
+				acceptBackoff = min(max(2*acceptBackoff, 5*time.Millisecond), time.Second)
+				s.logger.Printf("temporary accept error, retrying in %s: %v", acceptBackoff, acceptError)
+				time.Sleep(acceptBackoff)
+				continue
+			}
+
+			// Otherwise the listen is broken. We could continue to serve existing connections, but since this should
+			// never happen, let's give up instead.
+			return fmt.Errorf("fatal accept error: %w", acceptError)
 		}
+		acceptBackoff = 0
 
 		// Access to the shared resources is concurrent from all connections
 		// There is one connection handler coroutine for each connection.
-		go handleConnection(*connection, funnel)
+		go s.handleConnection(connection)
 	}
 }
 
 // The connection handler represents the connection's perspective on the interaction with the shared resource.
-func handleConnection(connection radiowave.Conn, funnel chan request.Request) {
-	// We're in charge on one connection.
+func (s *server) handleConnection(connection *connection.Conn) {
+	// We're in charge on one connection. How it ends depends on why it ends.
+	closeReason := closeFinished
+	defer func() { _ = connection.CloseFor(closeReason) }()
 
-	// This is our dedicated response channel just for this connection.
-	responseChannel := make(chan radiowave.Message)
+	// Nothing else happens until we and the client agree on which version of the protocol to speak.
+	session, agreed := s.handshake(connection)
+	if !agreed {
+		closeReason = closeRefused
+		s.leaveSession(session, closeReason)
+		return
+	}
+	// The session outlives the connection, so it is left once everything else about the connection is done with.
+	defer func() { s.leaveSession(session, closeReason) }()
+
+	s.startLogger(connection)
+	if s.debug.Load() {
+		if connection.AuthMethod != "" {
+			connection.Logger().Printf("debug: connection opened, authenticated by %s", connection.AuthMethod)
+		} else {
+			connection.Logger().Printf("debug: connection opened")
+		}
+		defer connection.Logger().Printf("debug: connection closed")
+	}
+
+	// Once the client speaks our protocol, it can be told when we are going away.
+	s.addConnection(connection)
+	defer s.removeConnection(connection)
+	s.startUsage(connection)
+	defer s.endUsage(connection)
+	window := s.startWindow(connection)
+	defer s.endWindow(connection)
+
+	// Each request gets its own response channel, so that nothing meant for one request can be taken for the answer to
+	// the next, even once we have stopped waiting for it. Once the client has gone, anything still being answered is
+	// dropped instead of waiting for us.
+	// A request whose reply is kept for the client to resume its session for closes gone itself, once it is answered.
+	gone := make(chan bool)
+	parked := false
+	defer func() {
+		if !parked {
+			close(gone)
+		}
+	}()
+
+	// A client that resumed its session first gets whatever it went before getting.
+	s.deliverParked(connection, session)
+
+	// Each connection has its own allowance of requests.
+	rateLimit := newRateLimit(s.connectionRateLimit())
+
+	// Process each message from the connection. Under flow control, they are read ahead, each request using up a
+	// credit as it arrives. Once a request with a credit is answered, however it is answered, the credit is given back.
+	for wave := range s.readAhead(connection, window, gone) {
+		if refused, isRefused := wave.(uncredited); isRefused {
+			s.drop(connection.ID, refused.Header.CorrelationID, dropNoCredit, "request sent without credit")
+			_ = connection.WriteMessage(s.encodeError(message.ImpactError{CorrelationID: refused.Header.CorrelationID, Code: message.NoCredit, Description: "request sent without flow control credit"}))
+			continue
+		}
+
+		// The rest of an oversized message was never read, so there's nothing to pass on.
+		if oversized, isOversized := asOversized(wave); isOversized {
+			description := fmt.Sprintf("message of %d bytes is larger than the server allows", oversized.Size)
+			s.drop(connection.ID, 0, dropOversized, description)
+			_ = connection.WriteMessage(s.encodeError(message.ImpactError{Code: message.MessageTooLarge, Description: description}))
+			continue
+		}
+
+		impactMessage, ok := wave.(message.ImpactMessage)
+		if !ok {
+			s.drop(connection.ID, correlationOf(wave), dropProtocol, "not an impact message")
+			_ = connection.WriteMessage(s.encodeError(message.ImpactError{CorrelationID: correlationOf(wave), Code: message.UnexpectedMessage, Description: "expected a request"}))
+			continue
+		}
+
+		// A payload that won't decompress means the client is confused or hostile. Either way, we stop listening to it.
+		impactMessage, decompressError := s.decompressFrom(connection, impactMessage)
+		if decompressError != nil {
+			s.drop(connection.ID, impactMessage.Header.CorrelationID, dropProtocol, decompressError.Error())
+			_ = connection.WriteMessage(s.encodeError(message.ImpactError{CorrelationID: impactMessage.Header.CorrelationID, Code: message.CorruptPayload, Description: decompressError.Error()}))
+			closeReason = closeProtocol
+			return
+		}
+
+		// A client may ask what limits apply to it at any time, and is answered by impact without troubling the resource.
+		if impactMessage.Header.Type == message.Limits {
+			s.answerLimits(connection, impactMessage.Header.CorrelationID)
+			continue
+		}
+
+		// Requests are passed on to the resource. What happens to any other type of message is up to the operator.
+		if impactMessage.Header.Type != message.Request {
+			description := fmt.Sprintf("no route for message type %d", impactMessage.Header.Type)
+
+			switch s.unknownType {
+			case unknownTypeReject:
+				s.drop(connection.ID, impactMessage.Header.CorrelationID, dropUnroutable, description)
+				_ = connection.WriteMessage(s.encodeError(message.ImpactError{CorrelationID: impactMessage.Header.CorrelationID, Code: message.UnknownMessageType, Description: description}))
+				continue
+
+			case unknownTypeClose:
+				s.drop(connection.ID, impactMessage.Header.CorrelationID, dropUnroutable, description)
+				closeReason = closeProtocol
+				return
+
+			case unknownTypeDefault:
+				// There is only one resource, so it is also the default route. It gets the message just like a request.
+			}
+		}
+
+		if impactMessage.Header.Version != connection.Version {
+			s.drop(connection.ID, impactMessage.Header.CorrelationID, dropProtocol, "wrong protocol version")
+			_ = connection.WriteMessage(s.encodeError(message.ImpactError{CorrelationID: impactMessage.Header.CorrelationID, Code: message.UnsupportedVersion, Description: "request does not use the version agreed in the handshake"}))
+			s.replenish(connection, window, impactMessage)
+			continue
+		}
+
+		// The resource is told which connection each request came from, so that it can push to that connection later.
+		impactMessage.Header.ConnectionID = connection.ID
 
-	// Process each message from the connection.
-	for wave := range connection.OutputChannel {
 		// Package this request up in a Request callback.
 		// The callback includes our dedicated response channel.
-		request := request.Request{wave, responseChannel}
+		request := request.Request{
+			Message:       impactMessage,
+			ReplyChannel:  make(chan radiowave.Message),
+			Gone:          gone,
+			CorrelationID: impactMessage.Header.CorrelationID,
+			ConnectionID:  connection.ID,
+			Identity:      connection.Identity,
+			Cost:          impactMessage.Header.Cost,
+			Priority:      impactMessage.Header.Priority,
+			Resource:      impactMessage.Header.Resource,
+			TraceID:       impactMessage.Header.Trace,
+			Status:        request.NewStatus(),
+		}
+		if impactMessage.Header.Deadline != 0 {
+			request.Deadline = time.Now().Add(time.Duration(impactMessage.Header.Deadline) * time.Millisecond)
+		}
+		request.Timeout = s.requestTimeout(impactMessage.Header)
+		trail := s.audit.begin(connection, request)
 
-		// All requests go into the funnel. There is just one funnel because there is just one process.
-		funnel <- request
+		// A retry of a request that has already been answered gets the same answer, without troubling the resource.
+		idempotencyKey := dedupKey{identity: connection.Identity, resource: impactMessage.Header.Resource, key: impactMessage.Header.IdempotencyKey}
+		if replies, found := s.replies.lookup(idempotencyKey); found {
+			s.dedupHits.Inc()
+			// The retry ends as the cached answer did, unless it doesn't reach the client this time.
+			failed, cancelled := false, false
+			for _, reply := range replies {
+				if _, isError := reply.(message.ImpactError); isError {
+					failed = true
+				}
+				writeError := connection.WriteMessage(s.compressFor(connection, s.encodeErrors(readdress(reply, request.CorrelationID))))
+				if writeError != nil {
+					s.drop(request.ConnectionID, request.CorrelationID, dropDisconnect, writeError.Error())
+					cancelled = true
+				} else {
+					s.countOut(connection, reply)
+				}
+				trail.add(reply)
+			}
+			s.audit.record(trail, auditOutcome(failed, cancelled))
+			s.replenish(connection, window, impactMessage)
+			continue
+		}
+
+		// A client that is sending too fast is told how long to back off for.
+		if limited, wait := s.rateLimited(rateLimit); limited {
+			description := fmt.Sprintf("rate limited, try again in %s", wait.Round(time.Millisecond))
+			s.drop(request.ConnectionID, request.CorrelationID, dropRateLimited, description)
+			refusal := message.ImpactError{CorrelationID: request.CorrelationID, Code: message.RateLimited, Description: description, RetryAfter: wait}
+			_ = connection.WriteMessage(s.encodeError(refusal))
+			trail.add(refusal)
+			s.audit.record(trail, auditRefused)
+			s.replenish(connection, window, impactMessage)
+			continue
+		}
+
+		// Once the connection is draining, only what was sent before is still answered.
+		if s.refuseDraining(connection, request) {
+			trail.add(message.ImpactError{Code: message.ShuttingDown})
+			s.audit.record(trail, auditRefused)
+			s.replenish(connection, window, impactMessage)
+			continue
+		}
+
+		s.limitLifetime(&request)
+		backend, refusal := s.submit(request, connection.Done())
+		if backend == nil {
+			request.End()
+			if refusal != nil {
+				_ = connection.WriteMessage(s.encodeError(*refusal))
+				trail.add(*refusal)
+			}
+			s.audit.record(trail, auditRefused)
+			s.replenish(connection, window, impactMessage)
+			continue
+		}
+		// Only requests that are taken count towards the client's usage, not those it is turned away with.
+		s.countIn(connection, impactMessage)
+		queued := time.Now()
+
+		// Finding the position costs time proportional to the queue, so clients only hear it if the operator asks.
+		// A request that has already left the queue is about to be answered, which says more than any position.
+		if s.queuePosition {
+			if position, stillQueued := backend.scheduler.Position(request); stillQueued {
+				// Whatever is waiting in a buffered funnel goes first.
+				position += len(backend.funnel)
+				_ = connection.WriteMessage(message.NewQueued(connection.Version, request.CorrelationID, position))
+			}
+		}
 
 		// Now we wait for a response on our dedicated response channel.
-		response := <-responseChannel
+		// A chunked response keeps coming until its final chunk.
+		// The next request from this connection isn't taken until this one is answered. Under flow control, or a cap on
+		// outstanding bytes, it may already have been read ahead, but it waits in the window's buffer until then. Either
+		// way, a client that pipelines its requests gets their replies in the order it sent them, even from a resource
+		// that answers out of order.
+		var responses []radiowave.Message
+		failed, cancelled, outlived := false, false, false
+		for {
+			var response radiowave.Message
+			select {
+			case response = <-request.ReplyChannel:
+			// A client that has gone has nobody left to tell. We stop waiting, and the answer is dropped, unless the
+			// client may come back for it.
+			case <-connection.Done():
+				s.audit.record(trail, auditDisconnected)
+				if session != nil && s.park(session, backend, request, gone) {
+					parked = true
+					return
+				}
+				s.drop(request.ConnectionID, request.CorrelationID, dropDisconnect, "client went away while its request was in flight")
+				s.untrack(request, false, true)
+				return
+			// Wherever the request has got to, it has run out of time. The client is told, and whatever is still to
+			// come of the answer is dropped.
+			case <-request.Lifetime():
+				response = backend.outlived(request)
+				failed, outlived = true, true
+			}
+
+			if idempotencyKey.key != "" {
+				responses = append(responses, response)
+			}
+			trail.add(response)
+			if _, isError := response.(message.ImpactError); isError {
+				failed = true
+			}
+
+			// Send the response back to the connection.
+			writeError := connection.WriteMessage(s.compressFor(connection, s.encodeErrors(response)))
+			if writeError != nil {
+				s.drop(request.ConnectionID, request.CorrelationID, dropDisconnect, writeError.Error())
+				cancelled = true
+			} else {
+				s.countOut(connection, response)
+			}
+
+			if outlived || !message.HasMore(response) {
+				break
+			}
+		}
+		s.observeLatency(request, time.Since(queued))
+		s.untrack(request, failed, cancelled)
+		s.audit.record(trail, auditOutcome(failed, cancelled))
+		// An answer cut short isn't one to give a retry.
+		if !outlived {
+			s.replies.store(idempotencyKey, responses)
+		}
+		s.replenish(connection, window, impactMessage)
+	}
+}
+
+// Hand a request to its backend's queue, unless it has to be turned away, in which case the error to answer it with
+// is returned instead. Every transport goes through here, so the same limits apply however a request arrives. A
+// request dropped without an answer gets neither a backend nor an error. Done is closed if the client goes away.
+func (s *server) submit(request request.Request, done <-chan bool) (*backend, *message.ImpactError) {
+	// Each request is served by one backend, chosen now.
+	backend := s.route(request)
+	if backend == nil {
+		s.drop(request.ConnectionID, request.CorrelationID, dropUnroutable, fmt.Sprintf("no resource named %q", request.Resource))
+		return nil, &message.ImpactError{CorrelationID: request.CorrelationID, Code: message.UnknownResource, Description: fmt.Sprintf("no resource named %q", request.Resource)}
+	}
 
-		// Send the response back to the connection.
-		connection.InputChannel <- response
+	// A resource that isn't taking its input can't take this request either, however long it queues.
+	if backend.inputBlocked() {
+		s.drop(request.ConnectionID, request.CorrelationID, dropBackpressure, "resource is not taking its input")
+		return nil, &message.ImpactError{CorrelationID: request.CorrelationID, Code: message.Overloaded, Description: "resource is not taking requests, try again later"}
 	}
+
+	// When the resource is slowing down, we turn some requests away now rather than make them all wait.
+	if backend.shedder.shed() {
+		s.drop(request.ConnectionID, request.CorrelationID, dropShed, "resource is overloaded")
+		return nil, &message.ImpactError{CorrelationID: request.CorrelationID, Code: message.Overloaded, Description: "resource is overloaded, try again later"}
+	}
+
+	// However many connections one client spreads its requests over, it can't have more than its share in flight. This
+	// comes before the server's own cap, which it would otherwise take, or make another client's request give up.
+	if !s.admitIdentity(request) {
+		s.drop(request.ConnectionID, request.CorrelationID, dropIdentityCapacity, fmt.Sprintf("%s has as many requests in flight as it may", identityOf(request)))
+		return nil, &message.ImpactError{CorrelationID: request.CorrelationID, Code: message.AtCapacity, Description: "too many requests in flight for this identity"}
+	}
+
+	// Every request in the pipeline holds on to memory. Past the cap, the overflow policy decides what gives.
+	if !s.admit() && !s.overflowInFlight(request, done) {
+		s.releaseIdentity(request)
+		if s.inFlightOverflow == overflowDropNewest {
+			s.drop(request.ConnectionID, request.CorrelationID, dropCapacity, "server at capacity, dropped without an answer")
+			return nil, nil
+		}
+
+		s.drop(request.ConnectionID, request.CorrelationID, dropCapacity, "server at capacity")
+		return nil, &message.ImpactError{CorrelationID: request.CorrelationID, Code: message.AtCapacity, Description: "server at capacity"}
+	}
+
+	// A client that hasn't said who it is can't push everyone else's requests back indefinitely.
+	if request.Identity == "" {
+		request.Priority = min(request.Priority, s.maxAnonymousPriority)
+	}
+
+	// All requests are queued for their backend's funnel, which every member of the backend's pool takes from.
+	s.tagRequest(&request)
+	s.track(request)
+	s.backendRequests.Inc(backend.name)
+	backend.scheduler.Push(request)
+
+	return backend, nil
 }
 
-func handleProcess(process radiowave.Process, funnel chan request.Request) {
-	// We only have one process.
+func (m *member) handleProcess(process *resource.Process) {
+	// Each member has one process.
 	// Requests will come in from multiple connections.
 	// We serialize them to provide multi-user access to the resource.
-	for request := range funnel {
-		// We have a message from the funnel.
-		// Send it to the process.
-		process.InputChannel <- request.Message
+	for process != nil {
+		select {
+		case request := <-m.intake():
+			if m.stale(request) || !m.journaled(request) {
+				continue
+			}
+
+			process = m.serveRequest(process, request)
+			m.pending.Add(-1)
+
+		case probe := <-m.probes:
+			process = m.serveRequest(process, probe)
+
+		case reason := <-m.restarts:
+			process = m.restartProcess(process, reason)
+
+		case done := <-m.quits:
+			m.quit(process)
+			close(done)
+			process = nil
+
+		// Draining or undraining changes whether we take from the funnel, which is looked at again next time round.
+		case <-m.wake:
+
+		// No more messages from the process means that it has terminated.
+		case <-process.ExitChannel:
+			process = m.processExited(process)
+		}
+	}
+
+	// We only get here if the resource stopped during shutdown. The drain is waiting for the funnel to empty.
+	m.stopped()
+}
+
+// A request that can't be journaled isn't run, since nobody could find out afterwards that it was.
+// The client is told so, and the request is no longer pending.
+func (b *backend) journaled(request request.Request) bool {
+	journalError := b.journal.record(request.Message)
+	if journalError == nil {
+		return true
+	}
+
+	b.drop(request.ConnectionID, request.CorrelationID, dropJournal, journalError.Error())
+	request.Reply(message.ImpactError{CorrelationID: request.CorrelationID, Code: message.NotJournaled, Description: "request could not be journaled"})
+	b.pending.Add(-1)
+
+	return false
+}
+
+// The scheduler's coroutine keeps the funnel topped up, in whatever order the scheduler chooses.
+func (b *backend) handleScheduler() {
+	for {
+		// The scheduler is closed once the server has stopped, and there is nothing more to feed.
+		next, open := b.scheduler.Pop()
+		if !open {
+			return
+		}
+
+		// A resource that has only just started is eased into its workload.
+		b.warmup.wait()
+
+		if b.stale(next) {
+			continue
+		}
+
+		next.SetState(request.Dispatched)
+		select {
+		case b.funnel <- next:
+		case <-b.halted:
+			return
+		}
+	}
+}
+
+// Report whether a request is no longer worth running, in which case it has been seen to and is no longer pending.
+// Requests are looked at as they leave the queue, and again as they reach the resource, since they can go stale while
+// they wait in a buffered funnel, or in the scheduler's hand for a full one.
+func (b *backend) stale(next request.Request) bool {
+	// A request that outlived its lifetime while queued has already been answered.
+	if next.Expired() {
+		b.pending.Add(-1)
+		return true
+	}
+
+	// Running a request whose client has given up on it would only make the requests behind it late as well.
+	if !next.Deadline.IsZero() && time.Now().After(next.Deadline) {
+		b.drop(next.ConnectionID, next.CorrelationID, dropExpired, "deadline passed while queued")
+		next.Reply(message.ImpactError{CorrelationID: next.CorrelationID, Code: message.DeadlineExceeded, Description: "deadline passed before the resource got to the request"})
+		b.pending.Add(-1)
+		return true
+	}
+
+	return false
+}
+
+// Serve one request, returning the process that should serve the next one.
+// This is only a different process from the one we were given if the resource had to be restarted.
+func (m *member) serveRequest(process *resource.Process, request request.Request) *resource.Process {
+	m.recordProgress()
+	defer m.recordProgress()
+
+	m.busy.Store(true)
+	defer m.busy.Store(false)
+
+	// We have a message from the funnel.
+	// Send it to the process.
+	switch outcome, reason := m.send(process, request.Message); outcome {
+	case sendDelivered:
+		m.markExecuting(request)
+	case sendRestart:
+		m.drop(request.ConnectionID, request.CorrelationID, dropRestart, "resource restarted before the request was sent")
+		request.Reply(message.ImpactError{CorrelationID: request.CorrelationID, Code: message.ResourceRestarted, Description: "resource restarted before the request was sent"})
+		return m.restartProcess(process, reason)
+	case sendExited:
+		m.drop(request.ConnectionID, request.CorrelationID, dropShutdown, "resource stopped before the request was sent")
+		request.Reply(message.ImpactError{CorrelationID: request.CorrelationID, Code: message.ResourceStopped, Description: "resource stopped before the request was sent"})
+		return m.processExited(process)
+	}
+
+	// Get the reply from the process. A big reply can come in chunks, which are relayed as they arrive.
+	x := &exchange{request: request, dispatched: time.Now()}
+
+	var expired <-chan time.Time
+	if due, hasTimeout := x.due(); hasTimeout {
+		timer := time.NewTimer(time.Until(due))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case reply, open := <-process.OutputChannel:
+			if !open {
+				m.abandonOutputClosed(x, process)
+				return m.outputClosed(process)
+			}
 
-		// Get the reply from the process.
-		reply := <-process.OutputChannel
+			if m.sentinel(x, reply) {
+				return m.restartProcess(process, restartSentinel)
+			}
 
-		// Send the reply back on the dedicated reply channel.
-		request.ReplyChannel <- reply
+			// Requests are serialized, so whatever the resource sends next is the reply to this request, whether
+			// or not the resource bothered to copy over the correlation id.
+			if m.relay(x, reply) {
+				return process
+			}
+
+		// The client gives up on the reply, but the resource still has to finish it before it can take the next request,
+		// unless it is restarted or killed for taking so long.
+		case <-expired:
+			m.timedOut(x)
+			expired = nil
+			if m.timeoutAction != timeoutActionNone {
+				return m.afterTimeout(process, nil)
+			}
+
+		// If the resource is hung, we will never get a reply. The prober or the watchdog notices and asks for a restart.
+		case reason := <-m.restarts:
+			m.abandon(x, dropRestart, message.ResourceRestarted, "resource restarted while handling the request")
+			return m.restartProcess(process, reason)
+
+		// Once the drain is over, the reply has nobody left to go to. The resource is asked to exit all the same, and
+		// killed if it is too hung to.
+		case done := <-m.quits:
+			m.abandon(x, dropShutdown, message.ResourceStopped, "resource stopped because the server is shutting down")
+			m.quit(process)
+			close(done)
+			return nil
+
+		case <-process.ExitChannel:
+			m.abandon(x, dropShutdown, message.ResourceStopped, "resource stopped while handling the request")
+			return m.processExited(process)
+		}
 	}
+}
+
+// An exchange is one request the resource has been sent, and as much of its reply as has come back so far.
+type exchange struct {
+	request    request.Request
+	dispatched time.Time
+
+	replySize        int
+	replyPayloadSize int
+	// The status the resource gave the reply, zero if none.
+	status uint16
+
+	// Whether the client has already had its answer, either the whole reply or an error in place of it.
+	answered bool
+	// Probes don't count towards the pending requests.
+	probe bool
+}
+
+// Pass one message of a reply on to whoever sent the request, and report whether the reply is now complete.
+func (b *backend) relay(x *exchange, reply radiowave.Message) bool {
+	// Limits apply to whole messages, headers and all, as they will go out on the wire.
+	chunkSize := len(reply.ToBytes())
+	first := x.replySize == 0
+	x.replySize += chunkSize
+	x.replyPayloadSize += payloadSize(reply)
+	more := message.HasMore(reply)
+	if !more {
+		x.request.SetFinished()
+	}
+
+	// Once we've given up on a reply, the rest of its chunks still have to be read, so that they aren't taken
+	// for the reply to the next request.
+	if x.answered {
+		return !more
+	}
+
+	if first && b.noteStatus(x, reply) {
+		x.answered = true
+	} else if b.maxMessageSize > 0 && chunkSize > b.maxMessageSize || b.maxReplySize > 0 && x.replySize > b.maxReplySize {
+		description := fmt.Sprintf("reply is larger than the server allows, %d bytes so far", x.replySize)
+		b.drop(x.request.ConnectionID, x.request.CorrelationID, dropOversized, description)
+		x.request.Reply(message.ImpactError{CorrelationID: x.request.CorrelationID, Code: message.ReplyTooLarge, Description: description})
+		x.answered = true
+	} else {
+		if typed, ok := reply.(message.ImpactMessage); ok {
+			typed.Header.CorrelationID = x.request.CorrelationID
+			typed.Header.ConnectionID = ""
+			reply = typed
+		}
+
+		// Send the reply back on the dedicated reply channel. A client that has gone away gets none of the rest, and
+		// its connection handler has already counted the request as dropped.
+		if !x.request.Reply(reply) {
+			x.answered = true
+		}
+	}
+
+	if !more {
+		b.shedder.observe(time.Since(x.dispatched))
+
+		// This is the one place where we know the size of both a request and its reply.
+		b.checkReplySize(x.request, x.replyPayloadSize)
+	}
+
+	return !more
+}
+
+// The reply is never coming. Unless the client already has its answer, it gets an error instead.
+func (b *backend) abandon(x *exchange, reason string, code message.ErrorCode, description string) {
+	if x.answered {
+		return
+	}
+
+	b.drop(x.request.ConnectionID, x.request.CorrelationID, reason, description)
+	x.request.Reply(message.ImpactError{CorrelationID: x.request.CorrelationID, Code: code, Description: description})
+}
+
+// Replace a running process with a fresh instance of the resource.
+// If shutdown has started, the process is stopped but not replaced, and there is no process to return.
+func (m *member) restartProcess(process *resource.Process, reason string) *resource.Process {
+	process.Kill()
+	<-process.ExitChannel
+	process.Release()
 
-	// No more messages from the process means that it has terminated.
-	os.Exit(40)
+	return m.relaunch(reason)
+}
+
+// Launch a fresh instance of the resource once the old one is gone, for the given reason.
+// If shutdown has started, there is no replacement, and no process to return.
+func (m *member) relaunch(reason string) *resource.Process {
+	m.healthy.Store(false)
+
+	// Shutdown takes precedence over restarts. Holding the lifecycle lock while we relaunch means shutdown either
+	// starts before we decide, so that we don't relaunch, or waits until the new process is in place.
+	m.lifecycleLock.Lock()
+	defer m.lifecycleLock.Unlock()
+
+	if m.shuttingDown.Load() {
+		m.logger.Printf("resource %s stopped, not restarting because the server is shutting down", m.name)
+		return nil
+	}
+
+	// A resource we attached to belongs to whoever runs it, so it isn't ours to restart. We have let go of it, and
+	// without it there's nothing to serve. Whoever runs it can restart the two of us together.
+	if m.attachPID != 0 {
+		m.logger.Printf("resource %s needs restarting, but impact attached to it rather than launching it, so giving up", m.name)
+		m.resourceGone(40)
+	}
+
+	// If we can't relaunch the resource, we must give up, just as if we couldn't launch it in the first place. A named
+	// resource gives up alone, and the rest of the server carries on without it. So does a member of a pool that other
+	// members are still serving.
+	replacement, resourceError := m.launch()
+	if resourceError != nil {
+		m.logger.Printf("resource %s could not be restarted: %v", m.name, resourceError)
+		if m.isolated {
+			return nil
+		}
+		if healthy := m.backend.healthyMembers(); healthy > 0 {
+			m.logger.Printf("warning: %s carries on with %d of %d members", m.backend.name, healthy, len(m.backend.members))
+			return nil
+		}
+		m.resourceGone(12)
+	}
+
+	oldPID, ran := m.process.Load().Pid(), time.Since(m.launched)
+	m.started(replacement)
+	m.restarted(reason, oldPID, ran)
+	m.recordProgress()
+	m.warmup.begin()
+
+	return replacement
+}
+
+// The resource exited without being asked to. When we are shutting down, that's just the resource getting there first,
+// and the drain can carry on without it. Otherwise, there's no way to carry on at all, unless it's a named resource, or
+// one of a pool whose other members are still serving, or -restart says to relaunch it.
+func (m *member) processExited(process *resource.Process) *resource.Process {
+	m.healthy.Store(false)
+
+	// A resource that stopped taking its input was killed for it. It is dealt with just as if it had exited.
+	if inputError := process.InputError(); inputError != nil && !m.shuttingDown.Load() {
+		m.logger.Printf("resource %s could not be written to, treating it as exited: %v", m.name, inputError)
+	}
+
+	if m.isolated {
+		return m.relaunchExited(process)
+	}
+	if healthy := m.backend.healthyMembers(); healthy > 0 && !m.shuttingDown.Load() {
+		m.logger.Printf("warning: resource %s exited, %s carries on with %d of %d members while it is relaunched", m.name, m.backend.name, healthy, len(m.backend.members))
+		return m.relaunchExited(process)
+	}
+	if !m.shuttingDown.Load() && m.restartsOnExit(process) {
+		m.logger.Printf("warning: resource %s exited, and is relaunched under -restart %s while requests wait for it", m.name, m.restartPolicy)
+		return m.relaunchExited(process)
+	}
+
+	m.lifecycleLock.Lock()
+	defer m.lifecycleLock.Unlock()
+
+	if !m.shuttingDown.Load() {
+		if m.attachPID != 0 {
+			m.logger.Printf("resource %s, which impact attached to, has gone, and isn't impact's to restart", m.name)
+		}
+		m.resourceGone(40)
+	}
+
+	m.logger.Printf("resource %s exited during shutdown", m.name)
+	process.Release()
+
+	return nil
+}
+
+// A reply much bigger than its request usually means a request that is making the resource misbehave.
+func (s *server) checkReplySize(request request.Request, replySize int) {
+	requestSize := payloadSize(request.Message)
+
+	// An empty request still has a reply ratio. Treat it as one byte rather than dividing by zero.
+	ratio := float64(replySize) / float64(max(requestSize, 1))
+	s.replyRatios.Observe(ratio)
+
+	if s.replyRatioAlarm > 0 && ratio > s.replyRatioAlarm {
+		s.replyRatioAlarms.Inc()
+		s.loggerFor(request.ConnectionID).Printf("reply to request %d is %d bytes, %.1f times the size of the %d byte request", request.CorrelationID, replySize, ratio, requestSize)
+	}
+}
+
+func payloadSize(wave radiowave.Message) int {
+	switch typed := wave.(type) {
+	case message.ImpactMessage:
+		return len(typed.Payload)
+	case message.ImpactError:
+		return len(typed.Description)
+	default:
+		return len(wave.ToBytes())
+	}
+}
+
+func isTemporaryAcceptError(acceptError error) bool {
+	temporary := []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET}
+	for _, errno := range temporary {
+		if errors.Is(acceptError, errno) {
+			return true
+		}
+	}
+
+	var netError net.Error
+	return errors.As(acceptError, &netError) && netError.Timeout()
+}
+
+func asOversized(wave radiowave.Message) (connection.Oversized, bool) {
+	oversized, isOversized := wave.(connection.Oversized)
+	return oversized, isOversized
+}
+
+func correlationOf(wave radiowave.Message) uint64 {
+	switch typed := wave.(type) {
+	case message.ImpactMessage:
+		return typed.Header.CorrelationID
+	case message.ImpactError:
+		return typed.CorrelationID
+	default:
+		return 0
+	}
 }
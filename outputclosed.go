@@ -0,0 +1,77 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"time"
+)
+
+// What to do when the resource closes its output but keeps running, as some resources do at the end of a batch.
+// Either way, the resource can't answer anything more, so requests waiting for a reply get an error.
+const (
+	// Treat it as the resource shutting down: stop it and handle it as if it had exited.
+	outputClosedExit = "exit"
+	// Stop it and start a fresh instance straight away.
+	outputClosedRestart = "restart"
+	// Close its input, so that it can finish whatever it had already read, and start a fresh instance once it exits.
+	outputClosedDrain = "drain"
+)
+
+// A process that exits closes its output too, a moment before we hear that it has exited. Only a process that is
+// still running after this long closed its output on purpose.
+const exitGrace = 100 * time.Millisecond
+
+// How long a draining resource has to exit on its own before it is stopped.
+const outputDrainTimeout = 10 * time.Second
+
+// The resource's output has ended. Return the process that should serve the next request.
+func (m *member) outputClosed(process *resource.Process) *resource.Process {
+	select {
+	case <-process.ExitChannel:
+		return m.processExited(process)
+	case <-time.After(exitGrace):
+	}
+
+	switch m.outputClosedPolicy {
+	case outputClosedRestart:
+		m.logger.Printf("resource %s closed its output, restarting it", m.name)
+		return m.restartProcess(process, restartOutputClosed)
+
+	case outputClosedDrain:
+		m.logger.Printf("resource %s closed its output, waiting for it to finish its input", m.name)
+		process.Release()
+
+		select {
+		case <-process.ExitChannel:
+		case <-time.After(outputDrainTimeout):
+			m.logger.Printf("resource %s did not exit within %s of closing its output, stopping it", m.name, outputDrainTimeout)
+			process.Kill()
+			<-process.ExitChannel
+		}
+
+		return m.relaunch(restartOutputClosed)
+
+	default:
+		m.logger.Printf("resource %s closed its output, stopping it", m.name)
+		process.Kill()
+		<-process.ExitChannel
+
+		return m.processExited(process)
+	}
+}
+
+// The request was sent, but its reply can never arrive. A resource that was killed because it couldn't be written to
+// didn't close its output itself, and is dealt with as having exited.
+func (b *backend) abandonOutputClosed(x *exchange, process *resource.Process) {
+	if process.InputError() != nil {
+		b.abandon(x, dropShutdown, message.ResourceStopped, "resource could not be written to while handling the request")
+		return
+	}
+
+	if b.outputClosedPolicy == outputClosedExit {
+		b.abandon(x, dropShutdown, message.ResourceStopped, "resource closed its output while handling the request")
+		return
+	}
+
+	b.abandon(x, dropRestart, message.ResourceRestarted, "resource closed its output while handling the request")
+}
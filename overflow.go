@@ -0,0 +1,107 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"strings"
+	"time"
+)
+
+// Where impact puts a bound on what it holds, something has to give once the bound is reached. Which thing gives is
+// the bound's overflow policy, chosen from the same four wherever there is a bound:
+const (
+	// Wait for room. The client is told nothing, and waits on its socket.
+	overflowBlock = "block"
+	// Turn the new request away with an error, so that its client knows to try again later.
+	overflowReject = "reject"
+	// Drop the new request without a word. Its client only finds out if it has a timeout of its own.
+	overflowDropNewest = "drop-newest"
+	// Make room by turning the oldest request still waiting away with an error, and take the new one.
+	overflowDropOldest = "drop-oldest"
+)
+
+// The bounds, whose policies are set by:
+//
+//	-in-flight-overflow, for -max-in-flight, the requests queued or executing across all connections. The default
+//	is reject. drop-oldest turns away the request that has been queued longest, and only requests still queued can
+//	be, not the one already taken to go next, so with nothing queued the new request is rejected instead. A UDP
+//	client can't be made to wait on a socket, but a datagram waits for room all the same.
+//
+//	-flow-overflow, for -flow-window, the requests each client may have unanswered. The default is reject, with a
+//	NoCredit error. block stops reading from the client until it has credit again. The oldest request a client has
+//	unanswered has already been read and is being served, so drop-oldest isn't one of the choices.
+//
+//	-accept-overflow, for -accept-rate, the connections let in each second. The default is reject, which closes the
+//	connection as soon as it is accepted, telling it why if that doesn't take a TLS handshake. Dropping it without a
+//	word would save nothing more, and older connections are already in, so neither drop policy is one of the choices.
+
+// How often a request waiting for room under the block policy looks again.
+const overflowPollInterval = 10 * time.Millisecond
+
+// Check a policy for a bound, given the policies the bound allows.
+func checkOverflowPolicy(flag string, policy string, allowed ...string) error {
+	for _, candidate := range allowed {
+		if policy == candidate {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s must be one of %s", flag, strings.Join(allowed, ", "))
+}
+
+// The request is past -max-in-flight. Let it in if the policy finds it room, and report whether it did.
+func (s *server) overflowInFlight(r request.Request, done <-chan bool) bool {
+	switch s.inFlightOverflow {
+	case overflowBlock:
+		return s.admitWhenRoom(r, done)
+	case overflowDropOldest:
+		return s.evictOldest() && s.admit()
+	default:
+		return false
+	}
+}
+
+// Wait until the request can be admitted. Give up if its client goes, its lifetime ends or the server starts shutting
+// down, since the drain won't wait for requests that aren't in yet.
+func (s *server) admitWhenRoom(r request.Request, done <-chan bool) bool {
+	ticker := time.NewTicker(overflowPollInterval)
+	defer ticker.Stop()
+
+	for !s.admit() {
+		if s.shuttingDown.Load() {
+			return false
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return false
+		case <-r.Lifetime():
+			return false
+		}
+	}
+
+	return true
+}
+
+// Turn away whichever request has been queued longest, to make room. Report whether there was one.
+func (s *server) evictOldest() bool {
+	for _, oldest := range s.trackedRequests() {
+		if oldest.Status.State() != request.Queued {
+			continue
+		}
+
+		backend := s.route(oldest)
+		if backend == nil || !backend.scheduler.Remove(oldest) {
+			continue
+		}
+		s.pending.Add(-1)
+
+		s.drop(oldest.ConnectionID, oldest.CorrelationID, dropCapacity, "server at capacity, turned away for a newer request")
+		oldest.Reply(message.ImpactError{CorrelationID: oldest.CorrelationID, Code: message.AtCapacity, Description: "server at capacity"})
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// Nothing but acknowledgements and credit comes for a while.
+func expectNoAnswer(t *testing.T, client *testClient, wait time.Duration) {
+	t.Helper()
+
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); {
+		answer, readError := client.tryReceive(time.Until(deadline))
+		if readError != nil {
+			return
+		}
+		if answer.Header.Type != message.Queued && answer.Header.Type != message.Credit {
+			t.Fatalf("got a message of type %d for request %d, which should have had no answer", answer.Header.Type, answer.Header.CorrelationID)
+		}
+	}
+}
+
+// With -max-in-flight 3, one slow request with the resource, one in the scheduler's hand to go next and one queued
+// behind them, each policy decides what gives when a fourth arrives. Only the queued one can be turned away for it.
+func TestInFlightOverflow(t *testing.T) {
+	for _, policy := range []string{overflowReject, overflowBlock, overflowDropNewest, overflowDropOldest} {
+		t.Run(policy, func(t *testing.T) {
+			server, address := startServer(t, "echo", func(config *Config) {
+				config.MaxInFlight = 3
+				config.InFlightOverflow = policy
+			})
+			executing, next, queued, newest := dial(t, address), dial(t, address), dial(t, address), dial(t, address)
+
+			executing.send(1, "sleep")
+			eventually(t, "the slow request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+			next.send(1, "next")
+			eventually(t, "the second request is next", func() bool { return server.s.pending.Load() == 2 })
+			queued.send(1, "queued")
+			eventually(t, "the third request is queued", func() bool { return server.s.pending.Load() == 3 })
+			newest.send(1, "newest")
+
+			switch policy {
+			case overflowReject:
+				expectError(t, receiveAnswer(newest), message.AtCapacity)
+				expectReply(t, receiveAnswer(queued), "queued")
+			case overflowBlock:
+				expectReply(t, receiveAnswer(queued), "queued")
+				expectReply(t, receiveAnswer(newest), "newest")
+			case overflowDropNewest:
+				expectReply(t, receiveAnswer(queued), "queued")
+				expectNoAnswer(t, newest, 300*time.Millisecond)
+			case overflowDropOldest:
+				expectError(t, receiveAnswer(queued), message.AtCapacity)
+				expectReply(t, receiveAnswer(newest), "newest")
+			}
+			expectReply(t, receiveAnswer(executing), "sleep")
+			expectReply(t, receiveAnswer(next), "next")
+
+			dropped := int64(1)
+			if policy == overflowBlock {
+				dropped = 0
+			}
+			if got := server.s.droppedRequests.Value(dropCapacity); got != dropped {
+				t.Fatalf("%d requests were dropped at capacity, not %d", got, dropped)
+			}
+		})
+	}
+}
+
+// With -flow-window 1, a client that sends a second request before its first is answered has no credit for it, and
+// each policy decides what becomes of it.
+func TestFlowOverflow(t *testing.T) {
+	for _, policy := range []string{overflowReject, overflowBlock, overflowDropNewest} {
+		t.Run(policy, func(t *testing.T) {
+			server, address := startServer(t, "echo", func(config *Config) {
+				config.FlowWindow = 1
+				config.FlowOverflow = policy
+			})
+			client := dial(t, address)
+
+			client.send(1, "sleep")
+			client.send(2, "uncredited")
+			expectReply(t, receiveAnswer(client), "sleep")
+
+			switch policy {
+			case overflowReject:
+				expectError(t, receiveAnswer(client), message.NoCredit)
+			case overflowBlock:
+				expectReply(t, receiveAnswer(client), "uncredited")
+			case overflowDropNewest:
+				expectNoAnswer(t, client, 300*time.Millisecond)
+				if got := server.s.droppedRequests.Value(dropNoCredit); got != 1 {
+					t.Fatalf("%d requests were dropped for want of credit, not 1", got)
+				}
+			}
+
+			// Whatever became of it, the client has its credit back for the next request.
+			client.send(3, "after")
+			expectReply(t, receiveAnswer(client), "after")
+		})
+	}
+}
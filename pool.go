@@ -0,0 +1,288 @@
+package impact
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/impact/internal/resource"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With -pool-size above one, a backend runs several copies of the resource. Each is a member of the backend's pool,
+// with its own process handler, watchdog and prober, and each takes the next request from the backend's funnel as
+// soon as it is free. The members share everything else: the queue, the warmup and the shedder.
+//
+// A member can be drained, so that it finishes what it is doing and then takes no more requests until it is undrained.
+// The others carry on serving the funnel, so members can be restarted or inspected one at a time.
+type member struct {
+	*backend
+
+	// The member's name, for logs. This is the backend's name, with the member's index if there is more than one.
+	name string
+	// Where the member comes in the pool, counting from zero.
+	index int
+
+	// The process serving the member right now, for anyone outside the process handler who wants to know about it.
+	process atomic.Pointer[resource.Process]
+
+	// Probes skip the funnel so that a long queue of client requests doesn't look like a hung resource.
+	probes chan request.Request
+	// Anything that decides the resource is unhealthy asks the process handler to restart it here.
+	restarts chan string
+	// Shutdown asks the process handler to send the resource its shutdown command here, and is told once it has gone.
+	quits chan chan bool
+
+	// Whether the resource is working on a request right now.
+	busy atomic.Bool
+	// When the process handler last made progress, in Unix nanoseconds.
+	lastProgress atomic.Int64
+
+	// Whether the resource has stopped taking its input.
+	inputBlocked atomic.Bool
+
+	// A drained member takes nothing new from the funnel.
+	drained atomic.Bool
+	// Wakes the process handler when the member is drained or undrained, so that it can look at the funnel again.
+	wake chan bool
+
+	// When the member's current process was launched.
+	launched time.Time
+	// How long the member waited before its resource was last relaunched after exiting.
+	relaunchDelay time.Duration
+	// Whether the member has a process running. One that is being relaunched, or has stopped, doesn't.
+	healthy atomic.Bool
+	// The current process's banner, under -resource-banner. Nil otherwise.
+	banner atomic.Pointer[bannerWatch]
+}
+
+func (b *backend) newMember(index int, size int) *member {
+	name := b.name
+	if size > 1 {
+		name = fmt.Sprintf("%s/%d", b.name, index)
+	}
+
+	m := &member{
+		backend:  b,
+		name:     name,
+		index:    index,
+		probes:   make(chan request.Request),
+		restarts: make(chan string),
+		quits:    make(chan chan bool),
+		wake:     make(chan bool, 1),
+	}
+	m.recordProgress()
+	b.members = append(b.members, m)
+
+	return m
+}
+
+// A process has just been launched for the member.
+func (m *member) started(process *resource.Process) {
+	m.process.Store(process)
+	m.launched = time.Now()
+	m.healthy.Store(true)
+	m.watchBanner(process)
+	m.routePushes(process)
+}
+
+func (m *member) recordProgress() {
+	m.lastProgress.Store(time.Now().UnixNano())
+}
+
+// How long it has been since the process handler last made progress.
+func (m *member) sinceProgress() time.Duration {
+	return time.Since(time.Unix(0, m.lastProgress.Load()))
+}
+
+// How many requests are waiting on this member: the one it is working on, if any. Requests still queued aren't waiting
+// on any member in particular, and a member that is idle, drained or not, isn't holding them up.
+func (m *member) waiting() int {
+	if m.busy.Load() {
+		return 1
+	}
+
+	return 0
+}
+
+// The funnel, for a member that may take requests from it. A drained member gets nil, and so takes nothing.
+func (m *member) intake() chan request.Request {
+	if m.drained.Load() {
+		return nil
+	}
+
+	return m.backend.funnel
+}
+
+func (m *member) setDrained(drained bool) {
+	if m.drained.Swap(drained) == drained {
+		return
+	}
+
+	if drained {
+		m.logger.Printf("resource %s drained, taking no new requests", m.name)
+	} else {
+		m.logger.Printf("resource %s undrained, taking requests again", m.name)
+	}
+
+	select {
+	case m.wake <- true:
+	default:
+	}
+}
+
+// The member's process handler has stopped for good, during shutdown or because a named resource, or a member of a
+// pool that others are still serving, couldn't be relaunched. The last member to stop refuses everything
+// still coming through the funnel, since the drain is waiting for it to empty. Every member refuses its own probes
+// and restarts, so that its prober and watchdog don't wait forever, until the server has stopped altogether.
+func (m *member) stopped() {
+	m.healthy.Store(false)
+	funnel := m.backend.funnel
+	if m.running.Add(-1) > 0 {
+		funnel = nil
+	}
+
+	// Outside shutdown, a member only stops once it can't be relaunched.
+	description := "resource has stopped because the server is shutting down"
+	if !m.shuttingDown.Load() {
+		description = "resource has stopped and could not be relaunched"
+	}
+
+	for {
+		select {
+		case request := <-funnel:
+			m.drop(request.ConnectionID, request.CorrelationID, dropShutdown, "resource has stopped")
+			request.Reply(message.ImpactError{CorrelationID: request.CorrelationID, Code: message.ResourceStopped, Description: description})
+			m.pending.Add(-1)
+
+		case probe := <-m.probes:
+			probe.Reply(message.ImpactError{Code: message.ResourceStopped, Description: "resource has stopped"})
+
+		// There is nothing left to restart, or to tell to exit.
+		case <-m.restarts:
+		case done := <-m.quits:
+			close(done)
+
+		case <-m.wake:
+
+		case <-m.halted:
+			return
+		}
+	}
+}
+
+type memberReport struct {
+	Backend string `json:"backend"`
+	Member  int    `json:"member"`
+	Pid     int    `json:"pid"`
+	Busy    bool   `json:"busy"`
+	Drained bool   `json:"drained"`
+	Blocked bool   `json:"blocked"`
+	Healthy bool   `json:"healthy"`
+	// The start of what the resource wrote before it was sent anything, under -resource-banner.
+	Banner string `json:"banner,omitempty"`
+}
+
+func (s *server) backends() []*backend {
+	backends := []*backend{s.primary}
+	if s.large != nil {
+		backends = append(backends, s.large)
+	}
+
+	return append(backends, s.namedOrder...)
+}
+
+func (m *member) report() memberReport {
+	report := memberReport{Backend: m.backend.name, Member: m.index, Busy: m.busy.Load(), Drained: m.drained.Load(), Blocked: m.inputBlocked.Load(), Healthy: m.healthy.Load()}
+	if process := m.process.Load(); process != nil {
+		report.Pid = process.Pid()
+	}
+	report.Banner = m.banner.Load().kept()
+
+	return report
+}
+
+// One value for each backend, by name.
+func (s *server) perBackend(value func(*backend) float64) map[string]float64 {
+	values := map[string]float64{}
+	for _, b := range s.backends() {
+		values[b.name] = value(b)
+	}
+
+	return values
+}
+
+// List the members of every pool as JSON.
+func (s *server) servePool(writer http.ResponseWriter, _ *http.Request) {
+	reports := []memberReport{}
+	for _, b := range s.backends() {
+		for _, m := range b.members {
+			reports = append(reports, m.report())
+		}
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(writer).Encode(reports)
+}
+
+// Drain or undrain one member, chosen by backend and index, or by the pid of its resource process. The backend is
+// primary unless it says otherwise.
+func (s *server) serveDrain(drained bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			http.Error(writer, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		m, problem := s.findMember(r)
+		if m == nil {
+			http.Error(writer, problem, http.StatusNotFound)
+			return
+		}
+
+		m.setDrained(drained)
+		s.servePool(writer, r)
+	}
+}
+
+func (s *server) findMember(r *http.Request) (*member, string) {
+	query := r.URL.Query()
+
+	if pidText := query.Get("pid"); pidText != "" {
+		pid, parseError := strconv.Atoi(pidText)
+		if parseError != nil {
+			return nil, "pid must be a number"
+		}
+
+		for _, b := range s.backends() {
+			for _, m := range b.members {
+				if process := m.process.Load(); process != nil && process.Pid() == pid {
+					return m, ""
+				}
+			}
+		}
+
+		return nil, fmt.Sprintf("no resource has pid %d", pid)
+	}
+
+	name := query.Get("backend")
+	if name == "" {
+		name = "primary"
+	}
+	index, parseError := strconv.Atoi(query.Get("member"))
+	if parseError != nil {
+		return nil, "give a member index or a pid"
+	}
+
+	for _, b := range s.backends() {
+		if b.name == name && index >= 0 && index < len(b.members) {
+			return b.members[index], ""
+		}
+	}
+
+	return nil, fmt.Sprintf("backend %s has no member %d", name, index)
+}
@@ -0,0 +1,80 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A pool whose members crash, all but one, keeps serving on the one left, and warns that it is doing so, until the
+// others are relaunched.
+func TestPoolSurvivesAllButOne(t *testing.T) {
+	logs := &lockedBuffer{}
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.PoolSize = 3
+		config.RestartBackoff = time.Second
+	}, WithLogger(log.New(logs, "", 0)))
+	pool := server.s.primary
+
+	for crashed := 1; crashed <= 2; crashed++ {
+		client := dial(t, address)
+		if _, requestError := client.tryRequest(1, "exit"); requestError != nil {
+			t.Fatalf("crashing member %d: %v", crashed, requestError)
+		}
+		eventually(t, fmt.Sprintf("%d members have crashed", crashed), func() bool { return pool.healthyMembers() == 3-crashed })
+	}
+	if !strings.Contains(logs.String(), "carries on with 1 of 3 members") {
+		t.Fatalf("the reduced capacity wasn't warned of:\n%s", logs.String())
+	}
+
+	client := dial(t, address)
+	for correlationID := uint64(1); correlationID <= 20; correlationID++ {
+		payload := fmt.Sprintf("survivor %d", correlationID)
+		expectReply(t, client.request(correlationID, payload), payload)
+	}
+	if healthy := pool.healthyMembers(); healthy != 1 {
+		t.Fatalf("%d members were serving while the others waited to be relaunched, not 1", healthy)
+	}
+
+	eventually(t, "the crashed members are relaunched", func() bool { return pool.healthyMembers() == 3 })
+	expectReply(t, client.request(21, "restored"), "restored")
+}
+
+// The watchdog only restarts a member that is stuck on a request. A member of the same pool that is idle, and so has
+// made no progress in a while either, isn't holding anybody up, and is left alone.
+func TestWatchdogSparesIdleMember(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.PoolSize = 2
+		config.WatchdogInterval = interval
+		config.WatchdogRestart = true
+	})
+	pool := server.s.primary
+	eventually(t, "both members are running", func() bool { return pool.healthyMembers() == 2 })
+	pids := map[*member]int{}
+	for _, m := range pool.members {
+		pids[m] = m.process.Load().Pid()
+	}
+
+	client := dial(t, address)
+	client.send(1, "hang")
+	expectError(t, receiveAnswer(client), message.ResourceRestarted)
+	// Long enough for the watchdog to have had several looks at the idle member.
+	time.Sleep(4 * interval)
+
+	if restarts := server.s.restartReasons.Value(restartWatchdog); restarts != 1 {
+		t.Fatalf("the watchdog restarted members %d times, not once", restarts)
+	}
+	relaunched := 0
+	for _, m := range pool.members {
+		if m.process.Load().Pid() != pids[m] {
+			relaunched += 1
+		}
+	}
+	if relaunched != 1 {
+		t.Fatalf("%d members were relaunched, not just the one that hung", relaunched)
+	}
+}
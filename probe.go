@@ -0,0 +1,87 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/metrics"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/radiowave"
+	"time"
+)
+
+// Probes of every backend are counted together.
+type probeCounters struct {
+	successes *metrics.Counter
+	failures  *metrics.Counter
+}
+
+func newProbeCounters(registry *metrics.Registry) probeCounters {
+	return probeCounters{
+		successes: registry.NewCounter("impact_probe_successes_total", "Liveness probes answered by the resource in time."),
+		failures:  registry.NewCounter("impact_probe_failures_total", "Liveness probes the resource failed to answer in time."),
+	}
+}
+
+// The prober checks that the resource is still responding, not just still running.
+// A resource that hangs silently never exits, so without this nobody would notice until every client is stuck.
+func (m *member) handleProbes(probe message.ImpactMessage, interval time.Duration, threshold int, counters probeCounters) {
+	consecutiveFailures := 0
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.halted:
+			return
+		}
+
+		// The timeout can be changed on reload.
+		if m.sendProbe(probe, time.Duration(m.probeTimeout.Load())) {
+			counters.successes.Inc()
+			consecutiveFailures = 0
+			continue
+		}
+
+		counters.failures.Inc()
+		consecutiveFailures += 1
+		m.logger.Printf("resource %s failed liveness probe (%d of %d)", m.name, consecutiveFailures, threshold)
+
+		// A single slow reply could just be an expensive request. Several in a row means the resource is unhealthy.
+		if consecutiveFailures >= threshold {
+			m.logger.Printf("resource %s is unhealthy, restarting", m.name)
+			select {
+			case m.restarts <- restartProbe:
+			case <-m.halted:
+				return
+			}
+			consecutiveFailures = 0
+		}
+	}
+}
+
+// Send one probe and report whether the resource replied to it in time.
+func (m *member) sendProbe(probe message.ImpactMessage, timeout time.Duration) bool {
+	// Each probe gets its own reply channel, so a late reply to one probe can never be mistaken for a reply to the next.
+	// It is buffered so that the process handler never blocks on a probe we have given up waiting for.
+	replyChannel := make(chan radiowave.Message, 1)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// The timeout covers waiting for the process handler to finish its current request, as well as the probe itself.
+	select {
+	case m.probes <- request.Request{Message: probe, ReplyChannel: replyChannel}:
+	case <-timer.C:
+		return false
+	}
+
+	select {
+	case reply := <-replyChannel:
+		// If the probe was caught up in a restart, the resource never answered it.
+		_, failed := reply.(message.ImpactError)
+		return !failed
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,75 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"github.com/blanu/radiowave"
+)
+
+// The resource can push messages to clients at any time, not just while it is answering a request. Pushes are taken
+// out of the process's output as they arrive and sent straight to their connections, so that the process handler
+// only ever sees replies.
+func (b *backend) routePushes(process *resource.Process) {
+	output := process.OutputChannel
+	replies := make(chan radiowave.Message)
+	process.OutputChannel = replies
+
+	go func() {
+		for {
+			select {
+			case wave, open := <-output:
+				// The resource's output has ended. The process handler finds out when the replies end too.
+				if !open {
+					close(replies)
+					return
+				}
+
+				if push, isPush := wave.(message.ImpactMessage); isPush && push.Header.Type == message.Push {
+					b.deliverPush(push)
+					continue
+				}
+
+				select {
+				case replies <- wave:
+				case <-process.ExitChannel:
+					return
+				}
+
+			case <-process.ExitChannel:
+				return
+			}
+		}
+	}()
+}
+
+// A push names the connection it is for. One that doesn't is for everyone.
+func (s *server) deliverPush(push message.ImpactMessage) {
+	target := push.Header.ConnectionID
+
+	// Connection ids are between us and the resource, so clients don't see them.
+	push.Header.ConnectionID = ""
+
+	if target == "" {
+		for _, connection := range s.currentConnections() {
+			if connection.WriteMessage(s.compressFor(connection, push)) == nil {
+				s.countOut(connection, push)
+			}
+		}
+		s.pushes.Inc("broadcast")
+		return
+	}
+
+	connection, found := s.findConnection(target)
+	if !found {
+		// The connection has gone away since the resource heard from it. There's nobody left to tell.
+		s.pushes.Inc("unroutable")
+		return
+	}
+
+	if connection.WriteMessage(s.compressFor(connection, push)) != nil {
+		s.pushes.Inc("unroutable")
+		return
+	}
+	s.countOut(connection, push)
+	s.pushes.Inc("delivered")
+}
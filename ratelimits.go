@@ -0,0 +1,85 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/ratelimit"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limits keep one busy client, or all clients together, from sending requests faster than configured. A request
+// over the limit is refused with a hint of how long until one would be accepted, so that a well-behaved client can
+// pause for exactly that long rather than guess.
+
+// A rateLimit allows rate requests per second, in bursts of up to one second's worth. The rate can be changed while the
+// limit is in use, which starts it afresh at the new rate. Zero or less means no limit.
+type rateLimit struct {
+	lock   sync.Mutex
+	rate   float64
+	bucket *ratelimit.TokenBucket
+}
+
+func newRateLimit(rate float64) *rateLimit {
+	limit := &rateLimit{}
+	limit.setRate(rate)
+
+	return limit
+}
+
+func (l *rateLimit) setRate(rate float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if rate == l.rate {
+		return
+	}
+
+	l.rate = rate
+	if rate <= 0 {
+		l.bucket = nil
+		return
+	}
+
+	l.bucket = ratelimit.NewTokenBucket(rate, max(rate, 1))
+}
+
+func (l *rateLimit) currentRate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rate
+}
+
+func (l *rateLimit) try() (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.bucket == nil {
+		return true, 0
+	}
+
+	return l.bucket.Try()
+}
+
+// Requests per second allowed on each connection. It can change on reload, so connections check it as they go.
+func (s *server) connectionRateLimit() float64 {
+	return math.Float64frombits(s.connectionRate.Load())
+}
+
+func (s *server) setConnectionRateLimit(rate float64) {
+	s.connectionRate.Store(math.Float64bits(rate))
+}
+
+// Report whether a request on a connection with the given limit may go ahead, and if not, how long it should wait.
+// The connection's own limit is checked first, so that a client over its limit doesn't use up the global one.
+func (s *server) rateLimited(connectionLimit *rateLimit) (bool, time.Duration) {
+	connectionLimit.setRate(s.connectionRateLimit())
+
+	for _, limit := range []*rateLimit{connectionLimit, s.globalRateLimit} {
+		if allowed, wait := limit.try(); !allowed {
+			return true, wait
+		}
+	}
+
+	return false, 0
+}
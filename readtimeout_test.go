@@ -0,0 +1,72 @@
+package impact
+
+import (
+	"bytes"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// A request as it goes on the wire, framed.
+func framedRequest(correlationID uint64, payload string) []byte {
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	var framed bytes.Buffer
+	_ = connection.WriteFrame(&framed, request.ToBytes())
+
+	return framed.Bytes()
+}
+
+// Write the bytes a piece at a time, pausing before each piece, and stopping after the last piece the sizes say.
+func (c *testClient) writeSlowly(data []byte, pause time.Duration, sizes ...int) {
+	c.t.Helper()
+
+	for _, size := range sizes {
+		time.Sleep(pause)
+		size = min(size, len(data))
+		if _, writeError := c.conn.Write(data[:size]); writeError != nil {
+			c.t.Fatalf("write: %v", writeError)
+		}
+		data = data[size:]
+	}
+}
+
+// Under -message-read-timeout, a client may idle as long as it likes between messages, and may pause within one, but
+// not for longer than the timeout once a message has started.
+func TestMessageReadTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	_, address := startServer(t, "echo", func(config *Config) { config.MessageReadTimeout = timeout })
+
+	t.Run("idle between messages", func(t *testing.T) {
+		client := dial(t, address)
+		request := framedRequest(1, "after idling")
+		client.writeSlowly(request, 2*timeout, len(request))
+		expectReply(t, client.receive(), "after idling")
+	})
+
+	t.Run("pause within a message", func(t *testing.T) {
+		client := dial(t, address)
+		request := framedRequest(1, "in pieces")
+		client.writeSlowly(request, timeout/4, 1, 2, 5, len(request))
+		expectReply(t, client.receive(), "in pieces")
+	})
+
+	t.Run("stall within a message", func(t *testing.T) {
+		client := dial(t, address)
+		// The frame's length, and then nothing more.
+		client.writeSlowly(framedRequest(1, "never finished"), 0, 2)
+
+		start := time.Now()
+		goingAway, readError := client.tryReceive(5 * time.Second)
+		if readError != nil || goingAway.Header.Type != message.GoingAway {
+			t.Fatalf("got a message of type %d, %v, from the server, not a going away", goingAway.Header.Type, readError)
+		}
+		if _, readError := client.tryReceive(5 * time.Second); readError == nil {
+			t.Fatal("the connection is still open after the going away")
+		}
+		if waited := time.Since(start); waited > 5*timeout {
+			t.Fatalf("the stalled client was only closed after %s", waited)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package impact
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// Settings that can be changed while running, by editing the config file or the environment and sending SIGHUP.
+// Everything else is read once at startup, and changing it needs a restart.
+var reloadable = map[string]bool{
+	"debug":                      true,
+	"max-in-flight":              true,
+	"max-in-flight-per-identity": true,
+	"rate-limit":                 true,
+	"global-rate-limit":          true,
+	"accept-rate":                true,
+	"probe-timeout":              true,
+	"request-timeout":            true,
+	"max-request-timeout":        true,
+}
+
+// Put the reloadable settings into effect. This is also how they are first set at startup.
+func (s *server) applySettings(config Config) {
+	s.debug.Store(config.Debug)
+	s.maxInFlight.Store(config.MaxInFlight)
+	s.maxInFlightIdentity.Store(config.MaxInFlightIdentity)
+	s.setConnectionRateLimit(config.RateLimit)
+	s.globalRateLimit.setRate(config.GlobalRateLimit)
+	s.acceptRateLimit.setRate(config.AcceptRate)
+	s.probeTimeout.Store(int64(config.ProbeTimeout))
+	s.defaultRequestTimeout.Store(int64(config.RequestTimeout))
+	s.maxRequestTimeout.Store(int64(config.MaxRequestTimeout))
+}
+
+func (s *server) handleReloads() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		s.reload()
+	}
+}
+
+// Read the configuration again and put any changes to reloadable settings into effect. The whole configuration is
+// checked before anything changes, so a mistake leaves the server running as it was rather than half reconfigured.
+// Changes to settings that can't be reloaded are reported, and otherwise ignored until the next restart.
+func (s *server) reload() {
+	config, flags, loadError := reloadConfig()
+	if loadError != nil {
+		s.logger.Printf("reload: %v, keeping the current settings", loadError)
+		return
+	}
+
+	if validationError := config.Validate(); validationError != nil {
+		s.logger.Printf("reload: configuration is not valid, keeping the current settings: %v", validationError)
+		return
+	}
+
+	values := flagValues(flags)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := false
+	for _, name := range names {
+		current, replacement := s.settings[name], values[name]
+		if replacement == current {
+			continue
+		}
+
+		if !reloadable[name] {
+			s.logger.Printf("reload: -%s can't be changed without a restart, keeping %q", name, current)
+			continue
+		}
+
+		s.logger.Printf("reload: -%s changed from %q to %q", name, current, replacement)
+		s.settings[name] = replacement
+		changed = true
+	}
+
+	if !changed {
+		s.logger.Println("reload: no reloadable settings changed")
+		return
+	}
+
+	s.applySettings(config)
+}
+
+// The value of every setting, as text, so that two configurations can be compared setting by setting. Another name for
+// a setting has the same value as the setting, so it is left out, and a change made by either name is reloaded, or
+// not, as the setting is.
+func flagValues(flags *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	flags.VisitAll(func(setting *flag.Flag) {
+		if setting.Name != "config" && settingName(setting.Name) == setting.Name {
+			values[setting.Name] = setting.Value.String()
+		}
+	})
+
+	return values
+}
@@ -0,0 +1,87 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Serve as if from the command line, with the settings in effect taken from it, so that reload has something to
+// compare the configuration it reads again with.
+func startReloadableServer(t *testing.T, mode string, arguments ...string) (*Server, string, *lockedBuffer) {
+	t.Helper()
+
+	port := freePort(t)
+	arguments = append([]string{os.Args[0], "-port", strconv.Itoa(port), "-path", os.Args[0]}, arguments...)
+	arguments, os.Args = os.Args, arguments
+	t.Cleanup(func() { os.Args = arguments })
+
+	config, flags, loadError := reloadConfig()
+	if loadError != nil {
+		t.Fatalf("loading the configuration: %v", loadError)
+	}
+
+	logs := &lockedBuffer{}
+	server, address := startServer(t, mode, func(c *Config) { *c = config }, WithLogger(log.New(logs, "", 0)))
+	server.s.settings = flagValues(flags)
+
+	return server, address, logs
+}
+
+// A reloaded request timeout applies to requests that arrive afterwards.
+func TestReloadRequestTimeout(t *testing.T) {
+	server, address, logs := startReloadableServer(t, "echo")
+	client := dial(t, address)
+
+	expectReply(t, client.request(1, "sleep"), "sleep")
+
+	t.Setenv(environmentName("request-timeout"), "50ms")
+	t.Setenv(environmentName("max-request-timeout"), "100ms")
+	server.s.reload()
+	if !strings.Contains(logs.String(), `reload: -request-timeout changed from "0s" to "50ms"`) {
+		t.Fatalf("the new timeout wasn't logged:\n%s", logs.String())
+	}
+	if got := server.s.requestTimeout(message.Header{Timeout: 1000}); got != 100*time.Millisecond {
+		t.Fatalf("a request asking for a second gets %s after the reload, not 100ms", got)
+	}
+
+	expectError(t, client.request(2, "sleep"), message.TimedOut)
+}
+
+// A setting that needs a restart is reported and left as it was, while reloadable ones still change.
+func TestReloadKeepsFixedSettings(t *testing.T) {
+	server, _, logs := startReloadableServer(t, "echo")
+
+	t.Setenv(environmentName("scheduler"), "edf")
+	t.Setenv(environmentName("max-in-flight"), "3")
+	server.s.reload()
+
+	if !strings.Contains(logs.String(), `reload: -scheduler can't be changed without a restart, keeping "fifo"`) {
+		t.Fatalf("the scheduler change wasn't refused:\n%s", logs.String())
+	}
+	if got := server.s.maxInFlight.Load(); got != 3 {
+		t.Fatalf("-max-in-flight is %d after the reload, not 3", got)
+	}
+}
+
+// A reloadable setting changed under another name is reloaded as the setting it names.
+func TestReloadAlias(t *testing.T) {
+	server, _, logs := startReloadableServer(t, "echo")
+
+	t.Setenv(environmentName("max-queue"), "3")
+	server.s.reload()
+
+	if strings.Contains(logs.String(), "can't be changed without a restart") {
+		t.Fatalf("-max-queue was taken for a setting that needs a restart:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `reload: -max-in-flight changed from "0" to "3"`) {
+		t.Fatalf("the change wasn't logged under -max-in-flight:\n%s", logs.String())
+	}
+	if got := server.s.maxInFlight.Load(); got != 3 {
+		t.Fatalf("-max-in-flight is %d after the reload, not 3", got)
+	}
+}
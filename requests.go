@@ -0,0 +1,101 @@
+package impact
+
+import (
+	"encoding/json"
+	"github.com/blanu/impact/internal/request"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Every client request between being queued and being answered, so that we can say where each one is stuck.
+func (s *server) track(r request.Request) {
+	r.SetState(request.Queued)
+
+	s.requestsLock.Lock()
+	defer s.requestsLock.Unlock()
+
+	s.requests[r.Status] = r
+}
+
+func (s *server) untrack(r request.Request, failed bool, cancelled bool) {
+	r.End()
+
+	switch {
+	case cancelled:
+		r.SetState(request.Cancelled)
+	case failed:
+		r.SetState(request.Failed)
+	default:
+		r.SetState(request.Replied)
+	}
+
+	s.releaseIdentity(r)
+	s.logSpan(r)
+
+	s.requestsLock.Lock()
+	defer s.requestsLock.Unlock()
+
+	delete(s.requests, r.Status)
+}
+
+// The member has sent the request to its resource.
+func (m *member) markExecuting(r request.Request) {
+	r.SetHolder(m.name)
+	r.SetState(request.Executing)
+
+	if r.Tag != "" && m.debug.Load() {
+		m.loggerFor(r.ConnectionID).Printf("debug: request %d, tag %s, sent to resource %s", r.CorrelationID, r.Tag, m.name)
+	}
+}
+
+type requestReport struct {
+	CorrelationID  uint64  `json:"correlation_id"`
+	ConnectionID   string  `json:"connection_id"`
+	State          string  `json:"state"`
+	AgeSeconds     float64 `json:"age_seconds"`
+	InStateSeconds float64 `json:"in_state_seconds"`
+	// The pool member serving the request, once it has been sent to one.
+	Member string `json:"member,omitempty"`
+	// The request's tag, under -correlation-tag.
+	Tag string `json:"tag,omitempty"`
+}
+
+// List the requests in flight as JSON, oldest first.
+func (s *server) serveRequests(writer http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+
+	reports := make([]requestReport, 0)
+	for _, r := range s.trackedRequests() {
+		reports = append(reports, newRequestReport(r, now))
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(writer).Encode(reports)
+}
+
+func newRequestReport(r request.Request, now time.Time) requestReport {
+	return requestReport{
+		CorrelationID:  r.CorrelationID,
+		ConnectionID:   r.ConnectionID,
+		State:          r.Status.State().String(),
+		AgeSeconds:     now.Sub(r.Status.Received()).Seconds(),
+		InStateSeconds: now.Sub(r.Status.Changed()).Seconds(),
+		Member:         r.Status.Holder(),
+		Tag:            r.Tag,
+	}
+}
+
+// A snapshot of the requests in flight, oldest first.
+func (s *server) trackedRequests() []request.Request {
+	s.requestsLock.Lock()
+	tracked := make([]request.Request, 0, len(s.requests))
+	for _, r := range s.requests {
+		tracked = append(tracked, r)
+	}
+	s.requestsLock.Unlock()
+
+	sort.Slice(tracked, func(i int, j int) bool { return tracked[i].Status.Received().Before(tracked[j].Status.Received()) })
+
+	return tracked
+}
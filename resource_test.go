@@ -0,0 +1,220 @@
+package impact
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A reply that arrives from the resource a few bytes at a time is only passed on once all of it has, and the rest of
+// it isn't taken for the next reply.
+func TestFragmentedReplies(t *testing.T) {
+	_, address := startServer(t, "echo", nil)
+	client := dial(t, address)
+
+	for correlationID := uint64(1); correlationID <= 6; correlationID++ {
+		payload := fmt.Sprintf("plain %d", correlationID)
+		if correlationID%2 == 1 {
+			payload = fmt.Sprintf("fragments %d", correlationID)
+		}
+
+		answer := client.request(correlationID, payload)
+		if answer.Header.CorrelationID != correlationID {
+			t.Fatalf("request %d was answered as %d", correlationID, answer.Header.CorrelationID)
+		}
+		expectReply(t, answer, payload)
+	}
+}
+
+// A frame from the resource that isn't a message is skipped, and the replies after it stay in step.
+func TestGarbledResourceOutput(t *testing.T) {
+	_, address := startServer(t, "echo", nil)
+	client := dial(t, address)
+
+	expectReply(t, client.request(1, "garbled"), "garbled")
+	expectReply(t, client.request(2, "after"), "after")
+}
+
+// A resource that closes its output but keeps running can't answer anything more. The request waiting on it fails,
+// and -output-closed says what becomes of the resource.
+func TestOutputClosed(t *testing.T) {
+	policies := []struct {
+		policy  string
+		restart string
+		code    message.ErrorCode
+		logged  string
+	}{
+		{outputClosedExit, restartAlways, message.ResourceStopped, "closed its output, stopping it"},
+		{outputClosedRestart, restartNever, message.ResourceRestarted, "closed its output, restarting it"},
+		{outputClosedDrain, restartNever, message.ResourceRestarted, "closed its output, waiting for it to finish its input"},
+	}
+	for _, policy := range policies {
+		t.Run(policy.policy, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			_, address := startServer(t, "echo", func(config *Config) {
+				config.OutputClosed = policy.policy
+				config.Restart = policy.restart
+				config.RestartBackoff = time.Millisecond
+			}, WithLogger(log.New(logs, "", 0)))
+			client := dial(t, address)
+
+			expectError(t, client.request(1, "eof"), policy.code)
+			// The handler waits a moment for the resource to exit before deciding it closed its output on purpose.
+			eventually(t, "the resource is seen to have closed only its output", func() bool { return strings.Contains(logs.String(), policy.logged) })
+			expectReply(t, client.request(2, "after"), "after")
+		})
+	}
+}
+
+// Under the exit policy, with nothing to relaunch the resource, the server gives up on it as if it had exited.
+func TestOutputClosedGivesUp(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) { config.OutputClosed = outputClosedExit })
+	client := dial(t, address)
+
+	expectError(t, client.request(1, "eof"), message.ResourceStopped)
+	go client.hangUpWhenClosed()
+	select {
+	case <-server.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server is still serving without its resource")
+	}
+	var exitError *ExitError
+	if closeError := server.Close(); !errors.As(closeError, &exitError) || exitError.Code != 40 {
+		t.Fatalf("the server ended with %v, not exit code 40", closeError)
+	}
+}
+
+// A client that disconnects while the resource is working on its request doesn't hold up anyone else. The rest of its
+// reply is read off the resource and thrown away, so the next client gets its own reply and not what was left of the
+// last one.
+func TestClientGoneMidRequest(t *testing.T) {
+	for _, payload := range []string{"sleep", "trickle"} {
+		t.Run(payload, func(t *testing.T) {
+			server, address := startServer(t, "echo", nil)
+			gone, staying := dial(t, address), dial(t, address)
+
+			gone.send(1, payload)
+			eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+			_ = gone.conn.Close()
+
+			for correlationID := uint64(1); correlationID <= 3; correlationID++ {
+				expectReply(t, staying.request(correlationID, fmt.Sprintf("after %d", correlationID)), fmt.Sprintf("after %d", correlationID))
+			}
+			eventually(t, "the request is counted as dropped", func() bool { return server.s.droppedRequests.Value(dropDisconnect) == 1 })
+		})
+	}
+}
+
+// A resource that stops reading its input fills the pipe to it. Once a send to it has been blocked for -input-stall,
+// new requests are turned away at once as Overloaded, rather than queued behind it.
+func TestResourceStopsReading(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.ResourceConcurrency = 16
+		config.InputStall = 100 * time.Millisecond
+		config.DrainTimeout = 100 * time.Millisecond
+	})
+
+	// Hanging, the resource reads nothing more, and requests big enough between them to fill any pipe back up. Each
+	// comes from a connection of its own, since a connection's requests are read one after another.
+	dial(t, address).send(1, "hang")
+	large := strings.Repeat("x", 32<<10)
+	for index := 0; index < 8; index++ {
+		dial(t, address).send(1, large)
+	}
+	eventually(t, "the resource is seen not to take its input", func() bool { return server.s.primary.inputBlocked() })
+
+	expectError(t, dial(t, address).request(1, "turned away"), message.Overloaded)
+	if dropped := server.s.droppedRequests.Value(dropBackpressure); dropped != 1 {
+		t.Fatalf("%d requests were counted as dropped for backpressure, not 1", dropped)
+	}
+}
+
+// Send a request for the named resource and wait for its answer.
+func (c *testClient) requestFrom(correlationID uint64, resource string, payload string) message.ImpactMessage {
+	c.t.Helper()
+
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	request.Header.Resource = resource
+	c.write(request)
+
+	return receiveAnswer(c)
+}
+
+// A named resource that keeps crashing is relaunched on its own, and another named resource serves on as if nothing
+// were happening: none of its requests waits for the crashed one's relaunch.
+func TestCrashingResourceIsIsolated(t *testing.T) {
+	const backoff = 300 * time.Millisecond
+	_, address := startServer(t, "echo", func(config *Config) {
+		config.Resources = fmt.Sprintf("alpha=%s,beta=%s", os.Args[0], os.Args[0])
+		config.RestartBackoff, config.RestartBackoffMax = backoff, backoff
+	})
+	alpha, beta := dial(t, address), dial(t, address)
+
+	// How fast beta serves with alpha left alone.
+	served, started := 0, time.Now()
+	for time.Since(started) < backoff {
+		served += 1
+		payload := fmt.Sprintf("beta %d", served)
+		expectReply(t, beta.requestFrom(uint64(served), "beta", payload), payload)
+	}
+	alone := float64(served) / time.Since(started).Seconds()
+
+	crashing := make(chan bool)
+	go func() {
+		defer close(crashing)
+		for crash := uint64(1); crash <= 3; crash++ {
+			if answer := alpha.requestFrom(crash, "alpha", "exit"); answer.Header.Type != message.Error {
+				t.Errorf("crash %d was answered with a message of type %d", crash, answer.Header.Type)
+			}
+		}
+		expectReply(t, alpha.requestFrom(4, "alpha", "relaunched"), "relaunched")
+	}()
+
+	served, slowest, started := 0, time.Duration(0), time.Now()
+	for running := true; running; {
+		select {
+		case <-crashing:
+			running = false
+		default:
+		}
+
+		served += 1
+		payload := fmt.Sprintf("beta %d", served)
+		sent := time.Now()
+		expectReply(t, beta.requestFrom(uint64(served), "beta", payload), payload)
+		slowest = max(slowest, time.Since(sent))
+	}
+
+	crashed := float64(served) / time.Since(started).Seconds()
+
+	t.Logf("beta served %.0f requests a second alone, and %.0f while alpha crashed three times, the slowest in %s", alone, crashed, slowest)
+	if slowest >= backoff/2 {
+		t.Fatalf("a request to beta took %s, as if it had waited for alpha to be relaunched", slowest)
+	}
+	if crashed < alone/2 {
+		t.Fatalf("beta served %.0f requests a second while alpha crashed, against %.0f alone", crashed, alone)
+	}
+}
+
+// A resource that closes its input but carries on running can't be sent anything more. The first write to it fails
+// with a broken pipe, and the resource is treated as having exited: the request that couldn't be written fails, and
+// -restart says what comes next.
+func TestResourceClosesInput(t *testing.T) {
+	logs := &lockedBuffer{}
+	_, address := startServer(t, "echo", func(config *Config) {
+		config.Restart = restartAlways
+		config.RestartBackoff = time.Millisecond
+	}, WithLogger(log.New(logs, "", 0)))
+	client := dial(t, address)
+
+	expectReply(t, client.request(1, "deaf"), "deaf")
+	expectError(t, client.request(2, "unheard"), message.ResourceStopped)
+	eventually(t, "the broken pipe is logged", func() bool { return strings.Contains(logs.String(), "could not be written to, treating it as exited") })
+	expectReply(t, client.request(3, "after"), "after")
+}
@@ -0,0 +1,29 @@
+package impact
+
+import (
+	"time"
+)
+
+// Why a resource was restarted. Each of these is a label value on the restarts counter, so that a crashing resource
+// can be told apart from an unhealthy one, and either from one that asked for it.
+const (
+	// The resource failed enough liveness probes in a row.
+	restartProbe = "probe"
+	// The resource made no progress for longer than the watchdog allows, with requests waiting.
+	restartWatchdog = "watchdog"
+	// The resource replied with the restart sentinel.
+	restartSentinel = "sentinel"
+	// The resource closed its output, under -output-closed restart or drain.
+	restartOutputClosed = "output-closed"
+	// A request to the resource timed out, under -timeout-action restart.
+	restartTimeout = "timeout"
+	// The resource exited without being asked to, and was relaunched.
+	restartExited = "exited"
+)
+
+// A fresh process has replaced the member's last one, for the given reason. Every restart is counted and logged here,
+// however it came about, with how long the old process had run.
+func (m *member) restarted(reason string, oldPID int, ran time.Duration) {
+	m.restartReasons.Inc(reason)
+	m.logger.Printf("resource %s restarted (%s) after running for %s, pid %d replaced by %d", m.name, reason, ran.Round(time.Millisecond), oldPID, m.process.Load().Pid())
+}
@@ -0,0 +1,52 @@
+package impact
+
+import (
+	"testing"
+	"time"
+)
+
+// Every way a resource comes to be restarted is counted under its own reason, and under no other.
+func TestRestartReasons(t *testing.T) {
+	reasons := []string{restartProbe, restartWatchdog, restartSentinel, restartOutputClosed, restartTimeout, restartExited}
+	causes := []struct {
+		reason    string
+		payload   string
+		configure func(config *Config)
+	}{
+		{restartProbe, "hang", func(config *Config) {
+			config.ProbeInterval = 50 * time.Millisecond
+			config.ProbeTimeout = 50 * time.Millisecond
+			config.ProbeFailures = 2
+		}},
+		{restartWatchdog, "hang", func(config *Config) {
+			config.WatchdogInterval = 100 * time.Millisecond
+			config.WatchdogRestart = true
+		}},
+		{restartSentinel, "restart me", func(config *Config) { config.RestartSentinel = "restart me" }},
+		{restartOutputClosed, "eof", func(config *Config) { config.OutputClosed = outputClosedRestart }},
+		{restartTimeout, "hang", func(config *Config) {
+			config.RequestTimeout = 100 * time.Millisecond
+			config.TimeoutAction = timeoutActionRestart
+		}},
+		{restartExited, "exit", func(config *Config) {
+			config.Restart = restartAlways
+			config.RestartBackoff = time.Millisecond
+		}},
+	}
+	for _, cause := range causes {
+		t.Run(cause.reason, func(t *testing.T) {
+			server, address := startServer(t, "echo", cause.configure)
+			client := dial(t, address)
+
+			client.send(1, cause.payload)
+			receiveAnswer(client)
+			eventually(t, "the resource is restarted", func() bool { return server.s.restartReasons.Value(cause.reason) == 1 })
+			for _, reason := range reasons {
+				if restarts := server.s.restartReasons.Value(reason); reason != cause.reason && restarts != 0 {
+					t.Fatalf("%d restarts were counted as %s", restarts, reason)
+				}
+			}
+			expectReply(t, client.request(2, "after"), "after")
+		})
+	}
+}
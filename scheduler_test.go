@@ -0,0 +1,95 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// Under -scheduler edf, a request whose deadline passes while it waits behind a slow one is never run, and the one
+// behind it, with time to spare, still is.
+func TestExpiredRequestsAreDropped(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) { config.Scheduler = "edf" })
+
+	slow := dial(t, address)
+	slow.send(1, "sleep")
+	eventually(t, "the slow request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+
+	clients := map[uint32]*testClient{}
+	for _, deadline := range []uint32{50, 5000} {
+		client := dial(t, address)
+		request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte("deadline")}
+		request.Header.CorrelationID = 2
+		request.Header.Deadline = deadline
+		client.write(request)
+		clients[deadline] = client
+	}
+
+	expectReply(t, slow.receive(), "sleep")
+	expectError(t, receiveAnswer(clients[50]), message.DeadlineExceeded)
+	expectReply(t, receiveAnswer(clients[5000]), "deadline")
+}
+
+// The next message from the server that isn't a queued acknowledgement or a grant of credit.
+func receiveAnswer(client *testClient) message.ImpactMessage {
+	for {
+		if answer := client.receive(); answer.Header.Type != message.Queued && answer.Header.Type != message.Credit {
+			return answer
+		}
+	}
+}
+
+// Under -max-anonymous-priority, a client that hasn't authenticated can't ask to go ahead of one that has just by
+// asking for more priority than the cap.
+func TestAnonymousPriorityCapped(t *testing.T) {
+	tokens := func(client Client) (string, error) {
+		if client.Token == "" {
+			return "", ErrNoIdentity
+		}
+		return client.Token, nil
+	}
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.Scheduler = "priority"
+		config.AuthFallback = authFallbackAnonymous
+		config.MaxAnonymousPriority = 1
+	}, WithIdentityExtractor("tokens", tokens))
+
+	// One request with the resource, and one chosen to go next, so that the two behind them are ordered by priority.
+	busy, next := dial(t, address), dial(t, address)
+	busy.send(1, "sleep")
+	eventually(t, "the first request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+	next.send(1, "sleep")
+	eventually(t, "the second request is chosen to go next", func() bool { return server.s.pending.Load() == 2 })
+
+	hello := message.NewHello(message.MinimumVersion, message.Version)
+	hello.Header.Token = "friend"
+	authenticated, _ := connect(t, address, hello)
+	anonymous := dial(t, address)
+	answered := make(chan string, 2)
+	for name, ask := range map[string]struct {
+		client   *testClient
+		priority uint8
+	}{"anonymous": {anonymous, 200}, "authenticated": {authenticated, 5}} {
+		request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(name)}
+		request.Header.CorrelationID = 1
+		request.Header.Priority = ask.priority
+		ask.client.write(request)
+		go func(client *testClient) {
+			if answer, readError := client.tryReceive(5 * time.Second); readError == nil {
+				answered <- string(answer.Payload)
+			}
+		}(ask.client)
+	}
+	eventually(t, "both requests are queued", func() bool { return server.s.pending.Load() == 4 })
+
+	for _, want := range []string{"authenticated", "anonymous"} {
+		select {
+		case got := <-answered:
+			if got != want {
+				t.Fatalf("the %s client was answered before the other", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the %s client wasn't answered", want)
+		}
+	}
+}
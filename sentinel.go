@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+	"strings"
+)
+
+// What happens to the sentinel reply itself, once the resource has said it is in a bad state.
+const (
+	// The client gets an error saying the resource was restarted, as if it had crashed.
+	sentinelSuppress = "suppress"
+	// The client gets the sentinel as its reply, for resources whose clients know what it means.
+	sentinelDeliver = "deliver"
+)
+
+// A sentinel is given as text, or as hex: followed by hex digits for bytes that aren't text.
+func parseSentinel(value string) ([]byte, error) {
+	if encoded, isHex := strings.CutPrefix(value, "hex:"); isHex {
+		decoded, decodeError := hex.DecodeString(encoded)
+		if decodeError != nil {
+			return nil, fmt.Errorf("bad hex: %w", decodeError)
+		}
+
+		return decoded, nil
+	}
+
+	return []byte(value), nil
+}
+
+// Some resources notice they have got into a bad state and say so with a particular reply, rather than crashing.
+// A reply whose payload is exactly the sentinel answers the request it arrived for, one way or the other, and
+// then the resource is restarted. Report whether this reply was the sentinel.
+func (b *backend) sentinel(x *exchange, reply radiowave.Message) bool {
+	if len(b.restartSentinel) == 0 {
+		return false
+	}
+
+	typed, ok := reply.(message.ImpactMessage)
+	if !ok || !bytes.Equal(typed.Payload, b.restartSentinel) {
+		return false
+	}
+
+	b.loggerFor(x.request.ConnectionID).Printf("resource %s sent its restart sentinel in reply to request %d", b.name, x.request.CorrelationID)
+
+	if b.sentinelReply == sentinelDeliver {
+		// Nothing more is coming from this process, whatever the sentinel's flags say.
+		typed.Header.Flags &^= message.More
+		b.relay(x, typed)
+		return true
+	}
+
+	b.abandon(x, dropRestart, message.ResourceRestarted, "resource reported a bad state and was restarted")
+	return true
+}
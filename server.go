@@ -0,0 +1,348 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/metrics"
+	"github.com/blanu/impact/internal/request"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The server holds everything shared between the connection handlers and the backends. Everything a server uses lives
+// here rather than in package variables, so that two servers in one process don't share a logger, metrics, or counters.
+type server struct {
+	factory message.ImpactMessageFactory
+
+	logger *log.Logger
+	// How the server gives up when it can't carry on, or exits once it has shut down. The process exits, unless
+	// whoever made the server says otherwise.
+	exit func(code int)
+	// Closed once an embedded server has stopped for good, so that the coroutines that run for as long as the server
+	// does can stop too. The impact program exits instead.
+	halted chan bool
+
+	// Requests go to the primary backend, unless they are big enough to go to the large one. There is no large
+	// backend unless one was asked for.
+	primary          *backend
+	large            *backend
+	largeRequestSize int
+	// Requests that name a resource go to the backend of that name, with its own pool, queue and restarts. These are in
+	// the order they were given, for listing.
+	named      map[string]*backend
+	namedOrder []*backend
+
+	// How many requests each backend's funnel holds, between its scheduler and its resources.
+	funnelBuffer int
+
+	// The number of client requests that have been submitted to the funnel but not yet answered.
+	pending atomic.Int64
+	// The most requests that may be pending at once. Zero means there is no limit.
+	maxInFlight atomic.Int64
+	// What gives once there are that many.
+	inFlightOverflow string
+	// The same for each identity, across all its connections, and how many each has pending now. Zero means no limit.
+	maxInFlightIdentity atomic.Int64
+	identityPendingLock sync.Mutex
+	identityPending     map[string]int64
+	// The most urgent a request from a client that didn't authenticate may be.
+	maxAnonymousPriority uint8
+	// The datagrams being handled now, each by a goroutine of its own.
+	datagramsHandled atomic.Int64
+
+	// Requests per second allowed on each connection, as math.Float64bits, and across all of them. Zero means no limit.
+	connectionRate  atomic.Uint64
+	globalRateLimit *rateLimit
+
+	// New connections per second let in across every listener, and what happens to those over it.
+	acceptRateLimit     *rateLimit
+	acceptOverflow      string
+	acceptedConnections *metrics.Counter
+	rejectedConnections *metrics.Counter
+
+	// How long the resource has to answer a liveness probe, in nanoseconds.
+	probeTimeout atomic.Int64
+
+	// The settings in effect, by flag name, as of startup or the last reload.
+	settings map[string]string
+
+	// Every client request in flight.
+	requestsLock sync.Mutex
+	requests     map[*request.Status]request.Request
+
+	// Every connection that has completed its handshake, by id.
+	connectionsLock sync.Mutex
+	connections     map[string]*connection.Conn
+
+	// The bytes each open connection has sent and been sent, by id, and each tenant's totals.
+	usageLock      sync.Mutex
+	usage          map[string]*connectionUsage
+	tenantBytesIn  *metrics.CounterVec
+	tenantBytesOut *metrics.CounterVec
+
+	// Each open connection's flow control window, by id, when there is flow control. How many requests a client may
+	// have unanswered, and how many credits are granted back at a time.
+	windowsLock     sync.Mutex
+	windows         map[string]*flowWindow
+	windowSize      int
+	windowReplenish int
+	// What happens to a request without credit.
+	flowOverflow string
+	// The most request payload bytes a connection may have outstanding at once. Zero means there is no cap.
+	maxOutstandingBytes int
+
+	// Longest any request may be in impact, all told. Zero means forever.
+	maxLifetime time.Duration
+
+	// Where requests' tags go, and the last tag given. An empty place means requests aren't tagged.
+	correlationTag string
+	tags           atomic.Uint32
+
+	// Sessions that can be resumed, by their current token, and how long one waits for its client to come back. Zero
+	// means sessions can't be resumed.
+	sessionsLock sync.Mutex
+	sessions     map[string]*session
+	resumeTTL    time.Duration
+	resumptions  *metrics.CounterVec
+	// What becomes of the reply to a request in flight when its client went, and the most payload bytes of it kept.
+	// Zero means no limit.
+	resumeReplies string
+	resumeBuffer  int
+
+	// What each resource is sent once the drain is done, to tell it to exit, as a request or as a signal, and how long
+	// it has to do it. With neither, resources aren't told.
+	shutdownCommand string
+	shutdownSignal  syscall.Signal
+	shutdownWait    time.Duration
+	// How long the drain may take before whatever is still pending is given up on. Zero means as long as it takes.
+	drainTimeout time.Duration
+
+	// Set once shutdown has started. Changing it, and acting on it to restart or give up on the resource, happen under
+	// the lifecycle lock, so that shutdown and the process handler can't make conflicting decisions.
+	shuttingDown  atomic.Bool
+	lifecycleLock sync.Mutex
+
+	// Log debugging detail.
+	debug atomic.Bool
+
+	// The largest reply chunk, and the largest reply in total, in bytes. Zero means there is no limit.
+	maxMessageSize int
+	maxReplySize   int
+
+	// How long a send to the resource may block before the resource counts as not taking its input. Zero means never.
+	inputStall  time.Duration
+	inputStalls *metrics.Counter
+
+	// Resource restarts, by why they happened.
+	restartReasons *metrics.CounterVec
+
+	// How long the resource has to reply to a request that doesn't ask for a timeout of its own, and the longest
+	// timeout a request may ask for, in nanoseconds. Zero means there is no limit.
+	defaultRequestTimeout atomic.Int64
+	maxRequestTimeout     atomic.Int64
+
+	// The largest message a client may send, which clients are told in the handshake. Zero means there is no limit.
+	maxRequestSize int
+
+	// What happens to client messages that aren't requests.
+	unknownType string
+
+	// How errors that impact synthesizes are put to clients.
+	encodeError errorEncoder
+
+	// Acknowledge each queued request with its place in the queue.
+	queuePosition bool
+
+	// A reply that means the resource needs restarting, and whether the client sees it. Empty means there is none.
+	restartSentinel []byte
+	sentinelReply   string
+
+	pushes *metrics.CounterVec
+
+	// The ways of telling who a client is, tried in order, and what becomes of a client that none of them knows. Empty
+	// means clients don't have to say.
+	authenticators  []identityMethod
+	authFallback    string
+	authentications *metrics.CounterVec
+
+	// The compression algorithms we offer clients, best first, and the smallest payload worth compressing.
+	compression        []message.Compression
+	compressionMinSize int
+
+	// Records every client request before the resource sees it. Nil if there is no journal.
+	journal *journal
+	// Records how every client request ended, tamper-evidently. Nil if there is no audit log.
+	audit *audit
+
+	// Counts requests slower than the latency objectives.
+	slo *sloCounter
+	// Requests at least this slow have their spans logged, as do this fraction of the rest. Zero for neither.
+	spanSlow   time.Duration
+	spanSample float64
+	// How long requests took, from queueing to reply, with exemplars for those that came with a trace id.
+	requestDurations *metrics.Histogram
+
+	// Remembers replies to requests with idempotency keys, to answer their retries.
+	replies   *replyCache
+	dedupHits *metrics.Counter
+
+	droppedRequests  *metrics.CounterVec
+	backendRequests  *metrics.CounterVec
+	resourceStatuses *metrics.CounterVec
+	// Statuses from the resource that are passed on to clients as errors.
+	statusErrors     map[uint16]bool
+	replyRatios      *metrics.Histogram
+	replyRatioAlarms *metrics.Counter
+	// Replies more than this many times the size of their request are logged. Zero means never.
+	replyRatioAlarm float64
+}
+
+// The ways the server can handle a client message that isn't a request.
+const (
+	// Answer it with an UnknownMessageType error.
+	unknownTypeReject = "reject"
+	// Send it to the default resource, as if it were a request.
+	unknownTypeDefault = "default"
+	// Close the connection.
+	unknownTypeClose = "close"
+)
+
+func newServer(factory message.ImpactMessageFactory, registry *metrics.Registry, logger *log.Logger) *server {
+	s := &server{
+		factory: factory,
+		logger:  logger,
+		exit:    os.Exit,
+		halted:  make(chan bool),
+
+		connections: make(map[string]*connection.Conn),
+		requests:    make(map[*request.Status]request.Request),
+		usage:       make(map[string]*connectionUsage),
+		windows:     make(map[string]*flowWindow),
+		sessions:    make(map[string]*session),
+
+		identityPending: make(map[string]int64),
+
+		droppedRequests:  registry.NewCounterVec("impact_dropped_requests_total", "Requests that did not complete normally, by reason.", "reason"),
+		backendRequests:  registry.NewCounterVec("impact_backend_requests_total", "Requests taken for each backend.", "backend"),
+		resourceStatuses: registry.NewCounterVec("impact_resource_statuses_total", "Replies from the resources, by the status the resource gave them, 0 for none.", "status"),
+		replyRatios:      registry.NewHistogram("impact_reply_size_ratio", "Size of each reply divided by the size of its request.", []float64{0.1, 0.5, 1, 2, 5, 10, 100, 1000}),
+		requestDurations: registry.NewHistogram("impact_request_duration_seconds", "Time from queueing each request to sending the last of its reply.", []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}),
+		replyRatioAlarms: registry.NewCounter("impact_reply_ratio_alarms_total", "Replies larger than the configured multiple of their request."),
+		authentications:  registry.NewCounterVec("impact_authentications_total", "Connections authenticated, by method, or failed if no method recognized the client.", "method"),
+		pushes:           registry.NewCounterVec("impact_pushes_total", "Messages pushed by the resource, by whether they reached a connection.", "outcome"),
+		dedupHits:        registry.NewCounter("impact_dedup_hits_total", "Retries answered with a remembered reply instead of running the request again."),
+		tenantBytesIn:    registry.NewCounterVec("impact_tenant_bytes_in_total", "Bytes of request payload sent by clients, by authenticated identity.", "tenant"),
+		tenantBytesOut:   registry.NewCounterVec("impact_tenant_bytes_out_total", "Bytes of reply and push payload sent to clients, by authenticated identity.", "tenant"),
+		resumptions:      registry.NewCounterVec("impact_session_resumptions_total", "Sessions resumed by a client that came back, refused to a client with a token that was no good, or expired waiting.", "outcome"),
+		restartReasons:   registry.NewCounterVec("impact_resource_restarts_total", "Resource restarts, by why the resource was restarted.", "reason"),
+		inputStalls:      registry.NewCounter("impact_resource_input_stalls_total", "Times a resource stopped taking its input for longer than the input stall threshold."),
+	}
+
+	return s
+}
+
+// Count a new pending request, unless that would take us over the in-flight cap.
+func (s *server) admit() bool {
+	maxInFlight := s.maxInFlight.Load()
+	if s.pending.Add(1) > maxInFlight && maxInFlight > 0 {
+		s.pending.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+// The same for the identity that sent the request, unless that would take it over its own cap. Anonymous clients are
+// all one identity, so that they can't get round the cap by not authenticating.
+func (s *server) admitIdentity(r request.Request) bool {
+	identity := identityOf(r)
+
+	s.identityPendingLock.Lock()
+	defer s.identityPendingLock.Unlock()
+
+	maxInFlight := s.maxInFlightIdentity.Load()
+	if maxInFlight > 0 && s.identityPending[identity] >= maxInFlight {
+		return false
+	}
+
+	s.identityPending[identity]++
+	return true
+}
+
+// The request is no longer pending. An identity with nothing pending isn't kept, so that clients that come and go
+// don't add up.
+func (s *server) releaseIdentity(r request.Request) {
+	identity := identityOf(r)
+
+	s.identityPendingLock.Lock()
+	defer s.identityPendingLock.Unlock()
+
+	s.identityPending[identity]--
+	if s.identityPending[identity] <= 0 {
+		delete(s.identityPending, identity)
+	}
+}
+
+// How many requests each identity has pending, for the metrics and the usage report.
+func (s *server) identitiesPending() map[string]int64 {
+	s.identityPendingLock.Lock()
+	defer s.identityPendingLock.Unlock()
+
+	pending := make(map[string]int64, len(s.identityPending))
+	for identity, count := range s.identityPending {
+		pending[identity] = count
+	}
+
+	return pending
+}
+
+func (s *server) addConnection(connection *connection.Conn) {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	s.connections[connection.ID] = connection
+	// A connection that finished its handshake after the going away broadcast missed it, but is draining all the same.
+	if s.shuttingDown.Load() {
+		connection.Draining.Store(true)
+	}
+}
+
+func (s *server) findConnection(id string) (*connection.Conn, bool) {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	connection, found := s.connections[id]
+	return connection, found
+}
+
+func (s *server) removeConnection(connection *connection.Conn) {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	delete(s.connections, connection.ID)
+}
+
+// How many connections are open.
+func (s *server) openConnections() int {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	return len(s.connections)
+}
+
+// A snapshot of the current connections, so they can be written to without holding the lock.
+func (s *server) currentConnections() []*connection.Conn {
+	s.connectionsLock.Lock()
+	defer s.connectionsLock.Unlock()
+
+	current := make([]*connection.Conn, 0, len(s.connections))
+	for _, connection := range s.connections {
+		current = append(current, connection)
+	}
+
+	return current
+}
@@ -0,0 +1,55 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Two servers in one process, each with its own resource, share nothing: not their replies, their counters, their logs,
+// nor their lifetimes.
+func TestServersAreIsolated(t *testing.T) {
+	echoLogs, upperLogs := &lockedBuffer{}, &lockedBuffer{}
+	echo, echoAddress := startServer(t, "echo", nil, WithLogger(log.New(echoLogs, "", 0)))
+	upper, upperAddress := startServer(t, "upper", nil, WithLogger(log.New(upperLogs, "", 0)))
+
+	var clients sync.WaitGroup
+	for index := 0; index < 4; index++ {
+		address, want := echoAddress, "hello"
+		if index == 0 {
+			address, want = upperAddress, "HELLO"
+		}
+
+		client := dial(t, address)
+		clients.Add(1)
+		go func(index int) {
+			defer clients.Done()
+			answer, requestError := client.tryRequest(uint64(index), "hello")
+			if requestError != nil || answer.Header.Type != message.Reply || string(answer.Payload) != want {
+				t.Errorf("client %d got %q, %v, not %q", index, answer.Payload, requestError, want)
+			}
+		}(index)
+	}
+	clients.Wait()
+
+	if served := echo.s.backendRequests.Value("primary"); served != 3 {
+		t.Errorf("the echo server counted %d requests, not 3", served)
+	}
+	if served := upper.s.backendRequests.Value("primary"); served != 1 {
+		t.Errorf("the upper server counted %d requests, not 1", served)
+	}
+	if strings.Count(echoLogs.String(), "starting:") != 1 || strings.Count(upperLogs.String(), "starting:") != 1 {
+		t.Errorf("the servers' logs are mixed up:\n%s\n%s", echoLogs.String(), upperLogs.String())
+	}
+
+	// Closing one leaves the other serving.
+	if closeError := echo.Close(); closeError != nil {
+		t.Fatalf("Close: %v", closeError)
+	}
+	expectReply(t, dial(t, upperAddress).request(5, "still here"), "STILL HERE")
+	if !strings.Contains(echoLogs.String(), "drained, exiting") || strings.Contains(upperLogs.String(), "drained") {
+		t.Errorf("closing the echo server was logged in the wrong place:\n%s\n%s", echoLogs.String(), upperLogs.String())
+	}
+}
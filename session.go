@@ -0,0 +1,273 @@
+package impact
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/radiowave"
+	"sync"
+	"time"
+)
+
+// A client whose connection drops, say on a flaky network, loses whatever it was waiting for. With -resume-ttl, every
+// welcome carries a resumption token, and a client that reconnects within the TTL and sends the token in its hello
+// takes up its session where it left off: it keeps its connection id, so that the resource's pushes and the usage
+// counts find it again, and it is sent the reply to whatever it had in flight when it went, which impact kept for it.
+//
+// A token is 16 bytes from crypto/rand, in hex, so it can't be guessed, only stolen. To limit what a stolen one is
+// good for, each token is good for one resumption, and the welcome that resumes a session carries its next one.
+// A session can only be resumed while it is detached, and only by a client with the identity it had, if it had one.
+
+// The reply to a request in flight when a client went is handled by -resume-replies, one of:
+const (
+	// Keep the reply until the client comes back for it, as long as it fits in -resume-buffer bytes of payload. One
+	// that doesn't is thrown away, and the client gets a ReplyLost error in its place.
+	resumeRepliesKeep = "keep"
+	// Throw the reply away, and tell the client it was lost with a ReplyLost error when it comes back.
+	resumeRepliesError = "error"
+	// Throw the reply away and say nothing, as if the session couldn't be resumed.
+	resumeRepliesDrop = "drop"
+)
+
+// Either way, a client that doesn't come back within the TTL never hears of the reply. It is counted as dropped, as it
+// would have been without sessions, and the resource goes on with the request all the same, its reply thrown away if
+// still to come.
+
+// The random bytes in a resumption token.
+const resumeTokenLength = 16
+
+// A session outlives its connection, for a while, once it has a token.
+type session struct {
+	id       string
+	identity string
+	token    string
+
+	lock sync.Mutex
+	// Running while nobody is connected to the session, until it expires. Nil while somebody is.
+	expiry *time.Timer
+	// Closed once the session has expired.
+	expired chan bool
+	// The reply to the request that was in flight when the client went, as much of it as has come, and a channel that
+	// is closed once all of it has. Nil if nothing was in flight.
+	parked    []radiowave.Message
+	parkedFor uint64
+	collected chan bool
+	// Whether the reply was given up on, and the request already counted as dropped.
+	lost bool
+}
+
+func newResumeToken() string {
+	random := make([]byte, resumeTokenLength)
+	// crypto/rand doesn't fail on the systems we run on, and a token of zeroes is still one nobody else has.
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// Find the session a client is asking to resume, or start it a new one, and give the welcome the session's token.
+// Nil if sessions can't be resumed.
+func (s *server) joinSession(conn *connection.Conn, hello message.ImpactMessage, welcome *message.ImpactMessage) *session {
+	if s.resumeTTL <= 0 {
+		return nil
+	}
+
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	var joined *session
+	if token := hello.Header.Resume; token != "" {
+		joined = s.sessions[token]
+		if joined != nil && joined.take(conn) {
+			delete(s.sessions, token)
+			conn.ID = joined.id
+			welcome.Header.Flags |= message.Resumed
+			s.resumptions.Inc("resumed")
+		} else {
+			joined = nil
+			s.resumptions.Inc("refused")
+		}
+	}
+	if joined == nil {
+		joined = &session{id: conn.ID, identity: conn.Identity, expired: make(chan bool)}
+	}
+
+	joined.token = newResumeToken()
+	s.sessions[joined.token] = joined
+	welcome.Header.Resume = joined.token
+	return joined
+}
+
+// Attach a connection to a detached session, if it is the session's to take.
+func (session *session) take(conn *connection.Conn) bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if session.expiry == nil || session.identity != conn.Identity {
+		return false
+	}
+
+	// A timer that has already fired is expiring the session, which is too late to take it.
+	if !session.expiry.Stop() {
+		return false
+	}
+	session.expiry = nil
+	return true
+}
+
+// The session's connection has closed. A client that went away can come back for it until the TTL is up. One that was
+// turned away can't.
+func (s *server) leaveSession(session *session, reason connection.CloseReason) {
+	if session == nil {
+		return
+	}
+
+	if reason != closeFinished {
+		s.endSession(session)
+		return
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.expiry = time.AfterFunc(s.resumeTTL, func() {
+		s.resumptions.Inc("expired")
+		s.endSession(session)
+	})
+}
+
+func (s *server) endSession(session *session) {
+	s.sessionsLock.Lock()
+	if s.sessions[session.token] == session {
+		delete(s.sessions, session.token)
+	}
+	s.sessionsLock.Unlock()
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	select {
+	case <-session.expired:
+		return
+	default:
+		close(session.expired)
+	}
+	if session.collected != nil && !session.lost {
+		s.drop(session.id, session.parkedFor, dropDisconnect, "client did not resume its session in time for its reply")
+	}
+}
+
+// The client went away with a request in flight. Unless -resume-replies says to drop it, the session keeps what the
+// client is to be told when it comes back, until the TTL is up. The request's gone channel is closed once nothing more
+// of the reply is wanted. Report whether the request was parked; if not, the caller drops it as usual.
+func (s *server) park(session *session, backend *backend, r request.Request, gone chan bool) bool {
+	if s.resumeReplies == resumeRepliesDrop {
+		return false
+	}
+
+	collected := make(chan bool)
+	session.lock.Lock()
+	session.parked, session.parkedFor, session.collected, session.lost = nil, r.CorrelationID, collected, false
+	session.lock.Unlock()
+
+	if s.resumeReplies == resumeRepliesError {
+		s.lose(session, r, "client went away while its request was in flight")
+		close(collected)
+		close(gone)
+		return true
+	}
+
+	go func() {
+		defer close(gone)
+		defer close(collected)
+
+		failed, size := false, 0
+		for {
+			var reply radiowave.Message
+			select {
+			case reply = <-r.ReplyChannel:
+			case <-r.Lifetime():
+				reply = backend.outlived(r)
+			case <-session.expired:
+				s.untrack(r, false, true)
+				return
+			}
+
+			// A reply too big to keep is only kept as the news that it was lost.
+			size += payloadSize(reply)
+			if s.resumeBuffer > 0 && size > s.resumeBuffer {
+				s.lose(session, r, fmt.Sprintf("reply to keep for the client was larger than %d bytes", s.resumeBuffer))
+				return
+			}
+
+			if _, isError := reply.(message.ImpactError); isError {
+				failed = true
+			}
+			session.lock.Lock()
+			session.parked = append(session.parked, reply)
+			session.lock.Unlock()
+
+			if !message.HasMore(reply) {
+				s.untrack(r, failed, false)
+				return
+			}
+		}
+	}()
+
+	return true
+}
+
+// Give up on the reply to a parked request, and keep the error that tells the client so instead.
+func (s *server) lose(session *session, r request.Request, why string) {
+	s.drop(r.ConnectionID, r.CorrelationID, dropDisconnect, why)
+	s.untrack(r, false, true)
+
+	lost := message.ImpactError{CorrelationID: r.CorrelationID, Code: message.ReplyLost, Description: "reply was lost while the client was away"}
+	session.lock.Lock()
+	session.parked, session.lost = []radiowave.Message{lost}, true
+	session.lock.Unlock()
+}
+
+// Send a resumed client the reply it went before getting, once it has all come. Nothing else is read from the client
+// until then, so that its replies still come in the order of its requests.
+func (s *server) deliverParked(conn *connection.Conn, session *session) {
+	if session == nil {
+		return
+	}
+
+	session.lock.Lock()
+	collected := session.collected
+	session.lock.Unlock()
+	if collected == nil {
+		return
+	}
+
+	select {
+	case <-collected:
+	case <-conn.Done():
+		return
+	}
+
+	// The reply has all come, so nothing more is parked while it's written, and a slow client doesn't hold up the
+	// session's expiry waiting on the lock.
+	session.lock.Lock()
+	parked := session.parked
+	session.lock.Unlock()
+
+	sent := 0
+	for _, reply := range parked {
+		if writeError := conn.WriteMessage(s.compressFor(conn, s.encodeErrors(reply))); writeError != nil {
+			break
+		}
+		s.countOut(conn, reply)
+		sent++
+	}
+
+	// If the client goes again part way through, whatever it wasn't sent is still kept for next time.
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.parked = parked[sent:]
+	if len(session.parked) == 0 {
+		session.collected = nil
+	}
+}
@@ -0,0 +1,132 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"testing"
+	"time"
+)
+
+// Connect, and ask to resume the session the token is for.
+func resume(t *testing.T, address string, token string) (*testClient, message.ImpactMessage) {
+	t.Helper()
+
+	hello := message.NewHello(message.MinimumVersion, message.Version)
+	hello.Header.Resume = token
+	client, welcome := connect(t, address, hello)
+	if welcome.Header.Type != message.Welcome {
+		t.Fatalf("got a message of type %d in answer to the hello", welcome.Header.Type)
+	}
+
+	return client, welcome
+}
+
+// Go away with a slow request in flight, once it is with the resource, and wait until impact has seen the connection
+// close, so that the session can be resumed. Return the token to resume it with.
+func goAwayMidRequest(t *testing.T, server *Server, address string) string {
+	t.Helper()
+
+	hello := message.NewHello(message.MinimumVersion, message.Version)
+	client, welcome := connect(t, address, hello)
+	token := welcome.Header.Resume
+	if token == "" {
+		t.Fatal("the welcome has no resumption token")
+	}
+
+	client.send(1, "sleep")
+	eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+	_ = client.conn.Close()
+	eventually(t, "the session is waiting for its client", func() bool {
+		server.s.sessionsLock.Lock()
+		detached := server.s.sessions[token]
+		server.s.sessionsLock.Unlock()
+		if detached == nil {
+			return false
+		}
+
+		detached.lock.Lock()
+		defer detached.lock.Unlock()
+		return detached.expiry != nil
+	})
+
+	return token
+}
+
+// A client that comes back for its session is told what became of the request it had in flight, as -resume-replies
+// and -resume-buffer say, before anything it sends on its new connection is answered.
+func TestResumeWithPendingReply(t *testing.T) {
+	outcomes := []struct {
+		name    string
+		replies string
+		buffer  int
+		lost    bool
+	}{
+		{"keep", resumeRepliesKeep, 1 << 20, false},
+		{"keep too much", resumeRepliesKeep, 3, true},
+		{"error", resumeRepliesError, 1 << 20, true},
+		{"drop", resumeRepliesDrop, 1 << 20, false},
+	}
+	for _, outcome := range outcomes {
+		t.Run(outcome.name, func(t *testing.T) {
+			server, address := startServer(t, "echo", func(config *Config) {
+				config.ResumeTTL = 5 * time.Second
+				config.ResumeReplies = outcome.replies
+				config.ResumeBuffer = outcome.buffer
+			})
+			token := goAwayMidRequest(t, server, address)
+
+			client, welcome := resume(t, address, token)
+			if welcome.Header.Flags&message.Resumed == 0 {
+				t.Fatal("the session wasn't resumed")
+			}
+			if welcome.Header.Resume == "" || welcome.Header.Resume == token {
+				t.Fatalf("the resumed session's welcome has the token %q, not a new one", welcome.Header.Resume)
+			}
+
+			client.send(2, "after")
+			switch {
+			case outcome.lost:
+				expectError(t, receiveAnswer(client), message.ReplyLost)
+			case outcome.replies == resumeRepliesKeep:
+				answer := receiveAnswer(client)
+				if answer.Header.CorrelationID != 1 {
+					t.Fatalf("request %d was answered before the kept reply", answer.Header.CorrelationID)
+				}
+				expectReply(t, answer, "sleep")
+			}
+			expectReply(t, receiveAnswer(client), "after")
+
+			// A reply the client never gets counts its request as dropped, once.
+			want := int64(1)
+			if outcome.replies == resumeRepliesKeep && !outcome.lost {
+				want = 0
+			}
+			if dropped := server.s.droppedRequests.Value(dropDisconnect); dropped != want {
+				t.Fatalf("%d requests were dropped for the disconnect, not %d", dropped, want)
+			}
+		})
+	}
+}
+
+// A client that never comes back never hears of its reply. The session expires once the TTL is up, the request is
+// counted as dropped once, and the token is no good afterwards.
+func TestNeverReattach(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) { config.ResumeTTL = 100 * time.Millisecond })
+	token := goAwayMidRequest(t, server, address)
+
+	eventually(t, "the session expires", func() bool { return server.s.resumptions.Value("expired") == 1 })
+	eventually(t, "the request is counted as dropped", func() bool { return server.s.droppedRequests.Value(dropDisconnect) == 1 })
+	// The reply comes from the resource after the session is gone, and has nowhere to go.
+	eventually(t, "the request is done with", func() bool { return server.s.pending.Load() == 0 })
+	if dropped := server.s.droppedRequests.Value(dropDisconnect); dropped != 1 {
+		t.Fatalf("%d requests were dropped for the disconnect, not 1", dropped)
+	}
+
+	client, welcome := resume(t, address, token)
+	if welcome.Header.Flags&message.Resumed != 0 {
+		t.Fatal("an expired session was resumed")
+	}
+	expectReply(t, client.request(2, "after"), "after")
+	if refused := server.s.resumptions.Value("refused"); refused != 1 {
+		t.Fatalf("%d resumptions were refused, not 1", refused)
+	}
+}
@@ -0,0 +1,130 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Shutting down is done in order: stop accepting connections, tell every client that we are going away, let the
+// requests already submitted finish, and then exit. Clients behind a load balancer get a chance to move elsewhere
+// before their sockets drop, rather than finding out by losing a request. Under -drain-timeout, a drain that takes
+// longer is cut short: requests still queued are turned away, since they never ran and can be sent elsewhere, and
+// those the resource is still handling are cut off when their connections close.
+func (s *server) handleShutdown(listeners []*connection.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	<-signals
+
+	// A second signal means whoever is stopping us doesn't want to wait for the drain.
+	go func() {
+		<-signals
+		s.logger.Println("shutting down immediately")
+		s.exit(1)
+	}()
+
+	s.shutdown(listeners)
+}
+
+// Shut down, for whatever reason, and exit once drained.
+func (s *server) shutdown(listeners []*connection.Listener) {
+	s.logger.Println("shutting down, draining pending requests")
+
+	s.lifecycleLock.Lock()
+	s.shuttingDown.Store(true)
+	s.lifecycleLock.Unlock()
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+	s.broadcastGoingAway("server is shutting down")
+
+	if !s.awaitDrain() {
+		s.logger.Printf("warning: drain did not finish within %s, giving up on %d pending requests", s.drainTimeout, s.pending.Load())
+		s.turnAwayQueued()
+	}
+
+	s.closeConnections(closeShutdown)
+	s.quitResources()
+	s.journal.close()
+	s.audit.close()
+	s.logger.Println("drained, exiting")
+	s.exit(0)
+}
+
+// Wait until every pending request has been answered, or the drain timeout is up. Report whether they all were.
+func (s *server) awaitDrain() bool {
+	deadline := time.Now().Add(s.drainTimeout)
+	for s.pending.Load() > 0 {
+		if s.drainTimeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return true
+}
+
+// Turn away every request still queued when the drain has run out of time.
+func (s *server) turnAwayQueued() {
+	for _, queued := range s.trackedRequests() {
+		if queued.Status.State() != request.Queued {
+			continue
+		}
+
+		backend := s.route(queued)
+		if backend == nil || !backend.scheduler.Remove(queued) {
+			continue
+		}
+		s.pending.Add(-1)
+
+		s.drop(queued.ConnectionID, queued.CorrelationID, dropShutdown, "drain timed out before the request was run")
+		queued.Reply(message.ImpactError{CorrelationID: queued.CorrelationID, Code: message.ShuttingDown, Description: "server shut down before the request was run, retry elsewhere"})
+	}
+}
+
+// Give up on the resource for good, and exit without it. Every client is told why first, rather than finding its
+// connection gone from under it.
+func (s *server) resourceGone(code int) {
+	s.closeConnections(closeResourceGone)
+	s.exit(code)
+}
+
+// Close every connection at once, each as its reason says, and wait until they are all closed.
+func (s *server) closeConnections(reason connection.CloseReason) {
+	var closing sync.WaitGroup
+	for _, conn := range s.currentConnections() {
+		closing.Add(1)
+		go func(conn *connection.Conn) {
+			defer closing.Done()
+			_ = conn.CloseFor(reason)
+		}(conn)
+	}
+	closing.Wait()
+}
+
+// Tell every client we are going away. From then on, each connection is draining: what its client sent before is
+// answered, and anything new is turned away, since we are trying to empty the queues, not fill them.
+func (s *server) broadcastGoingAway(reason string) {
+	for _, connection := range s.currentConnections() {
+		connection.Draining.Store(true)
+		// A client that can't be told is already gone, and has nothing left for us to drain.
+		_ = connection.WriteMessage(message.NewGoingAway(connection.Version, reason))
+	}
+}
+
+// Turn away a request that arrived after its connection started draining. Report whether it was turned away.
+func (s *server) refuseDraining(conn *connection.Conn, r request.Request) bool {
+	if !conn.Draining.Load() {
+		return false
+	}
+
+	s.drop(r.ConnectionID, r.CorrelationID, dropShutdown, "request arrived while draining")
+	_ = conn.WriteMessage(s.encodeError(message.ImpactError{CorrelationID: r.CorrelationID, Code: message.ShuttingDown, Description: "server is draining, retry elsewhere"}))
+	return true
+}
@@ -0,0 +1,206 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Every resource the server launched has exited.
+func expectResourcesGone(t *testing.T, server *Server) {
+	t.Helper()
+
+	for _, b := range server.s.backends() {
+		for _, m := range b.members {
+			process := m.process.Load()
+			if process == nil {
+				continue
+			}
+			select {
+			case <-process.ExitChannel:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("resource %s, pid %d, is still running after the server closed", m.name, process.Pid())
+			}
+		}
+	}
+}
+
+// Read whatever comes until the server closes the connection, then close it too, as a client would, rather than leave
+// the server to wait out its graceful close.
+func (c *testClient) hangUpWhenClosed() {
+	for {
+		if _, readError := c.tryReceive(5 * time.Second); readError != nil {
+			_ = c.conn.Close()
+			return
+		}
+	}
+}
+
+// A resource that crashes once shutdown has started is left to lie, however -restart says to deal with crashes, and
+// the server shuts down cleanly rather than giving up on the resource.
+func TestCrashDuringShutdown(t *testing.T) {
+	for _, restart := range []string{restartNever, restartAlways} {
+		t.Run(restart, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			server, address := startServer(t, "echo", func(config *Config) { config.Restart = restart }, WithLogger(log.New(logs, "", 0)))
+			client := dial(t, address)
+
+			client.send(1, "crash")
+			go client.hangUpWhenClosed()
+			eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+			if closeError := server.Close(); closeError != nil {
+				t.Fatalf("Close gave %v, not a clean shutdown", closeError)
+			}
+
+			if !strings.Contains(logs.String(), "exited during shutdown") {
+				t.Fatalf("the crash wasn't taken as part of the shutdown:\n%s", logs.String())
+			}
+			if strings.Contains(logs.String(), "restarted") {
+				t.Fatalf("the resource was restarted during shutdown:\n%s", logs.String())
+			}
+			expectResourcesGone(t, server)
+		})
+	}
+}
+
+// However a crash and a shutdown interleave, the server shuts down cleanly, with nothing left running.
+func TestCrashRacesShutdown(t *testing.T) {
+	for attempt := 0; attempt < 20; attempt++ {
+		server, address := startServer(t, "echo", func(config *Config) { config.Restart, config.RestartBackoff = restartAlways, time.Millisecond })
+		client := dial(t, address)
+
+		var racing sync.WaitGroup
+		racing.Add(2)
+		go func() {
+			defer racing.Done()
+			_, _ = client.tryRequest(1, "exit")
+			client.hangUpWhenClosed()
+		}()
+		var closeError error
+		go func() {
+			defer racing.Done()
+			time.Sleep(time.Duration(attempt) * 100 * time.Microsecond)
+			closeError = server.Close()
+		}()
+		racing.Wait()
+
+		if closeError != nil {
+			t.Fatalf("attempt %d: Close gave %v, not a clean shutdown", attempt, closeError)
+		}
+		expectResourcesGone(t, server)
+	}
+}
+
+// Once the drain has started, a request already with the resource is still answered, while one sent after the going
+// away is turned away at once, rather than queued behind it.
+func TestRequestsDuringDrain(t *testing.T) {
+	server, address := startServer(t, "echo", nil)
+	early, late := dial(t, address), dial(t, address)
+
+	early.send(1, "sleep")
+	eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close() }()
+
+	if goingAway := late.receive(); goingAway.Header.Type != message.GoingAway {
+		t.Fatalf("got a message of type %d when the drain started, not a going away", goingAway.Header.Type)
+	}
+	late.send(1, "too late")
+	expectError(t, late.receive(), message.ShuttingDown)
+	go late.hangUpWhenClosed()
+
+	for {
+		answer := early.receive()
+		if answer.Header.Type != message.GoingAway {
+			expectReply(t, answer, "sleep")
+			break
+		}
+	}
+	go early.hangUpWhenClosed()
+
+	if closeError := <-closed; closeError != nil {
+		t.Fatalf("Close gave %v, not a clean shutdown", closeError)
+	}
+	if dropped := server.s.droppedRequests.Value(dropShutdown); dropped != 1 {
+		t.Fatalf("%d requests were dropped for the shutdown, not 1", dropped)
+	}
+}
+
+// A request the resource never answers doesn't hold up the shutdown past -drain-timeout. Once the drain has given up
+// on it, the resource is sent its shutdown command like any other, and killed when it doesn't exit.
+func TestShutdownWithHungRequest(t *testing.T) {
+	logs := &lockedBuffer{}
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.DrainTimeout = 200 * time.Millisecond
+		config.ShutdownCommand = "quit"
+		config.ShutdownWait = 300 * time.Millisecond
+	}, WithLogger(log.New(logs, "", 0)))
+	client := dial(t, address)
+
+	client.send(1, "hang")
+	go client.hangUpWhenClosed()
+	eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close() }()
+	select {
+	case closeError := <-closed:
+		if closeError != nil {
+			t.Fatalf("Close gave %v, not a clean shutdown", closeError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close is still waiting for the hung resource:\n%s", logs.String())
+	}
+
+	if !strings.Contains(logs.String(), "did not exit after its shutdown command") {
+		t.Fatalf("the hung resource wasn't killed for not exiting:\n%s", logs.String())
+	}
+	expectResourcesGone(t, server)
+}
+
+// Under -shutdown-signal, the resource is sent the signal once the drain is over, even with a request still in hand,
+// and is killed if it hasn't exited -shutdown-command-timeout later.
+func TestShutdownSignal(t *testing.T) {
+	const wait = 300 * time.Millisecond
+	signals := filepath.Join(t.TempDir(), "signals")
+	t.Setenv(testResourceSignals, signals)
+	logs := &lockedBuffer{}
+	server, address := startServer(t, "echo", func(config *Config) {
+		config.DrainTimeout = 100 * time.Millisecond
+		config.ShutdownSignal = "USR1"
+		config.ShutdownWait = wait
+	}, WithLogger(log.New(logs, "", 0)))
+	client := dial(t, address)
+
+	client.send(1, "hang")
+	go client.hangUpWhenClosed()
+	eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close() }()
+	select {
+	case closeError := <-closed:
+		if closeError != nil {
+			t.Fatalf("Close gave %v, not a clean shutdown", closeError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close is still waiting for the resource:\n%s", logs.String())
+	}
+
+	received, _ := os.ReadFile(signals)
+	if !strings.Contains(string(received), syscall.SIGUSR1.String()) {
+		t.Fatalf("the resource noted %q, not SIGUSR1", received)
+	}
+	sent := strings.Index(logs.String(), "sent SIGUSR1")
+	killed := strings.Index(logs.String(), "did not exit after SIGUSR1 within "+wait.String())
+	if sent < 0 || killed < sent {
+		t.Fatalf("the resource wasn't signalled and then killed:\n%s", logs.String())
+	}
+	expectResourcesGone(t, server)
+}
@@ -0,0 +1,190 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Most resources exit by themselves once their input closes, which it does when impact exits. Some have work to
+// finish first, such as flushing or committing, that they only do when asked. With -shutdown-command, once the drain is
+// done, every resource is sent a final request with that payload, and impact waits up to -shutdown-command-timeout for
+// it to exit before killing it. Whatever the resource answers is ignored, since there is nobody left to tell. A
+// resource that is asked with a signal instead, such as SIGTERM, is sent -shutdown-signal, and given just as long.
+
+// The signals a resource can be asked to exit with, by the names -shutdown-signal takes.
+var shutdownSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// Parse a -shutdown-signal name, with or without its SIG prefix. Zero means none.
+func parseShutdownSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	signal, known := shutdownSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !known {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+
+	return signal, nil
+}
+
+// The name of a shutdown signal, for logs.
+func signalName(signal syscall.Signal) string {
+	for name, candidate := range shutdownSignals {
+		if candidate == signal {
+			return "SIG" + name
+		}
+	}
+
+	return signal.String()
+}
+
+// Ask every resource to exit, with its shutdown command or signal, and wait until they have all gone. A resource still
+// handling a request, once the drain has timed out, is asked just the same.
+func (s *server) quitResources() {
+	if s.shutdownCommand == "" && s.shutdownSignal == 0 {
+		return
+	}
+
+	var quitting sync.WaitGroup
+	for _, backend := range s.backends() {
+		for _, m := range backend.members {
+			// A member of a pool still being launched when we shut down may never have been.
+			if m.process.Load() == nil {
+				continue
+			}
+
+			quitting.Add(1)
+			go func(m *member) {
+				defer quitting.Done()
+
+				// A member that can't take the request to quit in time, such as one stuck sending to a resource that
+				// isn't reading, has its process killed instead, and takes the request once it has seen the process go.
+				timer := time.NewTimer(m.shutdownWait)
+				defer timer.Stop()
+
+				done := make(chan bool)
+				select {
+				case m.quits <- done:
+				case <-timer.C:
+					if process := m.process.Load(); process != nil {
+						m.logger.Printf("resource %s was not ready to be told to exit within %s, stopping it", m.name, m.shutdownWait)
+						process.Kill()
+					}
+					m.quits <- done
+				}
+				<-done
+			}(m)
+		}
+	}
+	quitting.Wait()
+}
+
+// Tell the resource to exit, and give it until the timeout to do so. Only the process handler may call this, and once
+// it has, the process is gone.
+func (m *member) quit(process *resource.Process) {
+	if m.shutdownCommand == "" {
+		m.signalQuit(process)
+		return
+	}
+
+	timer := time.NewTimer(m.shutdownWait)
+	defer timer.Stop()
+
+	command := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(m.shutdownCommand)}
+	output := process.OutputChannel
+	sent := false
+	for !sent {
+		select {
+		case process.InputChannel <- command:
+			m.logger.Printf("resource %s sent its shutdown command", m.name)
+			sent = true
+
+		// A reply to a probe that was abandoned can still be on its way, and has to be read for the resource to go on.
+		case _, open := <-output:
+			if !open {
+				output = nil
+			}
+
+		case <-process.ExitChannel:
+			process.Release()
+			return
+
+		case <-timer.C:
+			m.kill(process, "did not take its shutdown command")
+			return
+		}
+	}
+
+	for {
+		select {
+		case _, open := <-output:
+			if !open {
+				output = nil
+			}
+
+		case <-process.ExitChannel:
+			m.logger.Printf("resource %s exited after its shutdown command", m.name)
+			process.Release()
+			return
+
+		case <-timer.C:
+			m.kill(process, "did not exit after its shutdown command")
+			return
+		}
+	}
+}
+
+// The same, with the shutdown signal.
+func (m *member) signalQuit(process *resource.Process) {
+	if signalError := process.Signal(m.shutdownSignal); signalError != nil {
+		m.logger.Printf("resource %s could not be sent %s, stopping it: %v", m.name, signalName(m.shutdownSignal), signalError)
+		process.Kill()
+		<-process.ExitChannel
+		process.Release()
+		return
+	}
+	m.logger.Printf("resource %s sent %s", m.name, signalName(m.shutdownSignal))
+
+	timer := time.NewTimer(m.shutdownWait)
+	defer timer.Stop()
+
+	output := process.OutputChannel
+	for {
+		select {
+		// Whatever the resource writes as it goes still has to be read for it to get there.
+		case _, open := <-output:
+			if !open {
+				output = nil
+			}
+
+		case <-process.ExitChannel:
+			m.logger.Printf("resource %s exited after %s", m.name, signalName(m.shutdownSignal))
+			process.Release()
+			return
+
+		case <-timer.C:
+			m.kill(process, "did not exit after "+signalName(m.shutdownSignal))
+			return
+		}
+	}
+}
+
+func (m *member) kill(process *resource.Process, why string) {
+	m.logger.Printf("resource %s %s within %s, stopping it", m.name, why, m.shutdownWait)
+	process.Kill()
+	<-process.ExitChannel
+	process.Release()
+}
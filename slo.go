@@ -0,0 +1,58 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/metrics"
+	"github.com/blanu/impact/internal/request"
+	"strconv"
+	"time"
+)
+
+// Counting requests slower than a latency objective lets alerts work out how fast the error budget is burning, from
+// two counters, without anyone computing percentiles. Several thresholds can be watched at once, such as a fast one
+// for the usual objective and a slow one for requests that are far out of line.
+type sloCounter struct {
+	thresholds []time.Duration
+	requests   *metrics.Counter
+	violations *metrics.CounterVec
+}
+
+func newSLOCounter(registry *metrics.Registry, thresholds []time.Duration) *sloCounter {
+	c := &sloCounter{
+		thresholds: thresholds,
+		requests:   registry.NewCounter("impact_slo_requests_total", "Requests measured against the latency objectives."),
+		violations: registry.NewCounterVec("impact_slo_violations_total", "Requests slower than a latency objective, from queueing to reply, by threshold in seconds.", "threshold"),
+	}
+
+	// Every threshold is reported from the start, so that a burn rate alert has a zero to compare against rather
+	// than a missing series.
+	for _, threshold := range thresholds {
+		c.violations.Add(thresholdLabel(threshold), 0)
+	}
+
+	return c
+}
+
+func thresholdLabel(threshold time.Duration) string {
+	return strconv.FormatFloat(threshold.Seconds(), 'g', -1, 64)
+}
+
+// Measure one request, from when it was queued to when its reply was sent.
+func (c *sloCounter) observe(latency time.Duration) {
+	if len(c.thresholds) == 0 {
+		return
+	}
+
+	c.requests.Inc()
+	for _, threshold := range c.thresholds {
+		if latency > threshold {
+			c.violations.Inc(thresholdLabel(threshold))
+		}
+	}
+}
+
+// Measure a finished request, against the objectives and in the duration histogram, where a trace id the client sent
+// with the request goes in as an exemplar.
+func (s *server) observeLatency(r request.Request, latency time.Duration) {
+	s.slo.observe(latency)
+	s.requestDurations.ObserveWithTrace(latency.Seconds(), r.TraceID)
+}
@@ -0,0 +1,91 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/request"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// A slow request's latency is only worth something broken down: whether it waited in the queue, for a member, on the
+// resource, or on its client taking the reply. Every request's status keeps when it reached each stage, which is
+// cheap enough to always do. Logging it all for every request isn't, so a span, one line saying where a request's
+// time went, is only logged for every request slower than -span-slow, and for a -span-sample fraction of the rest.
+//
+// A span's stages are, in order:
+//
+//   - admitting, from being read to being queued
+//   - queued, from being queued to being chosen by the scheduler
+//   - dispatched, from being chosen to being taken by a member
+//   - executing, from being sent to the resource to the resource sending the last of its reply
+//   - delivering, from then to the client having been sent all of it
+//
+// A request that ended early, for instance because its client went, has none of the stages it never reached, and its
+// last stage runs to when it ended.
+
+// Log the span of a request that has just ended, if it is slow or sampled.
+func (s *server) logSpan(r request.Request) {
+	if r.Status == nil || s.spanSlow <= 0 && s.spanSample <= 0 {
+		return
+	}
+
+	ended := r.Status.Changed()
+	total := ended.Sub(r.Status.Received())
+
+	why := ""
+	switch {
+	case s.spanSlow > 0 && total >= s.spanSlow:
+		why = "slow"
+	case s.spanSample > 0 && rand.Float64() < s.spanSample:
+		why = "sampled"
+	default:
+		return
+	}
+
+	stages := []struct {
+		name  string
+		start time.Time
+	}{
+		{"admitting", r.Status.Received()},
+		{"queued", r.Status.Entered(request.Queued)},
+		{"dispatched", r.Status.Entered(request.Dispatched)},
+		{"executing", r.Status.Entered(request.Executing)},
+		{"delivering", r.Status.Finished()},
+	}
+
+	// The connection's logger names the connection.
+	attributes := []slog.Attr{
+		slog.Uint64("correlation", r.CorrelationID),
+		slog.String("outcome", r.Status.State().String()),
+		slog.Duration("total", roundSpan(total)),
+	}
+	for index, stage := range stages {
+		if stage.start.IsZero() {
+			continue
+		}
+
+		// A stage lasts until the next one the request reached, or until it ended.
+		end := ended
+		for _, next := range stages[index+1:] {
+			if !next.start.IsZero() {
+				end = next.start
+				break
+			}
+		}
+		attributes = append(attributes, slog.Duration(stage.name, roundSpan(end.Sub(stage.start))))
+	}
+	if holder := r.Status.Holder(); holder != "" {
+		attributes = append(attributes, slog.String("member", holder))
+	}
+	if r.TraceID != "" {
+		attributes = append(attributes, slog.String("trace", r.TraceID))
+	}
+	attributes = append(attributes, slog.String("why", why))
+
+	logAttrs(s.loggerFor(r.ConnectionID), "span", attributes...)
+}
+
+// Stages can be short, so they are given to the microsecond.
+func roundSpan(duration time.Duration) time.Duration {
+	return max(duration, 0).Round(time.Microsecond)
+}
@@ -0,0 +1,70 @@
+package impact
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The span lines logged, one for each request.
+func spanLines(logs *lockedBuffer) []string {
+	var spans []string
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "span: ") {
+			spans = append(spans, line)
+		}
+	}
+	return spans
+}
+
+// Under -span-slow, a request that takes at least that long has its span logged, with the stages it went through, and
+// one that's quicker doesn't. Under -span-sample 1, every request does.
+func TestSpans(t *testing.T) {
+	t.Run("slow", func(t *testing.T) {
+		logs := &lockedBuffer{}
+		_, address := startServer(t, "echo", func(config *Config) { config.SpanSlow = 150 * time.Millisecond }, WithLogger(log.New(logs, "", 0)))
+		client := dial(t, address)
+
+		expectReply(t, client.request(1, "quick"), "quick")
+		expectReply(t, client.request(2, "sleep"), "sleep")
+		eventually(t, "the slow request's span is logged", func() bool { return len(spanLines(logs)) > 0 })
+
+		spans := spanLines(logs)
+		if len(spans) != 1 {
+			t.Fatalf("%d spans were logged, not just the slow request's:\n%s", len(spans), strings.Join(spans, "\n"))
+		}
+		for _, field := range []string{"span: correlation=2 outcome=replied total=", " queued=", " executing=", " delivering=", " why=slow"} {
+			if !strings.Contains(spans[0], field) {
+				t.Fatalf("the span has no %q:\n%s", field, spans[0])
+			}
+		}
+	})
+
+	t.Run("sampled", func(t *testing.T) {
+		logs := &lockedBuffer{}
+		_, address := startServer(t, "echo", func(config *Config) { config.SpanSample = 1 }, WithLogger(log.New(logs, "", 0)))
+		client := dial(t, address)
+
+		for correlationID := uint64(1); correlationID <= 3; correlationID++ {
+			expectReply(t, client.request(correlationID, "quick"), "quick")
+		}
+		eventually(t, "every request's span is logged", func() bool { return len(spanLines(logs)) == 3 })
+		for _, span := range spanLines(logs) {
+			if !strings.Contains(span, " why=sampled") {
+				t.Fatalf("a span was logged for some other reason than sampling:\n%s", span)
+			}
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		logs := &lockedBuffer{}
+		_, address := startServer(t, "echo", nil, WithLogger(log.New(logs, "", 0)))
+
+		expectReply(t, dial(t, address).request(1, "sleep"), "sleep")
+		time.Sleep(50 * time.Millisecond)
+		if spans := spanLines(logs); len(spans) != 0 {
+			t.Fatalf("spans were logged with spans off:\n%s", strings.Join(spans, "\n"))
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"sync"
+	"time"
+)
+
+// A large pool launched all at once can swamp the machine, when each copy of the resource loads something big as it
+// starts. With -spawn-concurrency, a backend's pool is launched that many members at a time, and each batch has to be
+// ready before the next is launched. A member is ready once it answers the probe message, or as soon as it is
+// launched if there is none. One that isn't ready within -spawn-ready-timeout is left for the liveness probes to deal
+// with, and the next batch is launched all the same.
+//
+// -spawn-wait says how long startup waits for the pool, one of:
+const (
+	// Wait until every member has been launched, so that the server starts with its whole pool.
+	spawnWaitAll = "all"
+	// Wait for the first batch only, and launch the rest while serving, so that the server starts sooner, on part of
+	// its pool.
+	spawnWaitFirst = "first"
+)
+
+// Launch the backend's whole pool, in batches if there is a spawn concurrency.
+func (b *backend) spawnPool(config Config, probes probeCounters) {
+	members := make([]*member, 0, config.PoolSize)
+	for index := 0; index < config.PoolSize; index++ {
+		members = append(members, b.newMember(index, config.PoolSize))
+	}
+
+	batch := config.SpawnConcurrency
+	if batch <= 0 || batch > len(members) {
+		for _, m := range members {
+			m.spawn(config, probes)
+		}
+		return
+	}
+
+	b.spawnBatch(members[:batch], config, probes)
+	if config.SpawnWait == spawnWaitFirst {
+		go b.spawnBatches(members[batch:], batch, config, probes)
+		return
+	}
+	b.spawnBatches(members[batch:], batch, config, probes)
+}
+
+func (b *backend) spawnBatches(members []*member, batch int, config Config, probes probeCounters) {
+	for len(members) > 0 {
+		// Once we are shutting down, there is no point launching any more. Those that never were have nothing to stop.
+		if b.shuttingDown.Load() {
+			return
+		}
+
+		size := min(batch, len(members))
+		b.spawnBatch(members[:size], config, probes)
+		members = members[size:]
+	}
+}
+
+// Launch a batch of members, and wait for all of them to be ready.
+func (b *backend) spawnBatch(members []*member, config Config, probes probeCounters) {
+	b.logger.Printf("resource %s launching members %d to %d of %d", b.name, members[0].index, members[len(members)-1].index, config.PoolSize)
+
+	for _, m := range members {
+		m.spawn(config, probes)
+	}
+
+	if config.ProbeMessage == "" {
+		return
+	}
+
+	probe := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(config.ProbeMessage)}
+	var ready sync.WaitGroup
+	for _, m := range members {
+		ready.Add(1)
+		go func(m *member) {
+			defer ready.Done()
+			m.awaitReady(probe, config.SpawnReadyTimeout)
+		}(m)
+	}
+	ready.Wait()
+}
+
+// Launch the member's resource, and start the coroutines that serve and watch it.
+func (m *member) spawn(config Config, probes probeCounters) {
+	// If we can't launch the resource, we must give up.
+	process, resourceError := m.launch()
+	if resourceError != nil {
+		m.logger.Printf("error: resource %s could not be launched: %v", m.name, resourceError)
+		m.resourceGone(12)
+	}
+	m.started(process)
+
+	// There is one process handler coroutine per member.
+	m.running.Add(1)
+	if m.concurrency > 1 {
+		go m.handleConcurrentProcess(process)
+	} else {
+		go m.handleProcess(process)
+	}
+
+	if config.WatchdogInterval > 0 {
+		go m.handleWatchdog(config.WatchdogInterval, config.WatchdogRestart)
+	}
+
+	if config.ProbeInterval > 0 {
+		probe := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(config.ProbeMessage)}
+		go m.handleProbes(probe, config.ProbeInterval, config.ProbeFailures, probes)
+	}
+}
+
+// Probe a freshly launched member until it answers, or the timeout is up.
+func (m *member) awaitReady(probe message.ImpactMessage, timeout time.Duration) {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for remaining := timeout; remaining > 0; remaining = time.Until(deadline) {
+		if m.sendProbe(probe, min(time.Duration(m.probeTimeout.Load()), remaining)) {
+			m.logger.Printf("resource %s is ready after %s", m.name, time.Since(start).Round(time.Millisecond))
+			return
+		}
+
+		// A probe refused outright, say because the resource was restarted, is tried again after a pause, rather than
+		// straight away.
+		time.Sleep(min(100*time.Millisecond, time.Until(deadline)))
+	}
+
+	m.logger.Printf("warning: resource %s was not ready within %s, launching the next members anyway", m.name, timeout)
+}
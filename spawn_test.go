@@ -0,0 +1,53 @@
+package impact
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Under -spawn-concurrency, each batch of the pool is launched only once the batch before it has answered the probe
+// message. -spawn-wait all starts serving once the whole pool is launched, and first as soon as the first batch is
+// ready.
+func TestSpawnConcurrency(t *testing.T) {
+	for _, wait := range []string{spawnWaitAll, spawnWaitFirst} {
+		t.Run(wait, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			server, address := startServer(t, "echo", func(config *Config) {
+				config.PoolSize = 4
+				config.SpawnConcurrency = 2
+				config.SpawnWait = wait
+				// A member is ready once it has answered, which takes it a while.
+				config.ProbeMessage = "sleep"
+				config.SpawnReadyTimeout = 5 * time.Second
+			}, WithLogger(log.New(logs, "", 0)))
+			pool := server.s.primary
+
+			if ready := strings.Count(logs.String(), "is ready after"); wait == spawnWaitAll && ready != 4 {
+				t.Fatalf("serving started with %d of the pool ready, not all 4", ready)
+			} else if wait == spawnWaitFirst && ready != 2 {
+				t.Fatalf("serving started with %d of the pool ready, not the first batch of 2", ready)
+			}
+			expectReply(t, dial(t, address).request(1, "served"), "served")
+			eventually(t, "the whole pool is running", func() bool { return pool.healthyMembers() == 4 })
+
+			// Both members of the first batch were ready before the second was launched.
+			eventually(t, "the second batch is ready", func() bool { return strings.Count(logs.String(), "is ready after") == 4 })
+			lines := strings.Split(logs.String(), "\n")
+			second := -1
+			ready := 0
+			for index, line := range lines {
+				switch {
+				case strings.Contains(line, "launching members 2 to 3 of 4"):
+					second = index
+				case strings.Contains(line, "is ready after") && second == -1:
+					ready += 1
+				}
+			}
+			if second == -1 || ready != 2 {
+				t.Fatalf("%d members were ready before the second batch was launched, not 2:\n%s", ready, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package impact
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A summary of what the server is going to do, as name=value pairs, logged once at startup. Settings come from the
+// command line, the environment and a config file, so this is where an operator can check what impact ended up with,
+// and where each setting came from.
+//
+// Only settings that name files of secrets, such as -tls-key and -auth-tokens, could give a secret away, and those are
+// only ever given by path. The files' contents never appear.
+func (config Config) summary() []slog.Attr {
+	var fields []slog.Attr
+	field := func(name string, value any) {
+		fields = append(fields, slog.Any(name, value))
+	}
+	optional := func(name string, value string) {
+		if value == "" {
+			value = "off"
+		}
+		field(name, value)
+	}
+
+	if config.Port != 0 {
+		field("listen", "0.0.0.0:"+strconv.Itoa(config.Port))
+	} else {
+		field("listen", "off")
+	}
+	field("framing", config.Framing)
+	if config.UnixSocket != "" {
+		field("unix-socket", config.UnixSocket)
+		field("unix-framing", config.UnixFraming)
+	}
+	if config.UDPPort != 0 {
+		field("udp", "0.0.0.0:"+strconv.Itoa(config.UDPPort))
+	} else {
+		field("udp", "off")
+	}
+	optional("metrics", config.MetricsAddress)
+	field("pprof", config.Profiling)
+	field("debug-dump", config.DebugTokenFile != "")
+
+	field("tls", config.TLSCertificate != "")
+	field("client-certs", config.TLSClientCA != "")
+	if config.TLSClientCA != "" {
+		field("client-certs-required", config.TLSRequireClientCert)
+	}
+	optional("auth", config.Auth)
+	if config.Auth != "" {
+		field("auth-fallback", config.AuthFallback)
+	}
+
+	if config.AttachPID != 0 {
+		field("attach-pid", config.AttachPID)
+	} else {
+		field("resource", config.Path)
+	}
+	if config.LargeRequestSize > 0 {
+		large := config.LargePath
+		if large == "" {
+			large = config.Path
+		}
+		field("large-resource", large)
+		field("large-request-size", config.LargeRequestSize)
+	}
+	optional("resources", config.Resources)
+	field("pool-size", config.PoolSize)
+	field("spawn-concurrency", config.SpawnConcurrency)
+	field("spawn-wait", config.SpawnWait)
+	field("restart", config.Restart)
+	if config.Restart != restartNever {
+		field("restart-backoff", config.RestartBackoff)
+		field("restart-backoff-max", config.RestartBackoffMax)
+	}
+	field("resource-banner", config.ResourceBanner)
+	optional("resource-ready", config.ResourceReady)
+	field("span-slow", config.SpanSlow)
+	field("span-sample", config.SpanSample)
+	field("resource-concurrency", config.ResourceConcurrency)
+	field("scheduler", config.Scheduler)
+	field("funnel-buffer", config.FunnelBuffer)
+
+	field("request-timeout", config.RequestTimeout)
+	field("max-request-timeout", config.MaxRequestTimeout)
+	field("timeout-action", config.TimeoutAction)
+	field("max-lifetime", config.MaxLifetime)
+	field("probe-interval", config.ProbeInterval)
+	field("watchdog-interval", config.WatchdogInterval)
+	optional("shutdown-command", config.ShutdownCommand)
+	optional("shutdown-signal", config.ShutdownSignal)
+	field("drain-timeout", config.DrainTimeout)
+	optional("correlation-tag", config.CorrelationTag)
+
+	field("max-in-flight", config.MaxInFlight)
+	field("max-in-flight-per-identity", config.MaxInFlightIdentity)
+	field("max-anonymous-priority", config.MaxAnonymousPriority)
+	field("in-flight-overflow", config.InFlightOverflow)
+	field("rate-limit", config.RateLimit)
+	field("global-rate-limit", config.GlobalRateLimit)
+	field("accept-rate", config.AcceptRate)
+	field("accept-overflow", config.AcceptOverflow)
+	optional("journal", config.Journal)
+	optional("audit", config.Audit)
+	optional("compression", config.Compression)
+	field("dedup-size", config.DedupSize)
+	field("flow-window", config.FlowWindow)
+	field("flow-overflow", config.FlowOverflow)
+	field("max-outstanding-bytes", config.MaxOutstandingBytes)
+	field("resume-ttl", config.ResumeTTL)
+	if config.ResumeTTL > 0 {
+		field("resume-replies", config.ResumeReplies)
+		field("resume-buffer", config.ResumeBuffer)
+	}
+	field("log-format", config.LogFormat)
+
+	// Which settings came from where, by name only.
+	bySource := map[string][]string{}
+	for name, source := range config.Sources {
+		bySource[source] = append(bySource[source], name)
+	}
+	for _, source := range []string{sourceFlag, sourceEnvironment, sourceFile} {
+		names := bySource[source]
+		sort.Strings(names)
+		field("from-"+source, strings.Join(names, ","))
+	}
+
+	return fields
+}
@@ -0,0 +1,67 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/radiowave"
+	"strconv"
+	"strings"
+)
+
+// Whether a request went well, as far as the resource is concerned, is up to the resource. It says so with the status
+// in its reply's header, which is counted for each status, and passed on to the client along with the reply. That is
+// apart from impact's own errors, such as timeouts and overload, so operators can tell the resource turning a request
+// down from impact failing to deliver it.
+//
+// The statuses in -status-errors are passed on as a ResourceFailed error instead, for clients that only want to look
+// for errors in one place. The status is read from the first message of a reply, since by the time any later one
+// arrives the client already has the first.
+
+// The status the resource gave a reply, or zero if it gave none.
+func replyStatus(reply radiowave.Message) uint16 {
+	if typed, ok := reply.(message.ImpactMessage); ok {
+		return typed.Header.Status
+	}
+
+	return 0
+}
+
+// Parse the list of statuses to pass on as errors.
+func parseStatusErrors(list string) (map[uint16]bool, error) {
+	statuses := map[uint16]bool{}
+	if list == "" {
+		return statuses, nil
+	}
+
+	for _, field := range strings.Split(list, ",") {
+		status, parseError := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if parseError != nil || status == 0 {
+			return nil, fmt.Errorf("-status-errors: %q is not a status from 1 to 65535", field)
+		}
+		statuses[uint16(status)] = true
+	}
+
+	return statuses, nil
+}
+
+// Note the status of a reply, from its first message. Report whether the reply is to go to the client as an error
+// instead, in which case the client has already been sent the error.
+func (b *backend) noteStatus(x *exchange, reply radiowave.Message) bool {
+	x.status = replyStatus(reply)
+	if x.probe {
+		return false
+	}
+
+	b.resourceStatuses.Inc(strconv.Itoa(int(x.status)))
+	if x.status != 0 && b.debug.Load() {
+		b.loggerFor(x.request.ConnectionID).Printf("debug: resource %s answered request %d with status %d", b.name, x.request.CorrelationID, x.status)
+	}
+
+	if !b.statusErrors[x.status] {
+		return false
+	}
+
+	description := fmt.Sprintf("resource answered with status %d", x.status)
+	x.request.Reply(message.ImpactError{CorrelationID: x.request.CorrelationID, Code: message.ResourceFailed, Description: description})
+	return true
+}
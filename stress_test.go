@@ -0,0 +1,91 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Send a request and read its reply to the end, however many chunks it comes in, returning how many it came in.
+func (c *testClient) tryChunkedRequest(correlationID uint64, payload string) (int, error) {
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	c.write(request)
+
+	chunks := 0
+	for {
+		answer, readError := c.tryReceive(5 * time.Second)
+		switch {
+		case readError != nil:
+			return chunks, readError
+		case answer.Header.Type == message.Queued:
+			continue
+		case answer.Header.Type != message.Reply || answer.Header.CorrelationID != correlationID || string(answer.Payload) != payload:
+			return chunks, fmt.Errorf("got a message of type %d for request %d, rather than a reply to request %d", answer.Header.Type, answer.Header.CorrelationID, correlationID)
+		}
+
+		chunks += 1
+		if !message.HasMore(answer) {
+			return chunks, nil
+		}
+	}
+}
+
+// Clients that stop reading while their chunked replies are still coming, among many that keep up, can't wedge the
+// resource. Each of the stalled ones is cut off once a write to it has blocked for -write-timeout, and every other
+// client gets every reply.
+func TestStalledReadersCantDeadlock(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+
+	_, address := startServer(t, "echo", func(config *Config) { config.WriteTimeout = 200 * time.Millisecond })
+
+	// A big request makes for reply chunks bigger than the socket's buffers can take.
+	large := "chunks " + strings.Repeat("x", 8<<20)
+	for stalled := 0; stalled < 4; stalled++ {
+		client := dial(t, address)
+		_ = client.conn.(*net.TCPConn).SetReadBuffer(4096)
+		go func() {
+			for correlationID := uint64(1); ; correlationID++ {
+				request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(large)}
+				request.Header.CorrelationID = correlationID
+				if connection.WriteFrame(client.conn, request.ToBytes()) != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var clients sync.WaitGroup
+	served := make(chan bool)
+	for index := 0; index < 16; index++ {
+		client := dial(t, address)
+		clients.Add(1)
+		go func(index int) {
+			defer clients.Done()
+			for correlationID := uint64(1); correlationID <= 50; correlationID++ {
+				payload := fmt.Sprintf("chunks %d %d", index, correlationID)
+				if chunks, requestError := client.tryChunkedRequest(correlationID, payload); requestError != nil || chunks != 3 {
+					t.Errorf("client %d, request %d: %d chunks: %v", index, correlationID, chunks, requestError)
+					return
+				}
+			}
+		}(index)
+	}
+	go func() {
+		clients.Wait()
+		close(served)
+	}()
+
+	select {
+	case <-served:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the clients that kept reading weren't all served, as if the stalled ones had wedged the resource")
+	}
+}
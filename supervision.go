@@ -0,0 +1,51 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/resource"
+	"time"
+)
+
+// A resource that exits without being asked to is relaunched if anything else is still serving its requests: another
+// member of its pool, or, for a named resource, the rest of the server. The last resource the server has going would
+// otherwise take the whole server down with it. -restart says whether it does, one of:
+const (
+	// Relaunch the resource however it exited.
+	restartAlways = "always"
+	// Relaunch the resource if it failed, by exiting with a status other than 0 or being killed. One that exited with
+	// status 0 did so on purpose, and the server exits with it.
+	restartOnFailure = "on-failure"
+	// Exit with the resource, so that whatever runs impact can restart the two of them together.
+	restartNever = "never"
+)
+
+// Whatever the policy, requests the resource was handling when it exited are answered with ResourceStopped, since
+// they may or may not have run, and aren't sent again. Those still queued wait for the relaunched resource. A resource
+// that impact attached to isn't impact's to relaunch, so the server always exits with it.
+
+// Report whether the last resource the server has going is relaunched, now that it has exited.
+func (m *member) restartsOnExit(process *resource.Process) bool {
+	if m.attachPID != 0 {
+		return false
+	}
+
+	switch m.restartPolicy {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return !process.ExitedCleanly()
+	default:
+		return false
+	}
+}
+
+// A resource that crashes as soon as it starts would otherwise be relaunched as fast as it can crash, using up the CPU
+// that the other resources need. One that crashes within -restart-backoff-max of being launched waits -restart-backoff
+// before it is relaunched, and twice as long each time it crashes that quickly again, up to -restart-backoff-max. One
+// that ran for longer has been working, and is relaunched at once.
+func (m *member) nextRelaunchDelay(ran time.Duration) time.Duration {
+	if ran >= m.restartBackoffMax {
+		return 0
+	}
+
+	return min(max(2*m.relaunchDelay, m.restartBackoff), m.restartBackoffMax)
+}
@@ -0,0 +1,43 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+)
+
+// Matching a request in impact's logs to the same request in the resource's is hard when all the two have in common
+// is the payload. With -correlation-tag, impact gives each request a short tag, logs the request under it, and passes it
+// on to the resource, which can log it too. The tag can go in the request's header, in an extension of its own, or in
+// front of its payload, for a resource that doesn't read extensions. Either way the resource sees something other than
+// what the client sent, so it is off unless asked for.
+//
+// A tag is always tagLength lowercase hex digits. In front of a payload it is followed by a space, so a resource can
+// take it off by skipping the first tagLength+1 bytes.
+const (
+	correlationTagHeader  = "header"
+	correlationTagPayload = "payload"
+
+	tagLength = 8
+)
+
+// Give the request its tag, and put the tag where the resource will see it.
+func (s *server) tagRequest(r *request.Request) {
+	if s.correlationTag == "" {
+		return
+	}
+
+	typed, ok := r.Message.(message.ImpactMessage)
+	if !ok {
+		return
+	}
+
+	r.Tag = fmt.Sprintf("%0*x", tagLength, s.tags.Add(1))
+	switch s.correlationTag {
+	case correlationTagHeader:
+		typed.Header.Tag = r.Tag
+	case correlationTagPayload:
+		typed.Payload = append([]byte(r.Tag+" "), typed.Payload...)
+	}
+	r.Message = typed
+}
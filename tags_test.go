@@ -0,0 +1,30 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"strings"
+	"testing"
+)
+
+// Under -correlation-tag header, the tag goes to the resource in an extension of its own, and a trace id the client
+// sent still gets there as it was.
+func TestCorrelationTagKeepsTrace(t *testing.T) {
+	_, address := startServer(t, "echo", func(config *Config) { config.CorrelationTag = correlationTagHeader })
+	client := dial(t, address)
+
+	traced := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte("headers")}
+	traced.Header.CorrelationID = 1
+	traced.Header.Trace = "4bf92f3577b34da6"
+	client.write(traced)
+	seen := string(receiveAnswer(client).Payload)
+	tag, found := strings.CutPrefix(seen, "trace=4bf92f3577b34da6 tag=")
+	if !found || len(tag) != tagLength {
+		t.Fatalf("the resource saw %q", seen)
+	}
+
+	// A request without a trace id gets a tag all the same, and a new one.
+	seen = string(client.request(2, "headers").Payload)
+	if next, found := strings.CutPrefix(seen, "trace= tag="); !found || len(next) != tagLength || next == tag {
+		t.Fatalf("the resource saw %q after a request tagged %s", seen, tag)
+	}
+}
@@ -0,0 +1,105 @@
+package impact
+
+import (
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/resource"
+	"time"
+)
+
+// How long the resource has to reply to a request. A client that knows its request is expensive, or that it can't
+// wait long, can ask for a timeout of its own in the request's header. It gets what it asked for up to the server's
+// maximum, so no client can tie up the resource for longer than the operator allows. A request that doesn't ask gets
+// the server's default. The timeout is settled when the request arrives, so a reload changes it only for requests that
+// arrive afterwards.
+func (s *server) requestTimeout(header message.Header) time.Duration {
+	if header.Timeout == 0 {
+		return time.Duration(s.defaultRequestTimeout.Load())
+	}
+
+	asked := time.Duration(header.Timeout) * time.Millisecond
+	if maximum := time.Duration(s.maxRequestTimeout.Load()); maximum > 0 {
+		return min(asked, maximum)
+	}
+
+	return asked
+}
+
+// The resource has run out of time for a request. The client gets an error now. Unless -timeout-action says otherwise,
+// the resource is left to finish, since stopping it would fail everything else it has in hand, and its reply is thrown
+// away when it comes.
+func (b *backend) timedOut(x *exchange) {
+	b.abandon(x, dropTimedOut, message.TimedOut, fmt.Sprintf("resource did not reply within %s", x.request.Timeout))
+	x.answered = true
+}
+
+// A resource that is merely slow finishes in the end. One that is wedged never does, and everything behind it waits
+// for good. -timeout-action says what is done to the resource when a request to it times out, one of:
+const (
+	// Leave the resource to finish, and throw its reply away when it comes.
+	timeoutActionNone = "none"
+	// Restart the resource at once. Whatever else it has in hand fails with ResourceRestarted.
+	timeoutActionRestart = "restart"
+	// Kill the resource, as if it had crashed. Whatever else it has in hand fails with ResourceStopped. It is
+	// relaunched if something else is still serving, or -restart says so, and otherwise the server exits.
+	timeoutActionKill = "kill"
+)
+
+// A request to the resource has timed out. Deal with the resource as -timeout-action says, failing whatever else is in
+// flight on it if it is stopped, and return the process that should serve the next request.
+func (m *member) afterTimeout(process *resource.Process, inFlight map[uint64]*exchange) *resource.Process {
+	switch m.timeoutAction {
+	case timeoutActionRestart:
+		m.abandonAll(inFlight, dropRestart, message.ResourceRestarted, "resource restarted after a request to it timed out")
+		return m.restartProcess(process, restartTimeout)
+
+	case timeoutActionKill:
+		m.abandonAll(inFlight, dropShutdown, message.ResourceStopped, "resource killed after a request to it timed out")
+		m.logger.Printf("resource %s timed out on a request, killing it", m.name)
+		process.Kill()
+		<-process.ExitChannel
+		return m.processExited(process)
+
+	default:
+		return process
+	}
+}
+
+// When the request's reply is due, if it has a timeout.
+func (x *exchange) due() (time.Time, bool) {
+	if x.answered || x.request.Timeout == 0 {
+		return time.Time{}, false
+	}
+
+	return x.dispatched.Add(x.request.Timeout), true
+}
+
+// Time out every request in flight whose reply is overdue, and return how long until the next one is due, if any is,
+// and whether any timed out.
+func (b *backend) expireTimeouts(inFlight map[uint64]*exchange) (time.Duration, bool, bool) {
+	now := time.Now()
+	var next time.Time
+	expired := false
+	for _, x := range inFlight {
+		due, hasTimeout := x.due()
+		if !hasTimeout {
+			continue
+		}
+
+		if !due.After(now) {
+			b.timedOut(x)
+			expired = true
+			continue
+		}
+
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+	}
+
+	if next.IsZero() {
+		return 0, false, expired
+	}
+
+	return next.Sub(now), true, expired
+}
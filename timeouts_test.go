@@ -0,0 +1,70 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Under -timeout-action restart or kill, the member whose request timed out is relaunched, and the request another
+// member is still working on when it is stopped is served as usual.
+func TestTimeoutAction(t *testing.T) {
+	for _, action := range []string{timeoutActionRestart, timeoutActionKill} {
+		t.Run(action, func(t *testing.T) {
+			logs := &lockedBuffer{}
+			server, address := startServer(t, "echo", func(config *Config) {
+				config.PoolSize = 2
+				config.TimeoutAction = action
+				config.RestartBackoff = time.Millisecond
+			}, WithLogger(log.New(logs, "", 0)))
+			pool := server.s.primary
+			eventually(t, "both members are running", func() bool { return pool.healthyMembers() == 2 })
+			pids := map[*member]int{}
+			for _, m := range pool.members {
+				pids[m] = m.process.Load().Pid()
+			}
+
+			// Only the hung request has a timeout, and it times out while the other member is still busy.
+			hung, busy := dial(t, address), dial(t, address)
+			busy.send(1, "sleep")
+			eventually(t, "the first request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+			working := server.s.trackedRequests()[0].Status
+			hang := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte("hang")}
+			hang.Header.CorrelationID = 1
+			hang.Header.Timeout = 50
+			hung.write(hang)
+			expectError(t, receiveAnswer(hung), message.TimedOut)
+			if state := working.State(); state != request.Executing {
+				t.Fatalf("the other member's request was %v once the hung one timed out, not still executing", state)
+			}
+			expectReply(t, receiveAnswer(busy), "sleep")
+
+			eventually(t, "the member that hung is relaunched", func() bool {
+				relaunched := 0
+				for _, m := range pool.members {
+					if process := m.process.Load(); process != nil && process.Pid() != pids[m] {
+						relaunched += 1
+					}
+				}
+				return relaunched == 1 && pool.healthyMembers() == 2
+			})
+			switch action {
+			case timeoutActionRestart:
+				if restarts := server.s.restartReasons.Value(restartTimeout); restarts != 1 {
+					t.Fatalf("%d restarts were counted for timeouts, not 1", restarts)
+				}
+			case timeoutActionKill:
+				if !strings.Contains(logs.String(), "timed out on a request, killing it") {
+					t.Fatalf("the kill wasn't logged:\n%s", logs.String())
+				}
+			}
+
+			for _, client := range []*testClient{hung, busy} {
+				expectReply(t, client.request(2, "afterwards"), "afterwards")
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package impact
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Build the TLS configuration for the client listener.
+// Session tickets let a returning client resume its TLS session without a full handshake. Go rotates its own ticket
+// keys, but those keys die with the process and aren't shared between instances. Given a ticket key file, every
+// instance using the same file, and every restart, can resume each other's sessions.
+// Given a client CA, clients may present a certificate, which must be signed by that CA. Clients without one are still
+// let in, to prove who they are some other way if they have to, unless a client certificate is required, in which case
+// they fail the handshake.
+func newTLSConfig(certificatePath string, keyPath string, ticketKeyPath string, clientCAPath string, requireClientCert bool) (*tls.Config, error) {
+	certificate, certificateError := tls.LoadX509KeyPair(certificatePath, keyPath)
+	if certificateError != nil {
+		return nil, certificateError
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}}
+
+	if ticketKeyPath != "" {
+		keys, keyError := loadTicketKeys(ticketKeyPath)
+		if keyError != nil {
+			return nil, keyError
+		}
+		config.SetSessionTicketKeys(keys)
+	}
+
+	if clientCAPath != "" {
+		authorities, readError := os.ReadFile(clientCAPath)
+		if readError != nil {
+			return nil, readError
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(authorities) {
+			return nil, errors.New("client CA file has no certificates")
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// The ticket key file has one key per line, each 32 bytes written in hex. The first key is used to issue new tickets,
+// and all of them are accepted for resumption. To rotate, add a new key at the top, then later drop the oldest.
+func loadTicketKeys(path string) ([][32]byte, error) {
+	file, openError := os.Open(path)
+	if openError != nil {
+		return nil, openError
+	}
+	defer file.Close()
+
+	keys := make([][32]byte, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		decoded, decodeError := hex.DecodeString(line)
+		if decodeError != nil {
+			return nil, decodeError
+		}
+		if len(decoded) != 32 {
+			return nil, errors.New("session ticket keys must be 32 bytes")
+		}
+
+		var key [32]byte
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("session ticket key file has no keys")
+	}
+
+	return keys, nil
+}
+
+// Rotating ticket keys shouldn't need a restart, which would drop every connection. Instead, the key file is read
+// again whenever we get SIGHUP. If the new keys can't be loaded, the old ones stay in use.
+func handleTicketKeyRotation(config *tls.Config, ticketKeyPath string, logger *log.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		keys, keyError := loadTicketKeys(ticketKeyPath)
+		if keyError != nil {
+			logger.Println("session ticket keys not rotated:", keyError)
+			continue
+		}
+
+		config.SetSessionTicketKeys(keys)
+		logger.Printf("rotated session ticket keys, %d keys in use", len(keys))
+	}
+}
@@ -0,0 +1,126 @@
+package impact
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A certificate and its key, and where they were written as PEM.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pair        tls.Certificate
+	certFile    string
+	keyFile     string
+}
+
+// Make a certificate for the template, signed by the parent, or by itself if there is none, and write it out.
+func issueCertificate(t *testing.T, name string, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, keyError := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyError != nil {
+		t.Fatal(keyError)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	der, certificateError := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if certificateError != nil {
+		t.Fatal(certificateError)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	issued := &testCertificate{
+		certificate: certificate,
+		key:         key,
+		pair:        tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		certFile:    filepath.Join(t.TempDir(), name+".pem"),
+		keyFile:     filepath.Join(t.TempDir(), name+"-key.pem"),
+	}
+	writeError := os.WriteFile(issued.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if writeError == nil {
+		writeError = os.WriteFile(issued.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if writeError != nil {
+		t.Fatal(writeError)
+	}
+
+	return issued
+}
+
+// Connect over TLS, presenting the certificates, and send the hello. The handshake failing, or the server closing the
+// connection before it answers, is returned as an error.
+func connectTLS(t *testing.T, address string, authority *testCertificate, certificates ...tls.Certificate) (message.ImpactMessage, error) {
+	t.Helper()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.certificate)
+	conn, dialError := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", address, &tls.Config{RootCAs: roots, Certificates: certificates})
+	if dialError != nil {
+		return message.ImpactMessage{}, dialError
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), codec: connection.RadiowaveCodec(message.NewImpactMessageFactory())}
+	if writeError := client.codec.WriteFrame(conn, message.NewHello(message.MinimumVersion, message.Version)); writeError != nil {
+		return message.ImpactMessage{}, writeError
+	}
+	return client.tryReceive(5 * time.Second)
+}
+
+// Under -tls-require-client-cert, a client that presents no certificate is turned away in the TLS handshake, where
+// without it, it is let in to prove who it is some other way. A client with a certificate from -tls-ca is let in
+// either way.
+func TestTLSRequireClientCert(t *testing.T) {
+	authority := issueCertificate(t, "authority", &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	serving := issueCertificate(t, "server", &x509.Certificate{IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, authority)
+	client := issueCertificate(t, "client", &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, authority)
+
+	for _, required := range []bool{true, false} {
+		name := "optional"
+		if required {
+			name = "required"
+		}
+		t.Run(name, func(t *testing.T) {
+			_, address := startServer(t, "echo", func(config *Config) {
+				config.TLSCertificate, config.TLSKey = serving.certFile, serving.keyFile
+				config.TLSClientCA = authority.certFile
+				config.TLSRequireClientCert = required
+			})
+
+			welcome, connectError := connectTLS(t, address, authority, client.pair)
+			if connectError != nil || welcome.Header.Type != message.Welcome {
+				t.Fatalf("a client with a certificate got a message of type %d, %v, not a welcome", welcome.Header.Type, connectError)
+			}
+
+			welcome, connectError = connectTLS(t, address, authority)
+			switch {
+			case required && connectError == nil:
+				t.Fatalf("a client without a certificate got a message of type %d, rather than being turned away", welcome.Header.Type)
+			case !required && (connectError != nil || welcome.Header.Type != message.Welcome):
+				t.Fatalf("a client without a certificate got a message of type %d, %v, not a welcome", welcome.Header.Type, connectError)
+			}
+		})
+	}
+}
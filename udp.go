@@ -0,0 +1,226 @@
+package impact
+
+import (
+	"errors"
+	"fmt"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/radiowave"
+	"net"
+	"time"
+)
+
+// The biggest payload a UDP datagram can carry over IPv4.
+const maximumDatagramSize = 65507
+
+// The most datagrams handled at once when -max-in-flight doesn't say.
+const maximumDatagramsHandled = 1024
+
+// The UDP transport takes one request per datagram and sends its reply back to the address the request came from, in
+// one datagram. Datagrams carry impact messages as they are, without the length prefix used on streams, since a
+// datagram already has a length.
+//
+// There is no connection, so there is no handshake: a request gives its protocol version in its header and is
+// refused if we don't speak it. There is no authentication, compression, per-connection rate limit or queue position
+// either. Datagrams can be lost, duplicated or reordered on the way in both directions, so clients have to match
+// replies by correlation id and retry on a timeout of their own.
+//
+// A datagram's source address is easy to forge, so anything we send back could be aimed at somebody else. A reply is
+// never bigger than the request it answers, so that nobody can use us to turn a little traffic into a lot, and
+// datagrams are only handled as fast as -global-rate-limit, and as many at once as -max-in-flight, allow.
+func (s *server) serveDatagrams(listener *net.UDPConn) {
+	buffer := make([]byte, maximumDatagramSize)
+
+	for {
+		size, address, readError := listener.ReadFromUDP(buffer)
+		if readError != nil {
+			if errors.Is(readError, net.ErrClosed) {
+				return
+			}
+
+			s.logger.Printf("udp read failed: %v", readError)
+			continue
+		}
+
+		// Each datagram holds on to a goroutine until it is answered. Past the cap, datagrams are dropped unanswered,
+		// since answering a flood only adds to it.
+		if !s.admitDatagram() {
+			s.drop("udp:"+address.String(), 0, dropCapacity, "too many datagrams being handled")
+			continue
+		}
+
+		datagram := make([]byte, size)
+		copy(datagram, buffer[:size])
+
+		go func() {
+			defer s.datagramsHandled.Add(-1)
+			s.handleDatagram(listener, address, datagram)
+		}()
+	}
+}
+
+// Count a datagram being handled, unless there are already as many as -max-in-flight, or maximumDatagramsHandled if
+// that is unlimited.
+func (s *server) admitDatagram() bool {
+	limit := s.maxInFlight.Load()
+	if limit <= 0 {
+		limit = maximumDatagramsHandled
+	}
+	if s.datagramsHandled.Add(1) > limit {
+		s.datagramsHandled.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+// The reply to one datagram, which is at most one datagram, no bigger than the request.
+type datagramReply struct {
+	listener *net.UDPConn
+	address  *net.UDPAddr
+	limit    int
+	encode   func(radiowave.Message) radiowave.Message
+	sent     bool
+}
+
+// Send the reply, unless one has been sent already, or it won't fit. An error too big to go is sent without its
+// description. Report whether the message fit.
+func (r *datagramReply) send(wave radiowave.Message) (bool, error) {
+	if r.sent {
+		return true, nil
+	}
+
+	encoded := r.encode(wave).ToBytes()
+	if impactError, isError := wave.(message.ImpactError); isError && len(encoded) > r.limit {
+		impactError.Description = ""
+		encoded = r.encode(impactError).ToBytes()
+	}
+	if len(encoded) > r.limit {
+		return false, nil
+	}
+
+	r.sent = true
+	_, writeError := r.listener.WriteToUDP(encoded, r.address)
+	return true, writeError
+}
+
+func (s *server) handleDatagram(listener *net.UDPConn, address *net.UDPAddr, datagram []byte) {
+	// There's no connection id to give, so the resource is told where the request came from instead.
+	peer := "udp:" + address.String()
+	reply := &datagramReply{listener: listener, address: address, limit: len(datagram), encode: s.encodeErrors}
+	send := func(wave radiowave.Message) {
+		_, _ = reply.send(wave)
+	}
+
+	if s.maxRequestSize > 0 && len(datagram) > s.maxRequestSize {
+		description := fmt.Sprintf("message of %d bytes is larger than the server allows", len(datagram))
+		s.drop(peer, 0, dropOversized, description)
+		send(message.ImpactError{Code: message.MessageTooLarge, Description: description})
+		return
+	}
+
+	impactMessage, decodeError := message.Decode(datagram)
+	if decodeError != nil {
+		s.drop(peer, 0, dropProtocol, decodeError.Error())
+		send(message.ImpactError{Code: message.UnexpectedMessage, Description: "expected a request"})
+		return
+	}
+
+	correlationID := impactMessage.Header.CorrelationID
+	refuse := func(reason string, code message.ErrorCode, description string) {
+		s.drop(peer, correlationID, reason, description)
+		send(message.ImpactError{CorrelationID: correlationID, Code: code, Description: description})
+	}
+
+	switch {
+	case impactMessage.Header.Type != message.Request:
+		refuse(dropProtocol, message.UnexpectedMessage, "only requests can be sent over UDP")
+		return
+	case impactMessage.Header.Version < message.MinimumVersion || impactMessage.Header.Version > message.Version:
+		refuse(dropProtocol, message.UnsupportedVersion, fmt.Sprintf("protocol versions %d to %d are supported", message.MinimumVersion, message.Version))
+		return
+	case impactMessage.Header.Flags&message.Compressed != 0:
+		refuse(dropProtocol, message.CorruptPayload, "compression is not available over UDP")
+		return
+	case s.shuttingDown.Load():
+		// A stream client is told with a going away message. A datagram client just finds its requests refused.
+		refuse(dropShutdown, message.ShuttingDown, "server is draining, retry elsewhere")
+		return
+	}
+
+	if allowed, wait := s.globalRateLimit.try(); !allowed {
+		description := fmt.Sprintf("rate limited, try again in %s", wait.Round(time.Millisecond))
+		s.drop(peer, correlationID, dropRateLimited, description)
+		send(message.ImpactError{CorrelationID: correlationID, Code: message.RateLimited, Description: description, RetryAfter: wait})
+		return
+	}
+
+	impactMessage.Header.ConnectionID = peer
+	replyChannel := make(chan radiowave.Message)
+	request := request.Request{
+		Message:       impactMessage,
+		ReplyChannel:  replyChannel,
+		CorrelationID: correlationID,
+		ConnectionID:  peer,
+		Cost:          impactMessage.Header.Cost,
+		Priority:      impactMessage.Header.Priority,
+		Resource:      impactMessage.Header.Resource,
+		TraceID:       impactMessage.Header.Trace,
+		Status:        request.NewStatus(),
+	}
+	if impactMessage.Header.Deadline != 0 {
+		request.Deadline = time.Now().Add(time.Duration(impactMessage.Header.Deadline) * time.Millisecond)
+	}
+	request.Timeout = s.requestTimeout(impactMessage.Header)
+
+	s.limitLifetime(&request)
+	backend, refusal := s.submit(request, nil)
+	if backend == nil {
+		request.End()
+		if refusal != nil {
+			send(*refusal)
+		}
+		return
+	}
+	queued := time.Now()
+
+	failed, cancelled, outlived := false, false, false
+	for {
+		var response radiowave.Message
+		select {
+		case response = <-replyChannel:
+		case <-request.Lifetime():
+			response = backend.outlived(request)
+			outlived = true
+		}
+		if _, isError := response.(message.ImpactError); isError {
+			failed = true
+		}
+
+		// A reply in chunks won't go in one datagram however small they are, and nor will one bigger than the request.
+		// The client is told so instead, if even that fits, and nothing more is sent.
+		fits, writeError := false, error(nil)
+		if !message.HasMore(response) || reply.sent {
+			fits, writeError = reply.send(response)
+		}
+		if !fits {
+			description := "reply does not fit in one datagram no bigger than the request"
+			s.drop(peer, correlationID, dropOversized, description)
+			_, writeError = reply.send(message.ImpactError{CorrelationID: correlationID, Code: message.ReplyTooLarge, Description: description})
+			reply.sent = true
+			failed = true
+		}
+
+		// Nobody finds out if a datagram goes missing, but one that can't be sent at all is worth counting.
+		if writeError != nil {
+			s.drop(peer, correlationID, dropDisconnect, writeError.Error())
+			cancelled = true
+		}
+
+		if outlived || !message.HasMore(response) {
+			break
+		}
+	}
+	s.observeLatency(request, time.Since(queued))
+	s.untrack(request, failed, cancelled)
+}
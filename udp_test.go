@@ -0,0 +1,140 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/message"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// A client of the server's UDP transport.
+type datagramClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func dialDatagrams(t *testing.T, port int) *datagramClient {
+	t.Helper()
+
+	conn, dialError := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if dialError != nil {
+		t.Fatalf("dial udp: %v", dialError)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &datagramClient{t: t, conn: conn}
+}
+
+// Send a request in a datagram, returning how big the datagram was.
+func (c *datagramClient) send(correlationID uint64, payload string) int {
+	c.t.Helper()
+
+	request := message.ImpactMessage{Header: message.NewHeader(message.Request), Payload: []byte(payload)}
+	request.Header.CorrelationID = correlationID
+	datagram := request.ToBytes()
+	if _, writeError := c.conn.Write(datagram); writeError != nil {
+		c.t.Fatalf("write: %v", writeError)
+	}
+
+	return len(datagram)
+}
+
+// The next datagram from the server, and how big it was.
+func (c *datagramClient) tryReceive(timeout time.Duration) (message.ImpactMessage, int, error) {
+	buffer := make([]byte, maximumDatagramSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(timeout))
+	size, readError := c.conn.Read(buffer)
+	if readError != nil {
+		return message.ImpactMessage{}, 0, readError
+	}
+
+	answer, decodeError := message.Decode(buffer[:size])
+	return answer, size, decodeError
+}
+
+// Send a request and wait for its one datagram back, which must be no bigger than the request's.
+func (c *datagramClient) request(correlationID uint64, payload string) message.ImpactMessage {
+	c.t.Helper()
+
+	sent := c.send(correlationID, payload)
+	answer, received, readError := c.tryReceive(5 * time.Second)
+	if readError != nil {
+		c.t.Fatalf("request %d: %v", correlationID, readError)
+	}
+	if received > sent {
+		c.t.Fatalf("a request of %d bytes was answered with %d", sent, received)
+	}
+	if _, _, readError := c.tryReceive(200 * time.Millisecond); readError == nil {
+		c.t.Fatalf("request %d was answered with more than one datagram", correlationID)
+	}
+
+	return answer
+}
+
+func serveDatagrams(t *testing.T, configure func(config *Config)) (*Server, *datagramClient) {
+	t.Helper()
+
+	port := freePort(t)
+	server, _ := startServer(t, "echo", func(config *Config) {
+		config.UDPPort = port
+		if configure != nil {
+			configure(config)
+		}
+	})
+
+	return server, dialDatagrams(t, port)
+}
+
+// A reply is never bigger than its request, nor more than one datagram, so that a forged source address can't make
+// impact send somebody more than was sent to it.
+func TestDatagramReplySize(t *testing.T) {
+	server, client := serveDatagrams(t, nil)
+
+	expectReply(t, client.request(1, "echo"), "echo")
+	expectError(t, client.request(2, "double"), message.ReplyTooLarge)
+	expectError(t, client.request(3, "chunks"), message.ReplyTooLarge)
+	if oversized := server.s.droppedRequests.Value(dropOversized); oversized != 2 {
+		t.Fatalf("%d replies were dropped for their size, not 2", oversized)
+	}
+}
+
+// Datagrams go through -global-rate-limit, and are handled no more at once than -max-in-flight allows. Past that, they
+// are dropped without an answer.
+func TestDatagramLimits(t *testing.T) {
+	t.Run("global rate limit", func(t *testing.T) {
+		_, client := serveDatagrams(t, func(config *Config) { config.GlobalRateLimit = 1 })
+
+		expectReply(t, client.request(1, "first"), "first")
+		// Big enough for the refusal, but not its description.
+		refusal := expectError(t, client.request(2, "second try"), message.RateLimited)
+		if refusal.Description != "" {
+			t.Fatalf("a refusal too big for the request was sent with its description %q", refusal.Description)
+		}
+		// Too small even for that.
+		client.send(3, "")
+		if answer, _, readError := client.tryReceive(300 * time.Millisecond); readError == nil {
+			t.Fatalf("a request smaller than its refusal was answered, with a message of type %d", answer.Header.Type)
+		}
+	})
+
+	t.Run("max in flight", func(t *testing.T) {
+		server, client := serveDatagrams(t, func(config *Config) { config.MaxInFlight = 1 })
+
+		client.send(1, "sleep")
+		eventually(t, "the request is with the resource", func() bool { return server.s.pending.Load() == 1 })
+		for correlationID := uint64(2); correlationID <= 5; correlationID++ {
+			client.send(correlationID, "over the cap "+strconv.FormatUint(correlationID, 10))
+		}
+		eventually(t, "the datagrams over the cap are dropped", func() bool { return server.s.droppedRequests.Value(dropCapacity) == 4 })
+
+		answer, _, readError := client.tryReceive(5 * time.Second)
+		if readError != nil {
+			t.Fatalf("read: %v", readError)
+		}
+		expectReply(t, answer, "sleep")
+		if extra, _, readError := client.tryReceive(300 * time.Millisecond); readError == nil {
+			t.Fatalf("a datagram over the cap was answered, with a message of type %d", extra.Header.Type)
+		}
+	})
+}
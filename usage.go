@@ -0,0 +1,162 @@
+package impact
+
+import (
+	"encoding/json"
+	"github.com/blanu/impact/internal/connection"
+	"github.com/blanu/impact/internal/message"
+	"github.com/blanu/impact/internal/request"
+	"github.com/blanu/radiowave"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// Operators who bill by the byte need to know how much each client sent the resource and got back from it. Bytes in
+// are the payloads of the requests a client sends, as the resource gets them, so after decompression. Bytes out are
+// the payloads of the replies and pushes it is sent, counting every chunk, as the resource made them, so before
+// compression. Errors impact makes up itself, and the protocol's own messages, aren't counted.
+//
+// Each connection's counts are kept for as long as it is open. Each tenant's, by authenticated identity, are kept for
+// as long as the server runs, and are also exported as metrics.
+
+// A client whose connection didn't need to authenticate is counted as anonymous.
+const anonymousTenant = "anonymous"
+
+type connectionUsage struct {
+	tenant   string
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func tenantOf(conn *connection.Conn) string {
+	if conn.Identity == "" {
+		return anonymousTenant
+	}
+
+	return conn.Identity
+}
+
+func identityOf(r request.Request) string {
+	if r.Identity == "" {
+		return anonymousTenant
+	}
+
+	return r.Identity
+}
+
+// Start counting a connection's bytes.
+func (s *server) startUsage(conn *connection.Conn) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	s.usage[conn.ID] = &connectionUsage{tenant: tenantOf(conn)}
+}
+
+// A closed connection's bytes stay in its tenant's totals.
+func (s *server) endUsage(conn *connection.Conn) {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	delete(s.usage, conn.ID)
+}
+
+func (s *server) usageOf(conn *connection.Conn) *connectionUsage {
+	s.usageLock.Lock()
+	defer s.usageLock.Unlock()
+
+	return s.usage[conn.ID]
+}
+
+// The client sent a request.
+func (s *server) countIn(conn *connection.Conn, request message.ImpactMessage) {
+	usage := s.usageOf(conn)
+	if usage == nil {
+		return
+	}
+
+	size := int64(len(request.Payload))
+	usage.bytesIn.Add(size)
+	s.tenantBytesIn.Add(usage.tenant, size)
+}
+
+// The client was sent part of a reply, or a push. It only counts if it was sent in full.
+func (s *server) countOut(conn *connection.Conn, wave radiowave.Message) {
+	sent, isMessage := wave.(message.ImpactMessage)
+	if !isMessage {
+		return
+	}
+
+	usage := s.usageOf(conn)
+	if usage == nil {
+		return
+	}
+
+	size := int64(len(sent.Payload))
+	usage.bytesOut.Add(size)
+	s.tenantBytesOut.Add(usage.tenant, size)
+}
+
+type connectionUsageReport struct {
+	ConnectionID string `json:"connection_id"`
+	Tenant       string `json:"tenant"`
+	BytesIn      int64  `json:"bytes_in"`
+	BytesOut     int64  `json:"bytes_out"`
+	// The payload bytes of requests read but not answered yet. Only counted under -max-outstanding-bytes.
+	OutstandingBytes int64 `json:"outstanding_bytes"`
+}
+
+type tenantUsageReport struct {
+	Tenant   string `json:"tenant"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	// Requests queued or executing for the tenant now, across all its connections.
+	InFlight int64 `json:"in_flight"`
+}
+
+type usageReport struct {
+	Connections []connectionUsageReport `json:"connections"`
+	Tenants     []tenantUsageReport     `json:"tenants"`
+}
+
+// List the bytes counted for each open connection, and for each tenant since the server started, as JSON.
+func (s *server) serveUsage(writer http.ResponseWriter, _ *http.Request) {
+	report := usageReport{Connections: []connectionUsageReport{}, Tenants: []tenantUsageReport{}}
+
+	s.usageLock.Lock()
+	for id, usage := range s.usage {
+		report.Connections = append(report.Connections, connectionUsageReport{
+			ConnectionID: id,
+			Tenant:       usage.tenant,
+			BytesIn:      usage.bytesIn.Load(),
+			BytesOut:     usage.bytesOut.Load(),
+		})
+	}
+	s.usageLock.Unlock()
+	for index := range report.Connections {
+		report.Connections[index].OutstandingBytes = s.outstandingBytes(report.Connections[index].ConnectionID)
+	}
+	sort.Slice(report.Connections, func(i int, j int) bool {
+		return report.Connections[i].ConnectionID < report.Connections[j].ConnectionID
+	})
+
+	// A tenant may have sent nothing, or been sent nothing, so it may only have one of the two counters. One with a
+	// request in flight has sent something, but may not have been counted yet.
+	bytesIn, bytesOut, inFlight := s.tenantBytesIn.Values(), s.tenantBytesOut.Values(), s.identitiesPending()
+	tenants := map[string]bool{}
+	for tenant := range bytesIn {
+		tenants[tenant] = true
+	}
+	for tenant := range bytesOut {
+		tenants[tenant] = true
+	}
+	for tenant := range inFlight {
+		tenants[tenant] = true
+	}
+	for tenant := range tenants {
+		report.Tenants = append(report.Tenants, tenantUsageReport{Tenant: tenant, BytesIn: bytesIn[tenant], BytesOut: bytesOut[tenant], InFlight: inFlight[tenant]})
+	}
+	sort.Slice(report.Tenants, func(i int, j int) bool { return report.Tenants[i].Tenant < report.Tenants[j].Tenant })
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(writer).Encode(report)
+}
@@ -0,0 +1,93 @@
+package impact
+
+import (
+	"encoding/json"
+	"github.com/blanu/impact/internal/message"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Only requests that are taken count towards a tenant's bytes in. One turned away, here by the rate limit, doesn't.
+func TestRefusedRequestsArentCounted(t *testing.T) {
+	server, address := startServer(t, "echo", func(config *Config) { config.RateLimit = 1 })
+	client := dial(t, address)
+
+	expectReply(t, client.request(1, "taken"), "taken")
+	expectError(t, client.request(2, "turned away"), message.RateLimited)
+
+	if bytesIn := server.s.tenantBytesIn.Value(anonymousTenant); bytesIn != int64(len("taken")) {
+		t.Fatalf("the tenant was counted %d bytes in, not %d", bytesIn, len("taken"))
+	}
+	if bytesOut := server.s.tenantBytesOut.Value(anonymousTenant); bytesOut != int64(len("taken")) {
+		t.Fatalf("the tenant was counted %d bytes out, not %d", bytesOut, len("taken"))
+	}
+}
+
+// Each tenant's requests in flight, from /usage.
+func tenantsInFlight(t *testing.T, server *Server) map[string]int64 {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	server.s.serveUsage(recorder, httptest.NewRequest(http.MethodGet, "/usage", nil))
+	var report usageReport
+	if decodeError := json.NewDecoder(recorder.Body).Decode(&report); decodeError != nil {
+		t.Fatalf("GET /usage: %v", decodeError)
+	}
+
+	inFlight := map[string]int64{}
+	for _, tenant := range report.Tenants {
+		inFlight[tenant.Tenant] = tenant.InFlight
+	}
+	return inFlight
+}
+
+// Under -max-in-flight-per-identity, an identity can't get more than its share in flight by spreading its requests over
+// more connections, and another identity is still served while it is at its cap. /usage counts each identity's
+// requests in flight until they are answered.
+func TestMaxInFlightPerIdentity(t *testing.T) {
+	tokens := func(client Client) (string, error) {
+		if client.Token == "" {
+			return "", ErrNoIdentity
+		}
+		return client.Token, nil
+	}
+	server, address := startServer(t, "echo", func(config *Config) { config.MaxInFlightIdentity = 2 }, WithIdentityExtractor("tokens", tokens))
+	as := func(identity string) *testClient {
+		hello := message.NewHello(message.MinimumVersion, message.Version)
+		hello.Header.Token = identity
+		client, welcome := connect(t, address, hello)
+		if welcome.Header.Type != message.Welcome {
+			t.Fatalf("%s got a message of type %d in answer to the hello", identity, welcome.Header.Type)
+		}
+		return client
+	}
+
+	alice := []*testClient{as("alice"), as("alice"), as("alice")}
+	for index, client := range alice[:2] {
+		client.send(1, "sleep")
+		eventually(t, "alice's request is in flight", func() bool { return server.s.pending.Load() == int64(index+1) })
+	}
+	expectError(t, alice[2].request(1, "over the cap"), message.AtCapacity)
+	if dropped := server.s.droppedRequests.Value(dropIdentityCapacity); dropped != 1 {
+		t.Fatalf("%d requests were dropped for their identity's cap, not 1", dropped)
+	}
+
+	bob := as("bob")
+	bob.send(1, "sleep")
+	eventually(t, "bob's request is in flight", func() bool { return server.s.pending.Load() == 3 })
+	if inFlight := tenantsInFlight(t, server); inFlight["alice"] != 2 || inFlight["bob"] != 1 {
+		t.Fatalf("/usage has %v in flight, not alice 2 and bob 1", inFlight)
+	}
+
+	expectReply(t, alice[0].receive(), "sleep")
+	expectReply(t, alice[1].receive(), "sleep")
+	expectReply(t, bob.receive(), "sleep")
+	eventually(t, "nothing is in flight", func() bool {
+		inFlight := tenantsInFlight(t, server)
+		return inFlight["alice"] == 0 && inFlight["bob"] == 0
+	})
+
+	// Once its requests are answered, the identity has its allowance back.
+	expectReply(t, alice[2].request(2, "under the cap"), "under the cap")
+}
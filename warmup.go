@@ -0,0 +1,67 @@
+package impact
+
+import (
+	"github.com/blanu/impact/internal/ratelimit"
+	"sync"
+	"time"
+)
+
+// A freshly started resource may need time to warm its caches before it can keep up with the full backlog.
+// For the warmup period after each start, requests are paced into the funnel at a rate that ramps up steadily
+// from the start rate to the full rate. After that, they go in as fast as the resource takes them.
+type warmup struct {
+	period    time.Duration
+	startRate float64
+	fullRate  float64
+
+	lock    sync.Mutex
+	started time.Time
+
+	// There is only one request dispatched at a time, so a burst of one keeps the pacing even.
+	bucket *ratelimit.TokenBucket
+}
+
+func newWarmup(period time.Duration, startRate float64, fullRate float64) *warmup {
+	return &warmup{
+		period:    period,
+		startRate: startRate,
+		fullRate:  fullRate,
+		bucket:    ratelimit.NewTokenBucket(startRate, 1),
+	}
+}
+
+// Start the warmup over again, because the resource has just been (re)started.
+func (w *warmup) begin() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.started = time.Now()
+}
+
+// The request rate currently allowed, and whether the warmup is still going. There is no limit after the warmup.
+func (w *warmup) rate() (float64, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.period <= 0 {
+		return 0, false
+	}
+
+	progress := float64(time.Since(w.started)) / float64(w.period)
+	if progress >= 1 {
+		return 0, false
+	}
+
+	return w.startRate + (w.fullRate-w.startRate)*progress, true
+}
+
+// Wait until the warmup allows another request into the funnel.
+func (w *warmup) wait() {
+	rate, warming := w.rate()
+	if !warming {
+		return
+	}
+
+	w.bucket.SetRate(rate)
+	w.bucket.Wait()
+}
@@ -0,0 +1,51 @@
+package impact
+
+import (
+	"time"
+)
+
+// The shortest -watchdog-interval there can be.
+const minimumWatchdogInterval = time.Millisecond
+
+// The watchdog notices when the process handler has stopped making progress while clients are waiting on it.
+// Without it, a resource that never replies wedges the whole server with no indication of what went wrong.
+func (m *member) handleWatchdog(interval time.Duration, restart bool) {
+	// Check several times per interval so that a stall is reported soon after it crosses the threshold.
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	// Only warn once per stall, rather than on every tick until it clears.
+	warned := false
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.halted:
+			return
+		}
+
+		waiting := m.waiting()
+		stalled := m.sinceProgress()
+
+		if waiting == 0 || stalled < interval {
+			warned = false
+			continue
+		}
+
+		if warned {
+			continue
+		}
+		warned = true
+
+		m.logger.Printf("watchdog: resource %s has not completed a request in %s while working on one, with %d waiting in all", m.name, stalled.Round(time.Millisecond), m.backend.waiting())
+
+		if restart {
+			m.logger.Printf("watchdog: restarting stalled resource %s", m.name)
+			select {
+			case m.restarts <- restartWatchdog:
+			case <-m.halted:
+				return
+			}
+		}
+	}
+}